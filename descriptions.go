@@ -4,6 +4,7 @@ import (
 	"encoding/xml"
 	"fmt"
 	"path/filepath"
+	"sort"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago/internal/fs"
@@ -28,6 +29,11 @@ type SchemeManager struct {
 	XMLVersion        int      `xml:"version,attr"`
 	XMLName           xml.Name `xml:"SchemeManager"`
 
+	// (Optional) pins of the TLS certificate of the keyshare server; see HTTPTransport.SetCertificatePins
+	KeyshareServerPins []string `xml:"KeyshareServerPins>Pin"`
+	// (Optional) pins of the TLS certificate of the server at URL from which the scheme is downloaded
+	SchemeServerPins []string `xml:"SchemeServerPins>Pin"`
+
 	Status SchemeManagerStatus `xml:"-"`
 	Valid  bool                `xml:"-"` // true iff Status == SchemeManagerStatusValid
 
@@ -77,7 +83,7 @@ type CredentialType struct {
 // AttributeType is a description of an attribute within a credential type.
 type AttributeType struct {
 	ID          string `xml:"id,attr"`
-	Optional    string `xml:"optional,attr"  json:",omitempty"`
+	Optional    string `xml:"optional,attr,omitempty"  json:",omitempty"`
 	Name        TranslatedString
 	Description TranslatedString
 
@@ -146,12 +152,21 @@ type xmlTranslatedString struct {
 	Translations []xmlTranslation `xml:",any"`
 }
 
-// MarshalXML implements xml.Marshaler.
+// MarshalXML implements xml.Marshaler. Languages are written in alphabetical order,
+// and nothing is written for empty TranslatedStrings.
 func (ts *TranslatedString) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if len(*ts) == 0 {
+		return nil
+	}
+	langs := make([]string, 0, len(*ts))
+	for lang := range *ts {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
 	temp := &xmlTranslatedString{}
-	for lang, text := range *ts {
+	for _, lang := range langs {
 		temp.Translations = append(temp.Translations,
-			xmlTranslation{XMLName: xml.Name{Local: lang}, Text: text},
+			xmlTranslation{XMLName: xml.Name{Local: lang}, Text: (*ts)[lang]},
 		)
 	}
 	return e.EncodeElement(temp, start)
@@ -0,0 +1,125 @@
+// Package encryption encrypts data at rest, using a key derived from a passphrase or a key supplied by the caller.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+
+	"github.com/go-errors/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Current version of the encrypted format.
+const version = 1
+
+// Default scrypt parameters, as recommended for interactive logins in the scrypt documentation.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Upper bounds on the scrypt parameters of data being decrypted, so that maliciously crafted
+// parameters cannot make key derivation take excessive time or memory.
+const (
+	maxScryptN      = 1 << 20
+	maxScryptRP     = 64
+	maxScryptMemory = 1 << 30 // bytes; scrypt uses 128*N*R bytes
+)
+
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted ciphertext")
+
+// encrypted is the JSON serialization of data encrypted with EncryptWithPassphrase. The key is
+// derived from the passphrase using scrypt with the included parameters, after which the data is
+// encrypted using AES-256-GCM.
+type encrypted struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// EncryptWithPassphrase encrypts the plaintext using a key derived from the passphrase.
+func EncryptWithPassphrase(plaintext, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	enc := &encrypted{Version: version, KDF: "scrypt", Salt: make([]byte, 32), N: scryptN, R: scryptR, P: scryptP}
+	if _, err := rand.Read(enc.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := enc.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	enc.Nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(enc.Nonce); err != nil {
+		return nil, err
+	}
+	enc.Ciphertext = aead.Seal(nil, enc.Nonce, plaintext, nil)
+	return json.Marshal(enc)
+}
+
+// DecryptWithPassphrase decrypts data encrypted with EncryptWithPassphrase. It returns
+// ErrWrongPassphrase if the passphrase is incorrect.
+func DecryptWithPassphrase(ciphertext, passphrase []byte) ([]byte, error) {
+	enc := &encrypted{}
+	if err := json.Unmarshal(ciphertext, enc); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse encrypted data", 0)
+	}
+	if enc.Version != version || enc.KDF != "scrypt" {
+		return nil, errors.Errorf("unsupported encryption version %d (kdf %s)", enc.Version, enc.KDF)
+	}
+	if err := CheckScryptParameters(enc.N, enc.R, enc.P); err != nil {
+		return nil, err
+	}
+	aead, err := enc.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(enc.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+	plaintext, err := aead.Open(nil, enc.Nonce, enc.Ciphertext, nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+// CheckScryptParameters returns an error if the scrypt parameters are invalid, or so large that
+// deriving a key with them would take excessive time or memory.
+func CheckScryptParameters(n, r, p int) error {
+	if n <= 1 || n&(n-1) != 0 || r < 1 || p < 1 {
+		return errors.Errorf("invalid scrypt parameters N=%d, r=%d, p=%d", n, r, p)
+	}
+	if n > maxScryptN || r > maxScryptRP || p > maxScryptRP || r*p > maxScryptRP ||
+		128*int64(n)*int64(r) > maxScryptMemory {
+		return errors.Errorf("scrypt parameters N=%d, r=%d, p=%d exceed limits", n, r, p)
+	}
+	return nil
+}
+
+// IsEncrypted returns whether the data looks like the output of EncryptWithPassphrase.
+func IsEncrypted(data []byte) bool {
+	enc := &encrypted{}
+	return json.Unmarshal(data, enc) == nil && enc.Version != 0 && enc.KDF != "" && len(enc.Ciphertext) > 0
+}
+
+func (enc *encrypted) aead(passphrase []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, enc.Salt, enc.N, enc.R, enc.P, 32)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to derive key from passphrase", 0)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,72 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+
+	"github.com/go-errors/errors"
+)
+
+// Records encrypted with EncryptRecord consist of this prefix, followed by the nonce and the
+// AES-256-GCM ciphertext.
+var recordPrefix = []byte("irmaenc1")
+
+// KeySize is the size of the keys with which records are encrypted.
+const KeySize = 32
+
+var ErrRecordDecryption = errors.New("failed to decrypt record: wrong key or corrupted record")
+
+// EncryptRecord encrypts and authenticates the plaintext using the key, binding it to the name
+// of the record (e.g. its filename), so that it cannot be swapped with another record.
+func EncryptRecord(key, plaintext []byte, name string) ([]byte, error) {
+	aead, err := recordAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, len(recordPrefix)+aead.NonceSize(), len(recordPrefix)+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	copy(record, recordPrefix)
+	nonce := record[len(recordPrefix):]
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(record, nonce, plaintext, []byte(name)), nil
+}
+
+// DecryptRecord decrypts a record encrypted with EncryptRecord under the same name. It returns
+// ErrRecordDecryption if the key or name is wrong, or if the record was modified.
+func DecryptRecord(key, record []byte, name string) ([]byte, error) {
+	if !IsEncryptedRecord(record) {
+		return nil, errors.New("not an encrypted record")
+	}
+	aead, err := recordAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	record = record[len(recordPrefix):]
+	if len(record) < aead.NonceSize() {
+		return nil, ErrRecordDecryption
+	}
+	plaintext, err := aead.Open(nil, record[:aead.NonceSize()], record[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, ErrRecordDecryption
+	}
+	return plaintext, nil
+}
+
+// IsEncryptedRecord returns whether the data looks like the output of EncryptRecord.
+func IsEncryptedRecord(data []byte) bool {
+	return bytes.HasPrefix(data, recordPrefix)
+}
+
+func recordAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, errors.Errorf("record encryption key must be %d bytes", KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
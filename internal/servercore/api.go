@@ -6,9 +6,7 @@ package servercore
 
 import (
 	"encoding/json"
-	"io/ioutil"
 	"net/http"
-	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
@@ -16,7 +14,6 @@ import (
 	"github.com/go-errors/errors"
 	"github.com/jasonlvhit/gocron"
 	"github.com/privacybydesign/gabi"
-	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/server"
@@ -28,6 +25,8 @@ type Server struct {
 	sessions      sessionStore
 	scheduler     *gocron.Scheduler
 	stopScheduler chan bool
+
+	unsubscribeSchemeEvents func()
 }
 
 func New(conf *server.Configuration) (*Server, error) {
@@ -51,6 +50,9 @@ func New(conf *server.Configuration) (*Server, error) {
 func (s *Server) Stop() {
 	s.stopScheduler <- true
 	s.sessions.stop()
+	if s.unsubscribeSchemeEvents != nil {
+		s.unsubscribeSchemeEvents()
+	}
 }
 
 func (s *Server) verifyConfiguration(configuration *server.Configuration) error {
@@ -88,6 +90,16 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 		}
 	}
 
+	if s.conf.SchemesMirrorURL != "" {
+		s.conf.IrmaConfiguration.SchemeMirrorURL = s.conf.SchemesMirrorURL
+		s.conf.Logger.WithField("mirror", s.conf.SchemesMirrorURL).Info("Downloading schemes from mirror")
+	}
+
+	if s.conf.IrmaConfiguration.UpdateProgress == nil {
+		s.conf.IrmaConfiguration.UpdateProgress = s.logSchemeUpdateProgress
+	}
+	s.unsubscribeSchemeEvents = s.conf.IrmaConfiguration.SubscribeSchemeEvents(s.logSchemeEvent)
+
 	if len(s.conf.IrmaConfiguration.SchemeManagers) == 0 {
 		s.conf.Logger.Infof("No schemes found in %s, downloading default (irma-demo and pbdf)", s.conf.SchemesPath)
 		if err := s.conf.IrmaConfiguration.DownloadDefaultSchemes(); err != nil {
@@ -107,39 +119,42 @@ func (s *Server) verifyConfiguration(configuration *server.Configuration) error
 	if s.conf.IssuerPrivateKeys == nil {
 		s.conf.IssuerPrivateKeys = make(map[irma.IssuerIdentifier]*gabi.PrivateKey)
 	}
+	for _, issuer := range s.conf.IssuerPrivateKeysIssuers {
+		if _, ok := s.conf.IrmaConfiguration.Issuers[irma.NewIssuerIdentifier(issuer)]; !ok {
+			return server.LogError(errors.Errorf("Unknown issuer %s in privkeys_issuers", issuer))
+		}
+	}
 	if s.conf.IssuerPrivateKeysPath != "" {
-		files, err := ioutil.ReadDir(s.conf.IssuerPrivateKeysPath)
+		passphrase, err := s.conf.PrivateKeysPassphrase()
 		if err != nil {
 			return server.LogError(err)
 		}
-		for _, file := range files {
-			filename := file.Name()
-			if filepath.Ext(filename) != ".xml" || filename[0] == '.' || strings.Count(filename, ".") != 2 {
-				s.conf.Logger.WithField("file", filename).Infof("Skipping non-private key file encountered in private keys path")
-				continue
-			}
-			issid := irma.NewIssuerIdentifier(strings.TrimSuffix(filename, filepath.Ext(filename))) // strip .xml
+		keys, plaintext, err := server.ReadPrivateKeysFolder(s.conf.IssuerPrivateKeysPath, passphrase, s.conf.PrivateKeyAllowed)
+		if err != nil {
+			return server.LogError(err)
+		}
+		for issid, sk := range keys {
 			if _, ok := s.conf.IrmaConfiguration.Issuers[issid]; !ok {
-				return server.LogError(errors.Errorf("Private key %s belongs to an unknown issuer", filename))
-			}
-			sk, err := gabi.NewPrivateKeyFromFile(filepath.Join(s.conf.IssuerPrivateKeysPath, filename))
-			if err != nil {
-				return server.LogError(err)
+				return server.LogError(errors.Errorf("Private key of %s belongs to an unknown issuer", issid))
 			}
 			s.conf.IssuerPrivateKeys[issid] = sk
 		}
+		if s.conf.Production && len(plaintext) > 0 {
+			s.conf.Logger.WithField("files", plaintext).Warn("Unencrypted private keys loaded in production mode; " +
+				"consider encrypting them (see irma scheme issuer encrypt-key) or using a key server")
+		}
 	}
 	for issid, sk := range s.conf.IssuerPrivateKeys {
-		pk, err := s.conf.IrmaConfiguration.PublicKey(issid, int(sk.Counter))
-		if err != nil {
+		if err := s.conf.VerifyPrivateKey(issid, sk); err != nil {
 			return server.LogError(err)
 		}
-		if pk == nil {
-			return server.LogError(errors.Errorf("Missing public key belonging to private key %s-%d", issid.String(), sk.Counter))
-		}
-		if new(big.Int).Mul(sk.P, sk.Q).Cmp(pk.N) != 0 {
-			return server.LogError(errors.Errorf("Private key %s-%d does not belong to corresponding public key", issid.String(), sk.Counter))
+	}
+	if s.conf.IssuerPrivateKeysServer != "" {
+		if s.conf.IssuerPrivateKeyProvider != nil {
+			return server.LogError(errors.New("Cannot combine privkeys_server with a custom private key provider"))
 		}
+		s.conf.IssuerPrivateKeyProvider = server.NewKeyServerClient(s.conf.IssuerPrivateKeysServer)
+		s.conf.Logger.WithField("socket", s.conf.IssuerPrivateKeysServer).Info("Retrieving private keys from key server")
 	}
 
 	if s.conf.URL != "" {
@@ -236,12 +251,14 @@ func (s *Server) CancelSession(token string) error {
 	if session == nil {
 		return server.LogError(errors.Errorf("can't cancel unknown session %s", token))
 	}
+	session.Lock()
+	defer session.Unlock()
 	session.handleDelete()
 	return nil
 }
 
 func ParsePath(path string) (string, string, error) {
-	pattern := regexp.MustCompile("session/(\\w+)/?(|commitments|proofs|status|statusevents)$")
+	pattern := regexp.MustCompile("session/(\\w+)/?(|commitments|proofs|status|statusevents|statuswebsocket)$")
 	matches := pattern.FindStringSubmatch(path)
 	if len(matches) != 3 {
 		return "", "", server.LogWarning(errors.Errorf("Invalid URL: %s", path))
@@ -384,6 +401,11 @@ func (s *Server) handleProtocolMessage(
 			status, output = server.JsonResponse(nil, err)
 			return
 		}
+		if noun == "statuswebsocket" {
+			err := server.RemoteError(server.ErrorInvalidRequest, "websockets not supported by this server")
+			status, output = server.JsonResponse(nil, err)
+			return
+		}
 
 		if method == http.MethodGet && noun == "status" {
 			status, output = server.JsonResponse(session.handleGetStatus())
@@ -445,3 +467,35 @@ func (s *Server) handleProtocolMessage(
 		return
 	}
 }
+
+func (s *Server) logSchemeUpdateProgress(progress *irma.SchemeUpdateProgress) {
+	entry := s.conf.Logger.WithFields(logrus.Fields{
+		"scheme":     progress.Scheme,
+		"downloaded": progress.Downloaded,
+		"total":      progress.Total,
+	})
+	switch {
+	case progress.Downloaded == 0:
+		entry.Info("Downloading new version of scheme")
+	case progress.Downloaded == progress.Total:
+		entry.WithField("bytes", progress.Bytes).Info("Downloaded new version of scheme")
+	default:
+		entry.WithField("file", progress.File).Debug("Downloaded scheme file")
+	}
+}
+
+func (s *Server) logSchemeEvent(event *irma.SchemeEvent) {
+	entry := s.conf.Logger.WithFields(logrus.Fields{"scheme": event.Scheme, "event": event.Type})
+	switch event.Type {
+	case irma.SchemeEventUpdated:
+		entry.WithField("timestamp", time.Time(*event.Change.NewTimestamp).String()).Info("Scheme updated")
+	case irma.SchemeEventCredentialTypeDeprecated:
+		entry.WithField("credentialtype", event.CredentialType).
+			Warnf("Credential type deprecated since %s", time.Time(*event.DeprecatedSince).String())
+	case irma.SchemeEventPublicKeyAdded:
+		entry.WithFields(logrus.Fields{"issuer": event.PublicKey.Issuer, "counter": event.PublicKey.Counter}).
+			Info("Public key added")
+	case irma.SchemeEventUpdateFailed:
+		entry.Warn("Updating scheme failed: ", event.Err)
+	}
+}
@@ -39,6 +39,7 @@ func (session *session) onUpdate() {
 		// We send JSON like the other APIs, so quote
 		session.evtSource.SendEventMessage(fmt.Sprintf(`"%s"`, session.status), "", "")
 	}
+	session.sendWebsockets()
 }
 
 func (session *session) fail(err server.Error, message string) *irma.RemoteError {
@@ -27,6 +27,7 @@ type session struct {
 	status        server.Status
 	prevStatus    server.Status
 	evtSource     eventsource.EventSource
+	websockets    map[chan server.Status]struct{}
 	responseCache responseCache
 
 	lastActive time.Time
@@ -102,6 +103,9 @@ func (s *memorySessionStore) stop() {
 		if session.evtSource != nil {
 			session.evtSource.Close()
 		}
+		session.Lock()
+		session.closeWebsockets()
+		session.Unlock()
 	}
 }
 
@@ -139,6 +143,9 @@ func (s *memorySessionStore) deleteExpired() {
 		if session.evtSource != nil {
 			session.evtSource.Close()
 		}
+		session.Lock()
+		session.closeWebsockets()
+		session.Unlock()
 		delete(s.client, session.clientToken)
 		delete(s.requestor, token)
 	}
@@ -0,0 +1,164 @@
+package servercore
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/gorilla/websocket"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Interval at which we send pings to websocket listeners. This keeps the connection alive
+	// through reverse proxies that close connections that are idle for too long (commonly 60s).
+	websocketPingInterval = 25 * time.Second
+	// Time within which a pong must be received after a ping, otherwise the listener is dropped.
+	websocketPongTimeout  = 2 * websocketPingInterval
+	websocketWriteTimeout = 10 * time.Second
+	// Amount of status updates that may be queued for a listener. If a listener falls further
+	// behind than this it is disconnected; when it reconnects it receives the current status.
+	websocketBufferSize = 8
+)
+
+var websocketUpgrader = websocket.Upgrader{
+	// Like the other endpoints, the status endpoints may be accessed from any origin
+	CheckOrigin: func(_ *http.Request) bool { return true },
+}
+
+// SubscribeWebsocket upgrades the HTTP connection to a websocket over which status updates
+// of the specified session are sent, as JSON strings. The current status is sent immediately after
+// connecting, so a listener whose connection broke can just reconnect to resume. After the session
+// has finished its final status is sent and the connection is closed.
+// If an error is returned, the connection has not been upgraded and nothing has been written to w.
+func (s *Server) SubscribeWebsocket(w http.ResponseWriter, r *http.Request, token string, requestor bool) error {
+	if !s.conf.EnableWebsockets {
+		return errors.New("Websockets disabled")
+	}
+
+	var session *session
+	if requestor {
+		session = s.sessions.get(token)
+	} else {
+		session = s.sessions.clientGet(token)
+	}
+	if session == nil {
+		return server.LogError(errors.Errorf("can't subscribe to websocket of unknown session %s", token))
+	}
+
+	conn, err := websocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already written an error response to w
+		_ = server.LogWarning(errors.WrapPrefix(err, "failed to upgrade to websocket", 0))
+		return nil
+	}
+
+	session.Lock()
+	updates := session.addWebsocket()
+	status := session.status
+	session.Unlock()
+
+	go session.serveWebsocket(conn, updates, status)
+	return nil
+}
+
+// addWebsocket registers a new websocket listener. Requires the session lock.
+func (session *session) addWebsocket() chan server.Status {
+	if session.websockets == nil {
+		session.websockets = map[chan server.Status]struct{}{}
+	}
+	updates := make(chan server.Status, websocketBufferSize)
+	session.websockets[updates] = struct{}{}
+	session.conf.Logger.WithFields(logrus.Fields{"session": session.token}).Debug("New websocket listener")
+	return updates
+}
+
+// sendWebsockets sends the current status to all websocket listeners. Requires the session lock.
+func (session *session) sendWebsockets() {
+	for updates := range session.websockets {
+		select {
+		case updates <- session.status:
+		default:
+			// The listener is not keeping up; disconnect it, it may reconnect to resume
+			delete(session.websockets, updates)
+			close(updates)
+		}
+	}
+}
+
+// closeWebsockets disconnects all websocket listeners. Requires the session lock.
+func (session *session) closeWebsockets() {
+	for updates := range session.websockets {
+		delete(session.websockets, updates)
+		close(updates)
+	}
+}
+
+func (session *session) serveWebsocket(conn *websocket.Conn, updates chan server.Status, status server.Status) {
+	logger := session.conf.Logger.WithFields(logrus.Fields{"session": session.token})
+	defer func() {
+		session.Lock()
+		delete(session.websockets, updates)
+		session.Unlock()
+		_ = conn.Close()
+		logger.Debug("Websocket listener disconnected")
+	}()
+
+	// We don't expect any messages from the listener, but we must read from the connection
+	// to process pongs and to notice when the listener disconnects.
+	disconnected := make(chan struct{})
+	_ = conn.SetReadDeadline(time.Now().Add(websocketPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(websocketPongTimeout))
+	})
+	go func() {
+		defer close(disconnected)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(websocketPingInterval)
+	defer ping.Stop()
+
+	send := true
+	for {
+		if send {
+			// We send JSON like the other APIs, so quote
+			_ = conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`"%s"`, status))); err != nil {
+				logger.Debug("Failed to send status to websocket listener: ", err.Error())
+				return
+			}
+			if status.Finished() {
+				closeWebsocket(conn)
+				return
+			}
+		}
+
+		send = false
+		select {
+		case newStatus, ok := <-updates:
+			if !ok {
+				closeWebsocket(conn)
+				return
+			}
+			status, send = newStatus, true
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketWriteTimeout)); err != nil {
+				return
+			}
+		case <-disconnected:
+			return
+		}
+	}
+}
+
+func closeWebsocket(conn *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(websocketWriteTimeout))
+}
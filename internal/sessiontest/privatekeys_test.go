@@ -0,0 +1,135 @@
+package sessiontest
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/encryption"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	mijnOverheid = irma.NewIssuerIdentifier("irma-demo.MijnOverheid")
+	ru           = irma.NewIssuerIdentifier("irma-demo.RU")
+)
+
+func privateKeysConfiguration(privkeys string) *server.Configuration {
+	return &server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+		DisableSchemesUpdate:  true,
+		IssuerPrivateKeysPath: privkeys,
+	}
+}
+
+func TestEncryptedPrivateKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "privatekeys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	passphrase := []byte("correct horse battery staple")
+	bts, err := ioutil.ReadFile(filepath.Join(testdata, "privatekeys", "irma-demo.MijnOverheid.xml"))
+	require.NoError(t, err)
+	enc, err := encryption.EncryptWithPassphrase(bts, passphrase)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "irma-demo.MijnOverheid.xml.enc"), enc, 0600))
+	bts, err = ioutil.ReadFile(filepath.Join(testdata, "privatekeys", "irma-demo.RU.xml"))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "irma-demo.RU.xml"), bts, 0600))
+
+	// Without passphrase the encrypted key cannot be loaded
+	_, err = irmaserver.New(privateKeysConfiguration(dir))
+	require.Error(t, err)
+
+	// Wrong passphrase
+	conf := privateKeysConfiguration(dir)
+	conf.IssuerPrivateKeysPassphrase = "wrong"
+	_, err = irmaserver.New(conf)
+	require.Error(t, err)
+
+	passphraseFile := filepath.Join(dir, "passphrase")
+	require.NoError(t, ioutil.WriteFile(passphraseFile, append(passphrase, '\n'), 0600))
+	conf = privateKeysConfiguration(dir)
+	conf.IssuerPrivateKeysPassphraseFile = passphraseFile
+	_, err = irmaserver.New(conf)
+	require.NoError(t, err)
+	require.Contains(t, conf.IssuerPrivateKeys, mijnOverheid)
+	require.Contains(t, conf.IssuerPrivateKeys, ru)
+
+	// Restrict to MijnOverheid: the RU key is neither loaded from the private keys path, nor from
+	// the scheme
+	conf = privateKeysConfiguration(dir)
+	conf.IssuerPrivateKeysPassphraseFile = passphraseFile
+	conf.IssuerPrivateKeysIssuers = []string{mijnOverheid.String()}
+	_, err = irmaserver.New(conf)
+	require.NoError(t, err)
+	require.NotContains(t, conf.IssuerPrivateKeys, ru)
+	sk, err := conf.PrivateKey(mijnOverheid)
+	require.NoError(t, err)
+	require.NotNil(t, sk)
+	sk, err = conf.PrivateKey(ru)
+	require.NoError(t, err)
+	require.Nil(t, sk)
+
+	conf = privateKeysConfiguration(dir)
+	conf.IssuerPrivateKeysPassphraseFile = passphraseFile
+	conf.IssuerPrivateKeysIssuers = []string{"irma-demo.Nonexisting"}
+	_, err = irmaserver.New(conf)
+	require.Error(t, err)
+}
+
+func TestPrivateKeyServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyserver")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sk, err := gabi.NewPrivateKeyFromFile(filepath.Join(testdata, "privatekeys", "irma-demo.MijnOverheid.xml"))
+	require.NoError(t, err)
+	rusk, err := gabi.NewPrivateKeyFromFile(filepath.Join(testdata, "privatekeys", "irma-demo.RU.xml"))
+	require.NoError(t, err)
+	keys := map[irma.IssuerIdentifier]*gabi.PrivateKey{mijnOverheid: sk}
+	testIssuer := irma.NewIssuerIdentifier("test.test")
+	keys[testIssuer] = rusk // wrong key for test.test
+
+	socket := filepath.Join(dir, "keyserver.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	keyserver := &http.Server{Handler: server.KeyServerHandler(server.PrivateKeyProviderFunc(
+		func(id irma.IssuerIdentifier) (*gabi.PrivateKey, error) {
+			return keys[id], nil
+		},
+	))}
+	go func() {
+		_ = keyserver.Serve(listener)
+	}()
+	defer keyserver.Close()
+
+	conf := privateKeysConfiguration("")
+	conf.IssuerPrivateKeysServer = socket
+	_, err = irmaserver.New(conf)
+	require.NoError(t, err)
+
+	served, err := conf.PrivateKey(mijnOverheid)
+	require.NoError(t, err)
+	require.NotNil(t, served)
+	require.Equal(t, sk.Counter, served.Counter)
+	require.Zero(t, sk.P.Cmp(served.P))
+
+	// The key server returns a key not belonging to test.test, which must be rejected
+	_, err = conf.PrivateKey(testIssuer)
+	require.Error(t, err)
+
+	// Neither the key server nor the scheme have a key of this issuer
+	served, err = conf.PrivateKey(irma.NewIssuerIdentifier("irma-demo.Nonexisting"))
+	require.NoError(t, err)
+	require.Nil(t, served)
+}
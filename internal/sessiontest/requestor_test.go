@@ -4,15 +4,20 @@ import (
 	"bytes"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"path/filepath"
 	"reflect"
-
+	"strings"
 	"testing"
 
+	"github.com/gorilla/websocket"
+
 	"github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/irmaclient"
 	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
 	"github.com/stretchr/testify/require"
 )
 
@@ -333,3 +338,222 @@ func TestOptionalDisclosure(t *testing.T) {
 		require.True(t, reflect.DeepEqual(args.disclosed, result.Disclosed))
 	}
 }
+
+func TestWebsocketStatus(t *testing.T) {
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	qr, token, err := irmaServer.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	url := strings.Replace(qr.URL, "http://", "ws://", 1) + "/statuswebsocket"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var status server.Status
+	require.NoError(t, conn.ReadJSON(&status))
+	require.Equal(t, server.StatusInitialized, status)
+
+	require.NoError(t, irmaServer.CancelSession(token))
+	require.NoError(t, conn.ReadJSON(&status))
+	require.Equal(t, server.StatusCancelled, status)
+
+	// After the final status the server closes the connection
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+
+	// Reconnecting yields the current status
+	conn2, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn2.Close()
+	require.NoError(t, conn2.ReadJSON(&status))
+	require.Equal(t, server.StatusCancelled, status)
+}
+
+func TestLocalSession(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	// The test storage lacks this attribute, so the client can't perform the session,
+	// but it does receive the session request over the pipe
+	id := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.familyname")
+	serverChan := make(chan *server.SessionResult)
+	errChan := startLocalSession(serverConn, getDisclosureRequest(id), serverChan)
+
+	clientChan := make(chan *SessionResult, 1)
+	h := &UnsatisfiableTestHandler{TestHandler{t, clientChan, client, nil, ""}}
+	dismisser := client.NewLocalSession(clientConn, h)
+	require.NoError(t, <-errChan)
+	clientResult := <-clientChan
+	require.NotNil(t, clientResult)
+	require.NoError(t, clientResult.Err)
+	require.NotEmpty(t, clientResult.Missing)
+
+	// Dismissing sends a DELETE over the pipe, cancelling the session at the server
+	dismisser.Dismiss()
+	serverResult := <-serverChan
+	require.Equal(t, server.StatusCancelled, serverResult.Status)
+}
+
+func TestLocalDisclosureSession(t *testing.T) {
+	client, _ := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	StartIrmaServer(t, false)
+	defer StopIrmaServer()
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	serverChan := make(chan *server.SessionResult)
+	errChan := startLocalSession(serverConn, getDisclosureRequest(id), serverChan)
+
+	clientChan := make(chan *SessionResult, 1)
+	client.NewLocalSession(clientConn, &TestHandler{t, clientChan, client, nil, ""})
+	require.NoError(t, <-errChan)
+	if clientResult := <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+
+	serverResult := <-serverChan
+	require.Equal(t, server.StatusDone, serverResult.Status)
+	require.Equal(t, irma.ProofStatusValid, serverResult.ProofStatus)
+	require.Len(t, serverResult.Disclosed, 1)
+	require.Equal(t, id, serverResult.Disclosed[0][0].Identifier)
+	require.Equal(t, "456", serverResult.Disclosed[0][0].Value["en"])
+}
+
+// startLocalSession starts a session over the local stream, which blocks until the client reads
+// the session QR, and reports on the returned channel whether starting succeeded.
+// The session result is sent to results.
+func startLocalSession(conn net.Conn, request irma.SessionRequest, results chan *server.SessionResult) chan error {
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := irmaServer.StartLocalSession(conn, request, func(result *server.SessionResult) {
+			results <- result
+		})
+		errChan <- err
+	}()
+	return errChan
+}
+
+// inProcessClient returns a client that performs its sessions with the server without going over
+// the network: the protocol messages are passed over in-memory pipes, using the same framing and
+// (un)marshaling as sessions over a local byte stream (see irma.LocalTransport). The returned
+// function closes the pipes.
+func inProcessClient(t *testing.T, irmaserv *irmaserver.Server) (*irmaclient.Client, func()) {
+	var conns []net.Conn
+	client, err := irmaclient.New(
+		filepath.Join(testdata, "storage", "test"),
+		filepath.Join(testdata, "irma_configuration"),
+		&TestClientHandler{t: t, c: make(chan error)},
+		irmaclient.WithTransport(func(url string) irma.Transport {
+			serverConn, clientConn := net.Pipe()
+			conns = append(conns, serverConn, clientConn)
+			go func() {
+				_ = irmaserv.ServeLocal(serverConn)
+			}()
+			return irma.NewLocalTransport(clientConn, url)
+		}),
+	)
+	require.NoError(t, err)
+	return client, func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+}
+
+func startInProcessServer(t *testing.T) *irmaserver.Server {
+	irmaserv, err := irmaserver.New(&server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+	})
+	require.NoError(t, err)
+	return irmaserv
+}
+
+// inProcessSession performs a session with the server using a client from inProcessClient,
+// returning the result of the session at the server.
+func inProcessSession(t *testing.T, irmaserv *irmaserver.Server, request irma.SessionRequest) *server.SessionResult {
+	client, closer := inProcessClient(t, irmaserv)
+	defer closer()
+
+	serverChan := make(chan *server.SessionResult, 1)
+	qr, _, err := irmaserv.StartSession(request, func(result *server.SessionResult) {
+		serverChan <- result
+	})
+	require.NoError(t, err)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+
+	clientChan := make(chan *SessionResult, 1)
+	client.NewSession(string(j), &TestHandler{t, clientChan, client, nil, ""})
+	if clientResult := <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+	return <-serverChan
+}
+
+func TestInProcessSession(t *testing.T) {
+	test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t)
+	irmaserv := startInProcessServer(t)
+	defer irmaserv.Stop()
+	client, closer := inProcessClient(t, irmaserv)
+	defer closer()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.familyname")
+	qr, token, err := irmaserv.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+
+	clientChan := make(chan *SessionResult, 1)
+	dismisser := client.NewSession(string(j), &UnsatisfiableTestHandler{TestHandler{t, clientChan, client, nil, ""}})
+	clientResult := <-clientChan
+	require.NotNil(t, clientResult)
+	require.NoError(t, clientResult.Err)
+	require.NotEmpty(t, clientResult.Missing)
+	require.Equal(t, server.StatusConnected, irmaserv.GetSessionResult(token).Status)
+
+	dismisser.Dismiss()
+	require.Equal(t, server.StatusCancelled, irmaserv.GetSessionResult(token).Status)
+}
+
+func TestInProcessDisclosureSession(t *testing.T) {
+	test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t)
+	irmaserv := startInProcessServer(t)
+	defer irmaserv.Stop()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	result := inProcessSession(t, irmaserv, getDisclosureRequest(id))
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Len(t, result.Disclosed, 1)
+	require.Equal(t, id, result.Disclosed[0][0].Identifier)
+	require.Equal(t, "456", result.Disclosed[0][0].Value["en"])
+}
+
+func TestInProcessIssuanceSession(t *testing.T) {
+	test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t)
+	irmaserv := startInProcessServer(t)
+	defer irmaserv.Stop()
+
+	result := inProcessSession(t, irmaserv, getIssuanceRequest(true))
+	require.Equal(t, server.StatusDone, result.Status)
+	require.Nil(t, result.Err)
+}
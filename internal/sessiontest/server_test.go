@@ -1,11 +1,14 @@
 package sessiontest
 
 import (
+	"fmt"
+	"net"
 	"net/http"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/go-errors/errors"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/server"
@@ -40,7 +43,14 @@ func StartRequestorServer(configuration *requestorserver.Configuration) {
 			panic("Starting server failed: " + err.Error())
 		}
 	}()
-	time.Sleep(100 * time.Millisecond) // Give server time to start
+	if err := waitForServer(configuration.Port); err != nil {
+		panic(err)
+	}
+	if configuration.ClientPort != 0 {
+		if err := waitForServer(configuration.ClientPort); err != nil {
+			panic(err)
+		}
+	}
 }
 
 func StopRequestorServer() {
@@ -60,9 +70,10 @@ func StartIrmaServer(t *testing.T, updatedIrmaConf bool) {
 
 	var err error
 	irmaServer, err = irmaserver.New(&server.Configuration{
-		URL:         "http://localhost:48680",
-		Logger:      logger,
-		SchemesPath: filepath.Join(testdata, irmaconf),
+		URL:              "http://localhost:48680",
+		Logger:           logger,
+		SchemesPath:      filepath.Join(testdata, irmaconf),
+		EnableWebsockets: true,
 	})
 
 	require.NoError(t, err)
@@ -73,6 +84,23 @@ func StartIrmaServer(t *testing.T, updatedIrmaConf bool) {
 	go func() {
 		_ = httpServer.ListenAndServe()
 	}()
+	require.NoError(t, waitForServer(48680))
+}
+
+// waitForServer waits until a server accepts connections at the specified port on localhost.
+func waitForServer(port int) error {
+	addr := fmt.Sprintf("localhost:%d", port)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err == nil {
+			return conn.Close()
+		}
+		if time.Now().After(deadline) {
+			return errors.WrapPrefix(err, "Server at "+addr+" did not start", 0)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 }
 
 func StopIrmaServer() {
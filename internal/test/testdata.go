@@ -46,6 +46,7 @@ func StopSchemeManagerHttpServer() {
 
 // StartBadHttpServer starts an HTTP server that times out and returns 500 on the first few times.
 func StartBadHttpServer(count int, timeout time.Duration, success string) {
+	badServerCount = 0
 	badServer = &http.Server{Addr: ":48682", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if badServerCount >= count {
 			_, _ = fmt.Fprintln(w, success)
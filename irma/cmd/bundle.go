@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/spf13/cobra"
+)
+
+var bundleCmd = &cobra.Command{
+	Use:   "bundle [path]",
+	Short: "Bundle a scheme into a single signed archive",
+	Long: `The bundle command verifies the scheme at the specified path (or the current directory if not
+specified), and writes it as a single archive containing all of its signed files, for transferring it
+to environments without internet access. As all files are covered by the signed index, the archive
+is verified as a whole against the public key of the scheme when it is installed using
+"irma scheme unbundle".`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := absPathArg(args)
+		if err != nil {
+			return errors.WrapPrefix(err, "Invalid path", 0)
+		}
+		conf, id, err := parseSchemeFolder(path)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to parse scheme", 0)
+		}
+
+		output, _ := cmd.Flags().GetString("output")
+		if output == "" {
+			output = id.Name() + ".tar.gz"
+		}
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		if err = conf.BundleScheme(id, file); err != nil {
+			_ = file.Close()
+			_ = os.Remove(output)
+			return errors.WrapPrefix(err, "Failed to bundle scheme", 0)
+		}
+		if err = file.Close(); err != nil {
+			return err
+		}
+		fmt.Printf("Scheme %s (version %s) bundled into %s\n", id, conf.SchemeManagers[id].Timestamp.String(), output)
+		return nil
+	},
+}
+
+var unbundleCmd = &cobra.Command{
+	Use:   "unbundle bundle [irma_configuration]",
+	Short: "Install or update a scheme from a scheme bundle",
+	Long: `The unbundle command verifies the scheme bundle created with "irma scheme bundle", and installs
+the scheme within it into the specified irma_configuration folder (default ` + server.DefaultSchemesPath() + `),
+replacing the current version of the scheme if present.
+
+The bundle is verified against the public key specified with --publickey, or otherwise the public
+key of the currently installed version of the scheme, or for the default schemes (irma-demo and
+pbdf), their well-known public key. Installing a bundle containing an older version of the scheme
+than the current version requires --force.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := server.DefaultSchemesPath()
+		if len(args) > 1 {
+			path = args[1]
+		}
+		if err := fs.AssertPathExists(path); err != nil {
+			return errors.Errorf("irma_configuration folder %s does not exist", path)
+		}
+
+		var publickey []byte
+		var err error
+		if pkfile, _ := cmd.Flags().GetString("publickey"); pkfile != "" {
+			if publickey, err = ioutil.ReadFile(pkfile); err != nil {
+				return errors.WrapPrefix(err, "Failed to read public key", 0)
+			}
+		}
+		force, _ := cmd.Flags().GetBool("force")
+
+		conf, err := irma.NewConfiguration(path)
+		if err != nil {
+			return err
+		}
+		if err = conf.ParseFolder(); err != nil {
+			return errors.WrapPrefix(err, "Failed to parse irma_configuration", 0)
+		}
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		id, err := conf.InstallSchemeBundle(file, publickey, force)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to install scheme bundle", 0)
+		}
+		fmt.Printf("Installed scheme %s (version %s) into %s\n", id, conf.SchemeManagers[id].Timestamp.String(), path)
+		return nil
+	},
+}
+
+func init() {
+	schemeCmd.AddCommand(bundleCmd)
+	schemeCmd.AddCommand(unbundleCmd)
+
+	bundleCmd.Flags().StringP("output", "o", "", "path of the bundle (default <scheme>.tar.gz)")
+	unbundleCmd.Flags().StringP("publickey", "p", "", "path to the public key of the scheme to verify the bundle against")
+	unbundleCmd.Flags().BoolP("force", "f", false, "install the bundle even if it contains an older version of the scheme")
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/spf13/cobra"
+)
+
+// credtypeAddCmd represents the credtype add command
+var credtypeAddCmd = &cobra.Command{
+	Use:   "add [issuer-path]",
+	Short: "Add a credential type to an IRMA issuer",
+	Long: `Add a credential type to an IRMA issuer
+
+The add command adds a new credential type to the IRMA issuer specified by "issuer-path" (if not
+provided the current directory is taken), and resigns the scheme containing the issuer using the
+private key specified with --privatekey.
+
+The credential type is described either using the flags below, or using a YAML specification passed
+with --spec (see "irma scheme create" for the format); flags take precedence over the specification.
+When the attributes are specified with --attributes, their names and descriptions are set to their
+IDs; use a specification to set them.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		spec := &credentialTypeSpec{}
+		if specfile, _ := flags.GetString("spec"); specfile != "" {
+			if err := readSpec(specfile, spec); err != nil {
+				return err
+			}
+		}
+		stringFlag(flags, "id", &spec.ID)
+		stringFlag(flags, "logo", &spec.Logo)
+		if flags.Changed("singleton") {
+			spec.Singleton, _ = flags.GetBool("singleton")
+		}
+		for name, t := range map[string]*translations{
+			"name":        &spec.Name,
+			"shortname":   &spec.ShortName,
+			"description": &spec.Description,
+			"issue-url":   &spec.IssueURL,
+		} {
+			if err := translationFlag(flags, name, t); err != nil {
+				return err
+			}
+		}
+		if flags.Changed("attributes") {
+			attrs, _ := flags.GetStringSlice("attributes")
+			spec.Attributes = nil
+			for _, attr := range attrs {
+				spec.Attributes = append(spec.Attributes, &attributeSpec{ID: attr})
+			}
+		}
+		optional, _ := flags.GetStringSlice("optional")
+	optionalLoop:
+		for _, id := range optional {
+			for _, attr := range spec.Attributes {
+				if attr.ID == id {
+					attr.Optional = true
+					continue optionalLoop
+				}
+			}
+			return errors.Errorf("Optional attribute %s is not an attribute of the credential type", id)
+		}
+
+		path, err := absPathArg(args)
+		if err != nil {
+			return errors.WrapPrefix(err, "Invalid path", 0)
+		}
+		if err = fs.AssertPathExists(filepath.Join(path, "description.xml")); err != nil {
+			return errors.Errorf("%s is not an issuer directory", path)
+		}
+		pk, err := latestPublicKey(path)
+		if err != nil {
+			return err
+		}
+
+		skfile, _ := flags.GetString("privatekey")
+		overwrite, _ := flags.GetBool("force-overwrite")
+		if err = createCredentialType(path, spec, len(pk.R), overwrite); err != nil {
+			return err
+		}
+		if err = resignScheme(skfile, filepath.Dir(path)); err != nil {
+			return errors.WrapPrefix(err, "Failed to sign scheme", 0)
+		}
+		fmt.Println("Credential type", spec.ID, "added")
+		return nil
+	},
+}
+
+func init() {
+	credtypeCmd.AddCommand(credtypeAddCmd)
+
+	flags := credtypeAddCmd.Flags()
+	flags.String("spec", "", "YAML file specifying the credential type")
+	flags.String("id", "", "Credential type ID")
+	flags.StringArray("name", nil, "Credential type name, as lang=text (default credential type ID)")
+	flags.StringArray("shortname", nil, "Credential type short name, as lang=text (default credential type ID)")
+	flags.StringArray("description", nil, "Credential type description, as lang=text (default credential type ID)")
+	flags.StringArray("issue-url", nil, "URL at which the credential type can be obtained, as lang=text")
+	flags.StringSlice("attributes", nil, "Comma-separated attribute IDs")
+	flags.StringSlice("optional", nil, "Comma-separated IDs of the attributes that are optional")
+	flags.Bool("singleton", false, "Users can have at most one instance of the credential type")
+	flags.String("logo", "", "PNG file to use as logo of the credential type")
+	flags.StringP("privatekey", "s", "sk.pem", "Private key to sign the scheme with")
+	flags.BoolP("force-overwrite", "f", false, "Overwrite an existing description")
+}
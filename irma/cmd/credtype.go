@@ -0,0 +1,15 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// credtypeCmd represents the credtype command
+var credtypeCmd = &cobra.Command{
+	Use:   "credtype",
+	Short: "Manage credential types within an IRMA scheme",
+}
+
+func init() {
+	schemeCmd.AddCommand(credtypeCmd)
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/spf13/cobra"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff old-path new-path",
+	Short: "Show the differences between two versions of a scheme",
+	Long: `The diff command compares two versions of a scheme, each of which must be a valid (signed) scheme folder, and prints the issuers, credential types and attributes that were added, removed or changed, the public keys that were added, removed, or expired in between, and changes of DeprecatedSince dates.
+
+The two folders must have the same name, namely the scheme identifier, e.g.: irma scheme diff irma-demo /tmp/new/irma-demo`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		change, err := diffSchemes(args[0], args[1])
+		if err != nil {
+			die("Failed to compare schemes", err)
+		}
+		if asJson, _ := cmd.Flags().GetBool("json"); asJson {
+			fmt.Println(prettyprint(change))
+		} else {
+			fmt.Print(change.String())
+		}
+	},
+}
+
+func diffSchemes(oldpath, newpath string) (*irma.SchemeChange, error) {
+	oldconf, oldid, err := parseSchemeFolder(oldpath)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse old scheme", 0)
+	}
+	newconf, newid, err := parseSchemeFolder(newpath)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse new scheme", 0)
+	}
+	if oldid != newid {
+		return nil, errors.Errorf("Cannot compare different schemes %s and %s", oldid, newid)
+	}
+	return irma.DiffScheme(oldconf, newconf, newid)
+}
+
+// parseSchemeFolder parses the scheme at the specified path into a new read-only Configuration.
+func parseSchemeFolder(path string) (*irma.Configuration, irma.SchemeManagerIdentifier, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, irma.SchemeManagerIdentifier{}, err
+	}
+	conf, err := irma.NewConfigurationReadOnly(filepath.Dir(path))
+	if err != nil {
+		return nil, irma.SchemeManagerIdentifier{}, err
+	}
+	scheme := irma.NewSchemeManager(filepath.Base(path))
+	if err = conf.ParseSchemeManagerFolder(path, scheme); err != nil {
+		return nil, irma.SchemeManagerIdentifier{}, err
+	}
+	return conf, scheme.Identifier(), nil
+}
+
+func init() {
+	schemeCmd.AddCommand(diffCmd)
+
+	diffCmd.Flags().Bool("json", false, "output the differences as JSON")
+}
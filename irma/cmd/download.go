@@ -42,13 +42,14 @@ var downloadCmd = &cobra.Command{
 			}
 			fmt.Println("No irma_configuration path specified, using " + defaultIrmaconf)
 		}
-		if err := downloadSchemeManager(path, urls); err != nil {
+		mirror, _ := cmd.Flags().GetString("mirror")
+		if err := downloadSchemeManager(path, urls, mirror); err != nil {
 			die("Downloading scheme failed", err)
 		}
 	},
 }
 
-func downloadSchemeManager(dest string, urls []string) error {
+func downloadSchemeManager(dest string, urls []string, mirror string) error {
 	exists, err := fs.PathExists(dest)
 	if err != nil {
 		return errors.Errorf("Could not check path existence: %s", err.Error())
@@ -79,6 +80,10 @@ func downloadSchemeManager(dest string, urls []string) error {
 	}
 
 	conf, err := irma.NewConfiguration(dest)
+	if err != nil {
+		return err
+	}
+	conf.SchemeMirrorURL = mirror
 
 	if len(urls) == 0 {
 		if err := conf.DownloadDefaultSchemes(); err != nil {
@@ -90,7 +95,12 @@ func downloadSchemeManager(dest string, urls []string) error {
 			managerName := urlparts[len(urlparts)-1]
 			manager := irma.NewSchemeManager(managerName)
 			manager.URL = u
-			if err := conf.InstallSchemeManager(manager, nil); err != nil {
+			// Also when using a mirror, the public key is downloaded from the scheme itself
+			pk, err := conf.DownloadSchemePublicKey(manager)
+			if err != nil {
+				return errors.WrapPrefix(err, "failed to download public key of scheme "+managerName, 0)
+			}
+			if err := conf.InstallSchemeManager(manager, pk); err != nil {
 				return err
 			}
 		}
@@ -111,4 +121,6 @@ func downloadHelp() string {
 
 func init() {
 	schemeCmd.AddCommand(downloadCmd)
+
+	downloadCmd.Flags().String("mirror", "", "download from this mirror (see irma scheme mirror) instead of from the scheme's own URL")
 }
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/spf13/cobra"
+)
+
+var importSignatureCmd = &cobra.Command{
+	Use:   "import-signature signature [path]",
+	Short: "Import an index signature created offline into a scheme",
+	Long:  `Import a signature over the index of the scheme at the specified path (by default the working directory), created by "irma scheme sign-index" after exporting the index using "irma scheme sign --signer offline". The signature is checked against the public key specified by --publickey (by default the pk.pem of the scheme) and against the current index of the scheme, after which it is written to index.sig and the scheme is verified. If the scheme has no pk.pem yet, the public key is written to it; an existing pk.pem differing from the public key is only replaced with --replace-publickey.`,
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		confpath, err := absPathArg(args[1:])
+		if err != nil {
+			return errors.WrapPrefix(err, "Invalid path", 0)
+		}
+		if err = fs.AssertPathExists(filepath.Join(confpath, "index")); err != nil {
+			return errors.Errorf("%s contains no index", confpath)
+		}
+		pkfile, _ := cmd.Flags().GetString("publickey")
+		if pkfile == "" {
+			pkfile = filepath.Join(confpath, "pk.pem")
+		}
+		publickey, err := readPublicKey(pkfile)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to read public key", 0)
+		}
+		sig, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to read signature", 0)
+		}
+		skipverification, _ := cmd.Flags().GetBool("noverification")
+		replacekey, _ := cmd.Flags().GetBool("replace-publickey")
+		if err = installSignature(confpath, sig, publickey, skipverification, replacekey); err != nil {
+			return errors.WrapPrefix(err, "Failed to import signature", 0)
+		}
+		return nil
+	},
+}
+
+func init() {
+	schemeCmd.AddCommand(importSignatureCmd)
+
+	importSignatureCmd.Flags().StringP("publickey", "p", "", "Public key of the scheme (default pk.pem within the scheme)")
+	importSignatureCmd.Flags().BoolP("noverification", "n", false, "Skip verification of the scheme after importing the signature")
+	importSignatureCmd.Flags().Bool("replace-publickey", false, "Replace the pk.pem of the scheme if it differs from --publickey")
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/spf13/cobra"
+)
+
+// issuerAddCmd represents the issuer add command
+var issuerAddCmd = &cobra.Command{
+	Use:   "add [scheme-path]",
+	Short: "Add an issuer to an IRMA scheme",
+	Long: `Add an issuer to an IRMA scheme
+
+The add command adds a new issuer to the IRMA scheme specified by "scheme-path" (if not provided the
+current directory is taken), generates a key pair for it, and resigns the scheme using the private
+key specified with --privatekey.
+
+The issuer is described either using the flags below, or using a YAML specification passed with
+--spec, which may also contain the credential types of the issuer (see "irma scheme create" for the
+format); flags take precedence over the specification.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		spec := &issuerSpec{}
+		if specfile, _ := flags.GetString("spec"); specfile != "" {
+			if err := readSpec(specfile, spec); err != nil {
+				return err
+			}
+		}
+		stringFlag(flags, "id", &spec.ID)
+		stringFlag(flags, "contactaddress", &spec.ContactAddress)
+		stringFlag(flags, "contactemail", &spec.ContactEMail)
+		stringFlag(flags, "logo", &spec.Logo)
+		if err := translationFlag(flags, "name", &spec.Name); err != nil {
+			return err
+		}
+		if err := translationFlag(flags, "shortname", &spec.ShortName); err != nil {
+			return err
+		}
+
+		path, err := absPathArg(args)
+		if err != nil {
+			return errors.WrapPrefix(err, "Invalid path", 0)
+		}
+		if err = fs.AssertPathExists(path); err != nil {
+			return errors.WrapPrefix(err, "Nonexisting path specified", 0)
+		}
+
+		keys, err := parseIssuerKeyFlags(flags)
+		if err != nil {
+			return err
+		}
+		skfile, _ := flags.GetString("privatekey")
+		overwrite, _ := flags.GetBool("force-overwrite")
+
+		if err = createIssuer(path, spec, keys, overwrite); err != nil {
+			return err
+		}
+		if err = resignScheme(skfile, path); err != nil {
+			return errors.WrapPrefix(err, "Failed to sign scheme", 0)
+		}
+		fmt.Println("Issuer", spec.ID, "added")
+		return nil
+	},
+}
+
+func init() {
+	issuerCmd.AddCommand(issuerAddCmd)
+
+	flags := issuerAddCmd.Flags()
+	flags.String("spec", "", "YAML file specifying the issuer")
+	flags.String("id", "", "Issuer ID")
+	flags.StringArray("name", nil, "Issuer name, as lang=text (default issuer ID)")
+	flags.StringArray("shortname", nil, "Issuer short name, as lang=text (default issuer ID)")
+	flags.String("contactaddress", "", "Contact address of the issuer")
+	flags.String("contactemail", "", "Contact email address of the issuer")
+	flags.String("logo", "", "PNG file to use as logo of the issuer")
+	flags.StringP("privatekey", "s", "sk.pem", "Private key to sign the scheme with")
+	flags.BoolP("force-overwrite", "f", false, "Overwrite existing descriptions")
+	issuerKeyFlags(flags)
+}
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago/internal/encryption"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var issuerEncryptKeyCmd = &cobra.Command{
+	Use:   "encrypt-key privatekey [output]",
+	Short: "Encrypt an IRMA issuer private key using a passphrase",
+	Long: `Encrypt an IRMA issuer private key using a passphrase.
+
+The encrypted private key is written to "output", by default the path of the private key with the
+.enc extension appended. When placed in the private keys path of the IRMA server (under the name
+scheme.issuer.xml.enc), the server decrypts it at startup using the passphrase specified with
+--privkeys-passphrase-file or $IRMASERVER_PRIVKEYS_PASSPHRASE.
+
+The passphrase is read from the file specified with --passphrase-file, from $IRMA_PRIVKEYS_PASSPHRASE,
+or otherwise from the terminal.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		output := args[0] + server.EncryptedPrivateKeyExtension
+		if len(args) > 1 {
+			output = args[1]
+		}
+		force, _ := flags.GetBool("force-overwrite")
+		if !force {
+			if err := fs.AssertPathNotExists(output); err != nil {
+				return errors.Errorf("File %s already exists, not overwriting", output)
+			}
+		}
+
+		bts, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to read private key", 0)
+		}
+		if _, err = gabi.NewPrivateKeyFromXML(string(bts)); err != nil {
+			return errors.WrapPrefix(err, "Failed to parse private key", 0)
+		}
+		passphrase, err := readPassphrase(flags, true)
+		if err != nil {
+			return err
+		}
+		encrypted, err := encryption.EncryptWithPassphrase(bts, passphrase)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to encrypt private key", 0)
+		}
+		if err = ioutil.WriteFile(output, encrypted, 0600); err != nil {
+			return errors.WrapPrefix(err, "Failed to write encrypted private key", 0)
+		}
+		fmt.Println("Encrypted private key written to", output)
+
+		if remove, _ := flags.GetBool("remove"); remove {
+			if err = os.Remove(args[0]); err != nil {
+				return errors.WrapPrefix(err, "Failed to remove unencrypted private key", 0)
+			}
+			fmt.Println("Removed unencrypted private key", args[0])
+		}
+		return nil
+	},
+}
+
+func passphraseFlags(flags *pflag.FlagSet) {
+	flags.String("passphrase-file", "", "path to file containing the passphrase (default $IRMA_PRIVKEYS_PASSPHRASE or prompt)")
+}
+
+// readPassphrase reads the passphrase from the file specified with --passphrase-file, from
+// $IRMA_PRIVKEYS_PASSPHRASE, or from the terminal, in which case it is asked twice if confirm is true.
+func readPassphrase(flags *pflag.FlagSet, confirm bool) ([]byte, error) {
+	if path, _ := flags.GetString("passphrase-file"); path != "" {
+		bts, err := fs.ReadKey("", path)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to read passphrase", 0)
+		}
+		return []byte(strings.TrimRight(string(bts), "\r\n")), nil
+	}
+	if env := os.Getenv("IRMA_PRIVKEYS_PASSPHRASE"); env != "" {
+		return []byte(env), nil
+	}
+	if !terminal.IsTerminal(int(syscall.Stdin)) {
+		return nil, errors.New("No passphrase specified and not running in a terminal")
+	}
+
+	fmt.Print("Passphrase: ")
+	passphrase, err := terminal.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to read passphrase", 0)
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("Empty passphrase")
+	}
+	if confirm {
+		fmt.Print("Repeat passphrase: ")
+		repeated, err := terminal.ReadPassword(int(syscall.Stdin))
+		fmt.Println()
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to read passphrase", 0)
+		}
+		if !bytes.Equal(passphrase, repeated) {
+			return nil, errors.New("Passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+func init() {
+	issuerCmd.AddCommand(issuerEncryptKeyCmd)
+
+	flags := issuerEncryptKeyCmd.Flags()
+	passphraseFlags(flags)
+	flags.BoolP("force-overwrite", "f", false, "Force overwriting of the output file if it exists")
+	flags.Bool("remove", false, "Remove the unencrypted private key afterwards")
+}
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/spf13/cobra"
+)
+
+// issuerRotateCmd represents the issuer rotate command
+var issuerRotateCmd = &cobra.Command{
+	Use:   "rotate [issuer-path]",
+	Short: "Rotate the key pair of an IRMA issuer",
+	Long: `Rotate the key pair of an IRMA issuer
+
+The rotate command generates a new key pair for the IRMA issuer specified by "issuer-path" (if not
+provided the current directory is taken), using the next unused counter, and stores it in the
+PublicKeys and PrivateKeys subfolders next to the existing keys. Unless specified otherwise, the new
+key pair has the same key length and number of attributes as the current latest public key.
+
+Old public keys are kept, so that credentials issued with them keep verifying. The command shows
+for each public key of the issuer until when it can be used for issuance, and which key is used
+for issuance after the rotation: IRMA servers automatically use the private key with the highest
+counter whose public key is not expired.
+
+Finally the scheme is resigned, using the private key specified with --privatekey or another signer
+(see "irma scheme sign").`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		path, err := absPathArg(args)
+		if err != nil {
+			return errors.WrapPrefix(err, "Invalid path", 0)
+		}
+		schemepath := filepath.Dir(path)
+		if err = fs.AssertPathExists(filepath.Join(path, "description.xml")); err != nil {
+			return errors.Errorf("%s is not an issuer directory", path)
+		}
+
+		conf, schemeid, err := parseSchemeFolder(schemepath)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to parse scheme", 0)
+		}
+		issuerid := irma.NewIssuerIdentifier(schemeid.Name() + "." + filepath.Base(path))
+		if conf.Issuers[issuerid] == nil {
+			return errors.Errorf("Issuer %s not found in scheme", issuerid)
+		}
+
+		keys, err := parseIssuerKeyFlags(flags)
+		if err != nil {
+			return err
+		}
+		indices, err := conf.PublicKeyIndices(issuerid)
+		if err != nil {
+			return err
+		}
+		if len(indices) > 0 {
+			latest, err := conf.PublicKey(issuerid, indices[len(indices)-1])
+			if err != nil {
+				return err
+			}
+			if !flags.Changed("keylength") {
+				keys.keylength = latest.N.BitLen()
+			}
+			if !flags.Changed("numattributes") {
+				keys.numAttributes = len(latest.R)
+			}
+		}
+		for credid, cred := range conf.CredentialTypes {
+			if credid.IssuerIdentifier() == issuerid && len(cred.AttributeTypes)+2 > keys.numAttributes {
+				return errors.Errorf("Credential type %s requires at least %d attributes in the key pair, specify --numattributes",
+					credid, len(cred.AttributeTypes)+2)
+			}
+		}
+
+		// Load the signer before generating keys, so that we fail early if it cannot be used
+		sk, _ := flags.GetString("privatekey")
+		signer, err := newSigner(flags, sk)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to load signer", 0)
+		}
+		defer closeSigner(signer)
+
+		counter := uint(defaultCounter(path))
+		err = generateIssuerKeys(path, keys.keylength, counter, keys.numAttributes, keys.expiryDate, "", "", false)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Generated key pair %d of issuer %s, expiring at %s\n\n", counter, issuerid, keys.expiryDate.Format(time.RFC3339))
+
+		if err = printKeyStatus(path, issuerid); err != nil {
+			return err
+		}
+
+		if err = signManager(signer, schemepath, false, false); err != nil {
+			return errors.WrapPrefix(err, "Failed to sign scheme", 0)
+		}
+		return nil
+	},
+}
+
+// printKeyStatus prints for each public key of the issuer until when it can be used for issuance.
+func printKeyStatus(path string, issuerid irma.IssuerIdentifier) error {
+	matches, err := filepath.Glob(filepath.Join(path, "PublicKeys", "*.xml"))
+	if err != nil {
+		return err
+	}
+	var pks []*gabi.PublicKey
+	for _, match := range matches {
+		pk, err := gabi.NewPublicKeyFromFile(match)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to parse public key "+match, 0)
+		}
+		pks = append(pks, pk)
+	}
+	sort.Slice(pks, func(i, j int) bool { return pks[i].Counter < pks[j].Counter })
+
+	// The key used for issuance is the newest nonexpired one having a private key, like in
+	// irma.Configuration.PrivateKey()
+	now := time.Now().Unix()
+	issuing := -1
+	for _, pk := range pks {
+		if pk.ExpiryDate > now && fs.AssertPathExists(filepath.Join(path, "PrivateKeys", fmt.Sprintf("%d.xml", pk.Counter))) == nil {
+			issuing = int(pk.Counter)
+		}
+	}
+
+	fmt.Printf("Public keys of issuer %s (credentials issued with any of these keep verifying as long as the key remains in the scheme):\n", issuerid)
+	for _, pk := range pks {
+		expiry := time.Unix(pk.ExpiryDate, 0).UTC().Format(time.RFC3339)
+		status := "can be used for issuance until " + expiry
+		if pk.ExpiryDate <= now {
+			status = "expired at " + expiry + ", no longer used for issuance"
+		}
+		if int(pk.Counter) == issuing {
+			status += " (used for issuance)"
+		}
+		fmt.Printf("  %d: %d bits, %d attributes, %s\n", pk.Counter, pk.N.BitLen(), len(pk.R), status)
+	}
+	fmt.Println()
+	return nil
+}
+
+func init() {
+	issuerCmd.AddCommand(issuerRotateCmd)
+
+	flags := issuerRotateCmd.Flags()
+	flags.StringP("privatekey", "s", "sk.pem", "Private key to sign the scheme with")
+	issuerKeyFlags(flags)
+	signerFlags(flags, false)
+}
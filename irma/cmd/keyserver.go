@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/spf13/cobra"
+)
+
+var keyserverCmd = &cobra.Command{
+	Use:   "keyserver",
+	Short: "Serve IRMA issuer private keys to IRMA servers over a unix socket",
+	Long: `Serve IRMA issuer private keys to IRMA servers over a unix socket.
+
+The key server reads the private keys from the folder specified with --privkeys, using the same
+naming conventions as the private keys path of the IRMA server: scheme.issuer.xml, or
+scheme.issuer.xml.enc for private keys encrypted with "irma scheme issuer encrypt-key". The
+passphrase of encrypted private keys is read from the file specified with --passphrase-file,
+from $IRMA_PRIVKEYS_PASSPHRASE, or otherwise from the terminal.
+
+The keys are served on the unix socket specified with --socket, which is created accessible only to
+the current user. Start the IRMA server with --privkeys-server pointing to this socket, as the same
+user, to retrieve private keys from the key server. This way the IRMA server process does not read
+the private key files nor needs their passphrase, keeping them out of its configuration. Note that
+this does not protect the private keys against the IRMA server's user, which is the same user as
+that of the key server: it can still read the private key files and connect to the socket.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		socket, _ := flags.GetString("socket")
+		path, _ := flags.GetString("privkeys")
+		issuers, _ := flags.GetStringSlice("issuers")
+		verbosity, _ := flags.GetCount("verbose")
+		if socket == "" || path == "" {
+			return errors.New("--socket and --privkeys are required")
+		}
+
+		server.Logger = server.NewLogger(verbosity, false, false)
+		conf := &server.Configuration{IssuerPrivateKeysIssuers: issuers}
+		var passphrase []byte
+		encrypted, err := filepath.Glob(filepath.Join(path, "*.xml"+server.EncryptedPrivateKeyExtension))
+		if err != nil {
+			return err
+		}
+		if len(encrypted) > 0 {
+			if passphrase, err = readPassphrase(flags, false); err != nil {
+				return err
+			}
+		}
+		keys, _, err := server.ReadPrivateKeysFolder(path, passphrase, conf.PrivateKeyAllowed)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to read private keys", 0)
+		}
+		if len(keys) == 0 {
+			return errors.Errorf("No private keys found in %s", path)
+		}
+		for id, sk := range keys {
+			server.Logger.WithField("issuer", id.String()).Infof("Serving private key %d", sk.Counter)
+		}
+
+		// Remove a stale socket of a previous key server, refusing to remove other files
+		if info, err := os.Lstat(socket); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return errors.Errorf("%s exists and is not a socket", socket)
+			}
+			if err = os.Remove(socket); err != nil {
+				return err
+			}
+		}
+		listener, err := listenPrivate(socket)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to listen on socket", 0)
+		}
+
+		handler := server.KeyServerHandler(server.PrivateKeyProviderFunc(
+			func(id irma.IssuerIdentifier) (*gabi.PrivateKey, error) {
+				return keys[id], nil
+			},
+		))
+		serv := &http.Server{Handler: handler}
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-interrupt
+			server.Logger.Info("Exiting")
+			_ = serv.Close() // also removes the socket
+		}()
+
+		server.Logger.WithField("socket", socket).Info("Key server listening")
+		if err = serv.Serve(listener); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(keyserverCmd)
+
+	flags := keyserverCmd.Flags()
+	flags.String("socket", "", "path to the unix socket on which to listen")
+	flags.StringP("privkeys", "k", "", "path to IRMA private keys")
+	flags.StringSlice("issuers", nil, "if specified, only serve private keys of these issuers")
+	passphraseFlags(flags)
+	flags.CountP("verbose", "v", "verbose (repeatable)")
+}
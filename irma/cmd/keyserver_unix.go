@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenPrivate listens on a unix socket at the specified path that is accessible only to the
+// current user. The umask is set while creating the socket, so that it is never accessible to
+// others, not even between its creation and a subsequent chmod.
+func listenPrivate(socket string) (net.Listener, error) {
+	umask := syscall.Umask(0177)
+	defer syscall.Umask(umask)
+	return net.Listen("unix", socket)
+}
@@ -0,0 +1,20 @@
+package cmd
+
+import (
+	"net"
+	"os"
+)
+
+// listenPrivate listens on a unix socket at the specified path, restricting access to it to the
+// current user as far as supported on Windows.
+func listenPrivate(socket string) (net.Listener, error) {
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(socket, 0600); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
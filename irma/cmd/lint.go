@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/spf13/cobra"
+)
+
+var lintCmd = &cobra.Command{
+	Use:   "lint [path]",
+	Short: "Check a scheme for problems beyond those found by verify",
+	Long: `The lint command parses and verifies the scheme at the specified path (or the current directory if not specified), and then reports problems that do not prevent it from being used but that are likely to cause problems:
+
+  translations   texts that are not translated in all languages
+  logo           missing logos, logos that are not valid PNG images, too large or not square
+  displayindex   duplicate, missing or out of range displayIndex attributes
+  keyexpiry      issuers whose latest public key has expired or expires soon
+  keysize        credential types having more attributes than the latest public key of the issuer supports
+  optionalorder  required attributes after optional attributes, suggesting inserted attributes
+  unsigned       files that are not included in the index, and so are ignored
+  privatekeys    private keys, plaintext or encrypted, that do not belong to the latest public key of their issuer
+
+Each finding has a severity: error, warning or info. The command exits with a nonzero exit code if any finding is at least as severe as the --fail-on severity, so that it can be used in CI.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		failOn, _ := flags.GetString("fail-on")
+		languages, _ := flags.GetStringSlice("languages")
+		expiry, _ := flags.GetDuration("key-expiry")
+		asJson, _ := flags.GetBool("json")
+		if failOn != "none" && !irma.LintSeverity(failOn).AtLeast(irma.LintInfo) {
+			die("", errors.Errorf("Invalid --fail-on severity %s", failOn))
+		}
+
+		path, err := absPathArg(args)
+		if err != nil {
+			die("Invalid path", err)
+		}
+		conf, id, err := parseSchemeFolder(path)
+		if err != nil {
+			die("Failed to parse scheme", err)
+		}
+		findings, err := conf.LintScheme(id, &irma.LintOptions{Languages: languages, KeyExpiryWarning: expiry})
+		if err != nil {
+			die("Failed to lint scheme", err)
+		}
+
+		if asJson {
+			if findings == nil {
+				findings = []*irma.LintFinding{}
+			}
+			fmt.Println(prettyprint(findings))
+		} else {
+			for _, finding := range findings {
+				fmt.Println(finding.String())
+			}
+			fmt.Printf("%d findings\n", len(findings))
+		}
+
+		if failOn == "none" {
+			return
+		}
+		for _, finding := range findings {
+			if finding.Severity.AtLeast(irma.LintSeverity(failOn)) {
+				os.Exit(1)
+			}
+		}
+	},
+}
+
+func init() {
+	schemeCmd.AddCommand(lintCmd)
+
+	lintCmd.Flags().Bool("json", false, "output the findings as JSON")
+	lintCmd.Flags().String("fail-on", string(irma.LintError), "exit with a nonzero exit code on findings of at least this severity (error, warning, info or none)")
+	lintCmd.Flags().StringSlice("languages", []string{"en", "nl"}, "languages in which all texts must be translated")
+	lintCmd.Flags().Duration("key-expiry", 90*24*time.Hour, "report public keys that expire within this period")
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/spf13/cobra"
+)
+
+var mirrorCmd = &cobra.Command{
+	Use:   "mirror path [url...]",
+	Short: "Mirror schemes into a directory that can be served statically",
+	Long: `The mirror command downloads the schemes at the specified URLs, including all files listed in their
+signed index, into subdirectories of "path" named after the schemes. If no URLs are given, the
+schemes already present in "path" are updated, or if there are none, the default schemes
+(irma-demo and pbdf) are downloaded.
+
+The resulting directory can be served as-is by any static file server. Point IRMA servers and
+clients at it using their scheme mirror setting (e.g. "irma server --schemes-mirror URL" or
+"irma scheme update --mirror URL"), after which the schemes are downloaded from the mirror while
+still being verified against the public key of the scheme. Rerun this command periodically to
+keep the mirror up to date.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+		if err = fs.EnsureDirectoryExists(path); err != nil {
+			return errors.WrapPrefix(err, "Failed to create mirror directory", 0)
+		}
+		conf, err := irma.NewConfiguration(path)
+		if err != nil {
+			return err
+		}
+		conf.SchemeMirrorURL, _ = cmd.Flags().GetString("from-mirror")
+		if err = conf.ParseFolder(); err != nil {
+			return errors.WrapPrefix(err, "Failed to parse existing schemes in mirror", 0)
+		}
+
+		urls := args[1:]
+		if len(urls) == 0 && len(conf.SchemeManagers) == 0 {
+			fmt.Println("Downloading default schemes")
+			if err = conf.DownloadDefaultSchemes(); err != nil {
+				return errors.WrapPrefix(err, "Failed to download default schemes", 0)
+			}
+		}
+		for _, url := range urls {
+			url = strings.TrimSuffix(strings.TrimSuffix(url, "/description.xml"), "/")
+			manager := irma.NewSchemeManager(url[strings.LastIndex(url, "/")+1:])
+			if _, present := conf.SchemeManagers[manager.Identifier()]; present {
+				continue // updated below
+			}
+			fmt.Println("Downloading scheme", manager.ID)
+			manager.URL = url
+			// Also when using --from-mirror, the public key is downloaded from the scheme itself
+			pk, err := conf.DownloadSchemePublicKey(manager)
+			if err != nil {
+				return errors.WrapPrefix(err, "Failed to download public key of scheme "+manager.ID, 0)
+			}
+			if err = conf.InstallSchemeManager(manager, pk); err != nil {
+				return errors.WrapPrefix(err, "Failed to download scheme "+manager.ID, 0)
+			}
+		}
+		if err = conf.UpdateSchemes(); err != nil {
+			return errors.WrapPrefix(err, "Failed to update schemes", 0)
+		}
+
+		// Previous versions of updated schemes should not be served
+		previous, err := filepath.Glob(filepath.Join(path, ".*.previous"))
+		if err != nil {
+			return err
+		}
+		for _, dir := range previous {
+			if err = os.RemoveAll(dir); err != nil {
+				return err
+			}
+		}
+
+		for id, manager := range conf.SchemeManagers {
+			if !manager.Valid {
+				return errors.Errorf("Scheme %s in mirror is invalid: %s", id, conf.DisabledSchemeManagers[id])
+			}
+			if err = conf.VerifySchemeManager(manager); err != nil {
+				return errors.WrapPrefix(err, "Scheme "+id.String()+" in mirror is invalid", 0)
+			}
+			if err = checkMirrorComplete(path, id); err != nil {
+				return err
+			}
+			fmt.Printf("Mirrored scheme %s (version %s)\n", id, manager.Timestamp.String())
+		}
+		return nil
+	},
+}
+
+// checkMirrorComplete checks that all files listed in the index of the scheme are present,
+// as clients may download any of them from the mirror.
+func checkMirrorComplete(path string, id irma.SchemeManagerIdentifier) error {
+	bts, err := ioutil.ReadFile(filepath.Join(path, id.Name(), "index"))
+	if err != nil {
+		return err
+	}
+	index := irma.SchemeManagerIndex{}
+	if err = index.FromString(string(bts)); err != nil {
+		return err
+	}
+	for file := range index {
+		if err = fs.AssertPathExists(filepath.Join(path, filepath.FromSlash(file))); err != nil {
+			return errors.Errorf("Mirror of scheme %s is missing %s", id, file)
+		}
+	}
+	return nil
+}
+
+func init() {
+	schemeCmd.AddCommand(mirrorCmd)
+
+	mirrorCmd.Flags().String("from-mirror", "", "download from this mirror instead of from the schemes' own URLs")
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/spf13/cobra"
+)
+
+// schemeCreateCmd represents the scheme create command
+var schemeCreateCmd = &cobra.Command{
+	Use:   "create [path]",
+	Short: "Create a new IRMA scheme",
+	Long: `Create a new IRMA scheme
+
+The create command creates a new IRMA scheme in the directory specified by "path" (by default, a
+directory named after the scheme ID in the current directory). The scheme is described either using
+the flags below, or using a YAML specification passed with --spec, which may also contain the
+issuers and credential types of the scheme; flags take precedence over the specification. Example:
+
+  id: irma-demo
+  name: Demo scheme
+  url: https://example.com
+  demo: true
+  issuers:
+  - id: MijnOverheid
+    name:
+      en: My government
+      nl: Mijn overheid
+    credentialtypes:
+    - id: fullName
+      attributes:
+      - id: firstname
+      - id: familyname
+      - id: prefix
+        optional: true
+
+Translated texts may be specified as a single string which is then used for all languages, or as a
+map from languages to texts. The corresponding flags may be repeated and take values of the form
+"lang=text", or just "text" for all languages.
+
+For each issuer a key pair is generated, after which the scheme is signed using the private key
+specified with --privatekey (generated if it does not exist) and verified.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		spec := &schemeSpec{}
+		if specfile, _ := flags.GetString("spec"); specfile != "" {
+			if err := readSpec(specfile, spec); err != nil {
+				return err
+			}
+		}
+		stringFlag(flags, "id", &spec.ID)
+		stringFlag(flags, "url", &spec.URL)
+		stringFlag(flags, "contact", &spec.Contact)
+		stringFlag(flags, "keyshareserver", &spec.KeyshareServer)
+		stringFlag(flags, "keysharewebsite", &spec.KeyshareWebsite)
+		stringFlag(flags, "keyshareattribute", &spec.KeyshareAttribute)
+		stringFlag(flags, "timestampserver", &spec.TimestampServer)
+		if flags.Changed("demo") {
+			spec.Demo, _ = flags.GetBool("demo")
+		}
+		if err := translationFlag(flags, "name", &spec.Name); err != nil {
+			return err
+		}
+		if err := translationFlag(flags, "description", &spec.Description); err != nil {
+			return err
+		}
+
+		var path string
+		var err error
+		if len(args) == 0 && spec.ID != "" {
+			path, err = filepath.Abs(spec.ID)
+		} else {
+			path, err = absPathArg(args)
+		}
+		if err != nil {
+			return errors.WrapPrefix(err, "Invalid path", 0)
+		}
+		if spec.ID == "" {
+			spec.ID = filepath.Base(path)
+		}
+		if err = validateIdentifierPart("scheme", spec.ID); err != nil {
+			return err
+		}
+		if filepath.Base(path) != spec.ID {
+			return errors.Errorf("Scheme directory name %s must equal the scheme ID %s", filepath.Base(path), spec.ID)
+		}
+
+		keys, err := parseIssuerKeyFlags(flags)
+		if err != nil {
+			return err
+		}
+		skfile, _ := flags.GetString("privatekey")
+		overwrite, _ := flags.GetBool("force-overwrite")
+
+		if err = createScheme(path, spec, keys, overwrite); err != nil {
+			return err
+		}
+
+		exists, err := fs.PathExists(skfile)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err = generateSchemeKeys(skfile, filepath.Join(path, "pk.pem")); err != nil {
+				return err
+			}
+		}
+		if err = resignScheme(skfile, path); err != nil {
+			return errors.WrapPrefix(err, "Failed to sign scheme", 0)
+		}
+		fmt.Println("Scheme", spec.ID, "created at", path)
+		return nil
+	},
+}
+
+func createScheme(path string, spec *schemeSpec, keys *issuerKeyOptions, overwrite bool) error {
+	if err := writeDescription(path, spec.description(), overwrite); err != nil {
+		return err
+	}
+	for _, issuer := range spec.Issuers {
+		if err := createIssuer(path, issuer, keys, overwrite); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	schemeCmd.AddCommand(schemeCreateCmd)
+
+	flags := schemeCreateCmd.Flags()
+	flags.String("spec", "", "YAML file specifying the scheme")
+	flags.String("id", "", "Scheme ID (default name of the scheme directory)")
+	flags.StringArray("name", nil, "Scheme name, as lang=text (default scheme ID)")
+	flags.StringArray("description", nil, "Scheme description, as lang=text (default scheme ID)")
+	flags.String("url", "", "URL from which the scheme will be downloaded")
+	flags.String("contact", "", "Contact website or email address")
+	flags.Bool("demo", false, "Create a demo scheme, whose issuer private keys are published along with it")
+	flags.String("keyshareserver", "", "URL of the keyshare server of the scheme")
+	flags.String("keysharewebsite", "", "URL of the website of the keyshare server of the scheme")
+	flags.String("keyshareattribute", "", "Attribute containing the keyshare username")
+	flags.String("timestampserver", "", "URL of the timestamp server used for attribute-based signatures")
+	flags.StringP("privatekey", "s", "sk.pem", "Private key to sign the scheme with (generated if it does not exist)")
+	flags.BoolP("force-overwrite", "f", false, "Overwrite existing descriptions")
+	issuerKeyFlags(flags)
+}
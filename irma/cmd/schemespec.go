@@ -0,0 +1,392 @@
+package cmd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// This file contains the YAML specification format used by the scheme authoring commands
+// ("irma scheme create", "irma scheme issuer add" and "irma scheme credtype add"), and the
+// functions that turn such specifications into the description.xml files of a scheme.
+
+// The languages that a translated string given as a single string (instead of as a map
+// from languages to texts) is used for. These are the languages checked by "irma scheme verify".
+var specLanguages = []string{"en", "nl"}
+
+// The XML versions of the descriptions that we generate
+const (
+	schemeXMLVersion         = 7
+	issuerXMLVersion         = 4
+	credentialTypeXMLVersion = 4
+)
+
+type schemeSpec struct {
+	ID                string        `yaml:"id"`
+	Name              translations  `yaml:"name"`
+	Description       translations  `yaml:"description"`
+	URL               string        `yaml:"url"`
+	Contact           string        `yaml:"contact"`
+	Demo              bool          `yaml:"demo"`
+	KeyshareServer    string        `yaml:"keyshareserver"`
+	KeyshareWebsite   string        `yaml:"keysharewebsite"`
+	KeyshareAttribute string        `yaml:"keyshareattribute"`
+	TimestampServer   string        `yaml:"timestampserver"`
+	Issuers           []*issuerSpec `yaml:"issuers"`
+}
+
+type issuerSpec struct {
+	ID              string                `yaml:"id"`
+	Name            translations          `yaml:"name"`
+	ShortName       translations          `yaml:"shortname"`
+	ContactAddress  string                `yaml:"contactaddress"`
+	ContactEMail    string                `yaml:"contactemail"`
+	Logo            string                `yaml:"logo"`
+	CredentialTypes []*credentialTypeSpec `yaml:"credentialtypes"`
+}
+
+type credentialTypeSpec struct {
+	ID             string           `yaml:"id"`
+	Name           translations     `yaml:"name"`
+	ShortName      translations     `yaml:"shortname"`
+	Description    translations     `yaml:"description"`
+	Singleton      bool             `yaml:"singleton"`
+	DisallowDelete bool             `yaml:"disallowdelete"`
+	IssueURL       translations     `yaml:"issueurl"`
+	Logo           string           `yaml:"logo"`
+	Attributes     []*attributeSpec `yaml:"attributes"`
+}
+
+type attributeSpec struct {
+	ID           string       `yaml:"id"`
+	Name         translations `yaml:"name"`
+	Description  translations `yaml:"description"`
+	Optional     bool         `yaml:"optional"`
+	DisplayIndex *int         `yaml:"displayindex"`
+}
+
+// translations is a translated string within a specification. It may be specified either as a map
+// from languages to texts, or as a single string which is then used for all specLanguages.
+type translations irma.TranslatedString
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (t *translations) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var text string
+	if err := unmarshal(&text); err == nil {
+		*t = untranslated(text)
+		return nil
+	}
+	var m map[string]string
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	*t = m
+	return nil
+}
+
+func untranslated(text string) translations {
+	t := translations{}
+	for _, lang := range specLanguages {
+		t[lang] = text
+	}
+	return t
+}
+
+// orDefault returns t, or if t is empty, the specified text in all specLanguages.
+func (t translations) orDefault(text string) irma.TranslatedString {
+	if len(t) == 0 {
+		return irma.TranslatedString(untranslated(text))
+	}
+	return irma.TranslatedString(t)
+}
+
+// parseTranslations parses translation flags of the form "lang=text". Flags without "=" apply
+// to all specLanguages.
+func parseTranslations(values []string) (translations, error) {
+	t := translations{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) == 1 {
+			for lang, text := range untranslated(value) {
+				t[lang] = text
+			}
+			continue
+		}
+		if parts[0] == "" || strings.Contains(parts[0], " ") {
+			return nil, errors.Errorf("invalid translation %s, specify as lang=text", value)
+		}
+		t[parts[0]] = parts[1]
+	}
+	return t, nil
+}
+
+// translationFlag overrides *t with the translations from the specified flag, if it was set.
+func translationFlag(flags *pflag.FlagSet, name string, t *translations) error {
+	if !flags.Changed(name) {
+		return nil
+	}
+	values, _ := flags.GetStringArray(name)
+	parsed, err := parseTranslations(values)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to parse --"+name, 0)
+	}
+	*t = parsed
+	return nil
+}
+
+// stringFlag overrides *s with the value of the specified flag, if it was set.
+func stringFlag(flags *pflag.FlagSet, name string, s *string) {
+	if flags.Changed(name) {
+		*s, _ = flags.GetString(name)
+	}
+}
+
+// readSpec reads a YAML specification from the specified file into spec.
+func readSpec(path string, spec interface{}) error {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to read specification", 0)
+	}
+	if err = yaml.UnmarshalStrict(bts, spec); err != nil {
+		return errors.WrapPrefix(err, "Failed to parse specification "+path, 0)
+	}
+	return nil
+}
+
+func validateIdentifierPart(kind, id string) error {
+	if id == "" {
+		return errors.Errorf("No %s ID specified", kind)
+	}
+	if strings.ContainsAny(id, "./\\ ") {
+		return errors.Errorf("Invalid %s ID %s: must not contain dots, slashes or spaces", kind, id)
+	}
+	return nil
+}
+
+func (spec *schemeSpec) description() *irma.SchemeManager {
+	return &irma.SchemeManager{
+		ID:                spec.ID,
+		Name:              spec.Name.orDefault(spec.ID),
+		URL:               spec.URL,
+		Contact:           spec.Contact,
+		Demo:              spec.Demo,
+		Description:       spec.Description.orDefault(spec.ID),
+		KeyshareServer:    spec.KeyshareServer,
+		KeyshareWebsite:   spec.KeyshareWebsite,
+		KeyshareAttribute: spec.KeyshareAttribute,
+		TimestampServer:   spec.TimestampServer,
+		XMLVersion:        schemeXMLVersion,
+	}
+}
+
+func (spec *issuerSpec) description(scheme string) *irma.Issuer {
+	return &irma.Issuer{
+		ID:              spec.ID,
+		Name:            spec.Name.orDefault(spec.ID),
+		ShortName:       spec.ShortName.orDefault(spec.ID),
+		SchemeManagerID: scheme,
+		ContactAddress:  spec.ContactAddress,
+		ContactEMail:    spec.ContactEMail,
+		XMLVersion:      issuerXMLVersion,
+	}
+}
+
+func (spec *credentialTypeSpec) description(scheme, issuer string) (*irma.CredentialType, error) {
+	cred := &irma.CredentialType{
+		ID:              spec.ID,
+		Name:            spec.Name.orDefault(spec.ID),
+		ShortName:       spec.ShortName.orDefault(spec.ID),
+		IssuerID:        issuer,
+		SchemeManagerID: scheme,
+		IsSingleton:     spec.Singleton,
+		DisallowDelete:  spec.DisallowDelete,
+		Description:     spec.Description.orDefault(spec.ID),
+		IssueURL:        irma.TranslatedString(spec.IssueURL),
+		XMLVersion:      credentialTypeXMLVersion,
+	}
+	if len(spec.Attributes) == 0 {
+		return nil, errors.Errorf("Credential type %s has no attributes", spec.ID)
+	}
+	ids := map[string]struct{}{}
+	for _, attr := range spec.Attributes {
+		if err := validateIdentifierPart("attribute", attr.ID); err != nil {
+			return nil, err
+		}
+		if _, ok := ids[attr.ID]; ok {
+			return nil, errors.Errorf("Credential type %s has duplicate attribute %s", spec.ID, attr.ID)
+		}
+		ids[attr.ID] = struct{}{}
+		attrtype := &irma.AttributeType{
+			ID:           attr.ID,
+			Name:         attr.Name.orDefault(attr.ID),
+			Description:  attr.Description.orDefault(attr.ID),
+			DisplayIndex: attr.DisplayIndex,
+		}
+		if attr.Optional {
+			attrtype.Optional = "true"
+		}
+		cred.AttributeTypes = append(cred.AttributeTypes, attrtype)
+	}
+	return cred, nil
+}
+
+// writeDescription writes the XML serialization of the description to path/description.xml,
+// creating path if necessary.
+func writeDescription(path string, description interface{}, overwrite bool) error {
+	if err := fs.EnsureDirectoryExists(path); err != nil {
+		return errors.WrapPrefix(err, "Failed to create "+path, 0)
+	}
+	file := filepath.Join(path, "description.xml")
+	if !overwrite {
+		if err := fs.AssertPathNotExists(file); err != nil {
+			return errors.Errorf("%s already exists, will not overwrite (force with -f flag)", file)
+		}
+	}
+	bts, err := xml.MarshalIndent(description, "", "\t")
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to serialize description", 0)
+	}
+	bts = append([]byte(xml.Header), append(bts, '\n')...)
+	if err = ioutil.WriteFile(file, bts, 0644); err != nil {
+		return errors.WrapPrefix(err, "Failed to write "+file, 0)
+	}
+	fmt.Println("Written", file)
+	return nil
+}
+
+// copyLogo copies the specified logo, which must be a PNG file, to path/logo.png.
+func copyLogo(logo, path string) error {
+	if logo == "" {
+		return nil
+	}
+	if !strings.EqualFold(filepath.Ext(logo), ".png") {
+		return errors.Errorf("Logo %s is not a PNG file", logo)
+	}
+	bts, err := ioutil.ReadFile(logo)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to read logo", 0)
+	}
+	return ioutil.WriteFile(filepath.Join(path, "logo.png"), bts, 0644)
+}
+
+// issuerKeyOptions specify the issuer key pairs generated for new issuers.
+type issuerKeyOptions struct {
+	keylength     int
+	numAttributes int
+	expiryDate    time.Time
+}
+
+func issuerKeyFlags(flags *pflag.FlagSet) {
+	flags.StringP("expirydate", "e", "", "Expiry date for the issuer key pairs. Specify in RFC3339 (\"2006-01-02T15:04:05+07:00\") format. Alternatively, use the --valid-for option.")
+	flags.String("valid-for", "1y", "The duration issuer key pairs should be valid starting from now. Specify as a number followed by either y, M, d, h, or m. This flag is ignored when expirydate flag is used.")
+	flags.IntP("keylength", "l", 2048, "Keylength of the issuer key pairs")
+	flags.IntP("numattributes", "a", 12, "Number of attributes of the issuer key pairs")
+}
+
+func parseIssuerKeyFlags(flags *pflag.FlagSet) (*issuerKeyOptions, error) {
+	keylength, _ := flags.GetInt("keylength")
+	numAttributes, _ := flags.GetInt("numattributes")
+	expiryDateString, _ := flags.GetString("expirydate")
+	validFor, _ := flags.GetString("valid-for")
+	expiryDate, err := parseExpiryDate(expiryDateString, validFor)
+	if err != nil {
+		return nil, err
+	}
+	return &issuerKeyOptions{keylength: keylength, numAttributes: numAttributes, expiryDate: expiryDate}, nil
+}
+
+// createIssuer writes the description of the specified issuer and its credential types to the
+// scheme at schemepath, and generates a key pair for it.
+func createIssuer(schemepath string, spec *issuerSpec, keys *issuerKeyOptions, overwrite bool) error {
+	if err := validateIdentifierPart("issuer", spec.ID); err != nil {
+		return err
+	}
+	path := filepath.Join(schemepath, spec.ID)
+	if err := writeDescription(path, spec.description(filepath.Base(schemepath)), overwrite); err != nil {
+		return err
+	}
+	if err := copyLogo(spec.Logo, path); err != nil {
+		return err
+	}
+	for _, cred := range spec.CredentialTypes {
+		if err := createCredentialType(path, cred, keys.numAttributes, overwrite); err != nil {
+			return err
+		}
+	}
+	return generateIssuerKeys(path, keys.keylength, 0, keys.numAttributes, keys.expiryDate, "", "", false)
+}
+
+// createCredentialType writes the description of the specified credential type to the issuer
+// at issuerpath, whose public key supports keyAttributes attributes.
+func createCredentialType(issuerpath string, spec *credentialTypeSpec, keyAttributes int, overwrite bool) error {
+	if err := validateIdentifierPart("credential type", spec.ID); err != nil {
+		return err
+	}
+	// Apart from the attributes of the credential type, the key also contains the secret key and
+	// the metadata attribute
+	if required := len(spec.Attributes) + 2; required > keyAttributes {
+		return errors.Errorf("Credential type %s requires %d attributes, but the public key of the issuer supports %d",
+			spec.ID, required, keyAttributes)
+	}
+	scheme := filepath.Base(filepath.Dir(issuerpath))
+	cred, err := spec.description(scheme, filepath.Base(issuerpath))
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(issuerpath, "Issues", spec.ID)
+	if err = writeDescription(path, cred, overwrite); err != nil {
+		return err
+	}
+	return copyLogo(spec.Logo, path)
+}
+
+// latestPublicKey returns the public key of the issuer at issuerpath having the highest counter.
+func latestPublicKey(issuerpath string) (*gabi.PublicKey, error) {
+	matches, err := filepath.Glob(filepath.Join(issuerpath, "PublicKeys", "*.xml"))
+	if err != nil {
+		return nil, err
+	}
+	var latest *gabi.PublicKey
+	for _, match := range matches {
+		pk, err := gabi.NewPublicKeyFromFile(match)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to parse public key "+match, 0)
+		}
+		if latest == nil || pk.Counter > latest.Counter {
+			latest = pk
+		}
+	}
+	if latest == nil {
+		return nil, errors.Errorf("Issuer at %s has no public keys", issuerpath)
+	}
+	return latest, nil
+}
+
+// resignScheme signs the scheme at schemepath with the specified private key, and verifies it.
+func resignScheme(skfile, schemepath string) error {
+	privatekey, err := readPrivateKey(skfile)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to read private key", 0)
+	}
+	return signManager(privatekey, schemepath, false, false)
+}
+
+// absPathArg returns the absolute path of the first argument, or of the working directory if
+// there are no arguments.
+func absPathArg(args []string) (string, error) {
+	if len(args) == 0 {
+		return os.Getwd()
+	}
+	return filepath.Abs(args[0])
+}
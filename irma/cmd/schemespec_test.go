@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateCredentialTypeKeySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credtype")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	issuerpath := filepath.Join(dir, "irma-demo", "RU")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("..", "..", "testdata", "irma_configuration", "irma-demo", "RU"), issuerpath))
+
+	pk, err := latestPublicKey(issuerpath)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, pk.Counter)
+
+	spec := &credentialTypeSpec{ID: "toolarge"}
+	for i := 0; i < len(pk.R)-1; i++ {
+		spec.Attributes = append(spec.Attributes, &attributeSpec{ID: "attr" + string(rune('a'+i))})
+	}
+	require.Error(t, createCredentialType(issuerpath, spec, len(pk.R), false))
+	require.NoError(t, fs.AssertPathNotExists(filepath.Join(issuerpath, "Issues", "toolarge")))
+
+	spec.ID = "fits"
+	spec.Attributes = spec.Attributes[:len(pk.R)-2]
+	require.NoError(t, createCredentialType(issuerpath, spec, len(pk.R), false))
+	require.NoError(t, fs.AssertPathExists(filepath.Join(issuerpath, "Issues", "fits", "description.xml")))
+}
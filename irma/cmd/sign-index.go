@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-errors/errors"
+	"github.com/spf13/cobra"
+)
+
+var signIndexCmd = &cobra.Command{
+	Use:   "sign-index [privatekey] index",
+	Short: "Sign a scheme index exported for offline signing",
+	Long:  `Sign an index file exported by "irma scheme sign --signer offline", for example on an offline machine. The privatekey argument defaults to "sk.pem", and must be omitted when using --signer pkcs11 or remote. The signature is written to the file specified by --output (by default the index filename suffixed with ".sig"), and should be imported into the scheme using "irma scheme import-signature".`,
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		sk, index := "sk.pem", args[len(args)-1]
+		if len(args) == 2 {
+			sk = args[0]
+		}
+		output, _ := flags.GetString("output")
+		if output == "" {
+			output = index + ".sig"
+		}
+
+		bts, err := ioutil.ReadFile(index)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to read index", 0)
+		}
+		signer, err := newSigner(flags, sk)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to load signer", 0)
+		}
+		defer closeSigner(signer)
+
+		sig, err := signIndex(signer, bts)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(output, sig, 0644); err != nil {
+			return errors.WrapPrefix(err, "Failed to write signature", 0)
+		}
+		fmt.Println("Signature written to", output)
+		return nil
+	},
+}
+
+func init() {
+	schemeCmd.AddCommand(signIndexCmd)
+
+	signIndexCmd.Flags().StringP("output", "o", "", "File to write the signature to")
+	signerFlags(signIndexCmd.Flags(), false)
+}
@@ -1,14 +1,13 @@
 package cmd
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/ecdsa"
-	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
-	"encoding/asn1"
 	"encoding/pem"
 	"io/ioutil"
-	"math/big"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -26,14 +25,26 @@ import (
 var signCmd = &cobra.Command{
 	Use:   "sign [privatekey] [path]",
 	Short: "Sign a scheme directory",
-	Long: `Sign a scheme manager directory, using the specified ECDSA key. Both arguments are optional; "sk.pem" and the working directory are the defaults. Outputs an index file, signature over the index file, and the public key in the specified directory.
+	Long: `Sign a scheme manager directory, using the specified ECDSA key. Both arguments are optional; "sk.pem" and the working directory are the defaults. Outputs an index file, signature over the index file, and the public key in the specified directory. If the directory already contains a public key (pk.pem) differing from that of the signer, signing is aborted unless --replace-publickey is specified.
+
+Instead of with a private key file, the index can be signed using a key within a PKCS#11 module such as a hardware security module (--signer pkcs11), or by a remote signing server (--signer remote); in these cases the privatekey argument must be omitted. With --signer offline, only the index is written (and exported using --export), so that it can be signed elsewhere using "irma scheme sign-index", after which the signature is imported using "irma scheme import-signature".
 
 Careful: this command could fail and invalidate or destroy your scheme manager directory! Use this only if you can restore it from git or backups.`,
 	Args: cobra.MaximumNArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		signerType, _ := flags.GetString("signer")
+		if signerType != "file" && len(args) > 1 {
+			return errors.New("The privatekey argument can only be used with --signer file")
+		}
+
 		// Validate arguments
 		var err error
 		var sk, confpath string
+		if signerType != "file" {
+			// The only argument, if any, is the path
+			args = append([]string{"sk.pem"}, args...)
+		}
 		switch len(args) {
 		case 0:
 			sk = "sk.pem"
@@ -49,21 +60,31 @@ Careful: this command could fail and invalidate or destroy your scheme manager d
 			return errors.WrapPrefix(err, "Invalid path", 0)
 		}
 
-		privatekey, err := readPrivateKey(sk)
-		if err != nil {
-			return errors.WrapPrefix(err, "Failed to read private key:", 0)
-		}
-
 		if err = fs.AssertPathExists(confpath); err != nil {
 			return err
 		}
 
-		skipverification, err := cmd.Flags().GetBool("noverification")
+		if signerType == "offline" {
+			export, _ := flags.GetString("export")
+			if err = exportIndex(confpath, export); err != nil {
+				return errors.WrapPrefix(err, "Failed to write index", 0)
+			}
+			return nil
+		}
+
+		signer, err := newSigner(flags, sk)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to load signer", 0)
+		}
+		defer closeSigner(signer)
+
+		skipverification, err := flags.GetBool("noverification")
 		if err != nil {
 			return err
 		}
-		if err := signManager(privatekey, confpath, skipverification); err != nil {
-			die("Failed to sign scheme", err)
+		replacekey, _ := flags.GetBool("replace-publickey")
+		if err := signManager(signer, confpath, skipverification, replacekey); err != nil {
+			return errors.WrapPrefix(err, "Failed to sign scheme", 0)
 		}
 		return nil
 	},
@@ -73,13 +94,38 @@ func init() {
 	schemeCmd.AddCommand(signCmd)
 
 	signCmd.Flags().BoolP("noverification", "n", false, "Skip verification of the scheme after signing it")
+	signCmd.Flags().String("export", "", "With --signer offline, copy the index to be signed to this file")
+	signCmd.Flags().Bool("replace-publickey", false, "Replace the pk.pem of the scheme if it differs from the public key of the signer")
+	signerFlags(signCmd.Flags(), true)
+}
+
+// signManager signs the scheme at confpath using the specified signer, whose public key must be
+// an ECDSA public key equal to the pk.pem of the scheme, if present, unless replacekey is set.
+func signManager(signer crypto.Signer, confpath string, skipverification, replacekey bool) error {
+	bts, err := writeIndex(confpath)
+	if err != nil {
+		return err
+	}
+
+	// Create and write signature
+	sigbytes, err := signIndex(signer, bts)
+	if err != nil {
+		return err
+	}
+	publickey, err := signerPublicKey(signer)
+	if err != nil {
+		return err
+	}
+	return installSignature(confpath, sigbytes, publickey, skipverification, replacekey)
 }
 
-func signManager(privatekey *ecdsa.PrivateKey, confpath string, skipverification bool) error {
+// writeIndex writes a new timestamp, and an index containing the hashes of all files in the scheme,
+// returning the contents of the index.
+func writeIndex(confpath string) ([]byte, error) {
 	// Write timestamp
 	bts := []byte(strconv.FormatInt(time.Now().Unix(), 10) + "\n")
 	if err := ioutil.WriteFile(filepath.Join(confpath, "timestamp"), bts, 0644); err != nil {
-		return errors.WrapPrefix(err, "Failed to write timestamp", 0)
+		return nil, errors.WrapPrefix(err, "Failed to write timestamp", 0)
 	}
 
 	// Traverse dir and add file hashes to index
@@ -88,37 +134,63 @@ func signManager(privatekey *ecdsa.PrivateKey, confpath string, skipverification
 		return calculateFileHash(path, info, err, confpath, index)
 	})
 	if err != nil {
-		return errors.WrapPrefix(err, "Failed to calculate file index:", 0)
+		return nil, errors.WrapPrefix(err, "Failed to calculate file index:", 0)
 	}
 
 	// Write index
 	bts = []byte(index.String())
 	if err := ioutil.WriteFile(filepath.Join(confpath, "index"), bts, 0644); err != nil {
-		return errors.WrapPrefix(err, "Failed to write index", 0)
+		return nil, errors.WrapPrefix(err, "Failed to write index", 0)
 	}
+	return bts, nil
+}
 
-	// Create and write signature
-	indexHash := sha256.Sum256(bts)
-	r, s, err := ecdsa.Sign(rand.Reader, privatekey, indexHash[:])
-	if err != nil {
-		return errors.WrapPrefix(err, "Failed to sign index:", 0)
-	}
-	sigbytes, err := asn1.Marshal([]*big.Int{r, s})
+// installSignature checks the signature over the index of the scheme at confpath against the
+// public key, and writes the signature to index.sig. The public key must equal the pk.pem of the
+// scheme, unless replacekey is set or the scheme has no pk.pem yet, in which case it is written
+// to pk.pem.
+func installSignature(confpath string, sigbytes []byte, publickey *ecdsa.PublicKey, skipverification, replacekey bool) error {
+	bts, err := ioutil.ReadFile(filepath.Join(confpath, "index"))
 	if err != nil {
-		return errors.WrapPrefix(err, "Failed to serialize signature:", 0)
+		return errors.WrapPrefix(err, "Failed to read index", 0)
 	}
-	if err = ioutil.WriteFile(filepath.Join(confpath, "index.sig"), sigbytes, 0644); err != nil {
-		return errors.WrapPrefix(err, "Failed to write index.sig", 0)
+	if err = verifyIndexSignature(publickey, bts, sigbytes); err != nil {
+		return err
 	}
 
-	// Write public key
-	bts, err = x509.MarshalPKIXPublicKey(&privatekey.PublicKey)
+	// Never silently replace the public key of the scheme with one supplied by the signer
+	pkfile := filepath.Join(confpath, "pk.pem")
+	pkbts, err := x509.MarshalPKIXPublicKey(publickey)
 	if err != nil {
 		return errors.WrapPrefix(err, "Failed to serialize public key", 0)
 	}
-	pemEncodedPub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: bts})
-	if err := ioutil.WriteFile(filepath.Join(confpath, "pk.pem"), pemEncodedPub, 0644); err != nil {
-		return errors.WrapPrefix(err, "Failed to write public key", 0)
+	exists, err := fs.PathExists(pkfile)
+	if err != nil {
+		return err
+	}
+	writekey := !exists || replacekey
+	if exists && !replacekey {
+		current, err := readPublicKey(pkfile)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to read public key of the scheme", 0)
+		}
+		currentbts, err := x509.MarshalPKIXPublicKey(current)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to serialize public key", 0)
+		}
+		if !bytes.Equal(pkbts, currentbts) {
+			return errors.New("Public key of the signer differs from pk.pem of the scheme (use --replace-publickey to replace it)")
+		}
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(confpath, "index.sig"), sigbytes, 0644); err != nil {
+		return errors.WrapPrefix(err, "Failed to write index.sig", 0)
+	}
+	if writekey {
+		pemEncodedPub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkbts})
+		if err := ioutil.WriteFile(pkfile, pemEncodedPub, 0644); err != nil {
+			return errors.WrapPrefix(err, "Failed to write public key", 0)
+		}
 	}
 
 	if skipverification {
@@ -127,7 +199,7 @@ func signManager(privatekey *ecdsa.PrivateKey, confpath string, skipverification
 
 	// Verify that our folder is a valid scheme
 	if err := RunVerify(confpath, false); err != nil {
-		die("Scheme was signed but verification failed", err)
+		return errors.WrapPrefix(err, "Scheme was signed but verification failed", 0)
 	}
 	return nil
 }
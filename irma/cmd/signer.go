@@ -0,0 +1,226 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/spf13/pflag"
+)
+
+// Scheme indices are signed by a crypto.Signer, which computes an ASN.1 encoded ECDSA signature
+// over the SHA256 hash of the index, and whose public key is an *ecdsa.PublicKey. Next to private
+// key files (*ecdsa.PrivateKey), the following signers are supported:
+//  - pkcs11Signer: signs using a key within a PKCS#11 module, e.g. a hardware security module
+//    (only available when built with the pkcs11 build tag, as it requires cgo);
+//  - remoteSigner: signs by sending the hash to a remote signing server (see below).
+// Signers that implement io.Closer are closed after use.
+
+func signerFlags(flags *pflag.FlagSet, offline bool) {
+	types := "file, pkcs11 or remote"
+	if offline {
+		types = "file, pkcs11, remote or offline"
+	}
+	flags.String("signer", "file", "How to sign the scheme index: "+types)
+	flags.String("pkcs11-module", "", "With --signer pkcs11, path to the PKCS#11 module (e.g. /usr/lib/softhsm/libsofthsm2.so)")
+	flags.String("pkcs11-token", "", "With --signer pkcs11, label of the token containing the key (default first token)")
+	flags.String("pkcs11-key", "", "With --signer pkcs11, label of the key pair")
+	flags.String("pkcs11-pin", "", "With --signer pkcs11, user PIN of the token (default $IRMA_PKCS11_PIN)")
+	flags.String("remote-url", "", "With --signer remote, URL of the signing server")
+	flags.String("remote-token", "", "With --signer remote, bearer token to authenticate to the signing server (default $IRMA_SIGNER_TOKEN)")
+}
+
+// newSigner returns the signer specified by the flags registered by signerFlags. The privatekey
+// parameter is used for the file signer.
+func newSigner(flags *pflag.FlagSet, privatekey string) (crypto.Signer, error) {
+	signerType, _ := flags.GetString("signer")
+	switch signerType {
+	case "file":
+		sk, err := readPrivateKey(privatekey)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to read private key", 0)
+		}
+		return sk, nil
+	case "pkcs11":
+		module, _ := flags.GetString("pkcs11-module")
+		token, _ := flags.GetString("pkcs11-token")
+		key, _ := flags.GetString("pkcs11-key")
+		pin, _ := flags.GetString("pkcs11-pin")
+		if pin == "" {
+			pin = os.Getenv("IRMA_PKCS11_PIN")
+		}
+		if module == "" || key == "" {
+			return nil, errors.New("--pkcs11-module and --pkcs11-key are required with --signer pkcs11")
+		}
+		return newPKCS11Signer(module, token, key, pin)
+	case "remote":
+		url, _ := flags.GetString("remote-url")
+		token, _ := flags.GetString("remote-token")
+		if token == "" {
+			token = os.Getenv("IRMA_SIGNER_TOKEN")
+		}
+		if url == "" {
+			return nil, errors.New("--remote-url is required with --signer remote")
+		}
+		return newRemoteSigner(url, token)
+	default:
+		return nil, errors.Errorf("Unsupported signer %s", signerType)
+	}
+}
+
+func closeSigner(signer crypto.Signer) {
+	if closer, ok := signer.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			fmt.Println("Warning: failed to close signer:", err.Error())
+		}
+	}
+}
+
+func signerPublicKey(signer crypto.Signer) (*ecdsa.PublicKey, error) {
+	pk, ok := signer.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Signer does not have an ECDSA public key")
+	}
+	return pk, nil
+}
+
+// signIndex signs the index using the signer, and checks the resulting signature.
+func signIndex(signer crypto.Signer, index []byte) ([]byte, error) {
+	hash := sha256.Sum256(index)
+	sig, err := signer.Sign(rand.Reader, hash[:], crypto.SHA256)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to sign index", 0)
+	}
+	pk, err := signerPublicKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyIndexSignature(pk, index, sig); err != nil {
+		return nil, errors.WrapPrefix(err, "Signer produced invalid signature", 0)
+	}
+	return sig, nil
+}
+
+func verifyIndexSignature(pk *ecdsa.PublicKey, index, sig []byte) error {
+	hash := sha256.Sum256(index)
+	ints := make([]*big.Int, 0, 2)
+	if rest, err := asn1.Unmarshal(sig, &ints); err != nil || len(rest) > 0 || len(ints) != 2 {
+		return errors.New("Signature over index is not an ASN.1 encoded ECDSA signature")
+	}
+	if !ecdsa.Verify(pk, hash[:], ints[0], ints[1]) {
+		return errors.New("Signature over index does not verify against public key")
+	}
+	return nil
+}
+
+func readPublicKey(path string) (*ecdsa.PublicKey, error) {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return nil, errors.New("Public key is not PEM encoded")
+	}
+	pk, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecpk, ok := pk.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Public key is not an ECDSA public key")
+	}
+	return ecpk, nil
+}
+
+// remoteSigner signs scheme indices using a remote signing server. The protocol consists of two
+// JSON endpoints:
+//   - GET publickey, returning {"publickey": "<PEM encoded ECDSA public key>"};
+//   - POST sign with body {"hash": "<base64 SHA256 hash of the index>"}, returning
+//     {"signature": "<base64 ASN.1 encoded ECDSA signature over the hash>"}.
+//
+// If a token is configured, it is sent as bearer token in the Authorization header.
+type remoteSigner struct {
+	transport *irma.HTTPTransport
+	publickey *ecdsa.PublicKey
+}
+
+type remoteSignerPublicKey struct {
+	PublicKey string `json:"publickey"`
+}
+
+type remoteSignerRequest struct {
+	Hash []byte `json:"hash"`
+}
+
+type remoteSignerResponse struct {
+	Signature []byte `json:"signature"`
+}
+
+func newRemoteSigner(url, token string) (*remoteSigner, error) {
+	transport := irma.NewHTTPTransport(url)
+	if token != "" {
+		transport.SetHeader("Authorization", "Bearer "+token)
+	}
+	res := &remoteSignerPublicKey{}
+	if err := transport.Get("publickey", res); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to retrieve public key from signing server", 0)
+	}
+	block, _ := pem.Decode([]byte(res.PublicKey))
+	if block == nil {
+		return nil, errors.New("Signing server returned invalid public key")
+	}
+	pk, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Signing server returned invalid public key", 0)
+	}
+	ecpk, ok := pk.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Signing server returned non-ECDSA public key")
+	}
+	return &remoteSigner{transport: transport, publickey: ecpk}, nil
+}
+
+func (s *remoteSigner) Public() crypto.PublicKey {
+	return s.publickey
+}
+
+func (s *remoteSigner) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	res := &remoteSignerResponse{}
+	if err := s.transport.Post("sign", res, &remoteSignerRequest{Hash: digest}); err != nil {
+		return nil, err
+	}
+	return res.Signature, nil
+}
+
+// exportIndex writes a new timestamp and index to the scheme at confpath without signing it, and
+// if export is not empty, copies the index to the file export for signing it elsewhere.
+func exportIndex(confpath, export string) error {
+	bts, err := writeIndex(confpath)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(confpath, "index")
+	if export != "" {
+		if err = ioutil.WriteFile(export, bts, 0644); err != nil {
+			return errors.WrapPrefix(err, "Failed to export index", 0)
+		}
+		file = export
+	}
+	hash := sha256.Sum256(bts)
+	fmt.Printf("Index written to %s (SHA256 %x)\n", file, hash)
+	fmt.Println("Sign it using \"irma scheme sign-index\", and import the signature using \"irma scheme import-signature\".")
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package cmd
+
+import (
+	"crypto"
+
+	"github.com/go-errors/errors"
+)
+
+func newPKCS11Signer(module, token, key, pin string) (crypto.Signer, error) {
+	return nil, errors.New("PKCS#11 support not included in this build (build with -tags pkcs11)")
+}
@@ -0,0 +1,156 @@
+//go:build pkcs11
+// +build pkcs11
+
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11Signer signs using an ECDSA P-256 key pair within a PKCS#11 module.
+type pkcs11Signer struct {
+	ctx       *pkcs11.Ctx
+	session   pkcs11.SessionHandle
+	key       pkcs11.ObjectHandle
+	publickey *ecdsa.PublicKey
+}
+
+// DER encoding of the OID of the P-256 curve, as contained in the CKA_EC_PARAMS attribute
+var p256Params, _ = asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7})
+
+func newPKCS11Signer(module, token, key, pin string) (crypto.Signer, error) {
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, errors.Errorf("Failed to load PKCS#11 module %s", module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, errors.WrapPrefix(err, "Failed to initialize PKCS#11 module", 0)
+	}
+	signer := &pkcs11Signer{ctx: ctx}
+	if err := signer.open(token, key, pin); err != nil {
+		_ = signer.Close()
+		return nil, err
+	}
+	return signer, nil
+}
+
+func (s *pkcs11Signer) open(token, key, pin string) error {
+	slots, err := s.ctx.GetSlotList(true)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to list PKCS#11 slots", 0)
+	}
+	var slot uint
+	found := false
+	for _, id := range slots {
+		info, err := s.ctx.GetTokenInfo(id)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to get PKCS#11 token info", 0)
+		}
+		if token == "" || strings.TrimSpace(info.Label) == token {
+			slot, found = id, true
+			break
+		}
+	}
+	if !found {
+		return errors.Errorf("PKCS#11 token %s not found", token)
+	}
+
+	if s.session, err = s.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION); err != nil {
+		return errors.WrapPrefix(err, "Failed to open PKCS#11 session", 0)
+	}
+	if err = s.ctx.Login(s.session, pkcs11.CKU_USER, pin); err != nil {
+		return errors.WrapPrefix(err, "Failed to log in to PKCS#11 token", 0)
+	}
+
+	if s.key, err = s.findObject(pkcs11.CKO_PRIVATE_KEY, key); err != nil {
+		return err
+	}
+	pubkey, err := s.findObject(pkcs11.CKO_PUBLIC_KEY, key)
+	if err != nil {
+		return err
+	}
+	attrs, err := s.ctx.GetAttributeValue(s.session, pubkey, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to read PKCS#11 public key", 0)
+	}
+	if string(attrs[0].Value) != string(p256Params) {
+		return errors.New("PKCS#11 key is not a P-256 ECDSA key")
+	}
+	// CKA_EC_POINT is a DER encoded OCTET STRING containing the uncompressed point
+	var point []byte
+	if _, err = asn1.Unmarshal(attrs[1].Value, &point); err != nil {
+		return errors.WrapPrefix(err, "Failed to parse PKCS#11 public key", 0)
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), point)
+	if x == nil {
+		return errors.New("Failed to parse PKCS#11 public key")
+	}
+	s.publickey = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	return nil
+}
+
+func (s *pkcs11Signer) findObject(class uint, label string) (pkcs11.ObjectHandle, error) {
+	err := s.ctx.FindObjectsInit(s.session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	})
+	if err != nil {
+		return 0, errors.WrapPrefix(err, "Failed to search PKCS#11 keys", 0)
+	}
+	objects, _, err := s.ctx.FindObjects(s.session, 2)
+	if err != nil {
+		return 0, errors.WrapPrefix(err, "Failed to search PKCS#11 keys", 0)
+	}
+	if err = s.ctx.FindObjectsFinal(s.session); err != nil {
+		return 0, errors.WrapPrefix(err, "Failed to search PKCS#11 keys", 0)
+	}
+	if len(objects) != 1 {
+		return 0, errors.Errorf("Expected one PKCS#11 EC key with label %s, found %d", label, len(objects))
+	}
+	return objects[0], nil
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.publickey
+}
+
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, s.key)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := s.ctx.Sign(s.session, digest)
+	if err != nil {
+		return nil, err
+	}
+	// PKCS#11 returns r || s, while we need an ASN.1 sequence
+	if len(sig)%2 != 0 {
+		return nil, errors.New("PKCS#11 module returned invalid ECDSA signature")
+	}
+	half := len(sig) / 2
+	return asn1.Marshal([]*big.Int{new(big.Int).SetBytes(sig[:half]), new(big.Int).SetBytes(sig[half:])})
+}
+
+func (s *pkcs11Signer) Close() error {
+	if s.session != 0 {
+		_ = s.ctx.Logout(s.session)
+		_ = s.ctx.CloseSession(s.session)
+	}
+	err := s.ctx.Finalize()
+	s.ctx.Destroy()
+	return err
+}
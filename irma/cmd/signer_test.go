@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// remoteSignerServer returns a signing server implementing the protocol of remoteSigner, which signs
+// hashes with sk if requests carry the bearer token. If tamper is set, it signs another hash instead.
+func remoteSignerServer(t *testing.T, sk *ecdsa.PrivateKey, token string, tamper bool) *httptest.Server {
+	pkbts, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	require.NoError(t, err)
+	pkpem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkbts})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/publickey", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(&remoteSignerPublicKey{PublicKey: string(pkpem)})
+	})
+	mux.HandleFunc("/sign", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		req := &remoteSignerRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil || len(req.Hash) != sha256.Size {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if tamper {
+			req.Hash[0] ^= 1
+		}
+		rs, ss, err := ecdsa.Sign(rand.Reader, sk, req.Hash)
+		if err == nil {
+			var sig []byte
+			if sig, err = asn1.Marshal([]interface{}{rs, ss}); err == nil {
+				err = json.NewEncoder(w).Encode(&remoteSignerResponse{Signature: sig})
+			}
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestRemoteSigner(t *testing.T) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	index := []byte("irma-demo/description.xml: 0123456789abcdef\n")
+
+	srv := remoteSignerServer(t, sk, "secret", false)
+	defer srv.Close()
+
+	signer, err := newRemoteSigner(srv.URL, "secret")
+	require.NoError(t, err)
+	pk, err := signerPublicKey(signer)
+	require.NoError(t, err)
+	require.Equal(t, sk.PublicKey, *pk)
+
+	sig, err := signIndex(signer, index)
+	require.NoError(t, err)
+	require.NoError(t, verifyIndexSignature(&sk.PublicKey, index, sig))
+	require.Error(t, verifyIndexSignature(&sk.PublicKey, []byte("other index"), sig))
+	require.Error(t, verifyIndexSignature(&sk.PublicKey, index, []byte("not a signature")))
+
+	// Requests with a wrong token are refused
+	signer, err = newRemoteSigner(srv.URL, "wrong")
+	require.NoError(t, err)
+	_, err = signIndex(signer, index)
+	require.Error(t, err)
+
+	// Signatures that don't verify are not accepted
+	tampering := remoteSignerServer(t, sk, "secret", true)
+	defer tampering.Close()
+	signer, err = newRemoteSigner(tampering.URL, "secret")
+	require.NoError(t, err)
+	_, err = signIndex(signer, index)
+	require.Error(t, err)
+}
+
+func TestInstallSignaturePublicKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signature")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	index := []byte("irma-demo/description.xml: 0123456789abcdef\n")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index"), index, 0644))
+
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	sig, err := signIndex(sk, index)
+	require.NoError(t, err)
+
+	// Without a pk.pem, the public key of the signer is written to it
+	require.NoError(t, installSignature(dir, sig, &sk.PublicKey, true, false))
+	pk, err := readPublicKey(filepath.Join(dir, "pk.pem"))
+	require.NoError(t, err)
+	require.Equal(t, sk.PublicKey, *pk)
+
+	// Signers having another public key than pk.pem are refused, unless the key is to be replaced
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	othersig, err := signIndex(other, index)
+	require.NoError(t, err)
+	require.Error(t, installSignature(dir, othersig, &other.PublicKey, true, false))
+	bts, err := ioutil.ReadFile(filepath.Join(dir, "index.sig"))
+	require.NoError(t, err)
+	require.Equal(t, sig, bts)
+	pk, err = readPublicKey(filepath.Join(dir, "pk.pem"))
+	require.NoError(t, err)
+	require.Equal(t, sk.PublicKey, *pk)
+
+	require.NoError(t, installSignature(dir, othersig, &other.PublicKey, true, true))
+	pk, err = readPublicKey(filepath.Join(dir, "pk.pem"))
+	require.NoError(t, err)
+	require.Equal(t, other.PublicKey, *pk)
+}
@@ -1,8 +1,11 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago"
@@ -30,19 +33,21 @@ var updateCmd = &cobra.Command{
 			}
 			paths = make([]string, 0, len(files))
 			for _, file := range files {
-				if file.IsDir() {
+				// Hidden folders contain staged or previous versions of schemes
+				if file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
 					paths = append(paths, filepath.Join(irmaconf, file.Name()))
 				}
 			}
 		}
 
-		if err := updateSchemeManager(paths); err != nil {
+		mirror, _ := cmd.Flags().GetString("mirror")
+		if err := updateSchemeManager(paths, mirror); err != nil {
 			die("Updating schemes failed", err)
 		}
 	},
 }
 
-func updateSchemeManager(paths []string) error {
+func updateSchemeManager(paths []string, mirror string) error {
 	// Before doing anything, first check that all paths are scheme managers
 	for _, path := range paths {
 		if err := fs.AssertPathExists(filepath.Join(path, "index")); err != nil {
@@ -61,13 +66,20 @@ func updateSchemeManager(paths []string) error {
 		if err != nil {
 			return err
 		}
+		conf.SchemeMirrorURL = mirror
 		if err := conf.ParseSchemeManagerFolder(path, irma.NewSchemeManager(manager)); err != nil {
 			return err
 		}
 
-		if err = conf.UpdateSchemeManager(irma.NewSchemeManagerIdentifier(manager), nil); err != nil {
+		change, err := conf.UpdateSchemeManagerReport(context.Background(), irma.NewSchemeManagerIdentifier(manager), nil)
+		if err != nil {
 			return err
 		}
+		if change == nil {
+			fmt.Printf("Scheme %s is up to date\n", manager)
+		} else {
+			fmt.Print(change.String())
+		}
 	}
 
 	return nil
@@ -75,14 +87,16 @@ func updateSchemeManager(paths []string) error {
 
 func updateHelp() string {
 	defaultIrmaconf := server.DefaultSchemesPath()
-	str := "The update command updates an IRMA scheme within an irma_configuration folder by comparing its index with the online version, and downloading any new and changed files.\n\n"
+	str := "The update command updates an IRMA scheme within an irma_configuration folder by comparing its index with the online version, and downloading any new and changed files. Afterwards the changes are printed; use the diff command to review them beforehand.\n\n"
 	if defaultIrmaconf != "" {
 		str += "If no paths are given, the default schemes at " + defaultIrmaconf + " are updated.\n\n"
 	}
-	str += "Careful: this command could fail and invalidate or destroy your scheme manager folder! Use this only if you can restore it from git or backups."
+	str += "The new version is downloaded and verified in a temporary folder before it replaces the current version, so if this command fails your scheme manager folder is left untouched. The previous version is kept in a hidden folder next to it."
 	return str
 }
 
 func init() {
 	schemeCmd.AddCommand(updateCmd)
+
+	updateCmd.Flags().String("mirror", "", "update from this mirror (see irma scheme mirror) instead of from the scheme's own URL")
 }
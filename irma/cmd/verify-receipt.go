@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/spf13/cobra"
+)
+
+var verifyReceiptCmd = &cobra.Command{
+	Use:   "verify-receipt receipt",
+	Short: "Verify a receipt of a disclosure or signature session exported from an IRMA app",
+	Long: `The verify-receipt command verifies the disclosure or attribute-based signature in the specified receipt file against the request in the receipt, using the schemes in the irma_configuration folder specified by --schemes-path, and prints the result.
+
+The requestor name and the time in the receipt are stated by the app that exported it and are not verified. Only attribute-based signatures with a timestamp prove when the attributes were valid; for disclosures, it is checked that the disclosed credentials are currently valid.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		confpath, _ := cmd.Flags().GetString("schemes-path")
+		bts, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			die("Failed to read receipt", err)
+		}
+		if err = verifyReceipt(bts, confpath); err != nil {
+			die("Failed to verify receipt", err)
+		}
+		return nil
+	},
+}
+
+func verifyReceipt(bts []byte, confpath string) error {
+	receipt := &irma.Receipt{}
+	if err := json.Unmarshal(bts, receipt); err != nil {
+		return errors.WrapPrefix(err, "Failed to parse receipt", 0)
+	}
+
+	if err := fs.AssertPathExists(confpath); err != nil {
+		return errors.WrapPrefix(err, "Cannot read irma_configuration", 0)
+	}
+	conf, err := irma.NewConfigurationReadOnly(confpath)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to parse irma_configuration", 0)
+	}
+	if err = conf.ParseFolder(); err != nil {
+		return errors.WrapPrefix(err, "Failed to parse irma_configuration", 0)
+	}
+
+	attrs, status, err := receipt.Verify(conf)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Action    :", receipt.Action)
+	fmt.Println("Requestor :", receipt.ServerName["en"], "(unverified)")
+	fmt.Println("Time      :", time.Time(receipt.Time).String(), "(unverified)")
+	if receipt.SignedMessage != nil {
+		fmt.Println("Message   :", receipt.SignedMessage.Message)
+		if receipt.SignedMessage.Timestamp != nil {
+			fmt.Println("Timestamp :", time.Unix(receipt.SignedMessage.Timestamp.Time, 0).String())
+		}
+	}
+	fmt.Println("Status    :", status)
+	fmt.Println()
+	fmt.Println("Disclosed :", prettyprint(attrs))
+
+	if status != irma.ProofStatusValid {
+		return errors.Errorf("receipt is not valid: %s", status)
+	}
+	return nil
+}
+
+func init() {
+	RootCmd.AddCommand(verifyReceiptCmd)
+
+	verifyReceiptCmd.Flags().StringP("schemes-path", "s", server.DefaultSchemesPath(), "path to irma_configuration")
+}
@@ -0,0 +1,243 @@
+package irmaclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/encryption"
+	"golang.org/x/crypto/scrypt"
+)
+
+// This file contains the export and import of passphrase-encrypted backups of the client.
+
+// Version of the backup format produced by ExportBackup. ImportBackup accepts backups
+// of this version and older.
+const backupVersion = 1
+
+// Parameters of the scrypt key derivation function with which the key of new backups
+// is derived from the passphrase. Those of imported backups are checked by
+// encryption.CheckScryptParameters.
+const (
+	backupScryptN  = 1 << 15
+	backupScryptR  = 8
+	backupScryptP  = 1
+	backupSaltSize = 16
+)
+
+// ErrBackupDecryption is returned by ImportBackup when the backup could not be decrypted,
+// i.e. the passphrase is wrong or the backup was modified.
+var ErrBackupDecryption = errors.New("failed to decrypt backup: wrong passphrase or corrupted backup")
+
+// backup is the (unencrypted) outer structure of a backup.
+type backup struct {
+	Version int       `json:"version"`
+	KDF     backupKDF `json:"kdf"`
+	// The encrypted backupContents, authenticated along with the fields above
+	Contents []byte `json:"contents"`
+}
+
+type backupKDF struct {
+	Algorithm string `json:"algorithm"`
+	Salt      []byte `json:"salt"`
+	N         int    `json:"n"`
+	R         int    `json:"r"`
+	P         int    `json:"p"`
+}
+
+// backupContents contains everything that is restored from a backup.
+type backupContents struct {
+	Created         irma.Timestamp                                   `json:"created"`
+	SecretKey       *secretKey                                       `json:"secretKey"`
+	Attributes      []*irma.AttributeList                            `json:"attributes"`
+	Signatures      map[string]*gabi.CLSignature                     `json:"signatures"` // keyed by AttributeList.Hash()
+	Logs            []*LogEntry                                      `json:"logs"`
+	KeyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer `json:"keyshareServers"`
+	Preferences     Preferences                                      `json:"preferences"`
+}
+
+// ExportBackup returns a backup of the secret key, credentials, logs and keyshare enrollments of
+// the selected profile and the preferences of the client, encrypted and authenticated with a key
+// derived from the passphrase. It can be restored into a client on another device using ImportBackup.
+func (client *Client) ExportBackup(passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("Backup passphrase must not be empty")
+	}
+	contents, err := client.storage.LoadBackup()
+	if err != nil {
+		return nil, err
+	}
+	contents.Created = irma.Timestamp(time.Now())
+	contents.Preferences = client.Preferences // stored along with the default profile
+	plaintext, err := json.Marshal(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &backup{
+		Version: backupVersion,
+		KDF: backupKDF{
+			Algorithm: "scrypt",
+			Salt:      make([]byte, backupSaltSize),
+			N:         backupScryptN,
+			R:         backupScryptR,
+			P:         backupScryptP,
+		},
+	}
+	if _, err = rand.Read(b.KDF.Salt); err != nil {
+		return nil, err
+	}
+	key, err := b.key(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if b.Contents, err = encryption.EncryptRecord(key, plaintext, b.name()); err != nil {
+		return nil, err
+	}
+	return json.Marshal(b)
+}
+
+// ImportBackup replaces the secret key, credentials, logs and keyshare enrollments of the selected
+// profile and the preferences of the client by those of the backup, after decrypting it using the
+// passphrase and checking its integrity. The enrollment at the keyshare server of each scheme in
+// the backup is reauthenticated before anything is restored, using the PIN for that scheme from pins.
+func (client *Client) ImportBackup(bts []byte, passphrase string, pins map[irma.SchemeManagerIdentifier]string) error {
+	contents, err := client.decryptBackup(bts, passphrase)
+	if err != nil {
+		return err
+	}
+	if err = client.verifyBackup(contents); err != nil {
+		return err
+	}
+	for id, kss := range contents.KeyshareServers {
+		if err = client.reauthenticateKeyshare(id, kss, pins); err != nil {
+			return err
+		}
+	}
+
+	if err = client.storage.RestoreBackup(contents); err != nil {
+		return err
+	}
+	if client.storage != client.defaultStorage {
+		if err = client.defaultStorage.StorePreferences(contents.Preferences); err != nil {
+			return err
+		}
+	}
+	client.secretkey = contents.SecretKey
+	client.credentialsCache = make(map[irma.CredentialTypeIdentifier]map[int]*credential)
+	if client.attributes, err = client.storage.LoadAttributes(); err != nil {
+		return err
+	}
+	client.keyshareServers = contents.KeyshareServers
+	client.Preferences = contents.Preferences
+	client.applyPreferences()
+	return nil
+}
+
+func (client *Client) decryptBackup(bts []byte, passphrase string) (*backupContents, error) {
+	b := &backup{}
+	if err := json.Unmarshal(bts, b); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse backup", 0)
+	}
+	if b.Version < 1 || b.Version > backupVersion {
+		return nil, errors.Errorf("Unsupported backup version %d", b.Version)
+	}
+	if b.KDF.Algorithm != "scrypt" {
+		return nil, errors.Errorf("Unsupported backup key derivation function %s", b.KDF.Algorithm)
+	}
+	if err := encryption.CheckScryptParameters(b.KDF.N, b.KDF.R, b.KDF.P); err != nil {
+		return nil, errors.WrapPrefix(err, "Invalid backup key derivation parameters", 0)
+	}
+	key, err := b.key(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := encryption.DecryptRecord(key, b.Contents, b.name())
+	if err != nil {
+		return nil, ErrBackupDecryption
+	}
+	contents := &backupContents{}
+	if err = json.Unmarshal(plaintext, contents); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse backup contents", 0)
+	}
+	return contents, nil
+}
+
+// verifyBackup checks that the backup contains a secret key, that each credential has a
+// signature, and that the signatures of the credentials whose issuer we know are valid.
+func (client *Client) verifyBackup(contents *backupContents) error {
+	if contents.SecretKey == nil || contents.SecretKey.Key == nil {
+		return errors.New("Backup contains no secret key")
+	}
+	for _, attrs := range contents.Attributes {
+		if len(attrs.Ints) == 0 {
+			return errors.New("Backup contains credential without attributes")
+		}
+		sig := contents.Signatures[attrs.Hash()]
+		if sig == nil {
+			return errors.Errorf("Backup contains no signature for credential with attributes %s", attrs.Hash())
+		}
+		attrs.MetadataAttribute = irma.MetadataFromInt(attrs.Ints[0], client.Configuration)
+		if attrs.CredentialType() == nil {
+			continue // We can't verify it until we have the scheme of its issuer
+		}
+		pk, err := attrs.PublicKey()
+		if err != nil {
+			return err
+		}
+		if pk == nil {
+			continue
+		}
+		if !sig.Verify(pk, append([]*big.Int{contents.SecretKey.Key}, attrs.Ints...)) {
+			return errors.Errorf("Backup contains invalid signature for credential with attributes %s", attrs.Hash())
+		}
+	}
+	for id := range contents.KeyshareServers {
+		if scheme := client.Configuration.SchemeManagers[id]; scheme == nil || !scheme.Distributed() {
+			return errors.Errorf("Backup contains keyshare enrollment for unknown scheme %s", id)
+		}
+	}
+	return nil
+}
+
+// reauthenticateKeyshare verifies the PIN of the enrollment from a backup at the keyshare server,
+// checking that the enrollment is still valid and that the user controls it.
+func (client *Client) reauthenticateKeyshare(
+	id irma.SchemeManagerIdentifier, kss *keyshareServer, pins map[irma.SchemeManagerIdentifier]string,
+) error {
+	pin, ok := pins[id]
+	if !ok {
+		return errors.Errorf("No PIN specified for keyshare server of scheme %s", id)
+	}
+	transport, err := keyshareTransport(client.transport, client.Configuration.SchemeManagers[id])
+	if err != nil {
+		return err
+	}
+	success, tries, blocked, err := verifyPinWorker(context.Background(), pin, kss, transport)
+	switch {
+	case err != nil:
+		return err
+	case blocked != 0:
+		return errors.Errorf("Keyshare server of scheme %s blocked PIN verification for %d seconds", id, blocked)
+	case !success:
+		return errors.Errorf("Incorrect PIN for keyshare server of scheme %s, %d attempts left", id, tries)
+	}
+	return nil
+}
+
+func (b *backup) key(passphrase string) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), b.KDF.Salt, b.KDF.N, b.KDF.R, b.KDF.P, encryption.KeySize)
+}
+
+// name returns the name to which the encryption of the contents is bound,
+// so that the version and key derivation parameters are authenticated as well.
+func (b *backup) name() string {
+	return fmt.Sprintf("irmabackup/%d/%s/%x/%d/%d/%d",
+		b.Version, b.KDF.Algorithm, b.KDF.Salt, b.KDF.N, b.KDF.R, b.KDF.P)
+}
@@ -0,0 +1,137 @@
+package irmaclient
+
+import (
+	"sort"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the ranking of the candidate attributes for disclosure computed by
+// Client.Candidates, and the choice of the attributes to disclose by default.
+
+// Maximum amount of candidates that Candidates returns per disjunction,
+// if WithMaxCandidates is not used.
+const defaultMaxCandidates = 100
+
+// WithMaxCandidates bounds the amount of candidates that the Client computes and returns per
+// disjunction, so that requests for attributes of which the client has many instances don't
+// lead to a combinatorial blowup. When candidates are dropped, the best ranked ones are kept,
+// also when the candidates of a conjunction are bounded while they are being computed.
+// Zero means no bound.
+func WithMaxCandidates(max int) Option {
+	return func(client *Client) {
+		client.maxCandidates = max
+	}
+}
+
+// DefaultChoice returns the best ranked candidate of each disjunction (see Candidates), or the
+// missing attributes if the client can't satisfy all disjunctions.
+func (client *Client) DefaultChoice(condiscon irma.AttributeConDisCon) (*irma.DisclosureChoice, MissingAttributes) {
+	candidates, missing := client.CheckSatisfiability(condiscon)
+	if len(missing) > 0 {
+		return nil, missing
+	}
+	choice := &irma.DisclosureChoice{Attributes: make([][]*irma.AttributeIdentifier, 0, len(candidates))}
+	for _, discon := range candidates {
+		choice.Attributes = append(choice.Attributes, discon[0])
+	}
+	return choice, nil
+}
+
+// candidateRank contains the properties of a candidate by which it is ranked, in order of
+// importance: fewer credentials, fewer credentials of which the client has other instances of the
+// same type, and newer credentials (by the signing date of the oldest one) rank higher.
+type candidateRank struct {
+	credentials int
+	duplicates  int
+	issued      time.Time
+}
+
+func (r candidateRank) before(o candidateRank) bool {
+	if r.credentials != o.credentials {
+		return r.credentials < o.credentials
+	}
+	if r.duplicates != o.duplicates {
+		return r.duplicates < o.duplicates
+	}
+	return r.issued.After(o.issued)
+}
+
+// rankCandidates sorts the candidates from best to worst, keeping the order of equally ranked
+// candidates, and truncates them to the maximum amount of candidates.
+func (client *Client) rankCandidates(candidates [][]*irma.AttributeIdentifier) [][]*irma.AttributeIdentifier {
+	indices := client.rankedIndices(len(candidates), func(i int) candidateRank {
+		return client.candidateRank(candidates[i])
+	})
+	ranked := make([][]*irma.AttributeIdentifier, 0, len(candidates))
+	for _, i := range indices {
+		if client.maxCandidates > 0 && len(ranked) == client.maxCandidates {
+			break
+		}
+		ranked = append(ranked, candidates[i])
+	}
+	return ranked
+}
+
+// rankedIndices returns the indices of n candidates with the specified ranks, from best to worst,
+// keeping the order of equally ranked candidates.
+func (client *Client) rankedIndices(n int, rank func(i int) candidateRank) []int {
+	ranks := make([]candidateRank, n)
+	indices := make([]int, n)
+	for i := range indices {
+		ranks[i] = rank(i)
+		indices[i] = i
+	}
+	sort.SliceStable(indices, func(i, j int) bool {
+		return ranks[indices[i]].before(ranks[indices[j]])
+	})
+	return indices
+}
+
+func (client *Client) candidateRank(candidate []*irma.AttributeIdentifier) candidateRank {
+	var creds []*irma.CredentialIdentifier
+	seen := map[string]struct{}{}
+	for _, attr := range candidate {
+		if _, ok := seen[attr.CredentialHash]; ok {
+			continue
+		}
+		seen[attr.CredentialHash] = struct{}{}
+		creds = append(creds, &irma.CredentialIdentifier{
+			Type: attr.Type.CredentialTypeIdentifier(),
+			Hash: attr.CredentialHash,
+		})
+	}
+	return client.credentialsRank(creds)
+}
+
+// credentialsRank returns the rank of a candidate consisting of the specified distinct credentials.
+func (client *Client) credentialsRank(creds []*irma.CredentialIdentifier) candidateRank {
+	var rank candidateRank
+	for _, cred := range creds {
+		rank.credentials++
+
+		var instances int
+		for _, attrs := range client.attributes[cred.Type] {
+			if attrs.IsValid() {
+				instances++
+			}
+			if attrs.Hash() == cred.Hash {
+				if signed := attrs.SigningDate(); rank.issued.IsZero() || signed.Before(rank.issued) {
+					rank.issued = signed
+				}
+			}
+		}
+		if instances > 1 {
+			rank.duplicates++
+		}
+	}
+	return rank
+}
+
+// sortNewestFirst sorts credential instances by signing date, from new to old.
+func sortNewestFirst(creds []*irma.AttributeList) {
+	sort.SliceStable(creds, func(i, j int) bool {
+		return creds[i].SigningDate().After(creds[j].SigningDate())
+	})
+}
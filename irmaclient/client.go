@@ -1,8 +1,12 @@
 package irmaclient
 
 import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/bwesterb/go-atum"
@@ -11,7 +15,9 @@ import (
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/encryption"
 	"github.com/privacybydesign/irmago/internal/fs"
+	"go.etcd.io/bbolt"
 )
 
 // This file contains most methods of the Client (c.f. session.go
@@ -46,14 +52,80 @@ type Client struct {
 	keyshareServers  map[irma.SchemeManagerIdentifier]*keyshareServer
 	updates          []update
 
-	// Where we store/load it to/from
-	storage storage
+	// Where we store/load it to/from: the storage of the selected profile
+	storage *storage
+	// Storage of the default profile, which also contains the preferences, the performed updates
+	// and the list of profiles
+	defaultStorage *storage
+	// Profiles of the client, and the ID of the selected one; see profiles.go
+	profiles []*Profile
+	profile  string
+	// Disclosure policy of the selected profile; see policy.go
+	policy []*PolicyRule
 
 	// Other state
 	Preferences           Preferences
 	Configuration         *irma.Configuration
 	irmaConfigurationPath string
 	handler               ClientHandler
+	transport             TransportFactory
+	rootCAs               *x509.CertPool
+	storageKey            []byte
+	expiryWarning         time.Duration
+	maxCandidates         int
+
+	// Stops delivering scheme events to the handler, if it is a SchemeEventHandler
+	unsubscribeSchemeEvents func()
+
+	// Hashes of the credentials that have been reported as expiring
+	reportedExpiries map[string]struct{}
+
+	// Sessions in progress, during which the database is not compacted; see logretention.go
+	sessions     map[*session]struct{}
+	sessionsLock sync.Mutex
+}
+
+// TransportFactory returns an irma.Transport with which to communicate with the server at
+// the specified URL, which may be an IRMA server or a keyshare server.
+type TransportFactory func(serverURL string) irma.Transport
+
+// Option configures optional behaviour of a Client; see New.
+type Option func(*Client)
+
+// WithTransport makes the Client use the specified TransportFactory for all communication with
+// IRMA servers and keyshare servers, instead of irma.NewHTTPTransport.
+func WithTransport(factory TransportFactory) Option {
+	return func(client *Client) {
+		client.transport = factory
+	}
+}
+
+// WithStorageKey makes the Client encrypt all of its storage, except the irma_configuration folder,
+// with the specified 32-byte key, which should be kept outside of the storage, e.g. in the keystore
+// of the platform. Existing plaintext storage is encrypted in place when the Client is created.
+// Once the storage is encrypted, the Client must always be created with the same key.
+func WithStorageKey(key []byte) Option {
+	return func(client *Client) {
+		client.storageKey = key
+	}
+}
+
+// WithRootCAs makes the Client verify the TLS certificates of IRMA servers, keyshare servers and
+// the servers from which schemes are downloaded against the specified CA certificates instead of
+// those of the system, e.g. for deployments using a private PKI. It does not affect the transports
+// of a TransportFactory passed to WithTransport.
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(client *Client) {
+		client.rootCAs = pool
+	}
+}
+
+func (client *Client) httpTransport(serverURL string) irma.Transport {
+	transport := irma.NewHTTPTransport(serverURL)
+	if client.rootCAs != nil {
+		transport.SetRootCAs(client.rootCAs)
+	}
+	return transport
 }
 
 // SentryDSN should be set in the init() function
@@ -62,6 +134,11 @@ var SentryDSN = ""
 
 type Preferences struct {
 	EnableCrashReporting bool
+
+	// Log entries older than this amount of days are deleted; 0 means no maximum
+	MaxLogAgeDays int
+	// Only this amount of the newest log entries is kept; 0 means no maximum
+	MaxLogCount int
 }
 
 var defaultPreferences = Preferences{
@@ -92,6 +169,27 @@ type ClientHandler interface {
 	UpdateAttributes()
 }
 
+// ExpiringCredentialsHandler can optionally be implemented by a ClientHandler to be informed of
+// credentials that will soon expire, each of which is reported once; see
+// Client.CheckExpiringCredentials and Client.RefreshCredential.
+type ExpiringCredentialsHandler interface {
+	CredentialsExpiring(creds irma.CredentialInfoList)
+}
+
+// ConfigurationProgressHandler can optionally be implemented by a ClientHandler to be informed
+// of the progress of downloading new versions of schemes, before UpdateConfiguration is called
+// once the new version is installed.
+type ConfigurationProgressHandler interface {
+	UpdateConfigurationProgress(progress *irma.SchemeUpdateProgress)
+}
+
+// SchemeEventHandler can optionally be implemented by a ClientHandler to receive the events
+// published by the Configuration when its schemes are updated (see irma.SchemeEvent), such as
+// credential types becoming deprecated, in addition to UpdateConfiguration.
+type SchemeEventHandler interface {
+	SchemeEvent(event *irma.SchemeEvent)
+}
+
 // MissingAttributes contains all attribute requests that the client cannot satisfy with its
 // current attributes.
 type MissingAttributes map[int]map[int]map[int]MissingAttribute
@@ -118,6 +216,7 @@ func New(
 	storagePath string,
 	irmaConfigurationPath string,
 	handler ClientHandler,
+	options ...Option,
 ) (*Client, error) {
 	var err error
 	if err = fs.AssertPathExists(storagePath); err != nil {
@@ -133,12 +232,37 @@ func New(
 		attributes:            make(map[irma.CredentialTypeIdentifier][]*irma.AttributeList),
 		irmaConfigurationPath: irmaConfigurationPath,
 		handler:               handler,
+		expiryWarning:         defaultExpiryWarning,
+		maxCandidates:         defaultMaxCandidates,
+		reportedExpiries:      map[string]struct{}{},
+		sessions:              map[*session]struct{}{},
+	}
+	for _, option := range options {
+		option(cm)
+	}
+	if cm.transport == nil {
+		cm.transport = cm.httpTransport
 	}
 
 	cm.Configuration, err = irma.NewConfigurationFromAssets(filepath.Join(storagePath, "irma_configuration"), irmaConfigurationPath)
 	if err != nil {
 		return nil, err
 	}
+	cm.Configuration.RootCAs = cm.rootCAs
+	if h, ok := handler.(ConfigurationProgressHandler); ok {
+		cm.Configuration.UpdateProgress = h.UpdateConfigurationProgress
+	}
+	// Release the subscription and the databases if we fail below, so that the storage can be
+	// opened again
+	var success bool
+	defer func() {
+		if !success {
+			cm.Close()
+		}
+	}()
+	if h, ok := handler.(SchemeEventHandler); ok {
+		cm.unsubscribeSchemeEvents = cm.Configuration.SubscribeSchemeEvents(h.SchemeEvent)
+	}
 
 	schemeMgrErr := cm.Configuration.ParseOrRestoreFolder()
 	// If schemMgrErr is of type SchemeManagerError, we continue and
@@ -149,7 +273,16 @@ func New(
 	}
 
 	// Ensure storage path exists, and populate it with necessary files
-	cm.storage = storage{storagePath: storagePath, Configuration: cm.Configuration}
+	if cm.storageKey != nil && len(cm.storageKey) != encryption.KeySize {
+		return nil, errors.Errorf("Storage key must be %d bytes", encryption.KeySize)
+	}
+	cm.defaultStorage = &storage{
+		storagePath:      storagePath,
+		Configuration:    cm.Configuration,
+		key:              cm.storageKey,
+		plaintextAllowed: true, // until it has been encrypted below
+	}
+	cm.storage = cm.defaultStorage
 	if err = cm.storage.EnsureStorageExists(); err != nil {
 		return nil, err
 	}
@@ -163,23 +296,86 @@ func New(
 	if err = cm.update(); err != nil {
 		return nil, err
 	}
-
-	// Load our stuff
-	if cm.secretkey, err = cm.storage.LoadSecretKey(); err != nil {
+	// Encrypt plaintext storage that was created after the update that encrypts
+	// the storage ran without a storage key
+	if err = cm.encryptStorage(cm.storage); err != nil {
 		return nil, err
 	}
-	if cm.attributes, err = cm.storage.LoadAttributes(); err != nil {
+
+	// Load our stuff from the storage of the profile that was last selected
+	if err = cm.loadProfiles(); err != nil {
 		return nil, err
 	}
-	if cm.keyshareServers, err = cm.storage.LoadKeyshareServers(); err != nil {
-		return nil, err
+
+	success = true
+	cm.CheckExpiringCredentials()
+	return cm, schemeMgrErr
+}
+
+// Close stops delivering scheme events to the handler and closes the storage. Afterwards the
+// client can no longer be used.
+func (client *Client) Close() {
+	if client.unsubscribeSchemeEvents != nil {
+		client.unsubscribeSchemeEvents()
+		client.unsubscribeSchemeEvents = nil
 	}
+	client.closeStorage()
+}
 
-	if len(cm.UnenrolledSchemeManagers()) > 1 {
-		return nil, errors.New("Too many keyshare servers")
+// encryptStorage encrypts the plaintext records of the storage, if the client has a storage key,
+// after which plaintext records are no longer accepted.
+func (client *Client) encryptStorage(s *storage) error {
+	if client.storageKey != nil {
+		plaintext, err := s.isPlaintext()
+		if err != nil {
+			return err
+		}
+		if plaintext {
+			if err = s.encryptPlaintext(); err != nil {
+				return err
+			}
+		}
 	}
+	s.plaintextAllowed = false
+	return nil
+}
 
-	return cm, schemeMgrErr
+// loadProfile loads the secret key, credentials, keyshare enrollments and disclosure policy from
+// the storage of the selected profile, deleting the log entries that are no longer kept, and
+// compacts its database if records were deleted since it was last compacted.
+func (client *Client) loadProfile() (err error) {
+	client.credentialsCache = make(map[irma.CredentialTypeIdentifier]map[int]*credential)
+	if client.secretkey, err = client.storage.LoadSecretKey(); err != nil {
+		return err
+	}
+	if client.attributes, err = client.storage.LoadAttributes(); err != nil {
+		return err
+	}
+	if client.keyshareServers, err = client.storage.LoadKeyshareServers(); err != nil {
+		return err
+	}
+	if client.policy, err = client.storage.LoadPolicy(); err != nil {
+		return err
+	}
+	if client.reportedExpiries, err = client.storage.LoadReportedExpiries(); err != nil {
+		return err
+	}
+
+	if len(client.UnenrolledSchemeManagers()) > 1 {
+		return errors.New("Too many keyshare servers")
+	}
+
+	if err = client.pruneLogs(false); err != nil {
+		return err
+	}
+	var compact bool
+	if compact, err = client.storage.compactionNeeded(); err != nil {
+		return err
+	}
+	if compact {
+		return client.storage.Compact()
+	}
+	return nil
 }
 
 // CredentialInfoList returns a list of information of all contained credentials.
@@ -199,9 +395,9 @@ func (client *Client) CredentialInfoList() irma.CredentialInfoList {
 	return list
 }
 
-// addCredential adds the specified credential to the Client, saving its signature
-// imediately, and optionally cm.attributes as well.
-func (client *Client) addCredential(cred *credential, storeAttributes bool) (err error) {
+// addCredential adds the specified credential to the Client within the transaction, saving
+// its signature along with cm.attributes.
+func (client *Client) addCredential(tx *bbolt.Tx, cred *credential) (err error) {
 	id := irma.NewCredentialTypeIdentifier("")
 	if cred.CredentialType() != nil {
 		id = cred.CredentialType().Identifier()
@@ -221,13 +417,17 @@ func (client *Client) addCredential(cred *credential, storeAttributes bool) (err
 	if !id.Empty() {
 		if cred.CredentialType().IsSingleton {
 			for len(client.attrs(id)) != 0 {
-				_ = client.remove(id, 0, false)
+				if _, err = client.remove(tx, id, 0); err != nil {
+					return
+				}
 			}
 		}
 
 		for i := len(client.attrs(id)) - 1; i >= 0; i-- { // Go backwards through array because remove manipulates it
 			if client.attrs(id)[i].EqualsExceptMetadata(cred.AttributeList()) {
-				_ = client.remove(id, i, false)
+				if _, err = client.remove(tx, id, i); err != nil {
+					return
+				}
 			}
 		}
 	}
@@ -242,13 +442,26 @@ func (client *Client) addCredential(cred *credential, storeAttributes bool) (err
 		client.credentialsCache[id][counter] = cred
 	}
 
-	if err = client.storage.StoreSignature(cred); err != nil {
+	if err = client.storage.TxStoreSignature(tx, cred); err != nil {
 		return
 	}
-	if storeAttributes {
-		err = client.storage.StoreAttributes(client.attributes)
+	return client.storage.TxStoreAttributes(tx, client.attributes)
+}
+
+// transaction runs f in a single database transaction. If it fails, the in-memory credentials
+// are restored to their state before f was called, so that they keep matching the storage.
+func (client *Client) transaction(f func(tx *bbolt.Tx) error) error {
+	attributes := make(map[irma.CredentialTypeIdentifier][]*irma.AttributeList, len(client.attributes))
+	for id, attrlistlist := range client.attributes {
+		attributes[id] = append([]*irma.AttributeList(nil), attrlistlist...)
+	}
+	if err := client.storage.update(f); err != nil {
+		client.attributes = attributes
+		// The cache is indexed by position, which may no longer be valid
+		client.credentialsCache = make(map[irma.CredentialTypeIdentifier]map[int]*credential)
+		return err
 	}
-	return
+	return nil
 }
 
 func generateSecretKey() (*secretKey, error) {
@@ -261,19 +474,16 @@ func generateSecretKey() (*secretKey, error) {
 
 // Removal methods
 
-func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storenow bool) error {
+// remove removes the specified credential from the Client within the transaction, deleting
+// its signature, and returns its attributes. Storing cm.attributes is left to the caller.
+func (client *Client) remove(tx *bbolt.Tx, id irma.CredentialTypeIdentifier, index int) (*irma.AttributeList, error) {
 	// Remove attributes
 	list, exists := client.attributes[id]
 	if !exists || index >= len(list) {
-		return errors.Errorf("Can't remove credential %s-%d: no such credential", id.String(), index)
+		return nil, errors.Errorf("Can't remove credential %s-%d: no such credential", id.String(), index)
 	}
 	attrs := list[index]
 	client.attributes[id] = append(list[:index], list[index+1:]...)
-	if storenow {
-		if err := client.storage.StoreAttributes(client.attributes); err != nil {
-			return err
-		}
-	}
 
 	// Remove credential
 	if creds, exists := client.credentialsCache[id]; exists {
@@ -284,21 +494,10 @@ func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storen
 	}
 
 	// Remove signature from storage
-	if err := client.storage.DeleteSignature(attrs); err != nil {
-		return err
-	}
-
-	removed := map[irma.CredentialTypeIdentifier][]irma.TranslatedString{}
-	removed[id] = attrs.Strings()
-
-	if storenow {
-		return client.storage.AddLogEntry(&LogEntry{
-			Type:    ActionRemoval,
-			Time:    irma.Timestamp(time.Now()),
-			Removed: removed,
-		})
+	if err := client.storage.TxDeleteSignature(tx, attrs); err != nil {
+		return nil, err
 	}
-	return nil
+	return attrs, nil
 }
 
 // RemoveCredential removes the specified credential if that is allowed.
@@ -306,7 +505,20 @@ func (client *Client) RemoveCredential(id irma.CredentialTypeIdentifier, index i
 	if client.Configuration.CredentialTypes[id].DisallowDelete {
 		return errors.Errorf("configuration does not allow removal of credential type %s", id.String())
 	}
-	return client.remove(id, index, true)
+	return client.transaction(func(tx *bbolt.Tx) error {
+		attrs, err := client.remove(tx, id, index)
+		if err != nil {
+			return err
+		}
+		if err = client.storage.TxStoreAttributes(tx, client.attributes); err != nil {
+			return err
+		}
+		return client.storage.TxAddLogEntry(tx, &LogEntry{
+			Type:    ActionRemoval,
+			Time:    irma.Timestamp(time.Now()),
+			Removed: map[irma.CredentialTypeIdentifier][]irma.TranslatedString{id: attrs.Strings()},
+		})
+	})
 }
 
 // RemoveCredentialByHash removes the specified credential.
@@ -320,26 +532,30 @@ func (client *Client) RemoveCredentialByHash(hash string) error {
 
 // RemoveAllCredentials removes all credentials.
 func (client *Client) RemoveAllCredentials() error {
-	removed := map[irma.CredentialTypeIdentifier][]irma.TranslatedString{}
-	for _, attrlistlist := range client.attributes {
-		for _, attrs := range attrlistlist {
-			if attrs.CredentialType() != nil {
-				removed[attrs.CredentialType().Identifier()] = attrs.Strings()
+	return client.transaction(func(tx *bbolt.Tx) error {
+		removed := map[irma.CredentialTypeIdentifier][]irma.TranslatedString{}
+		for _, attrlistlist := range client.attributes {
+			for _, attrs := range attrlistlist {
+				if attrs.CredentialType() != nil {
+					removed[attrs.CredentialType().Identifier()] = attrs.Strings()
+				}
+				if err := client.storage.TxDeleteSignature(tx, attrs); err != nil {
+					return err
+				}
 			}
-			_ = client.storage.DeleteSignature(attrs)
 		}
-	}
-	client.attributes = map[irma.CredentialTypeIdentifier][]*irma.AttributeList{}
-	if err := client.storage.StoreAttributes(client.attributes); err != nil {
-		return err
-	}
+		client.attributes = map[irma.CredentialTypeIdentifier][]*irma.AttributeList{}
+		client.credentialsCache = make(map[irma.CredentialTypeIdentifier]map[int]*credential)
+		if err := client.storage.TxStoreAttributes(tx, client.attributes); err != nil {
+			return err
+		}
 
-	logentry := &LogEntry{
-		Type:    ActionRemoval,
-		Time:    irma.Timestamp(time.Now()),
-		Removed: removed,
-	}
-	return client.storage.AddLogEntry(logentry)
+		return client.storage.TxAddLogEntry(tx, &LogEntry{
+			Type:    ActionRemoval,
+			Time:    irma.Timestamp(time.Now()),
+			Removed: removed,
+		})
+	})
 }
 
 // Attribute and credential getter methods
@@ -447,9 +663,9 @@ func (client *Client) credential(id irma.CredentialTypeIdentifier, counter int)
 // Methods used in the IRMA protocol
 
 // credCandidates returns a list containing a list of candidate credential instances for each item
-// in the conjunction. (A credential instance from the client is a candidate it it contains
-// attributes required in this conjunction). If one credential type occurs multiple times in the
-// conjunction it is not added twice.
+// in the conjunction, sorted from new to old. (A credential instance from the client is a candidate
+// if it is valid and contains attributes required in this conjunction, with the required values).
+// If one credential type occurs multiple times in the conjunction it is not added twice.
 func (client *Client) credCandidates(con irma.AttributeCon) credCandidateSet {
 	var candidates [][]*irma.CredentialIdentifier
 	for _, credtype := range con.CredentialTypes() {
@@ -457,11 +673,22 @@ func (client *Client) credCandidates(con irma.AttributeCon) credCandidateSet {
 		if len(creds) == 0 {
 			return nil // we'll need at least one instance of each credtype in this conjunction
 		}
-		var c []*irma.CredentialIdentifier
+		var valid []*irma.AttributeList
+	credloop:
 		for _, cred := range creds {
 			if !cred.IsValid() {
 				continue
 			}
+			for _, attr := range con {
+				if attr.Type.CredentialTypeIdentifier() == credtype && !attr.Satisfy(attr.Type, cred.UntranslatedAttribute(attr.Type)) {
+					continue credloop
+				}
+			}
+			valid = append(valid, cred)
+		}
+		sortNewestFirst(valid)
+		c := make([]*irma.CredentialIdentifier, 0, len(valid))
+		for _, cred := range valid {
 			c = append(c, &irma.CredentialIdentifier{Type: credtype, Hash: cred.Hash()})
 		}
 		candidates = append(candidates, c)
@@ -511,17 +738,33 @@ outer:
 	return result
 }
 
-func cartesianProduct(candidates [][]*irma.CredentialIdentifier) credCandidateSet {
+// cartesianProduct computes the cartesian product of the candidates. If the client bounds the
+// amount of candidates, after each multiplication only the best ranked items are kept (see
+// candidateRank). All items consist of one credential of each type, so they differ in rank only by
+// their oldest signing date, which adding credentials can only make older; thus the kept items are
+// the best ranked items of the full product.
+func (client *Client) cartesianProduct(candidates [][]*irma.CredentialIdentifier) credCandidateSet {
 	set := credCandidateSet{[]*irma.CredentialIdentifier{}} // Unit element for this multiplication
 	for _, c := range candidates {
 		set = set.multiply(c)
+		if client.maxCandidates > 0 && len(set) > client.maxCandidates {
+			indices := client.rankedIndices(len(set), func(i int) candidateRank {
+				return client.credentialsRank(set[i])
+			})
+			best := make(credCandidateSet, 0, client.maxCandidates)
+			for _, i := range indices[:client.maxCandidates] {
+				best = append(best, set[i])
+			}
+			set = best
+		}
 	}
 	return set
 }
 
 // Candidates returns attributes present in this client that satisfy the specified attribute
 // disjunction. It returns a list of candidate attribute sets, each of which would satisfy the
-// specified disjunction. If the disjunction cannot be satisfied by the attributes that the client
+// specified disjunction, ranked from best to worst (see candidateRank) and bounded in number
+// (see WithMaxCandidates). If the disjunction cannot be satisfied by the attributes that the client
 // currently posesses (ie. len(candidates) == 0), then the second return parameter lists the missing
 // attributes that would be necessary to satisfy the disjunction.
 func (client *Client) Candidates(discon irma.AttributeDisCon) (
@@ -551,7 +794,8 @@ func (client *Client) Candidates(discon irma.AttributeDisCon) (
 		// each item is a list of credentials containing attributes that together will satisfy the
 		// current conjunction
 		// [ [ a.a.a #1, a.a.b #1 ], [ a.a.a #2, a.a.b #1 ] ]
-		c = cartesianProduct(c)
+		// If the product is bounded, the best ranked combinations are kept.
+		c = client.cartesianProduct(c)
 
 		// Expand each credential instance to those attribute instances within it that the con
 		// is asking for, resulting in attribute sets each of which would satisfy the conjunction,
@@ -564,6 +808,7 @@ func (client *Client) Candidates(discon irma.AttributeDisCon) (
 		missing = client.missingAttributes(discon)
 	}
 
+	candidates = client.rankCandidates(candidates)
 	return
 }
 
@@ -799,16 +1044,30 @@ func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, re
 		gabicreds = append(gabicreds, cred)
 	}
 
-	for _, gabicred := range gabicreds {
-		newcred, err := newCredential(gabicred, client.Configuration)
-		if err != nil {
-			return err
-		}
-		if err = client.addCredential(newcred, true); err != nil {
-			return err
+	return client.addCredentials(gabicreds)
+}
+
+// addCredentials adds the specified new credentials in a single transaction, so that either all
+// or none of them are stored. The credentials that they replace (see addCredential) are thereby
+// refreshed.
+func (client *Client) addCredentials(gabicreds []*gabi.Credential) error {
+	err := client.transaction(func(tx *bbolt.Tx) error {
+		for _, gabicred := range gabicreds {
+			newcred, err := newCredential(gabicred, client.Configuration)
+			if err != nil {
+				return err
+			}
+			if err = client.addCredential(tx, newcred); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
+	client.CheckExpiringCredentials()
 	return nil
 }
 
@@ -854,7 +1113,10 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 		return errors.New("PIN too short, must be at least 5 characters")
 	}
 
-	transport := irma.NewHTTPTransport(manager.KeyshareServer)
+	transport, err := keyshareTransport(client.transport, manager)
+	if err != nil {
+		return err
+	}
 	kss, err := newKeyshareServer(managerID)
 	if err != nil {
 		return err
@@ -866,7 +1128,7 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 	}
 
 	qr := &irma.Qr{}
-	err = transport.Post("client/register", qr, message)
+	err = transport.PostContext(context.Background(), "client/register", qr, message)
 	if err != nil {
 		return err
 	}
@@ -899,7 +1161,11 @@ func (client *Client) KeyshareVerifyPin(pin string, schemeid irma.SchemeManagerI
 		}
 	}
 	kss := client.keyshareServers[schemeid]
-	return verifyPinWorker(pin, kss, irma.NewHTTPTransport(scheme.KeyshareServer))
+	transport, err := keyshareTransport(client.transport, scheme)
+	if err != nil {
+		return false, 0, 0, &irma.SessionError{Err: err, ErrorType: irma.ErrorTransport}
+	}
+	return verifyPinWorker(context.Background(), pin, kss, transport)
 }
 
 func (client *Client) KeyshareChangePin(manager irma.SchemeManagerIdentifier, oldPin string, newPin string) {
@@ -917,7 +1183,10 @@ func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdenti
 		return errors.New("Unknown keyshare server")
 	}
 
-	transport := irma.NewHTTPTransport(client.Configuration.SchemeManagers[managerID].KeyshareServer)
+	transport, err := keyshareTransport(client.transport, client.Configuration.SchemeManagers[managerID])
+	if err != nil {
+		return err
+	}
 	message := keyshareChangepin{
 		Username: kss.Username,
 		OldPin:   kss.HashedPin(oldPin),
@@ -925,7 +1194,7 @@ func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdenti
 	}
 
 	res := &keysharePinStatus{}
-	err := transport.Post("users/change/pin", res, message)
+	err = transport.PostContext(context.Background(), "users/change/pin", res, message)
 	if err != nil {
 		return err
 	}
@@ -981,11 +1250,25 @@ func (client *Client) LoadLogsBefore(beforeIndex uint64, max int) ([]*LogEntry,
 	return client.storage.LoadLogsBefore(beforeIndex, max)
 }
 
+// ExportReceipt returns the receipt of the disclosure or signature session of the log entry with
+// the specified ID, as JSON, which can be verified by third parties using irma.Receipt.Verify.
+func (client *Client) ExportReceipt(id uint64) ([]byte, error) {
+	entry, err := client.storage.LoadLogEntry(id)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := entry.Receipt()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(receipt)
+}
+
 // SetCrashReportingPreference toggles whether or not crash reports should be sent to Sentry.
 // Has effect only after restarting.
 func (client *Client) SetCrashReportingPreference(enable bool) {
 	client.Preferences.EnableCrashReporting = enable
-	_ = client.storage.StorePreferences(client.Preferences)
+	_ = client.defaultStorage.StorePreferences(client.Preferences)
 	client.applyPreferences()
 }
 
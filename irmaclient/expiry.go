@@ -0,0 +1,139 @@
+package irmaclient
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the tracking of credentials that are about to expire, and their refreshing.
+
+// Period before their expiry during which credentials are reported as expiring,
+// if WithExpiryWarning is not used.
+const defaultExpiryWarning = 4 * 7 * 24 * time.Hour
+
+// Key of the record in the userdata bucket containing the hashes of the credentials of the
+// profile that have been reported as expiring
+const expiriesKey = "expiries"
+
+// WithExpiryWarning makes the Client report credentials as expiring to its ClientHandler
+// (see ExpiringCredentialsHandler) when they expire within the specified period.
+func WithExpiryWarning(period time.Duration) Option {
+	return func(client *Client) {
+		client.expiryWarning = period
+	}
+}
+
+// ExpiringCredentials returns the credentials that have not yet expired but will within the
+// expiry warning period (see WithExpiryWarning), sorted by expiry.
+func (client *Client) ExpiringCredentials() irma.CredentialInfoList {
+	return client.expiringCredentials(time.Now())
+}
+
+func (client *Client) expiringCredentials(now time.Time) irma.CredentialInfoList {
+	list := irma.CredentialInfoList{}
+	for _, attrlistlist := range client.attributes {
+		for _, attrs := range attrlistlist {
+			if attrs.CredentialType() == nil {
+				continue
+			}
+			expiry := attrs.Expiry()
+			if expiry.After(now) && !expiry.After(now.Add(client.expiryWarning)) {
+				list = append(list, attrs.Info())
+			}
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return time.Time(list[i].Expires).Before(time.Time(list[j].Expires))
+	})
+	return list
+}
+
+// CheckExpiringCredentials reports the expiring credentials (see ExpiringCredentials) that have not
+// been reported before to the ClientHandler, if it implements ExpiringCredentialsHandler. It is
+// called when the Client is created and after credentials have been issued; apps should also call
+// it periodically, e.g. when they are resumed.
+func (client *Client) CheckExpiringCredentials() {
+	client.checkExpiringCredentials(time.Now())
+}
+
+func (client *Client) checkExpiringCredentials(now time.Time) {
+	handler, ok := client.handler.(ExpiringCredentialsHandler)
+	if !ok {
+		return
+	}
+
+	// Forget the credentials that have since been removed or refreshed
+	var changed bool
+	for hash := range client.reportedExpiries {
+		if attrs, _ := client.attributesByHash(hash); attrs == nil {
+			delete(client.reportedExpiries, hash)
+			changed = true
+		}
+	}
+	var report irma.CredentialInfoList
+	for _, info := range client.expiringCredentials(now) {
+		if _, reported := client.reportedExpiries[info.Hash]; !reported {
+			client.reportedExpiries[info.Hash] = struct{}{}
+			report = append(report, info)
+		}
+	}
+	if changed || len(report) > 0 {
+		if err := client.storage.StoreReportedExpiries(client.reportedExpiries); err != nil {
+			irma.Logger.Warn(errors.WrapPrefix(err, "Failed to store reported expiring credentials", 0).Error())
+		}
+	}
+	if len(report) > 0 {
+		handler.CredentialsExpiring(report)
+	}
+}
+
+// RefreshCredential returns the IssueURL of the credential type of the specified credential, at
+// which the user can have the credential reissued. Once a credential with the same attribute values
+// has been issued, it replaces the old one (see addCredential).
+func (client *Client) RefreshCredential(hash string) (irma.TranslatedString, error) {
+	attrs, _ := client.attributesByHash(hash)
+	if attrs == nil {
+		return nil, errors.Errorf("Can't refresh credential %s: no such credential", hash)
+	}
+	credtype := attrs.CredentialType()
+	if credtype == nil {
+		return nil, errors.Errorf("Can't refresh credential %s: unknown credential type", hash)
+	}
+	var hasURL bool
+	for _, url := range credtype.IssueURL {
+		hasURL = hasURL || strings.TrimSpace(url) != ""
+	}
+	if !hasURL {
+		return nil, errors.Errorf("Can't refresh credential %s: credential type %s has no IssueURL", hash, credtype.Identifier())
+	}
+	return credtype.IssueURL, nil
+}
+
+// StoreReportedExpiries stores the hashes of the credentials of the profile that have been
+// reported as expiring.
+func (s *storage) StoreReportedExpiries(reported map[string]struct{}) error {
+	hashes := make([]string, 0, len(reported))
+	for hash := range reported {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return s.store(userdataBucket, expiriesKey, hashes)
+}
+
+// LoadReportedExpiries loads the hashes of the credentials of the profile that have been reported
+// as expiring.
+func (s *storage) LoadReportedExpiries() (map[string]struct{}, error) {
+	var hashes []string
+	if _, err := s.load(userdataBucket, expiriesKey, &hashes, ""); err != nil {
+		return nil, err
+	}
+	reported := make(map[string]struct{}, len(hashes))
+	for _, hash := range hashes {
+		reported[hash] = struct{}{}
+	}
+	return reported, nil
+}
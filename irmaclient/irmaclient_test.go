@@ -1,19 +1,29 @@
 package irmaclient
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/encryption"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
 )
 
 func TestMain(m *testing.M) {
@@ -79,6 +89,189 @@ func TestVerify(t *testing.T) {
 	})
 }
 
+func TestReceipt(t *testing.T) {
+	client, request, disclosure := parseDisclosure(t)
+	defer test.ClearTestStorage(t)
+
+	attrs, _, err := disclosure.Verify(client.Configuration, request)
+	require.NoError(t, err)
+	issued := attrs[0][0].IssuanceTime
+
+	bts, err := json.Marshal(request)
+	require.NoError(t, err)
+	serverName := irma.TranslatedString{"en": "Verifier", "nl": "Verifier"}
+	require.NoError(t, client.storage.AddLogEntry(&LogEntry{
+		Type:       irma.ActionDisclosing,
+		Time:       issued,
+		ServerName: serverName,
+		Disclosure: disclosure,
+		Request:    bts,
+	}))
+	logs, err := client.LoadNewestLogs(1)
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+
+	bts, err = client.ExportReceipt(logs[0].ID)
+	require.NoError(t, err)
+	receipt := &irma.Receipt{}
+	require.NoError(t, json.Unmarshal(bts, receipt))
+	require.Equal(t, irma.LDContextReceipt, receipt.LDContext)
+	require.Equal(t, serverName, receipt.ServerName)
+	require.IsType(t, &irma.DisclosureRequest{}, receipt.Request)
+
+	// The receipt verifies like the disclosure itself, at the current time
+	_, expected, err := disclosure.Verify(client.Configuration, request)
+	require.NoError(t, err)
+	attrs, status, err := receipt.Verify(client.Configuration)
+	require.NoError(t, err)
+	require.Equal(t, expected, status)
+	require.Equal(t, "456", *attrs[0][0].RawValue)
+
+	// The unverified time of the receipt does not affect its verification
+	receipt.Time = irma.Timestamp(time.Now().AddDate(10, 0, 0))
+	_, status, err = receipt.Verify(client.Configuration)
+	require.NoError(t, err)
+	require.Equal(t, expected, status)
+
+	// The disclosure must match the request of the receipt
+	receipt.Time = issued
+	modified := receipt.Request.(*irma.DisclosureRequest)
+	modified.Nonce = big.NewInt(1)
+	_, status, err = receipt.Verify(client.Configuration)
+	require.NoError(t, err)
+	require.NotEqual(t, irma.ProofStatusValid, status) // EXPIRED takes precedence once the credential expired
+	_, status, err = receipt.Disclosure.VerifyAgainstDisjunctions(client.Configuration,
+		modified.Disclose, modified.GetContext(), modified.GetNonce(nil), nil, false)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusInvalid, status)
+
+	_, err = client.ExportReceipt(logs[0].ID + 1)
+	require.Error(t, err)
+}
+
+func TestPolicy(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	hostname := "example.com"
+	session := &session{
+		Action:            irma.ActionDisclosing,
+		Hostname:          hostname,
+		hostAuthenticated: true,
+		ServerName:        irma.NewTranslatedString(&hostname),
+		client:            client,
+	}
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	university := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")
+	bsn := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	candidates := [][][]*irma.AttributeIdentifier{
+		{
+			{{Type: bsn, CredentialHash: "a"}},
+			{{Type: studentID, CredentialHash: "b"}, {Type: university, CredentialHash: "b"}},
+		},
+		{{}}, // optional disjunction
+	}
+
+	rule, choice := client.applyPolicy(session, candidates)
+	require.Nil(t, rule)
+	require.Nil(t, choice)
+
+	_, err := client.AddPolicyRule(PolicyRule{Decision: "maybe"})
+	require.Error(t, err)
+	_, err = client.AddPolicyRule(PolicyRule{Decision: PolicyAllow, Attributes: []irma.AttributeTypeIdentifier{
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.nonexisting"),
+	}})
+	require.Error(t, err)
+	_, err = client.AddPolicyRule(PolicyRule{Decision: PolicyAllow, Actions: []irma.Action{irma.ActionRedirect}})
+	require.Error(t, err)
+
+	// An allow rule discloses the first candidates consisting of its attributes
+	allow, err := client.AddPolicyRule(PolicyRule{
+		Decision:   PolicyAllow,
+		Requestor:  hostname,
+		Actions:    []irma.Action{irma.ActionDisclosing},
+		Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard")},
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, allow.ID)
+	rule, choice = client.applyPolicy(session, candidates)
+	require.Equal(t, allow, rule)
+	require.Equal(t, [][]*irma.AttributeIdentifier{candidates[0][1], {}}, choice.Attributes)
+
+	// Which applies only to its requestor and actions
+	other := "other.com"
+	session.Hostname, session.ServerName = other, irma.NewTranslatedString(&other)
+	rule, _ = client.applyPolicy(session, candidates)
+	require.Nil(t, rule)
+	// A server can't match the rule by claiming the requestor name of another
+	session.ServerName = irma.NewTranslatedString(&hostname)
+	rule, _ = client.applyPolicy(session, candidates)
+	require.Nil(t, rule)
+	// Nor can manual sessions, which have no hostname
+	session.Hostname = ""
+	rule, _ = client.applyPolicy(session, candidates)
+	require.Nil(t, rule)
+	session.Hostname, session.ServerName = hostname, irma.NewTranslatedString(&hostname)
+	// Nor can sessions over other transports, such as local sessions, that can claim any hostname
+	session.hostAuthenticated = false
+	rule, _ = client.applyPolicy(session, candidates)
+	require.Nil(t, rule)
+	session.hostAuthenticated = true
+	session.Action = irma.ActionSigning
+	rule, _ = client.applyPolicy(session, candidates)
+	require.Nil(t, rule)
+	session.Action = irma.ActionDisclosing
+
+	// Rules without actions apply to disclosure sessions only
+	anyRequestor, err := client.AddPolicyRule(PolicyRule{
+		Decision:   PolicyAllow,
+		Attributes: []irma.AttributeTypeIdentifier{bsn},
+	})
+	require.NoError(t, err)
+	for _, action := range []irma.Action{irma.ActionSigning, irma.ActionIssuing} {
+		session.Action = action
+		rule, _ = client.applyPolicy(session, candidates)
+		require.Nil(t, rule)
+	}
+	session.Action = irma.ActionDisclosing
+	require.NoError(t, client.RemovePolicyRule(anyRequestor.ID))
+
+	// Ask rules override allow rules, and deny rules override both
+	ask, err := client.AddPolicyRule(PolicyRule{Decision: PolicyAsk, Attributes: []irma.AttributeTypeIdentifier{university}})
+	require.NoError(t, err)
+	rule, _ = client.applyPolicy(session, candidates)
+	require.Nil(t, rule)
+	deny, err := client.AddPolicyRule(PolicyRule{Decision: PolicyDeny, Attributes: []irma.AttributeTypeIdentifier{bsn}})
+	require.NoError(t, err)
+	rule, choice = client.applyPolicy(session, candidates)
+	require.Equal(t, deny, rule)
+	require.Nil(t, choice)
+
+	// Expired rules don't apply
+	require.NoError(t, client.RemovePolicyRule(deny.ID))
+	require.NoError(t, client.RemovePolicyRule(ask.ID))
+	require.Error(t, client.RemovePolicyRule(ask.ID))
+	_, err = client.AddPolicyRule(PolicyRule{Decision: PolicyDeny, Expires: irma.Timestamp(time.Now().Add(-time.Minute))})
+	require.NoError(t, err)
+	rule, _ = client.applyPolicy(session, candidates)
+	require.Equal(t, allow, rule)
+
+	// The policy is stored in the selected profile
+	client.closeStorage()
+	client, err = New(
+		filepath.Join("..", "testdata", "storage", "test"),
+		filepath.Join("..", "testdata", "irma_configuration"),
+		&TestClientHandler{t: t},
+	)
+	require.NoError(t, err)
+	require.Len(t, client.PolicyRules(), 2)
+	require.Equal(t, allow.ID, client.PolicyRules()[0].ID)
+	profile, err := client.CreateProfile("Work")
+	require.NoError(t, err)
+	require.NoError(t, client.SelectProfile(profile.ID))
+	require.Empty(t, client.PolicyRules())
+}
+
 func verifyClientIsUnmarshaled(t *testing.T, client *Client) {
 	cred, err := client.credential(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), 0)
 	require.NoError(t, err, "could not fetch credential")
@@ -137,6 +330,740 @@ func TestStorageDeserialization(t *testing.T) {
 	verifyKeyshareIsUnmarshaled(t, client)
 }
 
+func TestStorageMigration(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	storagePath := filepath.Join("..", "testdata", "storage", "test")
+
+	// The files of the teststorage have been moved into the database
+	for _, file := range []string{skFile, attributesFile, kssFile, updatesFile, logsFile, preferencesFile, signaturesDir} {
+		exists, err := fs.PathExists(filepath.Join(storagePath, file))
+		require.NoError(t, err)
+		require.False(t, exists, "%s still exists", file)
+	}
+	var sigs int
+	require.NoError(t, client.storage.db.View(func(tx *bbolt.Tx) error {
+		for _, key := range []string{skKey, attributesKey, kssKey, updatesKey} {
+			require.NotNil(t, tx.Bucket([]byte(userdataBucket)).Get([]byte(key)), "%s not in database", key)
+		}
+		sigs = tx.Bucket([]byte(signaturesBucket)).Stats().KeyN
+		return nil
+	}))
+	require.Equal(t, len(client.CredentialInfoList()), sigs)
+
+	// Reopening the migrated storage yields the same client
+	require.NoError(t, client.storage.db.Close())
+	client, err := New(storagePath, filepath.Join("..", "testdata", "irma_configuration"), &TestClientHandler{t: t})
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+	verifyCredentials(t, client)
+	verifyKeyshareIsUnmarshaled(t, client)
+	require.Len(t, client.updates, len(clientUpdates))
+}
+
+func TestStorageMigrationInterrupted(t *testing.T) {
+	test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t)
+	storagePath := filepath.Join("..", "testdata", "storage", "test")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("..", "testdata", "teststorage"), storagePath))
+
+	s := &storage{storagePath: storagePath}
+	require.NoError(t, s.EnsureStorageExists())
+	updates, err := s.LoadUpdates()
+	require.NoError(t, err)
+	require.NotEmpty(t, updates)
+	require.NoError(t, s.moveIntoDatabase(updates))
+
+	// Although the updates file is gone, the updates are not lost if we stop before storing them
+	require.NoError(t, s.db.Close())
+	exists, err := fs.PathExists(filepath.Join(storagePath, updatesFile))
+	require.NoError(t, err)
+	require.False(t, exists)
+	s = &storage{storagePath: storagePath}
+	require.NoError(t, s.EnsureStorageExists())
+	stored, err := s.LoadUpdates()
+	require.NoError(t, err)
+	require.Len(t, stored, len(updates))
+	require.NoError(t, s.db.Close())
+}
+
+func TestTransactionRestore(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	before := len(client.attrs(id))
+	require.NotZero(t, before)
+	hash := client.attrs(id)[0].Hash()
+	_, err := client.credential(id, 0)
+	require.NoError(t, err)
+
+	// If the transaction fails after changing the in-memory credentials, they are restored
+	err = client.transaction(func(tx *bbolt.Tx) error {
+		if _, err := client.remove(tx, id, 0); err != nil {
+			return err
+		}
+		require.Len(t, client.attrs(id), before-1)
+		return errors.New("failure")
+	})
+	require.Error(t, err)
+	require.Len(t, client.attrs(id), before)
+	require.Equal(t, hash, client.attrs(id)[0].Hash())
+	cred, err := client.credential(id, 0)
+	require.NoError(t, err)
+	require.Equal(t, hash, cred.AttributeList().Hash())
+
+	// The storage was left unchanged as well
+	require.NoError(t, client.storage.db.Close())
+	client, err = New(filepath.Join("..", "testdata", "storage", "test"),
+		filepath.Join("..", "testdata", "irma_configuration"), &TestClientHandler{t: t})
+	require.NoError(t, err)
+	require.Len(t, client.attrs(id), before)
+}
+
+func TestProfiles(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	storagePath := filepath.Join("..", "testdata", "storage", "test")
+
+	require.Equal(t, DefaultProfile, client.SelectedProfile())
+	require.Len(t, client.Profiles(), 1)
+	creds := len(client.CredentialInfoList())
+	require.NotZero(t, creds)
+	defaultKey := client.secretkey.Key
+	logs, err := client.LoadNewestLogs(100)
+	require.NoError(t, err)
+	defaultLogs := len(logs)
+
+	_, err = client.CreateProfile("")
+	require.Error(t, err)
+	work, err := client.CreateProfile("Work")
+	require.NoError(t, err)
+	require.Len(t, client.Profiles(), 2)
+	require.Equal(t, DefaultProfile, client.SelectedProfile())
+
+	// The new profile has its own secret key, credentials, logs and keyshare enrollments
+	require.NoError(t, client.SelectProfile(work.ID))
+	require.Equal(t, work.ID, client.SelectedProfile())
+	require.Empty(t, client.CredentialInfoList())
+	require.Empty(t, client.keyshareServers)
+	require.NotEqual(t, 0, defaultKey.Cmp(client.secretkey.Key))
+	logs, err = client.LoadNewestLogs(100)
+	require.NoError(t, err)
+	require.Empty(t, logs)
+	require.NoError(t, client.storage.AddLogEntry(&LogEntry{Type: irma.ActionDisclosing, Time: irma.Timestamp(time.Now())}))
+	workKey := client.secretkey.Key
+
+	// The selected profile is remembered
+	client.closeStorage()
+	client, err = New(storagePath, filepath.Join("..", "testdata", "irma_configuration"), &TestClientHandler{t: t})
+	require.NoError(t, err)
+	require.Equal(t, work.ID, client.SelectedProfile())
+	profiles := client.Profiles()
+	require.Len(t, profiles, 2)
+	require.Equal(t, DefaultProfile, profiles[0].ID)
+	require.Equal(t, work.ID, profiles[1].ID)
+	require.Equal(t, "Work", profiles[1].Name)
+	require.Equal(t, 0, workKey.Cmp(client.secretkey.Key))
+	logs, err = client.LoadNewestLogs(100)
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+
+	require.Error(t, client.DeleteProfile(work.ID))
+	require.Error(t, client.DeleteProfile(DefaultProfile))
+	require.Error(t, client.SelectProfile("nonexisting"))
+
+	// Profiles can't be switched while a session is in progress
+	session := &session{}
+	client.sessionStarted(session)
+	require.Error(t, client.SelectProfile(DefaultProfile))
+	require.Equal(t, work.ID, client.SelectedProfile())
+	client.sessionEnded(session)
+
+	require.NoError(t, client.SelectProfile(DefaultProfile))
+	require.Len(t, client.CredentialInfoList(), creds)
+	require.Equal(t, 0, defaultKey.Cmp(client.secretkey.Key))
+	verifyCredentials(t, client)
+	verifyKeyshareIsUnmarshaled(t, client)
+	logs, err = client.LoadNewestLogs(100)
+	require.NoError(t, err)
+	require.Len(t, logs, defaultLogs)
+
+	require.NoError(t, client.DeleteProfile(work.ID))
+	require.Len(t, client.Profiles(), 1)
+	exists, err := fs.PathExists(filepath.Join(storagePath, profilesDir, work.ID))
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+// requireDatabaseEncrypted checks that all records in the database except the updates record are encrypted.
+func requireDatabaseEncrypted(t *testing.T, client *Client) {
+	require.NoError(t, client.storage.db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(bucket []byte, b *bbolt.Bucket) error {
+			return b.ForEach(func(k, v []byte) error {
+				if v == nil { // nested bucket containing the log indexes, whose digests are keyed
+					return nil
+				}
+				if string(bucket) != userdataBucket || string(k) != updatesKey {
+					require.True(t, encryption.IsEncryptedRecord(v), "%s is not encrypted", recordName(string(bucket), k))
+				}
+				return nil
+			})
+		})
+	}))
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t)
+	storagePath := filepath.Join("..", "testdata", "storage", "test")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("..", "testdata", "teststorage"), storagePath))
+	key := make([]byte, encryption.KeySize)
+	key[0] = 1
+	open := func(options ...Option) (*Client, error) {
+		return New(storagePath, filepath.Join("..", "testdata", "irma_configuration"), &TestClientHandler{t: t}, options...)
+	}
+
+	// The plaintext teststorage is encrypted by the updates
+	client, err := open(WithStorageKey(key))
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+	verifyCredentials(t, client)
+	verifyKeyshareIsUnmarshaled(t, client)
+	require.NoError(t, client.storage.AddLogEntry(&LogEntry{Type: irma.ActionDisclosing, Time: irma.Timestamp(time.Now())}))
+	logs, err := client.LoadNewestLogs(10)
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	logs, err = client.QueryLogs(&LogQuery{Actions: []irma.Action{irma.ActionDisclosing}})
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	requireDatabaseEncrypted(t, client)
+
+	// Records are bound to their name, so they cannot be swapped
+	var sig []byte
+	require.NoError(t, client.storage.db.View(func(tx *bbolt.Tx) error {
+		_, v := tx.Bucket([]byte(signaturesBucket)).Cursor().First()
+		sig = append([]byte(nil), v...)
+		return nil
+	}))
+	require.NoError(t, client.storage.db.Close())
+
+	// Without the key, or with another key, the storage cannot be read
+	_, err = open()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no storage key")
+	otherKey := make([]byte, encryption.KeySize)
+	_, err = open(WithStorageKey(otherKey))
+	require.Equal(t, encryption.ErrRecordDecryption, err)
+	_, err = open(WithStorageKey(key[:16]))
+	require.Error(t, err)
+
+	db, err := bbolt.Open(filepath.Join(storagePath, databaseFile), 0600, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(userdataBucket)).Put([]byte(attributesKey), sig)
+	}))
+	require.NoError(t, db.Close())
+	_, err = open(WithStorageKey(key))
+	require.Equal(t, encryption.ErrRecordDecryption, err)
+}
+
+func TestEncryptStorageLater(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	storagePath := filepath.Join("..", "testdata", "storage", "test")
+
+	// The update encrypting the storage already ran without a key
+	require.NoError(t, client.storage.AddLogEntry(&LogEntry{Type: irma.ActionDisclosing, Time: irma.Timestamp(time.Now())}))
+	require.NoError(t, client.storage.db.Close())
+	key := make([]byte, encryption.KeySize)
+	client, err := New(storagePath, filepath.Join("..", "testdata", "irma_configuration"),
+		&TestClientHandler{t: t}, WithStorageKey(key))
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+	logs, err := client.LoadNewestLogs(10)
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	requireDatabaseEncrypted(t, client)
+}
+
+func TestEncryptStorageInterrupted(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	storagePath := filepath.Join("..", "testdata", "storage", "test")
+	var hashes []string
+	for _, attrs := range client.attributes {
+		for _, a := range attrs {
+			hashes = append(hashes, a.Hash())
+		}
+	}
+	require.NotEmpty(t, hashes)
+	require.NoError(t, client.storage.db.Close())
+
+	// A previous conversion got as far as encrypting the secret key
+	key := make([]byte, encryption.KeySize)
+	db, err := bbolt.Open(filepath.Join(storagePath, databaseFile), 0600, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(userdataBucket))
+		sk, err := encryption.EncryptRecord(key, b.Get([]byte(skKey)), recordName(userdataBucket, []byte(skKey)))
+		if err != nil {
+			return err
+		}
+		if err = b.Put([]byte(skKey), sk); err != nil {
+			return err
+		}
+		return b.Put([]byte(encryptingKey), []byte("true"))
+	}))
+	require.NoError(t, db.Close())
+
+	client, err = New(storagePath, filepath.Join("..", "testdata", "irma_configuration"),
+		&TestClientHandler{t: t}, WithStorageKey(key))
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+	requireDatabaseEncrypted(t, client)
+
+	// The database was compacted, and signatures are not keyed by the plain hash of the attributes
+	compact, err := client.storage.compactionNeeded()
+	require.NoError(t, err)
+	require.False(t, compact)
+	require.NoError(t, client.storage.db.View(func(tx *bbolt.Tx) error {
+		require.Nil(t, tx.Bucket([]byte(userdataBucket)).Get([]byte(encryptingKey)))
+		for _, hash := range hashes {
+			require.Nil(t, tx.Bucket([]byte(signaturesBucket)).Get([]byte(hash)))
+			require.NotNil(t, tx.Bucket([]byte(signaturesBucket)).Get([]byte(client.storage.signatureKey(hash))))
+		}
+		return nil
+	}))
+}
+
+// pinTransport emulates the PIN verification endpoint of a keyshare server.
+type pinTransport struct {
+	kss      *keyshareServer
+	pin      string
+	verified int
+}
+
+func (pt *pinTransport) SetHeader(name, val string) {}
+
+func (pt *pinTransport) GetContext(ctx context.Context, url string, result interface{}) error {
+	return errors.New("not implemented")
+}
+
+func (pt *pinTransport) PostContext(ctx context.Context, url string, result interface{}, object interface{}) error {
+	if url != "users/verify/pin" {
+		return errors.New("not implemented")
+	}
+	msg := object.(keysharePinMessage)
+	status := result.(*keysharePinStatus)
+	if msg.Username == pt.kss.Username && msg.Pin == pt.kss.HashedPin(pt.pin) {
+		pt.verified++
+		*status = keysharePinStatus{Status: kssPinSuccess, Message: "token"}
+	} else {
+		*status = keysharePinStatus{Status: kssPinFailure, Message: "2"}
+	}
+	return nil
+}
+
+func (pt *pinTransport) DeleteContext(ctx context.Context) error {
+	return errors.New("not implemented")
+}
+
+func TestBackup(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	require.NoError(t, client.storage.AddLogEntry(&LogEntry{Type: irma.ActionDisclosing, Time: irma.Timestamp(time.Now())}))
+	bts, err := client.ExportBackup("passphrase")
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "irmabackup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	scheme := irma.NewSchemeManagerIdentifier("test")
+	transport := &pinTransport{kss: client.keyshareServers[scheme], pin: "12345"}
+	restored, err := New(dir, filepath.Join("..", "testdata", "irma_configuration"), &TestClientHandler{t: t},
+		WithTransport(func(string) irma.Transport { return transport }))
+	require.NoError(t, err)
+	require.Empty(t, restored.CredentialInfoList())
+	require.Empty(t, restored.EnrolledSchemeManagers())
+
+	// Wrong passphrase, modified backups, and wrong or missing PINs are rejected
+	_, err = restored.ExportBackup("")
+	require.Error(t, err)
+	require.Equal(t, ErrBackupDecryption, restored.ImportBackup(bts, "wrong", nil))
+	b := &backup{}
+	require.NoError(t, json.Unmarshal(bts, b))
+	b.KDF.N = 1 << 14
+	modified, err := json.Marshal(b)
+	require.NoError(t, err)
+	require.Equal(t, ErrBackupDecryption, restored.ImportBackup(modified, "passphrase", nil))
+	for _, params := range [][3]int{{1 << 14, 0, 1}, {1 << 14, 8, 0}, {3, 8, 1}, {1 << 21, 8, 1}, {1 << 14, 8, 64}} {
+		kdf := b.KDF
+		b.KDF.N, b.KDF.R, b.KDF.P = params[0], params[1], params[2]
+		modified, err = json.Marshal(b)
+		require.NoError(t, err)
+		err = restored.ImportBackup(modified, "passphrase", nil)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "Invalid backup key derivation parameters")
+		b.KDF = kdf
+	}
+	b.Version = backupVersion + 1
+	modified, err = json.Marshal(b)
+	require.NoError(t, err)
+	err = restored.ImportBackup(modified, "passphrase", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Unsupported backup version")
+	err = restored.ImportBackup(bts, "passphrase", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "No PIN")
+	err = restored.ImportBackup(bts, "passphrase", map[irma.SchemeManagerIdentifier]string{scheme: "54321"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Incorrect PIN")
+	require.Empty(t, restored.CredentialInfoList())
+
+	require.NoError(t, restored.ImportBackup(bts, "passphrase", map[irma.SchemeManagerIdentifier]string{scheme: "12345"}))
+	require.Equal(t, 1, transport.verified)
+	require.Equal(t, client.secretkey.Key, restored.secretkey.Key)
+	verifyClientIsUnmarshaled(t, restored)
+	verifyCredentials(t, restored)
+	verifyKeyshareIsUnmarshaled(t, restored)
+	logs, err := restored.LoadNewestLogs(10)
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+
+	// The restored client survives a restart
+	require.NoError(t, restored.storage.db.Close())
+	restored, err = New(dir, filepath.Join("..", "testdata", "irma_configuration"), &TestClientHandler{t: t})
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, restored)
+	verifyCredentials(t, restored)
+	require.NoError(t, restored.storage.db.Close())
+
+	// Backups of encrypted storage can be restored into storage encrypted with another key
+	require.NoError(t, os.RemoveAll(dir))
+	require.NoError(t, os.Mkdir(dir, 0700))
+	key := make([]byte, encryption.KeySize)
+	key[0] = 2
+	require.NoError(t, client.storage.db.Close())
+	client, err = New(filepath.Join("..", "testdata", "storage", "test"), filepath.Join("..", "testdata", "irma_configuration"),
+		&TestClientHandler{t: t}, WithStorageKey(key))
+	require.NoError(t, err)
+	bts, err = client.ExportBackup("passphrase")
+	require.NoError(t, err)
+	key[0] = 3
+	restored, err = New(dir, filepath.Join("..", "testdata", "irma_configuration"), &TestClientHandler{t: t},
+		WithTransport(func(string) irma.Transport { return transport }), WithStorageKey(key))
+	require.NoError(t, err)
+	require.NoError(t, restored.ImportBackup(bts, "passphrase", map[irma.SchemeManagerIdentifier]string{scheme: "12345"}))
+	verifyCredentials(t, restored)
+	requireDatabaseEncrypted(t, restored)
+	require.NoError(t, restored.storage.db.Close())
+}
+
+type expiryHandler struct {
+	TestClientHandler
+	reported irma.CredentialInfoList
+}
+
+func (h *expiryHandler) CredentialsExpiring(creds irma.CredentialInfoList) {
+	h.reported = append(h.reported, creds...)
+}
+
+func credentialHashes(list irma.CredentialInfoList) []string {
+	hashes := []string{}
+	for _, info := range list {
+		hashes = append(hashes, info.Hash)
+	}
+	return hashes
+}
+
+func TestExpiringCredentials(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	handler := &expiryHandler{TestClientHandler: TestClientHandler{t: t}}
+	client.handler = handler
+
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	require.Len(t, client.attrs(id), 1)
+	attrs := client.attrs(id)[0]
+	hash := attrs.Hash()
+	expiry := attrs.Expiry()
+	require.NotContains(t, credentialHashes(client.expiringCredentials(expiry.Add(-2*defaultExpiryWarning))), hash)
+	require.Contains(t, credentialHashes(client.expiringCredentials(expiry.Add(-time.Hour))), hash)
+	require.NotContains(t, credentialHashes(client.expiringCredentials(expiry.Add(time.Hour))), hash)
+
+	// Expiring credentials are reported once
+	client.checkExpiringCredentials(expiry.Add(-time.Hour))
+	require.Contains(t, credentialHashes(handler.reported), hash)
+	reported := len(handler.reported)
+	client.checkExpiringCredentials(expiry.Add(-time.Hour))
+	require.Len(t, handler.reported, reported)
+
+	// Refreshing requires an IssueURL
+	_, err := client.RefreshCredential(hash)
+	require.Error(t, err)
+	url := irma.TranslatedString{"en": "https://example.com/studentcard"}
+	client.Configuration.CredentialTypes[id].IssueURL = url
+	issueURL, err := client.RefreshCredential(hash)
+	require.NoError(t, err)
+	require.Equal(t, url, issueURL)
+
+	// Issuing a credential with the same attribute values but a later expiry replaces the old one
+	cred, err := client.credential(id, 0)
+	require.NoError(t, err)
+	ints := append([]*big.Int{}, cred.Attributes...)
+	validity := new(big.Int).Lsh(big.NewInt(1), 8*18) // least significant byte of the validity field
+	ints[1] = new(big.Int).Add(ints[1], validity)
+	require.NoError(t, client.addCredentials([]*gabi.Credential{{Attributes: ints, Signature: cred.Signature, Pk: cred.Pk}}))
+	require.Len(t, client.attrs(id), 1)
+	require.NotEqual(t, hash, client.attrs(id)[0].Hash())
+	require.Equal(t, expiry.Add(irma.ExpiryFactor*time.Second), client.attrs(id)[0].Expiry())
+	require.NotContains(t, client.reportedExpiries, hash)
+}
+
+func TestExpiringCredentialsOnStartup(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	open := func(handler ClientHandler) *Client {
+		require.NoError(t, client.storage.db.Close())
+		c, err := New(filepath.Join("..", "testdata", "storage", "test"),
+			filepath.Join("..", "testdata", "irma_configuration"), handler)
+		require.NoError(t, err)
+		return c
+	}
+
+	// Reissue the credential such that it expires within the expiry warning period from now,
+	// using a handler that is not interested in expiring credentials
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	cred, err := client.credential(id, 0)
+	require.NoError(t, err)
+	expiry := client.attrs(id)[0].Expiry()
+	epochs := int64(time.Since(expiry)/(irma.ExpiryFactor*time.Second)) + 1
+	ints := append([]*big.Int{}, cred.Attributes...)
+	validity := new(big.Int).Lsh(big.NewInt(epochs), 8*18)
+	ints[1] = new(big.Int).Add(ints[1], validity)
+	require.NoError(t, client.addCredentials([]*gabi.Credential{{Attributes: ints, Signature: cred.Signature, Pk: cred.Pk}}))
+	hash := client.attrs(id)[0].Hash()
+	require.Contains(t, credentialHashes(client.ExpiringCredentials()), hash)
+
+	// The credential is reported when the client is next created, and only once
+	handler := &expiryHandler{TestClientHandler: TestClientHandler{t: t}}
+	client = open(handler)
+	require.Equal(t, []string{hash}, credentialHashes(handler.reported))
+	handler = &expiryHandler{TestClientHandler: TestClientHandler{t: t}}
+	client = open(handler)
+	require.Empty(t, handler.reported)
+	client.CheckExpiringCredentials()
+	require.Empty(t, handler.reported)
+}
+
+func TestLogQuery(t *testing.T) {
+	client, request, disclosure := parseDisclosure(t)
+	defer test.ClearTestStorage(t)
+
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	fullName := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName")
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	verifierA := irma.TranslatedString{"en": "Verifier A", "nl": "Verifier A"}
+	verifierB := irma.TranslatedString{"en": "Verifier B", "nl": "Verifier B"}
+	t0 := time.Now().Add(-24 * time.Hour)
+
+	entries := []*LogEntry{
+		{Type: ActionRemoval, Time: irma.Timestamp(t0), Removed: map[irma.CredentialTypeIdentifier][]irma.TranslatedString{studentCard: nil}},
+		{Type: irma.ActionDisclosing, Time: irma.Timestamp(t0.Add(time.Hour)), ServerName: verifierA, Disclosure: disclosure, request: request},
+		{Type: irma.ActionDisclosing, Time: irma.Timestamp(t0.Add(2 * time.Hour)), ServerName: verifierB, Disclosure: disclosure, request: request},
+		{Type: irma.ActionIssuing, Time: irma.Timestamp(t0.Add(3 * time.Hour)), ServerName: verifierA, request: irma.NewIssuanceRequest(
+			[]*irma.CredentialRequest{{CredentialTypeID: fullName}},
+		)},
+	}
+	for _, entry := range entries {
+		if entry.request != nil {
+			require.NoError(t, entry.setSessionRequest())
+		}
+		require.NoError(t, client.storage.AddLogEntry(entry))
+	}
+	ids := func(logs []*LogEntry) []uint64 {
+		list := []uint64{}
+		for _, entry := range logs {
+			list = append(list, entry.ID)
+		}
+		return list
+	}
+	removal, discA, discB, issuance := entries[0].ID, entries[1].ID, entries[2].ID, entries[3].ID
+
+	check := func() {
+		for _, c := range []struct {
+			query    LogQuery
+			expected []uint64
+		}{
+			{LogQuery{}, []uint64{issuance, discB, discA, removal}},
+			{LogQuery{Actions: []irma.Action{irma.ActionDisclosing}}, []uint64{discB, discA}},
+			{LogQuery{Actions: []irma.Action{irma.ActionIssuing, ActionRemoval}}, []uint64{issuance, removal}},
+			{LogQuery{Actions: []irma.Action{irma.ActionSigning}}, []uint64{}},
+			{LogQuery{ServerName: "Verifier A"}, []uint64{issuance, discA}},
+			{LogQuery{ServerName: "Verifier A", Actions: []irma.Action{irma.ActionDisclosing}}, []uint64{discA}},
+			{LogQuery{CredentialType: &studentCard}, []uint64{discB, discA, removal}},
+			{LogQuery{CredentialType: &fullName}, []uint64{issuance}},
+			{LogQuery{Attribute: &studentID}, []uint64{discB, discA}},
+			{LogQuery{From: t0.Add(30 * time.Minute), Until: t0.Add(150 * time.Minute)}, []uint64{discB, discA}},
+			{LogQuery{Actions: []irma.Action{irma.ActionDisclosing}, Max: 1}, []uint64{discB}},
+			{LogQuery{Actions: []irma.Action{irma.ActionDisclosing}, Before: discB}, []uint64{discA}},
+		} {
+			logs, err := client.QueryLogs(&c.query)
+			require.NoError(t, err)
+			require.Equal(t, c.expected, ids(logs), "query %+v", c.query)
+		}
+
+		recipients, err := client.AttributeRecipients(studentID)
+		require.NoError(t, err)
+		require.Equal(t, []irma.TranslatedString{verifierB, verifierA}, recipients)
+	}
+	check()
+
+	// The update indexing existing log entries rebuilds the same indexes
+	require.NoError(t, client.storage.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(logsBucket)).DeleteBucket([]byte(logIndexBucket))
+	}))
+	logs, err := client.QueryLogs(&LogQuery{Actions: []irma.Action{irma.ActionDisclosing}})
+	require.NoError(t, err)
+	require.Empty(t, logs)
+	require.NoError(t, client.storage.ReindexLogs())
+	check()
+
+	// Paging through the log entries skips the indexes
+	logs, err = client.LoadNewestLogs(10)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{issuance, discB, discA, removal}, ids(logs))
+}
+
+func TestLogRetention(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	storagePath := filepath.Join("..", "testdata", "storage", "test")
+
+	now := time.Now()
+	addLogs := func(ages ...time.Duration) {
+		for _, age := range ages {
+			require.NoError(t, client.storage.AddLogEntry(&LogEntry{
+				Type:       ActionRemoval,
+				Time:       irma.Timestamp(now.Add(-age)),
+				ServerName: irma.TranslatedString{"en": fmt.Sprintf("requestor-%d", int(age.Hours()))},
+			}))
+		}
+	}
+	ids := func() []uint64 {
+		logs, err := client.LoadNewestLogs(100)
+		require.NoError(t, err)
+		list := []uint64{}
+		for _, entry := range logs {
+			list = append(list, entry.ID)
+		}
+		// The indexes contain the same log entries
+		indexed, err := client.QueryLogs(&LogQuery{Actions: []irma.Action{ActionRemoval}})
+		require.NoError(t, err)
+		require.Len(t, indexed, len(list))
+		return list
+	}
+	requireDatabaseContains := func(name string, contains bool) {
+		bts, err := ioutil.ReadFile(filepath.Join(storagePath, databaseFile))
+		require.NoError(t, err)
+		require.Equal(t, contains, strings.Contains(string(bts), name), name)
+	}
+	day := 24 * time.Hour
+	addLogs(10*day, 8*day, 5*day, 2*day, time.Hour)
+	require.Equal(t, []uint64{5, 4, 3, 2, 1}, ids())
+	requireDatabaseContains("requestor-240", true)
+
+	// Maximum age and count
+	require.NoError(t, client.SetLogRetentionPreference(7, 0))
+	require.Equal(t, []uint64{5, 4, 3}, ids())
+	requireDatabaseContains("requestor-240", false)
+	requireDatabaseContains("requestor-192", false)
+	require.NoError(t, client.SetLogRetentionPreference(0, 2))
+	require.Equal(t, []uint64{5, 4}, ids())
+	requireDatabaseContains("requestor-120", false)
+	require.Error(t, client.SetLogRetentionPreference(-1, 0))
+
+	// Deletion by the user
+	require.Error(t, client.DeleteLogEntry(3))
+	require.NoError(t, client.DeleteLogEntry(4))
+	require.Equal(t, []uint64{5}, ids())
+	requireDatabaseContains("requestor-48", false)
+	addLogs(3*time.Hour, 2*time.Hour)
+	count, err := client.DeleteLogs(&LogQuery{From: now.Add(-150 * time.Minute), Until: now})
+	require.NoError(t, err)
+	require.Equal(t, 2, count) // entries 5 and 7
+	require.Equal(t, []uint64{6}, ids())
+
+	// New log entries get new IDs after compaction
+	addLogs(time.Minute, 0, 4*time.Hour)
+	require.Equal(t, []uint64{10, 9, 8, 6}, ids())
+
+	// While a session is in progress, the database is compacted only at startup
+	s := &session{}
+	client.sessionStarted(s)
+	require.NoError(t, client.DeleteLogEntry(10))
+	require.Equal(t, []uint64{9, 8, 6}, ids())
+	requireDatabaseContains("requestor-4", true)
+	compact, err := client.storage.compactionNeeded()
+	require.NoError(t, err)
+	require.True(t, compact)
+	client.sessionEnded(s)
+	client.sessionEnded(s)
+	require.Empty(t, client.sessions)
+
+	// Pruning and compaction happen at startup
+	require.NoError(t, client.storage.db.Close())
+	client, err = New(storagePath, filepath.Join("..", "testdata", "irma_configuration"), &TestClientHandler{t: t})
+	require.NoError(t, err)
+	require.Equal(t, 2, client.Preferences.MaxLogCount)
+	require.Equal(t, []uint64{9, 8}, ids())
+	requireDatabaseContains("requestor-3", false)
+	requireDatabaseContains("requestor-4", false)
+	verifyClientIsUnmarshaled(t, client)
+	verifyCredentials(t, client)
+	for _, suffix := range []string{compactedFileSuffix, oldFileSuffix} {
+		exists, err := fs.PathExists(filepath.Join(storagePath, databaseFile+suffix))
+		require.NoError(t, err)
+		require.False(t, exists)
+	}
+}
+
+func TestCompactConcurrent(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, client.storage.AddLogEntry(&LogEntry{Type: ActionRemoval, Time: irma.Timestamp(time.Now())}))
+	}
+
+	// Other goroutines can keep using the storage while the database is compacted and reopened
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				logs, err := client.LoadNewestLogs(100)
+				require.NoError(t, err)
+				require.NotEmpty(t, logs)
+				require.NoError(t, client.storage.StorePreferences(client.Preferences))
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, client.storage.Compact())
+	}
+	close(done)
+	wg.Wait()
+	require.NoError(t, client.storage.Close())
+}
+
 // TestCandidates tests the correctness of the function of the client that, given a disjunction of attributes
 // requested by the verifier, calculates a list of candidate attributes contained by the client that would
 // satisfy the attribute disjunction.
@@ -220,6 +1147,144 @@ func TestCandidateConjunctionOrder(t *testing.T) {
 	}
 }
 
+// addCandidateCredential adds a copy of the credential, signed the specified amount of epochs later
+// and valid for long enough, to the attributes of the client (without its signature).
+func addCandidateCredential(client *Client, base *irma.AttributeList, epochs int64) *irma.AttributeList {
+	ints := append([]*big.Int{}, base.Ints...)
+	signed := new(big.Int).Lsh(big.NewInt(epochs), 8*20)  // least significant byte of the signing date field
+	validity := new(big.Int).Lsh(big.NewInt(10000), 8*18) // least significant byte of the validity field
+	ints[0] = new(big.Int).Add(ints[0], new(big.Int).Add(signed, validity))
+	attrs := irma.NewAttributeListFromInts(ints, client.Configuration)
+	id := attrs.CredentialType().Identifier()
+	client.attributes[id] = append(client.attributes[id], attrs)
+	return attrs
+}
+
+func TestCandidateRanking(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	mijnirma := irma.NewCredentialTypeIdentifier("test.test.mijnirma")
+	studentID := irma.NewAttributeRequest("irma-demo.RU.studentCard.studentID")
+	email := irma.NewAttributeRequest("test.test.mijnirma.email")
+	base := client.attrs(studentCard)[0]
+	older := addCandidateCredential(client, base, 1)
+	newest := addCandidateCredential(client, base, 3)
+	newer := addCandidateCredential(client, base, 2)
+	other := addCandidateCredential(client, client.attrs(mijnirma)[0], 1)
+	hashes := func(candidates [][]*irma.AttributeIdentifier) []string {
+		var list []string
+		for _, candidate := range candidates {
+			var hs []string
+			for _, attr := range candidate {
+				hs = append(hs, attr.CredentialHash)
+			}
+			list = append(list, strings.Join(hs, ","))
+		}
+		return list
+	}
+
+	// Newer credentials rank higher
+	candidates, missing := client.Candidates(irma.AttributeDisCon{{studentID}})
+	require.Empty(t, missing)
+	require.Equal(t, []string{newest.Hash(), newer.Hash(), older.Hash()}, hashes(candidates))
+
+	// Candidates with fewer credentials rank higher, as do those without duplicates
+	candidates, _ = client.Candidates(irma.AttributeDisCon{{studentID, email}, {studentID}, {email}})
+	require.Equal(t, []string{
+		other.Hash(), newest.Hash(), newer.Hash(), older.Hash(),
+		newest.Hash() + "," + other.Hash(), newer.Hash() + "," + other.Hash(), older.Hash() + "," + other.Hash(),
+	}, hashes(candidates))
+	candidates, _ = client.Candidates(irma.AttributeDisCon{{studentID}, {}})
+	require.Equal(t, []string{"", newest.Hash(), newer.Hash(), older.Hash()}, hashes(candidates))
+
+	// The amount of candidates is bounded, keeping the best ones
+	client.maxCandidates = 2
+	candidates, _ = client.Candidates(irma.AttributeDisCon{{studentID}})
+	require.Equal(t, []string{newest.Hash(), newer.Hash()}, hashes(candidates))
+	candidates, _ = client.Candidates(irma.AttributeDisCon{{studentID, email}})
+	require.Equal(t, []string{newest.Hash() + "," + other.Hash(), newer.Hash() + "," + other.Hash()}, hashes(candidates))
+	client.maxCandidates = defaultMaxCandidates
+
+	// The default choice consists of the best candidates
+	choice, unsatisfied := client.DefaultChoice(irma.AttributeConDisCon{{{studentID}}, {{email}}})
+	require.Empty(t, unsatisfied)
+	require.Equal(t, []string{newest.Hash(), other.Hash()}, hashes(choice.Attributes))
+	choice, unsatisfied = client.DefaultChoice(irma.AttributeConDisCon{{{irma.NewAttributeRequest("irma-demo.MijnOverheid.ageLower.over12")}}})
+	require.Nil(t, choice)
+	require.NotEmpty(t, unsatisfied)
+}
+
+func TestCandidateRankingBounded(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Instances of two credential types, with signing dates relative to the newest base instance
+	studentCard := client.attrs(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))[0]
+	mijnirma := client.attrs(irma.NewCredentialTypeIdentifier("test.test.mijnirma"))[0]
+	newest := studentCard.SigningDate()
+	if mijnirma.SigningDate().After(newest) {
+		newest = mijnirma.SigningDate()
+	}
+	add := func(base *irma.AttributeList, epochs int64) string {
+		offset := int64(newest.Sub(base.SigningDate()) / (irma.ExpiryFactor * time.Second))
+		return addCandidateCredential(client, base, offset+epochs).Hash()
+	}
+	a1, a2 := add(studentCard, 3), add(studentCard, 1)
+	b1, b2, b3 := add(mijnirma, 3), add(mijnirma, 2), add(mijnirma, 1)
+	con := irma.AttributeDisCon{{
+		irma.NewAttributeRequest("irma-demo.RU.studentCard.studentID"),
+		irma.NewAttributeRequest("test.test.mijnirma.email"),
+	}}
+	hashes := func(candidates [][]*irma.AttributeIdentifier) []string {
+		var list []string
+		for _, candidate := range candidates {
+			list = append(list, candidate[0].CredentialHash+","+candidate[1].CredentialHash)
+		}
+		return list
+	}
+
+	// Candidates are ranked by the signing date of their oldest credential
+	client.maxCandidates = 0
+	candidates, _ := client.Candidates(con)
+	require.Equal(t, []string{
+		a1 + "," + b1, a1 + "," + b2,
+		a2 + "," + b1, a2 + "," + b2, a1 + "," + b3, a2 + "," + b3,
+	}, hashes(candidates))
+
+	// The best ones are kept when bounding the candidates, instead of the first ones of the
+	// product, which would be a1,b1 and a2,b1
+	client.maxCandidates = 2
+	candidates, _ = client.Candidates(con)
+	require.Equal(t, []string{a1 + "," + b1, a1 + "," + b2}, hashes(candidates))
+	client.maxCandidates = 1
+	candidates, _ = client.Candidates(con)
+	require.Equal(t, []string{a1 + "," + b1}, hashes(candidates))
+}
+
+func TestKeyshareTransportPinning(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	scheme := &irma.SchemeManager{
+		ID:                 "test",
+		KeyshareServer:     srv.URL,
+		KeyshareServerPins: []string{irma.CertificatePin(srv.Certificate())},
+	}
+
+	transport, err := keyshareTransport(func(url string) irma.Transport {
+		return irma.NewHTTPTransport(url)
+	}, scheme)
+	require.NoError(t, err)
+	require.NotNil(t, transport)
+
+	// Transports that can't pin certificates are refused
+	_, err = keyshareTransport(func(url string) irma.Transport {
+		return irma.NewLocalTransport(nil, url)
+	}, scheme)
+	require.Error(t, err)
+}
+
 func TestCredentialRemoval(t *testing.T) {
 	client := parseStorage(t)
 	defer test.ClearTestStorage(t)
@@ -289,6 +1354,97 @@ func TestCredentialInfoListNewAttribute(t *testing.T) {
 	require.Fail(t, "studentCard credential not found")
 }
 
+type schemeEventHandler struct {
+	TestClientHandler
+	events []*irma.SchemeEvent
+}
+
+func (h *schemeEventHandler) SchemeEvent(event *irma.SchemeEvent) {
+	h.events = append(h.events, event)
+}
+
+func TestSchemeEventsUnsubscribedOnClose(t *testing.T) {
+	test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t)
+	require.NoError(t, fs.CopyDirectory(filepath.Join("..", "testdata", "teststorage"),
+		filepath.Join("..", "testdata", "storage", "test")))
+	handler := &schemeEventHandler{TestClientHandler: TestClientHandler{t: t}}
+	client, err := New(
+		filepath.Join("..", "testdata", "storage", "test"),
+		filepath.Join("..", "testdata", "irma_configuration"),
+		handler,
+	)
+	require.NoError(t, err)
+
+	// After closing the client its handler receives no more events of the Configuration
+	conf := client.Configuration
+	var published int
+	conf.SubscribeSchemeEvents(func(*irma.SchemeEvent) { published++ })
+	client.Close()
+	schemeid := irma.NewSchemeManagerIdentifier("irma-demo")
+	conf.SchemeManagers[schemeid].URL = "http://localhost:48681/irma_configuration_updated/irma-demo"
+	require.NoError(t, conf.UpdateSchemes())
+	require.NotZero(t, published)
+	require.Empty(t, handler.events)
+}
+
+func TestUpdateSchemeManagerRollback(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	schemeid := irma.NewSchemeManagerIdentifier("irma-demo")
+	attrid := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")
+	conf := client.Configuration
+
+	require.Error(t, conf.RollbackSchemeManager(schemeid))
+
+	conf.SchemeManagers[schemeid].URL = "http://localhost:48681/irma_configuration_updated/irma-demo"
+	require.NoError(t, conf.UpdateSchemeManager(schemeid, nil))
+	require.NoError(t, conf.ParseFolder())
+	require.Contains(t, conf.AttributeTypes, attrid)
+
+	require.NoError(t, conf.RollbackSchemeManager(schemeid))
+	require.NoError(t, conf.ParseFolder())
+	require.NotContains(t, conf.AttributeTypes, attrid)
+	require.True(t, conf.SchemeManagers[schemeid].Valid)
+}
+
+func TestUpdateSchemeManagerInvalid(t *testing.T) {
+	client := parseStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Serve the updated scheme, except for one file which does not match the index
+	files := http.FileServer(http.Dir(filepath.Join("..", "testdata", "irma_configuration_updated")))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "studentCard/description.xml") {
+			_, _ = w.Write([]byte("<IssueSpecification></IssueSpecification>"))
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	schemeid := irma.NewSchemeManagerIdentifier("irma-demo")
+	conf := client.Configuration
+	index, err := ioutil.ReadFile(filepath.Join(conf.Path, "irma-demo", "index"))
+	require.NoError(t, err)
+
+	conf.SchemeManagers[schemeid].URL = server.URL + "/irma-demo"
+	require.Error(t, conf.UpdateSchemeManager(schemeid, nil))
+
+	// The stored version must be untouched, and nothing of the new version may be left behind
+	newIndex, err := ioutil.ReadFile(filepath.Join(conf.Path, "irma-demo", "index"))
+	require.NoError(t, err)
+	require.Equal(t, index, newIndex)
+	hidden, err := filepath.Glob(filepath.Join(conf.Path, ".*"))
+	require.NoError(t, err)
+	require.Empty(t, hidden)
+
+	require.NoError(t, conf.ParseFolder())
+	require.True(t, conf.SchemeManagers[schemeid].Valid)
+	require.NotContains(t, conf.AttributeTypes, irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute"))
+}
+
 // ------
 
 type TestClientHandler struct {
@@ -1,6 +1,7 @@
 package irmaclient
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
@@ -47,10 +48,11 @@ type keyshareSession struct {
 	conf             *irma.Configuration
 	keyshareServers  map[irma.SchemeManagerIdentifier]*keyshareServer
 	keyshareServer   *keyshareServer // The one keyshare server in use in case of issuance
-	transports       map[irma.SchemeManagerIdentifier]*irma.HTTPTransport
+	transports       map[irma.SchemeManagerIdentifier]irma.Transport
 	issuerProofNonce *big.Int
 	timestamp        *atum.Timestamp
 	pinCheck         bool
+	ctx              context.Context
 }
 
 type keyshareServer struct {
@@ -157,6 +159,8 @@ func startKeyshareSession(
 	keyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer,
 	issuerProofNonce *big.Int,
 	timestamp *atum.Timestamp,
+	newTransport TransportFactory,
+	ctx context.Context,
 ) {
 	ksscount := 0
 	for managerID := range session.Identifiers().SchemeManagers {
@@ -179,13 +183,14 @@ func startKeyshareSession(
 		session:          session,
 		builders:         builders,
 		sessionHandler:   sessionHandler,
-		transports:       map[irma.SchemeManagerIdentifier]*irma.HTTPTransport{},
+		transports:       map[irma.SchemeManagerIdentifier]irma.Transport{},
 		pinRequestor:     pin,
 		conf:             conf,
 		keyshareServers:  keyshareServers,
 		issuerProofNonce: issuerProofNonce,
 		timestamp:        timestamp,
 		pinCheck:         false,
+		ctx:              ctx,
 	}
 
 	for managerID := range session.Identifiers().SchemeManagers {
@@ -195,7 +200,11 @@ func startKeyshareSession(
 		}
 
 		ks.keyshareServer = ks.keyshareServers[managerID]
-		transport := irma.NewHTTPTransport(scheme.KeyshareServer)
+		transport, err := keyshareTransport(newTransport, scheme)
+		if err != nil {
+			sessionHandler.KeyshareError(&managerID, err)
+			return
+		}
 		transport.SetHeader(kssUsernameHeader, ks.keyshareServer.Username)
 		transport.SetHeader(kssAuthHeader, "Bearer "+ks.keyshareServer.token)
 		transport.SetHeader(kssVersionHeader, "2")
@@ -205,7 +214,7 @@ func startKeyshareSession(
 		parser := new(jwt.Parser)
 		parser.SkipClaimsValidation = true // We want to verify expiry on our own below so we can add leeway
 		claims := jwt.StandardClaims{}
-		_, err := parser.ParseWithClaims(ks.keyshareServer.token, &claims, ks.conf.KeyshareServerKeyFunc(managerID))
+		_, err = parser.ParseWithClaims(ks.keyshareServer.token, &claims, ks.conf.KeyshareServerKeyFunc(managerID))
 		if err != nil {
 			irma.Logger.Info("Keyshare server token invalid, asking for PIN")
 			irma.Logger.Debug("Token: ", ks.keyshareServer.token)
@@ -280,11 +289,29 @@ func (ks *keyshareSession) VerifyPin(attempts int) {
 	}))
 }
 
-func verifyPinWorker(pin string, kss *keyshareServer, transport *irma.HTTPTransport) (
+// keyshareTransport returns a transport to the keyshare server of the scheme, which only accepts
+// the TLS certificates pinned by the scheme, if any. If the scheme pins certificates but the
+// transport does not support pinning, an error is returned.
+func keyshareTransport(newTransport TransportFactory, scheme *irma.SchemeManager) (irma.Transport, error) {
+	transport := newTransport(scheme.KeyshareServer)
+	if len(scheme.KeyshareServerPins) == 0 {
+		return transport, nil
+	}
+	pinner, ok := transport.(interface{ SetCertificatePins(pins []string) error })
+	if !ok {
+		return nil, errors.Errorf("Scheme %s pins the certificate of its keyshare server, but the transport does not support pinning", scheme.ID)
+	}
+	if err := pinner.SetCertificatePins(scheme.KeyshareServerPins); err != nil {
+		return nil, err
+	}
+	return transport, nil
+}
+
+func verifyPinWorker(ctx context.Context, pin string, kss *keyshareServer, transport irma.Transport) (
 	success bool, tries int, blocked int, err error) {
 	pinmsg := keysharePinMessage{Username: kss.Username, Pin: kss.HashedPin(pin)}
 	pinresult := &keysharePinStatus{}
-	err = transport.Post("users/verify/pin", pinresult, pinmsg)
+	err = transport.PostContext(ctx, "users/verify/pin", pinresult, pinmsg)
 	if err != nil {
 		return
 	}
@@ -328,7 +355,7 @@ func (ks *keyshareSession) verifyPinAttempt(pin string) (
 
 		kss := ks.keyshareServers[manager]
 		transport := ks.transports[manager]
-		success, tries, blocked, err = verifyPinWorker(pin, kss, transport)
+		success, tries, blocked, err = verifyPinWorker(ks.ctx, pin, kss, transport)
 		if !success {
 			return
 		}
@@ -366,7 +393,7 @@ func (ks *keyshareSession) GetCommitments() {
 
 		transport := ks.transports[managerID]
 		comms := &proofPCommitmentMap{}
-		err := transport.Post("prove/getCommitments", comms, pkids[managerID])
+		err := transport.PostContext(ks.ctx, "prove/getCommitments", comms, pkids[managerID])
 		if err != nil {
 			if err.(*irma.SessionError).RemoteError != nil &&
 				err.(*irma.SessionError).RemoteError.Status == http.StatusForbidden && !ks.pinCheck {
@@ -414,7 +441,7 @@ func (ks *keyshareSession) GetProofPs() {
 			continue
 		}
 		var j string
-		err := transport.Post("prove/getResponse", &j, challenge)
+		err := transport.PostContext(ks.ctx, "prove/getResponse", &j, challenge)
 		if err != nil {
 			ks.sessionHandler.KeyshareError(&managerID, err)
 			return
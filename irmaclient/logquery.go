@@ -0,0 +1,321 @@
+package irmaclient
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"go.etcd.io/bbolt"
+)
+
+// This file contains the secondary indexes of the log entries, and the queries using them.
+
+// Name of the bucket nested in the logs bucket that contains the indexes of the log entries.
+// Its keys consist of the name of the index, a zero byte, the digest of the indexed value and
+// the ID of the log entry; its values are empty.
+const logIndexBucket = "index"
+
+// Names of the log indexes
+const (
+	logIndexAction         = "action"
+	logIndexServerName     = "server"
+	logIndexCredentialType = "credtype"
+	logIndexAttribute      = "attr"
+)
+
+// LogQuery specifies which log entries QueryLogs returns. Log entries must match all specified
+// filters; zero fields match all log entries.
+type LogQuery struct {
+	// Log entries of any of these types
+	Actions []irma.Action
+	// Log entries of sessions with a requestor having this name in any language
+	ServerName string
+	// Log entries in which a credential of this type was disclosed, issued or removed
+	CredentialType *irma.CredentialTypeIdentifier
+	// Log entries in which this attribute was disclosed
+	Attribute *irma.AttributeTypeIdentifier
+	// Log entries of sessions completed in this time range (inclusive)
+	From, Until time.Time
+
+	// Log entries with an ID less than this one, for paging through the results
+	Before uint64
+	// The maximum amount of log entries to return; 0 means no maximum
+	Max int
+}
+
+// QueryLogs returns the log entries matching the query, sorted from new to old.
+func (client *Client) QueryLogs(query *LogQuery) ([]*LogEntry, error) {
+	return client.storage.QueryLogs(query)
+}
+
+// AttributeRecipients returns the names of the requestors to which the specified attribute
+// has been disclosed, sorted by the time at which that last happened, from new to old.
+func (client *Client) AttributeRecipients(attr irma.AttributeTypeIdentifier) ([]irma.TranslatedString, error) {
+	logs, err := client.storage.QueryLogs(&LogQuery{Attribute: &attr})
+	if err != nil {
+		return nil, err
+	}
+	recipients := []irma.TranslatedString{}
+	seen := map[string]struct{}{}
+	for _, entry := range logs {
+		if len(entry.ServerName) == 0 {
+			continue
+		}
+		key := translatedStringKey(entry.ServerName)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		recipients = append(recipients, entry.ServerName)
+	}
+	return recipients, nil
+}
+
+func translatedStringKey(ts irma.TranslatedString) string {
+	langs := make([]string, 0, len(ts))
+	for lang, text := range ts {
+		langs = append(langs, lang+"="+text)
+	}
+	sort.Strings(langs)
+	return strings.Join(langs, "\x00")
+}
+
+// indexValues returns the values of the log entry per index.
+func (entry *LogEntry) indexValues(conf *irma.Configuration) map[string][]string {
+	values := map[string][]string{
+		logIndexAction: {string(entry.Type)},
+	}
+	for _, name := range entry.ServerName {
+		if name != "" {
+			values[logIndexServerName] = append(values[logIndexServerName], name)
+		}
+	}
+
+	credtypes := map[irma.CredentialTypeIdentifier]struct{}{}
+	for id := range entry.Removed {
+		credtypes[id] = struct{}{}
+	}
+	if entry.Type == irma.ActionIssuing {
+		if request, err := entry.SessionRequest(); err == nil {
+			for _, cred := range request.(*irma.IssuanceRequest).Credentials {
+				credtypes[cred.CredentialTypeID] = struct{}{}
+			}
+		}
+	}
+	if (entry.Type == irma.ActionIssuing && entry.IssueCommitment != nil) ||
+		((entry.Type == irma.ActionDisclosing || entry.Type == irma.ActionSigning) && entry.Disclosure != nil) {
+		disclosed, err := entry.GetDisclosedCredentials(conf)
+		if err != nil {
+			// The entry remains findable through the other indexes
+			irma.Logger.Warn(errors.WrapPrefix(err, "Failed to index disclosed attributes of log entry", 0).Error())
+		}
+		attrs := map[irma.AttributeTypeIdentifier]struct{}{}
+		for _, con := range disclosed {
+			for _, attr := range con {
+				if attr != nil {
+					attrs[attr.Identifier] = struct{}{}
+					credtypes[attr.Identifier.CredentialTypeIdentifier()] = struct{}{}
+				}
+			}
+		}
+		for id := range attrs {
+			values[logIndexAttribute] = append(values[logIndexAttribute], id.String())
+		}
+	}
+	for id := range credtypes {
+		values[logIndexCredentialType] = append(values[logIndexCredentialType], id.String())
+	}
+	return values
+}
+
+// logIndexPrefix returns the prefix of the keys in the specified index of the value. If the storage
+// is encrypted, the digest of the value is keyed, so that the indexes reveal nothing about the logs.
+func (s *storage) logIndexPrefix(index, value string) []byte {
+	var digest []byte
+	if s.key == nil {
+		sum := sha256.Sum256([]byte(value))
+		digest = sum[:]
+	} else {
+		mac := hmac.New(sha256.New, s.logIndexKey())
+		mac.Write([]byte(value))
+		digest = mac.Sum(nil)
+	}
+	return append(append([]byte(index), 0), digest...)
+}
+
+// logIndexKey returns the key with which the log index digests of encrypted storage are computed,
+// derived from the storage key.
+func (s *storage) logIndexKey() []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte("irmaclient log index"))
+	return mac.Sum(nil)
+}
+
+// txIndexLogEntry adds the log entry, stored under the specified key, to the indexes.
+func (s *storage) txIndexLogEntry(tx *bbolt.Tx, entry *LogEntry, k []byte) error {
+	b, err := tx.Bucket([]byte(logsBucket)).CreateBucketIfNotExists([]byte(logIndexBucket))
+	if err != nil {
+		return err
+	}
+	for index, values := range entry.indexValues(s.Configuration) {
+		for _, value := range values {
+			if err = b.Put(append(s.logIndexPrefix(index, value), k...), []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// txReindexLogs rebuilds the indexes of all log entries.
+func (s *storage) txReindexLogs(tx *bbolt.Tx) error {
+	b := tx.Bucket([]byte(logsBucket))
+	if b == nil {
+		return nil
+	}
+	if err := b.DeleteBucket([]byte(logIndexBucket)); err != nil && err != bbolt.ErrBucketNotFound {
+		return err
+	}
+	entries := map[string]*LogEntry{}
+	err := b.ForEach(func(k, v []byte) error {
+		if v == nil { // nested bucket
+			return nil
+		}
+		entry, err := s.decryptLogEntry(k, v)
+		entries[string(k)] = entry
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for k, entry := range entries {
+		if err = s.txIndexLogEntry(tx, entry, []byte(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReindexLogs rebuilds the indexes of all log entries in a single transaction.
+func (s *storage) ReindexLogs() error {
+	return s.update(s.txReindexLogs)
+}
+
+func (s *storage) decryptLogEntry(k, v []byte) (*LogEntry, error) {
+	v, err := s.decrypt(v, recordName(logsBucket, k))
+	if err != nil {
+		return nil, err
+	}
+	var entry LogEntry
+	if err = json.Unmarshal(v, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// QueryLogs returns the log entries matching the query, sorted from new to old.
+func (s *storage) QueryLogs(query *LogQuery) ([]*LogEntry, error) {
+	logs := []*LogEntry{}
+	err := s.view(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(logsBucket))
+		if b == nil {
+			return nil
+		}
+		ids, err := s.queryLogIndexes(b.Bucket([]byte(logIndexBucket)), query)
+		if err != nil {
+			return err
+		}
+		if ids == nil { // No index applies, consider all log entries
+			ids = [][]byte{}
+			c := b.Cursor()
+			for k, v := c.Last(); k != nil; k, v = c.Prev() {
+				if v != nil {
+					ids = append(ids, k)
+				}
+			}
+		}
+
+		for _, k := range ids {
+			if query.Max > 0 && len(logs) >= query.Max {
+				break
+			}
+			if query.Before != 0 && binary.BigEndian.Uint64(k) >= query.Before {
+				continue
+			}
+			v := b.Get(k)
+			if v == nil {
+				continue
+			}
+			entry, err := s.decryptLogEntry(k, v)
+			if err != nil {
+				return err
+			}
+			t := time.Time(entry.Time)
+			if (!query.From.IsZero() && t.Before(query.From)) || (!query.Until.IsZero() && t.After(query.Until)) {
+				continue
+			}
+			logs = append(logs, entry)
+		}
+		return nil
+	})
+	return logs, err
+}
+
+// queryLogIndexes returns the keys of the log entries matching all indexed filters of the query,
+// sorted from new to old, or nil if the query has no indexed filters.
+func (s *storage) queryLogIndexes(b *bbolt.Bucket, query *LogQuery) ([][]byte, error) {
+	var filters [][][]byte // per filter, the prefixes of which any must match
+	if len(query.Actions) > 0 {
+		var prefixes [][]byte
+		for _, action := range query.Actions {
+			prefixes = append(prefixes, s.logIndexPrefix(logIndexAction, string(action)))
+		}
+		filters = append(filters, prefixes)
+	}
+	if query.ServerName != "" {
+		filters = append(filters, [][]byte{s.logIndexPrefix(logIndexServerName, query.ServerName)})
+	}
+	if query.CredentialType != nil {
+		filters = append(filters, [][]byte{s.logIndexPrefix(logIndexCredentialType, query.CredentialType.String())})
+	}
+	if query.Attribute != nil {
+		filters = append(filters, [][]byte{s.logIndexPrefix(logIndexAttribute, query.Attribute.String())})
+	}
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	if b == nil {
+		return [][]byte{}, nil
+	}
+
+	var matches map[string]struct{}
+	for _, prefixes := range filters {
+		ids := map[string]struct{}{}
+		c := b.Cursor()
+		for _, prefix := range prefixes {
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				id := string(k[len(prefix):])
+				if _, ok := matches[id]; matches == nil || ok {
+					ids[id] = struct{}{}
+				}
+			}
+		}
+		matches = ids
+	}
+
+	keys := make([][]byte, 0, len(matches))
+	for id := range matches {
+		keys = append(keys, []byte(id))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) > 0
+	})
+	return keys, nil
+}
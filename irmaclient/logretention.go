@@ -0,0 +1,296 @@
+package irmaclient
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"go.etcd.io/bbolt"
+)
+
+// This file contains the deletion of log entries, according to the retention preferences or on
+// request of the user, and the compaction of the database that removes their remnants. As the
+// database cannot be used by sessions while it is compacted, it is only compacted right away if no
+// sessions are in progress; otherwise that happens when the client is next created.
+
+// SetLogRetentionPreference sets the maximum age in days and the maximum amount of the log entries
+// that are kept (0 meaning no maximum), deleting the log entries that are no longer kept.
+func (client *Client) SetLogRetentionPreference(maxAgeDays, maxCount int) error {
+	if maxAgeDays < 0 || maxCount < 0 {
+		return errors.New("Log retention must not be negative")
+	}
+	client.Preferences.MaxLogAgeDays = maxAgeDays
+	client.Preferences.MaxLogCount = maxCount
+	if err := client.defaultStorage.StorePreferences(client.Preferences); err != nil {
+		return err
+	}
+	return client.pruneLogs(true)
+}
+
+// sessionStarted registers the session as in progress, postponing compaction of the database.
+func (client *Client) sessionStarted(session *session) {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	client.sessions[session] = struct{}{}
+}
+
+// sessionEnded unregisters the session; it may be called more than once.
+func (client *Client) sessionEnded(session *session) {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	delete(client.sessions, session)
+}
+
+// compact compacts the database if no sessions are in progress. Otherwise the database stays
+// marked for compaction, which then happens when the client is next created. Sessions starting
+// during compaction wait for it to finish.
+func (client *Client) compact() error {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	if len(client.sessions) > 0 {
+		irma.Logger.Info("Sessions in progress, postponing database compaction until next startup")
+		return nil
+	}
+	return client.storage.Compact()
+}
+
+// DeleteLogEntry deletes the log entry with the specified ID.
+func (client *Client) DeleteLogEntry(id uint64) error {
+	if err := client.storage.DeleteLogEntries([]uint64{id}); err != nil {
+		return err
+	}
+	return client.compact()
+}
+
+// DeleteLogs deletes the log entries matching the query, e.g. those in a time range,
+// returning the amount of deleted log entries.
+func (client *Client) DeleteLogs(query *LogQuery) (int, error) {
+	logs, err := client.storage.QueryLogs(query)
+	if err != nil || len(logs) == 0 {
+		return 0, err
+	}
+	ids := make([]uint64, 0, len(logs))
+	for _, entry := range logs {
+		ids = append(ids, entry.ID)
+	}
+	if err = client.storage.DeleteLogEntries(ids); err != nil {
+		return 0, err
+	}
+	return len(ids), client.compact()
+}
+
+// pruneLogs deletes the log entries that are no longer kept according to the preferences. The
+// database is compacted only if compact is true; otherwise that is done when the client is next
+// created.
+func (client *Client) pruneLogs(compact bool) error {
+	prefs := client.Preferences
+	if prefs.MaxLogAgeDays == 0 && prefs.MaxLogCount == 0 {
+		return nil
+	}
+	var before time.Time
+	if prefs.MaxLogAgeDays > 0 {
+		before = time.Now().AddDate(0, 0, -prefs.MaxLogAgeDays)
+	}
+	pruned, err := client.storage.PruneLogs(before, prefs.MaxLogCount)
+	if err != nil || pruned == 0 || !compact {
+		return err
+	}
+	return client.compact()
+}
+
+// PruneLogs deletes the log entries from before the specified time, if not zero, and those
+// beyond the newest maxCount ones, if not zero, returning the amount of deleted log entries.
+func (s *storage) PruneLogs(before time.Time, maxCount int) (int, error) {
+	var ids []uint64
+	err := s.view(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(logsBucket))
+		if b == nil {
+			return nil
+		}
+		count := 0
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if v == nil { // nested bucket containing the indexes
+				continue
+			}
+			count++
+			if maxCount > 0 && count > maxCount {
+				ids = append(ids, binary.BigEndian.Uint64(k))
+				continue
+			}
+			if before.IsZero() {
+				continue
+			}
+			entry, err := s.decryptLogEntry(k, v)
+			if err != nil {
+				return err
+			}
+			if time.Time(entry.Time).Before(before) {
+				ids = append(ids, entry.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	return len(ids), s.DeleteLogEntries(ids)
+}
+
+// DeleteLogEntries deletes the specified log entries and their index entries in a single
+// transaction, marking the database for compaction.
+func (s *storage) DeleteLogEntries(ids []uint64) error {
+	return s.update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(logsBucket))
+		if b == nil {
+			return errors.New("No such log entry")
+		}
+		index := b.Bucket([]byte(logIndexBucket))
+		for _, id := range ids {
+			k := s.logEntryKeyToBytes(id)
+			v := b.Get(k)
+			if v == nil {
+				return errors.Errorf("No log entry with ID %d", id)
+			}
+			entry, err := s.decryptLogEntry(k, v)
+			if err != nil {
+				return err
+			}
+			if index != nil {
+				for name, values := range entry.indexValues(s.Configuration) {
+					for _, value := range values {
+						if err = index.Delete(append(s.logIndexPrefix(name, value), k...)); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			if err = b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return s.txStore(tx, userdataBucket, compactKey, true)
+	})
+}
+
+// compactionNeeded returns whether records were deleted since the database was last compacted.
+func (s *storage) compactionNeeded() (bool, error) {
+	var compact bool
+	_, err := s.load(userdataBucket, compactKey, &compact, "")
+	return compact, err
+}
+
+// Compact rewrites the database into a new file without the free pages, which may still contain
+// deleted records, after which the old file is overwritten and removed. Other use of the storage
+// waits until it has finished.
+func (s *storage) Compact() error {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+
+	path := s.path(databaseFile)
+	if err := os.Remove(path + compactedFileSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	compacted, err := bbolt.Open(path+compactedFileSuffix, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		return compacted.Update(func(ctx *bbolt.Tx) error {
+			return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+				cb, err := ctx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(b, cb, func(k []byte) bool {
+					return string(name) == userdataBucket && string(k) == compactKey
+				})
+			})
+		})
+	})
+	if cerr := compacted.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path + compactedFileSuffix)
+		return err
+	}
+
+	if err = s.db.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(path, path+oldFileSuffix); err != nil {
+		return s.reopenAfter(err)
+	}
+	if err = os.Rename(path+compactedFileSuffix, path); err != nil {
+		return s.reopenAfter(err)
+	}
+	if err = s.removeOldDatabase(); err != nil {
+		irma.Logger.Warn(errors.WrapPrefix(err, "Failed to remove old database after compaction", 0).Error())
+	}
+	return s.openDatabase()
+}
+
+// reopenAfter reopens the original database after compaction failed with err, which it returns.
+// If the original database was already moved away, openDatabase moves it back. Requires s.dbLock.
+func (s *storage) reopenAfter(err error) error {
+	if oerr := s.openDatabase(); oerr != nil {
+		return errors.WrapPrefix(oerr, "Failed to reopen database after failed compaction", 0)
+	}
+	return err
+}
+
+// copyBucket recursively copies the contents of src, except the keys for which skip returns true,
+// into dst, including the sequences of the buckets.
+func copyBucket(src, dst *bbolt.Bucket, skip func(k []byte) bool) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if skip(k) {
+			return nil
+		}
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		nested, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(src.Bucket(k), nested, func([]byte) bool { return false })
+	})
+}
+
+// removeOldDatabase overwrites and removes the database file that was replaced by its
+// compacted version, if present.
+func (s *storage) removeOldDatabase() error {
+	return overwriteAndRemove(s.path(databaseFile) + oldFileSuffix)
+}
+
+// overwriteAndRemove overwrites the file with zeroes and removes it, if present.
+func overwriteAndRemove(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(make([]byte, info.Size()))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
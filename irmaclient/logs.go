@@ -33,6 +33,7 @@ type LogEntry struct {
 	Disclosure *irma.Disclosure      `json:",omitempty"`
 	Request    json.RawMessage       `json:",omitempty"` // Message that started the session
 	request    irma.SessionRequest   // cached parsed version of Request; get with LogEntry.SessionRequest()
+	PolicyRule string                `json:",omitempty"` // ID of the policy rule that consented instead of the user
 }
 
 const ActionRemoval = irma.Action("removal")
@@ -123,6 +124,36 @@ func (entry *LogEntry) GetSignedMessage() (abs *irma.SignedMessage, err error) {
 	}, nil
 }
 
+// Receipt returns a receipt of the session of the log entry, which must be a disclosure or
+// signature session.
+func (entry *LogEntry) Receipt() (*irma.Receipt, error) {
+	if entry.Type != irma.ActionDisclosing && entry.Type != irma.ActionSigning {
+		return nil, errors.Errorf("Can't create receipt of %s log entry", entry.Type)
+	}
+	if entry.Disclosure == nil {
+		return nil, errors.New("Log entry contains no disclosure")
+	}
+	request, err := entry.SessionRequest()
+	if err != nil {
+		return nil, err
+	}
+	receipt := &irma.Receipt{
+		LDContext:  irma.LDContextReceipt,
+		Action:     entry.Type,
+		ServerName: entry.ServerName,
+		Time:       entry.Time,
+		Request:    request,
+	}
+	if entry.Type == irma.ActionSigning {
+		if receipt.SignedMessage, err = entry.GetSignedMessage(); err != nil {
+			return nil, err
+		}
+	} else {
+		receipt.Disclosure = entry.Disclosure
+	}
+	return receipt, nil
+}
+
 func (session *session) createLogEntry(response interface{}) (*LogEntry, error) {
 	entry := &LogEntry{
 		Type:       session.Action,
@@ -130,6 +161,7 @@ func (session *session) createLogEntry(response interface{}) (*LogEntry, error)
 		ServerName: session.ServerName,
 		Version:    session.Version,
 		request:    session.request,
+		PolicyRule: session.policyRule,
 	}
 
 	if err := entry.setSessionRequest(); err != nil {
@@ -0,0 +1,248 @@
+package irmaclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+)
+
+// This file contains the disclosure policy of the client: rules, set by the user, with which
+// sessions are consented to or rejected without asking the user.
+
+// PolicyDecision is the decision of a PolicyRule about the sessions to which it applies.
+type PolicyDecision string
+
+const (
+	// PolicyAllow rules consent to the session, disclosing the best ranked candidate attributes
+	// allowed by the rule for each disjunction
+	PolicyAllow = PolicyDecision("allow")
+	// PolicyDeny rules reject the session
+	PolicyDeny = PolicyDecision("deny")
+	// PolicyAsk rules make sure the user is asked for permission, overriding PolicyAllow rules
+	PolicyAsk = PolicyDecision("ask")
+)
+
+// Key of the record in the userdata bucket containing the policy rules of the profile
+const policyKey = "policy"
+
+// PolicyRule decides about the sessions to which it applies. A rule applies to a session if it
+// matches the requestor, the action and the attributes of the session, and has not expired.
+// If deny rules apply to a session it is rejected; otherwise, if ask rules apply the user is
+// asked for permission; otherwise, if an allow rule applies the session is consented to.
+type PolicyRule struct {
+	ID      string         `json:"id"`
+	Created irma.Timestamp `json:"created"`
+
+	Decision PolicyDecision `json:"decision"`
+
+	// Hostname of the IRMA server of the session, i.e. the server that the app connects to, which
+	// is not necessarily the requestor itself: requestors may share an IRMA server. The requestor
+	// name shown in sessions is not used, as it can be chosen by the server. Empty matches all
+	// sessions; other values only match sessions with an IRMA server whose hostname is
+	// authenticated, i.e. sessions over HTTPS using the transport of the client, and so never
+	// match manual sessions or sessions over other transports such as local sessions.
+	Requestor string `json:"requestor,omitempty"`
+	// The actions of the sessions; empty matches disclosure sessions only
+	Actions []irma.Action `json:"actions,omitempty"`
+	// Attribute types, or credential types meaning all of their attributes. Deny and ask rules
+	// apply if any attribute of these types is requested; allow rules apply if the session can be
+	// performed disclosing only attributes of these types, which are then disclosed.
+	// Empty matches all sessions.
+	Attributes []irma.AttributeTypeIdentifier `json:"attributes,omitempty"`
+	// Time after which the rule no longer applies; zero means never
+	Expires irma.Timestamp `json:"expires,omitempty"`
+}
+
+// PolicyHandler can optionally be implemented by a Handler to be informed when a session is
+// consented to or rejected by a PolicyRule instead of by the user. For rejected sessions
+// the choice is nil.
+type PolicyHandler interface {
+	PolicyApplied(rule *PolicyRule, choice *irma.DisclosureChoice)
+}
+
+// PolicyRules returns the policy rules of the selected profile.
+func (client *Client) PolicyRules() []*PolicyRule {
+	rules := make([]*PolicyRule, 0, len(client.policy))
+	for _, rule := range client.policy {
+		r := *rule
+		rules = append(rules, &r)
+	}
+	return rules
+}
+
+// AddPolicyRule adds the rule to the policy of the selected profile, returning it with its new ID.
+func (client *Client) AddPolicyRule(rule PolicyRule) (*PolicyRule, error) {
+	switch rule.Decision {
+	case PolicyAllow, PolicyDeny, PolicyAsk:
+	default:
+		return nil, errors.Errorf("Unknown policy decision %s", rule.Decision)
+	}
+	for _, action := range rule.Actions {
+		switch action {
+		case irma.ActionDisclosing, irma.ActionSigning, irma.ActionIssuing:
+		default:
+			return nil, errors.Errorf("Unsupported action %s in policy rule", action)
+		}
+	}
+	for _, attr := range rule.Attributes {
+		if client.Configuration.AttributeTypes[attr] == nil &&
+			(!attr.IsCredential() || client.Configuration.CredentialTypes[attr.CredentialTypeIdentifier()] == nil) {
+			return nil, errors.Errorf("Unknown attribute type %s in policy rule", attr)
+		}
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	rule.ID = hex.EncodeToString(id)
+	rule.Created = irma.Timestamp(time.Now())
+
+	policy := append(client.PolicyRules(), &rule)
+	if err := client.storage.StorePolicy(policy); err != nil {
+		return nil, err
+	}
+	client.policy = policy
+	r := rule
+	return &r, nil
+}
+
+// RemovePolicyRule removes the rule with the specified ID from the policy of the selected profile.
+func (client *Client) RemovePolicyRule(id string) error {
+	policy := make([]*PolicyRule, 0, len(client.policy))
+	for _, rule := range client.policy {
+		if rule.ID != id {
+			policy = append(policy, rule)
+		}
+	}
+	if len(policy) == len(client.policy) {
+		return errors.Errorf("No policy rule with ID %s", id)
+	}
+	if err := client.storage.StorePolicy(policy); err != nil {
+		return err
+	}
+	client.policy = policy
+	return nil
+}
+
+// applyPolicy returns the policy rule that decides about the session, if any, along with the
+// attributes to disclose if the rule allows the session.
+func (client *Client) applyPolicy(session *session, candidates [][][]*irma.AttributeIdentifier) (*PolicyRule, *irma.DisclosureChoice) {
+	now := time.Now()
+	var ask, allow *PolicyRule
+	var choice *irma.DisclosureChoice
+	for _, rule := range client.policy {
+		if !rule.matches(session, now) {
+			continue
+		}
+		switch rule.Decision {
+		case PolicyDeny:
+			if rule.requests(candidates) {
+				return rule, nil
+			}
+		case PolicyAsk:
+			if ask == nil && rule.requests(candidates) {
+				ask = rule
+			}
+		case PolicyAllow:
+			if allow == nil {
+				if c := rule.choose(candidates); c != nil {
+					allow, choice = rule, c
+				}
+			}
+		}
+	}
+	if ask != nil || allow == nil {
+		return nil, nil
+	}
+	return allow, choice
+}
+
+// matches returns whether the rule matches the IRMA server hostname and action of the session
+// at the specified time.
+func (rule *PolicyRule) matches(session *session, now time.Time) bool {
+	if !time.Time(rule.Expires).IsZero() && now.After(time.Time(rule.Expires)) {
+		return false
+	}
+	actions := rule.Actions
+	if len(actions) == 0 {
+		actions = []irma.Action{irma.ActionDisclosing}
+	}
+	var found bool
+	for _, action := range actions {
+		found = found || action == session.Action
+	}
+	if !found {
+		return false
+	}
+	return rule.Requestor == "" || (session.hostAuthenticated && rule.Requestor == session.Hostname)
+}
+
+// requests returns whether any of the attribute types of the rule is among the candidates,
+// or true if the rule has no attribute types.
+func (rule *PolicyRule) requests(candidates [][][]*irma.AttributeIdentifier) bool {
+	if len(rule.Attributes) == 0 {
+		return true
+	}
+	for _, discon := range candidates {
+		for _, con := range discon {
+			for _, attr := range con {
+				if rule.covers(attr) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// choose returns, for each disjunction, the best ranked of the candidates consisting only of
+// attributes of the types of the rule, or nil if there is no such candidate for some disjunction.
+func (rule *PolicyRule) choose(candidates [][][]*irma.AttributeIdentifier) *irma.DisclosureChoice {
+	choice := &irma.DisclosureChoice{Attributes: make([][]*irma.AttributeIdentifier, 0, len(candidates))}
+	for _, discon := range candidates {
+		var found bool
+		for _, con := range discon {
+			allowed := true
+			for _, attr := range con {
+				allowed = allowed && (len(rule.Attributes) == 0 || rule.covers(attr))
+			}
+			if allowed {
+				choice.Attributes = append(choice.Attributes, con)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	return choice
+}
+
+// covers returns whether the attribute is of one of the attribute types of the rule,
+// or of one of its credential types.
+func (rule *PolicyRule) covers(attr *irma.AttributeIdentifier) bool {
+	for _, typ := range rule.Attributes {
+		if typ == attr.Type || (typ.IsCredential() && typ.CredentialTypeIdentifier() == attr.Type.CredentialTypeIdentifier()) {
+			return true
+		}
+	}
+	return false
+}
+
+// StorePolicy stores the policy rules of the profile.
+func (s *storage) StorePolicy(policy []*PolicyRule) error {
+	return s.store(userdataBucket, policyKey, policy)
+}
+
+// LoadPolicy loads the policy rules of the profile.
+func (s *storage) LoadPolicy() ([]*PolicyRule, error) {
+	policy := []*PolicyRule{}
+	if _, err := s.load(userdataBucket, policyKey, &policy, ""); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
@@ -0,0 +1,278 @@
+package irmaclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/fs"
+	"go.etcd.io/bbolt"
+)
+
+// This file contains the profiles of the client: independent identities, each having its own
+// secret key, credentials, logs and keyshare enrollments, of which one is selected at a time.
+// Sessions use the selected profile; the irma_configuration and the preferences are shared by
+// all profiles. The default profile is stored in the database in the storage folder, along with
+// the preferences and the list of profiles; each other profile has its own database in a
+// subfolder of profilesDir.
+
+// DefaultProfile is the ID of the profile that every client has, which can't be deleted.
+const DefaultProfile = "default"
+
+// Folder within the storage folder containing the storage folders of the profiles
+// other than the default profile
+const profilesDir = "profiles"
+
+// Keys of the records in the userdata bucket of the default profile
+const (
+	profilesKey        = "profiles"
+	selectedProfileKey = "profile"
+)
+
+// Profile is an identity of the client, having its own secret key, credentials, logs and
+// keyshare enrollments.
+type Profile struct {
+	ID      string         `json:"id"`
+	Name    string         `json:"name"`
+	Created irma.Timestamp `json:"created"`
+}
+
+// Profiles returns the profiles of the client, in the order in which they were created.
+func (client *Client) Profiles() []*Profile {
+	profiles := make([]*Profile, 0, len(client.profiles))
+	for _, profile := range client.profiles {
+		p := *profile
+		profiles = append(profiles, &p)
+	}
+	return profiles
+}
+
+// SelectedProfile returns the ID of the profile that is currently used.
+func (client *Client) SelectedProfile() string {
+	return client.profile
+}
+
+// CreateProfile creates a new profile with the specified name, with a new secret key and
+// without credentials, logs or keyshare enrollments. The selected profile does not change.
+func (client *Client) CreateProfile(name string) (*Profile, error) {
+	if name == "" {
+		return nil, errors.New("Profile name must not be empty")
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	profile := &Profile{ID: hex.EncodeToString(id), Name: name, Created: irma.Timestamp(time.Now())}
+	if err := fs.EnsureDirectoryExists(client.profilePath(profile.ID)); err != nil {
+		return nil, err
+	}
+
+	// Create the database of the profile, containing its new secret key
+	s, err := client.openProfileStorage(profile.ID)
+	if err == nil {
+		if _, err = s.LoadSecretKey(); err == nil {
+			err = s.Close()
+		} else {
+			_ = s.Close()
+		}
+	}
+	if err == nil {
+		err = client.defaultStorage.StoreProfiles(append(client.profiles, profile), client.profile)
+	}
+	if err != nil {
+		_ = client.removeProfileStorage(profile.ID)
+		return nil, err
+	}
+
+	client.profiles = append(client.profiles, profile)
+	p := *profile
+	return &p, nil
+}
+
+// SelectProfile switches to the specified profile, loading its secret key, credentials and
+// keyshare enrollments, after which the ClientHandler is informed that the attributes have changed.
+// It returns an error while sessions are in progress.
+func (client *Client) SelectProfile(id string) error {
+	changed, err := client.selectProfile(id)
+	if err != nil || !changed {
+		return err
+	}
+	client.handler.UpdateAttributes()
+	return nil
+}
+
+// selectProfile switches to the specified profile, returning whether it was not already selected.
+// Sessions cannot start meanwhile, as they register themselves using sessionStarted.
+func (client *Client) selectProfile(id string) (bool, error) {
+	client.sessionsLock.Lock()
+	defer client.sessionsLock.Unlock()
+	if len(client.sessions) > 0 {
+		return false, errors.New("Cannot switch profiles while sessions are in progress")
+	}
+	if client.profileByID(id) == nil {
+		return false, errors.Errorf("No profile with ID %s", id)
+	}
+	if id == client.profile {
+		return false, nil
+	}
+	s, err := client.openProfileStorage(id)
+	if err != nil {
+		return false, err
+	}
+
+	old, oldID := client.storage, client.profile
+	client.storage, client.profile = s, id
+	if err = client.loadProfile(); err == nil {
+		err = client.defaultStorage.StoreProfiles(client.profiles, id)
+	}
+	if err != nil {
+		if s != client.defaultStorage {
+			_ = s.Close()
+		}
+		client.storage, client.profile = old, oldID
+		if lerr := client.loadProfile(); lerr != nil {
+			irma.Logger.Warn(errors.WrapPrefix(lerr, "Failed to reload profile "+oldID, 0).Error())
+		}
+		return false, err
+	}
+
+	if old != client.defaultStorage {
+		if err = old.Close(); err != nil {
+			irma.Logger.Warn(errors.WrapPrefix(err, "Failed to close storage of profile "+oldID, 0).Error())
+		}
+	}
+	return true, nil
+}
+
+// DeleteProfile deletes the specified profile, which must not be the default profile nor the
+// selected profile, along with its secret key, credentials and logs. Its enrollments at keyshare
+// servers are not removed from those servers.
+func (client *Client) DeleteProfile(id string) error {
+	switch {
+	case id == DefaultProfile:
+		return errors.New("Can't delete default profile")
+	case id == client.profile:
+		return errors.New("Can't delete selected profile")
+	case client.profileByID(id) == nil:
+		return errors.Errorf("No profile with ID %s", id)
+	}
+
+	profiles := make([]*Profile, 0, len(client.profiles)-1)
+	for _, profile := range client.profiles {
+		if profile.ID != id {
+			profiles = append(profiles, profile)
+		}
+	}
+	if err := client.defaultStorage.StoreProfiles(profiles, client.profile); err != nil {
+		return err
+	}
+	client.profiles = profiles
+	return client.removeProfileStorage(id)
+}
+
+// loadProfiles loads the list of profiles, and selects the profile that was last selected.
+func (client *Client) loadProfiles() error {
+	var (
+		id  string
+		err error
+	)
+	if client.profiles, id, err = client.defaultStorage.LoadProfiles(); err != nil {
+		return err
+	}
+	if client.profileByID(id) == nil {
+		id = DefaultProfile
+	}
+	if client.storage, err = client.openProfileStorage(id); err != nil {
+		return err
+	}
+	client.profile = id
+	return client.loadProfile()
+}
+
+func (client *Client) profileByID(id string) *Profile {
+	for _, profile := range client.profiles {
+		if profile.ID == id {
+			return profile
+		}
+	}
+	return nil
+}
+
+func (client *Client) profilePath(id string) string {
+	return filepath.Join(client.defaultStorage.storagePath, profilesDir, id)
+}
+
+// openProfileStorage opens the storage of the specified profile, encrypting it if necessary.
+func (client *Client) openProfileStorage(id string) (*storage, error) {
+	if id == DefaultProfile {
+		return client.defaultStorage, nil
+	}
+	s := &storage{
+		storagePath:      client.profilePath(id),
+		Configuration:    client.Configuration,
+		key:              client.storageKey,
+		plaintextAllowed: true,
+	}
+	if err := s.EnsureStorageExists(); err != nil {
+		return nil, err
+	}
+	if err := client.encryptStorage(s); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// removeProfileStorage overwrites and removes the database of the profile, and its folder.
+func (client *Client) removeProfileStorage(id string) error {
+	path := client.profilePath(id)
+	for _, file := range []string{databaseFile, databaseFile + compactedFileSuffix, databaseFile + oldFileSuffix} {
+		if err := overwriteAndRemove(filepath.Join(path, file)); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(path)
+}
+
+// closeStorage closes the databases of the selected and the default profile.
+func (client *Client) closeStorage() {
+	if client.storage != nil && client.storage != client.defaultStorage && client.storage.db != nil {
+		_ = client.storage.Close()
+	}
+	if client.defaultStorage != nil && client.defaultStorage.db != nil {
+		_ = client.defaultStorage.Close()
+	}
+}
+
+// LoadProfiles returns the list of profiles, which always contains the default profile, and
+// the ID of the selected profile.
+func (s *storage) LoadProfiles() (profiles []*Profile, selected string, err error) {
+	err = s.view(func(tx *bbolt.Tx) error {
+		if _, err := s.txLoad(tx, userdataBucket, profilesKey, &profiles, ""); err != nil {
+			return err
+		}
+		_, err := s.txLoad(tx, userdataBucket, selectedProfileKey, &selected, "")
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if len(profiles) == 0 {
+		profiles = []*Profile{{ID: DefaultProfile}}
+	}
+	return profiles, selected, nil
+}
+
+// StoreProfiles stores the list of profiles and the ID of the selected profile.
+func (s *storage) StoreProfiles(profiles []*Profile, selected string) error {
+	return s.update(func(tx *bbolt.Tx) error {
+		if err := s.txStore(tx, userdataBucket, profilesKey, profiles); err != nil {
+			return err
+		}
+		return s.txStore(tx, userdataBucket, selectedProfileKey, selected)
+	})
+}
@@ -1,8 +1,10 @@
 package irmaclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/url"
 	"reflect"
 	"runtime/debug"
@@ -73,6 +75,7 @@ type session struct {
 	ServerName irma.TranslatedString
 
 	choice      *irma.DisclosureChoice
+	policyRule  string // ID of the policy rule that consented to the session, if any
 	attrIndices irma.DisclosedAttributeIndices
 	client      *Client
 	request     irma.SessionRequest
@@ -85,10 +88,17 @@ type session struct {
 	// State for signature sessions
 	timestamp *atum.Timestamp
 
+	// Cancelled when the session is finished or dismissed, aborting requests that are still in flight
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+
 	// These are empty on manual sessions
 	Hostname  string
 	ServerURL string
-	transport *irma.HTTPTransport
+	transport irma.Transport
+	// Whether the session is with the server at Hostname, as the session uses the transport of
+	// the client over HTTPS; not so for sessions over other transports such as local sessions
+	hostAuthenticated bool
 }
 
 // We implement the handler for the keyshare protocol
@@ -144,6 +154,8 @@ func (client *Client) newManualSession(request irma.SessionRequest, handler Hand
 		Version: minVersion,
 		request: request,
 	}
+	client.sessionStarted(session)
+	session.ctx, session.cancelCtx = context.WithCancel(context.Background())
 	session.Handler.StatusUpdate(session.Action, irma.StatusManualStarted)
 
 	session.processSessionInfo()
@@ -153,11 +165,12 @@ func (client *Client) newManualSession(request irma.SessionRequest, handler Hand
 func (client *Client) newSchemeSession(qr *irma.SchemeManagerRequest, handler Handler) SessionDismisser {
 	session := &session{
 		ServerURL: qr.URL,
-		transport: irma.NewHTTPTransport(qr.URL),
+		transport: client.transport(qr.URL),
 		Action:    irma.ActionSchemeManager,
 		Handler:   handler,
 		client:    client,
 	}
+	session.ctx, session.cancelCtx = context.WithCancel(context.Background())
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 
 	go session.managerSession()
@@ -168,7 +181,7 @@ func (client *Client) newSchemeSession(qr *irma.SchemeManagerRequest, handler Ha
 func (client *Client) newQrSession(qr *irma.Qr, handler Handler) SessionDismisser {
 	if qr.Type == irma.ActionRedirect {
 		newqr := &irma.Qr{}
-		if err := irma.NewHTTPTransport("").Post(qr.URL, newqr, struct{}{}); err != nil {
+		if err := client.transport("").PostContext(context.Background(), qr.URL, newqr, struct{}{}); err != nil {
 			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorTransport, Err: errors.Wrap(err, 0)})
 			return nil
 		}
@@ -179,15 +192,46 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) SessionDismisse
 		return client.newQrSession(newqr, handler)
 	}
 
+	return client.newSessionWithTransport(qr, client.transport(qr.URL), strings.HasPrefix(qr.URL, "https://"), handler)
+}
+
+// NewLocalSession starts a new IRMA session with a server over the specified local byte stream,
+// such as a Unix socket or a pipe (see irma.LocalTransport). The server is expected to send the
+// session QR as the first frame over the stream, after which the session proceeds as usual.
+func (client *Client) NewLocalSession(conn io.ReadWriter, handler Handler) SessionDismisser {
+	qr := &irma.Qr{}
+	if err := irma.ReadFrame(conn, qr); err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorTransport, Err: errors.Wrap(err, 0)})
+		return nil
+	}
+	if err := qr.Validate(); err != nil || qr.Type == irma.ActionRedirect {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: errors.New("invalid session QR")})
+		return nil
+	}
+	return client.NewSessionWithTransport(qr, irma.NewLocalTransport(conn, qr.URL), handler)
+}
+
+// NewSessionWithTransport starts a new interactive IRMA session with the server from the QR, sending
+// the protocol messages over the specified transport instead of the transport of the Client.
+// As the transport need not connect to the server from the QR, policy rules for specific
+// requestors do not apply to the session.
+func (client *Client) NewSessionWithTransport(qr *irma.Qr, transport irma.Transport, handler Handler) SessionDismisser {
+	return client.newSessionWithTransport(qr, transport, false, handler)
+}
+
+func (client *Client) newSessionWithTransport(qr *irma.Qr, transport irma.Transport, hostAuthenticated bool, handler Handler) SessionDismisser {
 	u, _ := url.ParseRequestURI(qr.URL) // Qr validator already checked this for errors
 	session := &session{
-		ServerURL: qr.URL,
-		Hostname:  u.Hostname(),
-		transport: irma.NewHTTPTransport(qr.URL),
-		Action:    irma.Action(qr.Type),
-		Handler:   handler,
-		client:    client,
+		ServerURL:         qr.URL,
+		Hostname:          u.Hostname(),
+		transport:         transport,
+		hostAuthenticated: hostAuthenticated,
+		Action:            irma.Action(qr.Type),
+		Handler:           handler,
+		client:            client,
 	}
+	client.sessionStarted(session)
+	session.ctx, session.cancelCtx = context.WithCancel(context.Background())
 
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 	min := minVersion
@@ -227,7 +271,7 @@ func (session *session) getSessionInfo() {
 	session.Handler.StatusUpdate(session.Action, irma.StatusCommunicating)
 
 	// Get the first IRMA protocol message and parse it
-	err := session.transport.Get("", session.request)
+	err := session.transport.GetContext(session.ctx, "", session.request)
 	if err != nil {
 		session.fail(err.(*irma.SessionError))
 		return
@@ -316,6 +360,12 @@ func (session *session) processSessionInfo() {
 		session.Handler.ClientReturnURLSet(session.request.Base().ClientReturnURL)
 	}
 
+	// Consent to or reject the session without asking the user if a policy rule decides about it
+	if rule, choice := session.client.applyPolicy(session, candidates); rule != nil {
+		session.applyPolicyRule(rule, choice, callback)
+		return
+	}
+
 	switch session.Action {
 	case irma.ActionDisclosing:
 		session.Handler.RequestVerificationPermission(
@@ -331,6 +381,21 @@ func (session *session) processSessionInfo() {
 	}
 }
 
+// applyPolicyRule consents to or rejects the session according to the policy rule.
+func (session *session) applyPolicyRule(rule *PolicyRule, choice *irma.DisclosureChoice, callback PermissionHandler) {
+	if h, ok := session.Handler.(PolicyHandler); ok {
+		h.PolicyApplied(rule, choice)
+	}
+	if rule.Decision == PolicyDeny {
+		irma.Logger.Infof("Session with %s rejected by policy rule %s", session.ServerName["en"], rule.ID)
+		callback(false, nil)
+		return
+	}
+	irma.Logger.Infof("Session with %s consented to by policy rule %s", session.ServerName["en"], rule.ID)
+	session.policyRule = rule.ID
+	callback(true, choice)
+}
+
 // doSession performs the session: it computes all proofs of knowledge, constructs credentials in case of issuance,
 // asks for the pin and performs the keyshare session, and finishes the session by either POSTing the result to the
 // API server or returning it to the caller (in case of interactive and noninteractive sessions, respectively).
@@ -365,6 +430,8 @@ func (session *session) doSession(proceed bool) {
 			session.client.keyshareServers,
 			session.issuerProofNonce,
 			session.timestamp,
+			session.client.transport,
+			session.ctx,
 		)
 	}
 }
@@ -394,7 +461,7 @@ func (session *session) sendResponse(message interface{}) {
 
 		if session.IsInteractive() {
 			var response disclosureResponse
-			if err = session.transport.Post("proofs", &response, irmaSignature); err != nil {
+			if err = session.transport.PostContext(session.ctx, "proofs", &response, irmaSignature); err != nil {
 				session.fail(err.(*irma.SessionError))
 				return
 			}
@@ -416,7 +483,7 @@ func (session *session) sendResponse(message interface{}) {
 		}
 		if session.IsInteractive() {
 			var response disclosureResponse
-			if err = session.transport.Post("proofs", &response, message); err != nil {
+			if err = session.transport.PostContext(session.ctx, "proofs", &response, message); err != nil {
 				session.fail(err.(*irma.SessionError))
 				return
 			}
@@ -432,7 +499,7 @@ func (session *session) sendResponse(message interface{}) {
 		}
 	case irma.ActionIssuing:
 		response := []*gabi.IssueSignatureMessage{}
-		if err = session.transport.Post("commitments", &response, message); err != nil {
+		if err = session.transport.PostContext(session.ctx, "commitments", &response, message); err != nil {
 			session.fail(err.(*irma.SessionError))
 			return
 		}
@@ -450,10 +517,15 @@ func (session *session) sendResponse(message interface{}) {
 	if err = session.client.storage.AddLogEntry(log); err != nil {
 		irma.Logger.Warn(errors.WrapPrefix(err, "Failed to write log entry", 0).ErrorStack())
 	}
+	if err = session.client.pruneLogs(false); err != nil {
+		irma.Logger.Warn(errors.WrapPrefix(err, "Failed to delete old log entries", 0).ErrorStack())
+	}
 	if session.Action == irma.ActionIssuing {
 		session.client.handler.UpdateAttributes()
 	}
 	session.done = true
+	session.client.sessionEnded(session)
+	session.cancelCtx()
 	session.Handler.Success(string(messageJson))
 }
 
@@ -475,7 +547,12 @@ func (session *session) managerSession() {
 			session.Handler.Cancelled() // No need to DELETE session here
 			return
 		}
-		if err := session.client.Configuration.InstallSchemeManager(manager, nil); err != nil {
+		pk, err := session.client.Configuration.DownloadSchemePublicKey(manager)
+		if err != nil {
+			session.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
+			return
+		}
+		if err := session.client.Configuration.InstallSchemeManager(manager, pk); err != nil {
 			session.Handler.Failure(&irma.SessionError{ErrorType: irma.ErrorConfigurationDownload, Err: err})
 			return
 		}
@@ -633,10 +710,13 @@ func panicToError(e interface{}) *irma.SessionError {
 // Idempotently send DELETE to remote server, returning whether or not we did something
 func (session *session) delete() bool {
 	if !session.done {
+		session.done = true
+		session.client.sessionEnded(session)
+		session.cancelCtx()
 		if session.IsInteractive() {
-			session.transport.Delete()
+			// session.ctx is cancelled now, so the DELETE gets a context of its own
+			_ = session.transport.DeleteContext(context.Background())
 		}
-		session.done = true
 		return true
 	}
 	return false
@@ -1,15 +1,21 @@
 package irmaclient
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/encryption"
 	"github.com/privacybydesign/irmago/internal/fs"
 	"go.etcd.io/bbolt"
 )
@@ -17,14 +23,27 @@ import (
 // This file contains the storage struct and its methods,
 // and some general filesystem functions.
 
-// Storage provider for a Client
+// Storage provider for a Client. Everything is stored in a bbolt database, so that changes
+// affecting multiple records (e.g. adding a credential) can be done in a single transaction.
 type storage struct {
 	storagePath   string
 	db            *bbolt.DB
 	Configuration *irma.Configuration
+
+	// Held for reading during each transaction, and for writing while db is closed or reopened,
+	// so that Compact and Close can be called while other goroutines use the storage
+	dbLock sync.RWMutex
+
+	// If set, all records except the updates record are encrypted with this key using
+	// authenticated encryption, bound to the name of the record
+	key []byte
+	// Whether plaintext records may be read despite key being set, i.e. before the storage
+	// has been converted by encryptPlaintext
+	plaintextAllowed bool
 }
 
-// Filenames in which we store stuff
+// Filenames in which we stored stuff before it was moved into the database by clientUpdates;
+// when a record is absent in the database, it is still read from its file if present.
 const (
 	skFile          = "sk"
 	attributesFile  = "attrs"
@@ -33,13 +52,30 @@ const (
 	logsFile        = "logs"
 	preferencesFile = "preferences"
 	signaturesDir   = "sigs"
+	encryptingFile  = "encrypting" // Present while encryptPlaintext had not finished, before the database was used
 
 	databaseFile = "db"
+	// Suffixes of the files used while compacting the database
+	compactedFileSuffix = ".compacted"
+	oldFileSuffix       = ".old"
 )
 
 // Bucketnames bbolt
 const (
-	logsBucket = "logs"
+	userdataBucket   = "userdata"   // Keyed by the constants below
+	signaturesBucket = "signatures" // Keyed by signatureKey
+	logsBucket       = "logs"       // Keyed by the log entry ID
+)
+
+// Keys of the records in the userdata bucket
+const (
+	skKey          = "sk"
+	attributesKey  = "attrs"
+	kssKey         = "kss"
+	updatesKey     = "updates"
+	preferencesKey = "preferences"
+	compactKey     = "compact"    // Present if records were deleted since the database was last compacted
+	encryptingKey  = "encrypting" // Present (unencrypted) while encryptPlaintext has not finished
 )
 
 func (s *storage) path(p string) string {
@@ -56,14 +92,114 @@ func (s *storage) EnsureStorageExists() error {
 	if err = fs.AssertPathExists(s.storagePath); err != nil {
 		return err
 	}
-	if err = fs.EnsureDirectoryExists(s.path(signaturesDir)); err != nil {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	return s.openDatabase()
+}
+
+// openDatabase opens the database, first finishing or undoing a compaction that was interrupted.
+// Requires s.dbLock.
+func (s *storage) openDatabase() error {
+	path := s.path(databaseFile)
+	exists, err := fs.PathExists(path)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		// Compaction was interrupted after moving the old database away
+		if err = os.Rename(path+oldFileSuffix, path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err = os.Remove(path + compactedFileSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = s.removeOldDatabase(); err != nil {
 		return err
 	}
-	s.db, err = bbolt.Open(s.path(databaseFile), 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	s.db, err = bbolt.Open(path, 0600, &bbolt.Options{Timeout: 1 * time.Second})
 	return err
 }
 
-func (s *storage) load(dest interface{}, path string) (err error) {
+// view runs fn in a read-only transaction; see bbolt.DB.View.
+func (s *storage) view(fn func(tx *bbolt.Tx) error) error {
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+	return s.db.View(fn)
+}
+
+// update runs fn in a read-write transaction; see bbolt.DB.Update.
+func (s *storage) update(fn func(tx *bbolt.Tx) error) error {
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+	return s.db.Update(fn)
+}
+
+// Close closes the database, waiting for running transactions to finish.
+func (s *storage) Close() error {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	return s.db.Close()
+}
+
+// txStore stores the contents under the key in the bucket.
+func (s *storage) txStore(tx *bbolt.Tx, bucket, key string, contents interface{}) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	bts, err := json.Marshal(contents)
+	if err != nil {
+		return err
+	}
+	// The updates record is never encrypted: it contains nothing sensitive, and it must be
+	// readable before the update that encrypts the storage has run
+	if bucket != userdataBucket || key != updatesKey {
+		if bts, err = s.encrypt(bts, recordName(bucket, []byte(key))); err != nil {
+			return err
+		}
+	}
+	return b.Put([]byte(key), bts)
+}
+
+// txLoad loads the record under the key in the bucket into dest, if present. Otherwise,
+// it is loaded from the file in which it was stored before, if present.
+func (s *storage) txLoad(tx *bbolt.Tx, bucket, key string, dest interface{}, file string) (found bool, err error) {
+	var bts []byte
+	if b := tx.Bucket([]byte(bucket)); b != nil {
+		bts = b.Get([]byte(key))
+	}
+	if bts == nil {
+		if file == "" {
+			return false, nil
+		}
+		return s.loadFile(dest, file)
+	}
+	if bucket != userdataBucket || key != updatesKey {
+		if bts, err = s.decrypt(bts, recordName(bucket, []byte(key))); err != nil {
+			return false, err
+		}
+	}
+	return true, json.Unmarshal(bts, dest)
+}
+
+func (s *storage) store(bucket, key string, contents interface{}) error {
+	return s.update(func(tx *bbolt.Tx) error {
+		return s.txStore(tx, bucket, key, contents)
+	})
+}
+
+func (s *storage) load(bucket, key string, dest interface{}, file string) (found bool, err error) {
+	err = s.view(func(tx *bbolt.Tx) error {
+		found, err = s.txLoad(tx, bucket, key, dest, file)
+		return err
+	})
+	return
+}
+
+// loadFile loads the contents of the file in which a record was stored before it was moved
+// into the database, if present.
+func (s *storage) loadFile(dest interface{}, path string) (found bool, err error) {
 	exists, err := fs.PathExists(s.path(path))
 	if err != nil || !exists {
 		return
@@ -72,39 +208,88 @@ func (s *storage) load(dest interface{}, path string) (err error) {
 	if err != nil {
 		return
 	}
-	return json.Unmarshal(bytes, dest)
+	if path != updatesFile {
+		if bytes, err = s.decrypt(bytes, filepath.ToSlash(path)); err != nil {
+			return
+		}
+	}
+	return true, json.Unmarshal(bytes, dest)
 }
 
-func (s *storage) store(contents interface{}, file string) error {
-	bts, err := json.Marshal(contents)
-	if err != nil {
-		return err
+// encrypt encrypts the record if the storage is encrypted.
+func (s *storage) encrypt(record []byte, name string) ([]byte, error) {
+	if s.key == nil {
+		return record, nil
+	}
+	return encryption.EncryptRecord(s.key, record, name)
+}
+
+// decrypt decrypts the record if it is encrypted, checking that this is the case if the storage
+// is encrypted.
+func (s *storage) decrypt(record []byte, name string) ([]byte, error) {
+	if !encryption.IsEncryptedRecord(record) {
+		if s.key != nil && !s.plaintextAllowed {
+			return nil, errors.Errorf("record %s in encrypted storage is not encrypted", name)
+		}
+		return record, nil
 	}
-	return fs.SaveFile(s.path(file), bts)
+	if s.key == nil {
+		return nil, errors.New("storage is encrypted, but no storage key was specified")
+	}
+	return encryption.DecryptRecord(s.key, record, name)
+}
+
+// recordName returns the name to which the encryption of a database record is bound.
+func recordName(bucket string, key []byte) string {
+	return bucket + "/" + hex.EncodeToString(key)
 }
 
 func (s *storage) signatureFilename(attrs *irma.AttributeList) string {
-	// We take the SHA256 hash over all attributes as the filename for the signature.
-	// This means that the signatures of two credentials that have identical attributes
-	// will be written to the same file, one overwriting the other - but that doesn't
-	// matter, because either one of the signatures is valid over both attribute lists,
-	// so keeping one of them suffices.
-	return filepath.Join(signaturesDir, attrs.Hash())
+	return filepath.Join(signaturesDir, s.signatureKey(attrs.Hash()))
+}
+
+// signatureKey returns the key of the signature of the credential having the specified
+// AttributeList.Hash() in the signatures bucket. In encrypted storage this is a keyed hash,
+// as the plain hash of the attributes would allow guessing attribute values.
+func (s *storage) signatureKey(hash string) string {
+	if s.key == nil {
+		return hash
+	}
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte("signatures"))
+	mac = hmac.New(sha256.New, mac.Sum(nil))
+	mac.Write([]byte(hash))
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
-func (s *storage) DeleteSignature(attrs *irma.AttributeList) error {
-	return os.Remove(s.path(s.signatureFilename(attrs)))
+func (s *storage) TxDeleteSignature(tx *bbolt.Tx, attrs *irma.AttributeList) error {
+	b := tx.Bucket([]byte(signaturesBucket))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(s.signatureKey(attrs.Hash())))
 }
 
-func (s *storage) StoreSignature(cred *credential) error {
-	return s.store(cred.Signature, s.signatureFilename(cred.AttributeList()))
+func (s *storage) TxStoreSignature(tx *bbolt.Tx, cred *credential) error {
+	// We take the SHA256 hash over all attributes as the key for the signature.
+	// This means that the signatures of two credentials that have identical attributes
+	// will be written to the same key, one overwriting the other - but that doesn't
+	// matter, because either one of the signatures is valid over both attribute lists,
+	// so keeping one of them suffices.
+	return s.txStore(tx, signaturesBucket, s.signatureKey(cred.AttributeList().Hash()), cred.Signature)
 }
 
 func (s *storage) StoreSecretKey(sk *secretKey) error {
-	return s.store(sk, skFile)
+	return s.store(userdataBucket, skKey, sk)
 }
 
 func (s *storage) StoreAttributes(attributes map[irma.CredentialTypeIdentifier][]*irma.AttributeList) error {
+	return s.update(func(tx *bbolt.Tx) error {
+		return s.TxStoreAttributes(tx, attributes)
+	})
+}
+
+func (s *storage) TxStoreAttributes(tx *bbolt.Tx, attributes map[irma.CredentialTypeIdentifier][]*irma.AttributeList) error {
 	temp := []*irma.AttributeList{}
 	for _, attrlistlist := range attributes {
 		for _, attrlist := range attrlistlist {
@@ -112,19 +297,15 @@ func (s *storage) StoreAttributes(attributes map[irma.CredentialTypeIdentifier][
 		}
 	}
 
-	return s.store(temp, attributesFile)
+	return s.txStore(tx, userdataBucket, attributesKey, temp)
 }
 
 func (s *storage) StoreKeyshareServers(keyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer) error {
-	return s.store(keyshareServers, kssFile)
-}
-
-func (s *storage) StoreLogs(logs []*LogEntry) error {
-	return s.store(logs, logsFile)
+	return s.store(userdataBucket, kssKey, keyshareServers)
 }
 
 func (s *storage) AddLogEntry(entry *LogEntry) error {
-	return s.db.Update(func(tx *bbolt.Tx) error {
+	return s.update(func(tx *bbolt.Tx) error {
 		return s.TxAddLogEntry(tx, entry)
 	})
 }
@@ -141,8 +322,17 @@ func (s *storage) TxAddLogEntry(tx *bbolt.Tx, entry *LogEntry) error {
 	}
 	k := s.logEntryKeyToBytes(entry.ID)
 	v, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if v, err = s.encrypt(v, recordName(logsBucket, k)); err != nil {
+		return err
+	}
 
-	return b.Put(k, v)
+	if err = b.Put(k, v); err != nil {
+		return err
+	}
+	return s.txIndexLogEntry(tx, entry, k)
 }
 
 func (s *storage) logEntryKeyToBytes(id uint64) []byte {
@@ -152,22 +342,22 @@ func (s *storage) logEntryKeyToBytes(id uint64) []byte {
 }
 
 func (s *storage) StorePreferences(prefs Preferences) error {
-	return s.store(prefs, preferencesFile)
+	return s.store(userdataBucket, preferencesKey, prefs)
 }
 
 func (s *storage) StoreUpdates(updates []update) (err error) {
-	return s.store(updates, updatesFile)
+	return s.store(userdataBucket, updatesKey, updates)
 }
 
 func (s *storage) LoadSignature(attrs *irma.AttributeList) (signature *gabi.CLSignature, err error) {
-	sigpath := s.signatureFilename(attrs)
-	if err := fs.AssertPathExists(s.path(sigpath)); err != nil {
-		return nil, err
-	}
 	signature = new(gabi.CLSignature)
-	if err := s.load(signature, sigpath); err != nil {
+	found, err := s.load(signaturesBucket, s.signatureKey(attrs.Hash()), signature, s.signatureFilename(attrs))
+	if err != nil {
 		return nil, err
 	}
+	if !found {
+		return nil, errors.Errorf("Signature of credential with attributes %s not found", attrs.Hash())
+	}
 	return signature, nil
 }
 
@@ -176,7 +366,7 @@ func (s *storage) LoadSignature(attrs *irma.AttributeList) (signature *gabi.CLSi
 func (s *storage) LoadSecretKey() (*secretKey, error) {
 	var err error
 	sk := &secretKey{}
-	if err = s.load(sk, skFile); err != nil {
+	if _, err = s.load(userdataBucket, skKey, sk, skFile); err != nil {
 		return nil, err
 	}
 	if sk.Key != nil {
@@ -195,7 +385,7 @@ func (s *storage) LoadSecretKey() (*secretKey, error) {
 func (s *storage) LoadAttributes() (list map[irma.CredentialTypeIdentifier][]*irma.AttributeList, err error) {
 	// The attributes are stored as a list of instances of AttributeList
 	temp := []*irma.AttributeList{}
-	if err = s.load(&temp, attributesFile); err != nil {
+	if _, err = s.load(userdataBucket, attributesKey, &temp, attributesFile); err != nil {
 		return
 	}
 
@@ -218,7 +408,7 @@ func (s *storage) LoadAttributes() (list map[irma.CredentialTypeIdentifier][]*ir
 
 func (s *storage) LoadKeyshareServers() (ksses map[irma.SchemeManagerIdentifier]*keyshareServer, err error) {
 	ksses = make(map[irma.SchemeManagerIdentifier]*keyshareServer)
-	if err := s.load(&ksses, kssFile); err != nil {
+	if _, err := s.load(userdataBucket, kssKey, &ksses, kssFile); err != nil {
 		return nil, err
 	}
 	return ksses, nil
@@ -240,12 +430,31 @@ func (s *storage) LoadNewestLogs(max int) ([]*LogEntry, error) {
 	})
 }
 
+// LoadLogEntry returns the log entry with the specified ID.
+func (s *storage) LoadLogEntry(id uint64) (*LogEntry, error) {
+	var entry *LogEntry
+	err := s.view(func(tx *bbolt.Tx) error {
+		var v []byte
+		k := s.logEntryKeyToBytes(id)
+		if bucket := tx.Bucket([]byte(logsBucket)); bucket != nil {
+			v = bucket.Get(k)
+		}
+		if v == nil {
+			return errors.Errorf("No log entry with ID %d", id)
+		}
+		var err error
+		entry, err = s.decryptLogEntry(k, v)
+		return err
+	})
+	return entry, err
+}
+
 // Returns the logs stored sorted from new to old with a maximum result length of 'max' where the starting position
 // of the bbolt cursor can be manipulated by the anonymous function 'startAt'. 'startAt' should return
 // the key and the value of the first element from the bbolt database that should be loaded.
 func (s *storage) loadLogs(max int, startAt func(*bbolt.Cursor) (key, value []byte)) ([]*LogEntry, error) {
 	logs := make([]*LogEntry, 0, max)
-	return logs, s.db.View(func(tx *bbolt.Tx) error {
+	return logs, s.view(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(logsBucket))
 		if bucket == nil {
 			return nil
@@ -253,12 +462,15 @@ func (s *storage) loadLogs(max int, startAt func(*bbolt.Cursor) (key, value []by
 		c := bucket.Cursor()
 
 		for k, v := startAt(c); k != nil && len(logs) < max; k, v = c.Prev() {
-			var log LogEntry
-			if err := json.Unmarshal(v, &log); err != nil {
+			if v == nil { // nested bucket containing the indexes
+				continue
+			}
+			log, err := s.decryptLogEntry(k, v)
+			if err != nil {
 				return err
 			}
 
-			logs = append(logs, &log)
+			logs = append(logs, log)
 		}
 		return nil
 	})
@@ -266,7 +478,7 @@ func (s *storage) loadLogs(max int, startAt func(*bbolt.Cursor) (key, value []by
 
 func (s *storage) LoadUpdates() (updates []update, err error) {
 	updates = []update{}
-	if err := s.load(&updates, updatesFile); err != nil {
+	if _, err := s.load(userdataBucket, updatesKey, &updates, updatesFile); err != nil {
 		return nil, err
 	}
 	return updates, nil
@@ -274,5 +486,320 @@ func (s *storage) LoadUpdates() (updates []update, err error) {
 
 func (s *storage) LoadPreferences() (Preferences, error) {
 	config := defaultPreferences
-	return config, s.load(&config, preferencesFile)
+	_, err := s.load(userdataBucket, preferencesKey, &config, preferencesFile)
+	return config, err
+}
+
+// LoadBackup loads all records that are included in a backup in a single transaction.
+func (s *storage) LoadBackup() (*backupContents, error) {
+	contents := &backupContents{
+		SecretKey:       &secretKey{},
+		Attributes:      []*irma.AttributeList{},
+		Signatures:      map[string]*gabi.CLSignature{},
+		Logs:            []*LogEntry{},
+		KeyshareServers: map[irma.SchemeManagerIdentifier]*keyshareServer{},
+		Preferences:     defaultPreferences,
+	}
+	return contents, s.view(func(tx *bbolt.Tx) error {
+		if _, err := s.txLoad(tx, userdataBucket, skKey, contents.SecretKey, skFile); err != nil {
+			return err
+		}
+		if _, err := s.txLoad(tx, userdataBucket, attributesKey, &contents.Attributes, attributesFile); err != nil {
+			return err
+		}
+		if _, err := s.txLoad(tx, userdataBucket, kssKey, &contents.KeyshareServers, kssFile); err != nil {
+			return err
+		}
+		if _, err := s.txLoad(tx, userdataBucket, preferencesKey, &contents.Preferences, preferencesFile); err != nil {
+			return err
+		}
+		for _, attrs := range contents.Attributes {
+			sig := new(gabi.CLSignature)
+			found, err := s.txLoad(tx, signaturesBucket, s.signatureKey(attrs.Hash()), sig, s.signatureFilename(attrs))
+			if err != nil {
+				return err
+			}
+			if !found {
+				return errors.Errorf("Signature of credential with attributes %s not found", attrs.Hash())
+			}
+			contents.Signatures[attrs.Hash()] = sig
+		}
+		b := tx.Bucket([]byte(logsBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if v == nil { // nested bucket containing the indexes
+				return nil
+			}
+			log, err := s.decryptLogEntry(k, v)
+			if err != nil {
+				return err
+			}
+			contents.Logs = append(contents.Logs, log)
+			return nil
+		})
+	})
+}
+
+// RestoreBackup replaces all records that are included in a backup by those of the backup
+// in a single transaction, marking the database for compaction. The log entries get new IDs,
+// in the same order.
+func (s *storage) RestoreBackup(contents *backupContents) error {
+	return s.update(func(tx *bbolt.Tx) error {
+		for _, bucket := range []string{signaturesBucket, logsBucket} {
+			if err := tx.DeleteBucket([]byte(bucket)); err != nil && err != bbolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		if err := s.txStore(tx, userdataBucket, skKey, contents.SecretKey); err != nil {
+			return err
+		}
+		if err := s.txStore(tx, userdataBucket, attributesKey, contents.Attributes); err != nil {
+			return err
+		}
+		if err := s.txStore(tx, userdataBucket, kssKey, contents.KeyshareServers); err != nil {
+			return err
+		}
+		if err := s.txStore(tx, userdataBucket, preferencesKey, contents.Preferences); err != nil {
+			return err
+		}
+		for hash, sig := range contents.Signatures {
+			if err := s.txStore(tx, signaturesBucket, s.signatureKey(hash), sig); err != nil {
+				return err
+			}
+		}
+		for _, log := range contents.Logs {
+			if err := s.TxAddLogEntry(tx, log); err != nil {
+				return err
+			}
+		}
+		return s.txStore(tx, userdataBucket, compactKey, true)
+	})
+}
+
+// legacyFiles returns the files in which records were stored before they were moved
+// into the database, that are present.
+func (s *storage) legacyFiles() ([]string, error) {
+	var files []string
+	for _, file := range []string{skFile, attributesFile, kssFile, logsFile, preferencesFile} {
+		exists, err := fs.PathExists(s.path(file))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			files = append(files, file)
+		}
+	}
+	exists, err := fs.PathExists(s.path(signaturesDir))
+	if err != nil || !exists {
+		return files, err
+	}
+	sigs, err := ioutil.ReadDir(s.path(signaturesDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, sig := range sigs {
+		files = append(files, filepath.Join(signaturesDir, sig.Name()))
+	}
+	return files, nil
+}
+
+// moveIntoDatabase moves the records from the files in which they were stored before into the
+// database in a single transaction, after which the files are removed. The updates that have been
+// performed are stored in the same transaction, as the updates file is removed as well.
+func (s *storage) moveIntoDatabase(updates []update) error {
+	keys := map[string]string{
+		skFile:          skKey,
+		attributesFile:  attributesKey,
+		kssFile:         kssKey,
+		preferencesFile: preferencesKey,
+	}
+	files, err := s.legacyFiles()
+	if err != nil {
+		return err
+	}
+	err = s.update(func(tx *bbolt.Tx) error {
+		for _, file := range files {
+			var contents json.RawMessage
+			if _, err := s.loadFile(&contents, file); err != nil {
+				return err
+			}
+			if filepath.Dir(file) == signaturesDir {
+				key, err := s.legacySignatureKey(file)
+				if err != nil {
+					return err
+				}
+				if err = s.txStore(tx, signaturesBucket, key, contents); err != nil {
+					return err
+				}
+			} else if key, ok := keys[file]; ok {
+				if err := s.txStore(tx, userdataBucket, key, contents); err != nil {
+					return err
+				}
+			}
+			// The logs file was already converted into the logs bucket by update 7
+		}
+		return s.txStore(tx, userdataBucket, updatesKey, updates)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, file := range append(files, updatesFile) {
+		if err = os.Remove(s.path(file)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err = os.Remove(s.path(signaturesDir)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// legacySignatureKey returns the key in the signatures bucket of the signature in the specified
+// file. Plaintext signature files are named by the plain hash of the attributes, while encrypted
+// ones are already named by their signatureKey.
+func (s *storage) legacySignatureKey(file string) (string, error) {
+	bts, err := ioutil.ReadFile(s.path(file))
+	if err != nil {
+		return "", err
+	}
+	if encryption.IsEncryptedRecord(bts) {
+		return filepath.Base(file), nil
+	}
+	return s.signatureKey(filepath.Base(file)), nil
+}
+
+// encryptPlaintext encrypts all plaintext records in place, if the storage is encrypted. While it
+// has not finished a marker is present in the database, so that an interrupted conversion is
+// resumed instead of leaving the storage partially encrypted. The records in the database are
+// converted in a single transaction, after which the database is marked for compaction, removing
+// the remnants of the plaintext records.
+func (s *storage) encryptPlaintext() error {
+	if s.key == nil {
+		return nil
+	}
+
+	err := s.update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(userdataBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(encryptingKey), []byte("true"))
+	})
+	if err != nil {
+		return err
+	}
+
+	files, err := s.legacyFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		bts, err := ioutil.ReadFile(s.path(file))
+		if err != nil {
+			return err
+		}
+		if encryption.IsEncryptedRecord(bts) {
+			continue
+		}
+		name := file
+		if filepath.Dir(file) == signaturesDir {
+			name = filepath.Join(signaturesDir, s.signatureKey(filepath.Base(file)))
+		}
+		if bts, err = s.encrypt(bts, filepath.ToSlash(name)); err != nil {
+			return err
+		}
+		if err = fs.SaveFile(s.path(name), bts); err != nil {
+			return err
+		}
+		if name != file {
+			if err = os.Remove(s.path(file)); err != nil {
+				return err
+			}
+		}
+	}
+
+	err = s.update(func(tx *bbolt.Tx) error {
+		for _, bucket := range []string{userdataBucket, signaturesBucket, logsBucket} {
+			b := tx.Bucket([]byte(bucket))
+			if b == nil {
+				continue
+			}
+			plaintext := map[string][]byte{}
+			err := b.ForEach(func(k, v []byte) error {
+				key := string(k)
+				if v != nil && (bucket != userdataBucket || (key != updatesKey && key != encryptingKey)) &&
+					!encryption.IsEncryptedRecord(v) {
+					plaintext[key] = append([]byte(nil), v...)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for k, v := range plaintext {
+				key := k
+				if bucket == signaturesBucket {
+					// Plaintext signatures are keyed by the plain hash of the attributes
+					if err = b.Delete([]byte(k)); err != nil {
+						return err
+					}
+					key = s.signatureKey(k)
+				}
+				if v, err = s.encrypt(v, recordName(bucket, []byte(key))); err != nil {
+					return err
+				}
+				if err = b.Put([]byte(key), v); err != nil {
+					return err
+				}
+			}
+		}
+		// The digests in the log indexes are keyed in encrypted storage
+		if err := s.txReindexLogs(tx); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(userdataBucket)).Delete([]byte(encryptingKey)); err != nil {
+			return err
+		}
+		return s.txStore(tx, userdataBucket, compactKey, true)
+	})
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(s.path(encryptingFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// isPlaintext returns whether the storage contains a plaintext secret key, which is always present
+// in storage that has been used, or whether encryptPlaintext was interrupted.
+func (s *storage) isPlaintext() (bool, error) {
+	var bts []byte
+	var encrypting bool
+	err := s.view(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket([]byte(userdataBucket)); b != nil {
+			bts = append([]byte(nil), b.Get([]byte(skKey))...)
+			encrypting = b.Get([]byte(encryptingKey)) != nil
+		}
+		return nil
+	})
+	if err != nil || encrypting {
+		return encrypting, err
+	}
+	if encrypting, err = fs.PathExists(s.path(encryptingFile)); err != nil || encrypting {
+		return encrypting, err
+	}
+	if len(bts) == 0 {
+		exists, err := fs.PathExists(s.path(skFile))
+		if err != nil || !exists {
+			return false, err
+		}
+		if bts, err = ioutil.ReadFile(s.path(skFile)); err != nil {
+			return false, err
+		}
+	}
+	return !encryption.IsEncryptedRecord(bts), nil
 }
@@ -46,11 +46,11 @@ var clientUpdates = []func(client *Client) error{
 	func(client *Client) error {
 		var logs []*LogEntry
 		var err error
-		if err = client.storage.load(&logs, logsFile); err != nil {
+		if _, err = client.storage.loadFile(&logs, logsFile); err != nil {
 			return err
 		}
 		// Open one bolt transaction to process all our log entries in
-		err = client.storage.db.Update(func(tx *bbolt.Tx) error {
+		err = client.storage.update(func(tx *bbolt.Tx) error {
 			for _, log := range logs {
 				// As log.Request is a json.RawMessage it would not get updated to the new session request
 				// format by re-marshaling the containing struct, as normal struct members would,
@@ -71,11 +71,26 @@ var clientUpdates = []func(client *Client) error{
 		})
 		return err
 	},
+
+	// 8: Encrypt the storage in place, if a storage key was specified
+	func(client *Client) error {
+		return client.storage.encryptPlaintext()
+	},
+
+	// 9: Move all records from their separate files into the bbolt database
+	func(client *Client) error {
+		return client.storage.moveIntoDatabase(client.updates)
+	},
+
+	// 10: Index the existing log entries, for LogQuery
+	func(client *Client) error {
+		return client.storage.ReindexLogs()
+	},
 }
 
 // update performs any function from clientUpdates that has not
 // already been executed in the past, keeping track of previously executed updates
-// in the file at updatesFile.
+// in the storage.
 func (client *Client) update() error {
 	// Load and parse file containing info about already performed updates
 	var err error
@@ -1,15 +1,18 @@
 package irma
 
 import (
+	"context"
 	"crypto/rsa"
 	"encoding/base64"
 	"encoding/xml"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
 	"crypto/sha256"
@@ -55,15 +58,57 @@ type Configuration struct {
 
 	Warnings []string
 
+	// If set, schemes are downloaded and updated from the folder named after the scheme at this
+	// URL (e.g. a directory created by "irma scheme mirror") instead of from their own URL. As the
+	// stored pk.pem of the scheme is never downloaded from the mirror, the mirror cannot alter the
+	// scheme contents without failing signature verification.
+	SchemeMirrorURL string
+
+	// Maximum amount of files of a scheme that are downloaded concurrently when it is updated
+	// (0 means 4)
+	DownloadConcurrency int
+
+	// Timeout of each request made when downloading schemes, including reading the response
+	// (0 means 30 seconds)
+	DownloadTimeout time.Duration
+
+	// If set, the TLS certificates of the servers from which schemes are downloaded are verified
+	// against these CA certificates instead of those of the system
+	RootCAs *x509.CertPool
+
+	// If set, called when a new version of a scheme is being downloaded: once before the changed
+	// files are downloaded, and after each downloaded file. Calls are never concurrent.
+	UpdateProgress func(progress *SchemeUpdateProgress)
+
 	kssPublicKeys map[SchemeManagerIdentifier]map[int]*rsa.PublicKey
 	publicKeys    map[IssuerIdentifier]map[int]*gabi.PublicKey
-	privateKeys   map[IssuerIdentifier]*gabi.PrivateKey
+	privateKeys   map[IssuerIdentifier]*privateKeyEntry
 	reverseHashes map[string]CredentialTypeIdentifier
 	initialized   bool
 	assets        string
 	readOnly      bool
 	cronchan      chan bool
 	scheduler     *gocron.Scheduler
+	stopUpdates   context.CancelFunc
+	transports    *schemeTransports
+
+	subscribersLock sync.Mutex
+	subscribers     map[int]func(*SchemeEvent)
+	nextSubscriber  int
+
+	// Guards the scheme folders within Path against concurrent updates and parsing
+	folderLock sync.Mutex
+	// Guards the parsed contents against being replaced while they are read; see RLock
+	parsedLock sync.RWMutex
+	// Guards privateKeys, which is updated by PrivateKey
+	privateKeysLock sync.RWMutex
+}
+
+// privateKeyEntry caches the private key of an issuer that is used for issuance.
+type privateKeyEntry struct {
+	sk      *gabi.PrivateKey // nil if the issuer has no private keys
+	modTime time.Time        // Modification time of the private key folder when it was scanned
+	expiry  int64            // Time after which another private key may have to be used
 }
 
 // ConfigurationFileHash encodes the SHA256 hash of an authenticated
@@ -97,6 +142,8 @@ const (
 
 	pubkeyPattern  = "%s/%s/%s/PublicKeys/*.xml"
 	privkeyPattern = "%s/%s/%s/PrivateKeys/*.xml"
+	// Suffix of private keys encrypted with "irma scheme issuer encrypt-key"
+	encryptedPrivkeySuffix = ".xml.enc"
 )
 
 func (sme SchemeManagerError) Error() string {
@@ -128,8 +175,9 @@ func NewConfigurationFromAssets(path, assets string) (*Configuration, error) {
 
 func newConfiguration(path string, assets string) (conf *Configuration, err error) {
 	conf = &Configuration{
-		Path:   path,
-		assets: assets,
+		Path:       path,
+		assets:     assets,
+		transports: newSchemeTransports(),
 	}
 
 	if conf.assets != "" { // If an assets folder is specified, then it must exist
@@ -155,15 +203,23 @@ func (conf *Configuration) clear() {
 	conf.DisabledSchemeManagers = make(map[SchemeManagerIdentifier]*SchemeManagerError)
 	conf.kssPublicKeys = make(map[SchemeManagerIdentifier]map[int]*rsa.PublicKey)
 	conf.publicKeys = make(map[IssuerIdentifier]map[int]*gabi.PublicKey)
-	conf.privateKeys = make(map[IssuerIdentifier]*gabi.PrivateKey)
+	conf.privateKeysLock.Lock()
+	conf.privateKeys = make(map[IssuerIdentifier]*privateKeyEntry)
+	conf.privateKeysLock.Unlock()
 	conf.reverseHashes = make(map[string]CredentialTypeIdentifier)
 }
 
 // ParseFolder populates the current Configuration by parsing the storage path,
 // listing the containing scheme managers, issuers and credential types.
 func (conf *Configuration) ParseFolder() (err error) {
-	// Init all maps
-	conf.clear()
+	conf.folderLock.Lock()
+	defer conf.folderLock.Unlock()
+
+	if !conf.readOnly {
+		if err = conf.recoverSchemeFolders(); err != nil {
+			return err
+		}
+	}
 
 	// Copy any new or updated scheme managers out of the assets into storage
 	if conf.assets != "" {
@@ -174,7 +230,7 @@ func (conf *Configuration) ParseFolder() (err error) {
 				return err
 			}
 			if !uptodate {
-				_, err = conf.CopyManagerFromAssets(scheme)
+				_, err = conf.copyManagerFromAssets(scheme)
 			}
 			return err
 		})
@@ -183,11 +239,17 @@ func (conf *Configuration) ParseFolder() (err error) {
 		}
 	}
 
-	// Parse scheme managers in storage
+	// Parse scheme managers in storage into a new instance, whose contents we take over afterwards,
+	// so that users of this instance don't see a partially parsed configuration in the meantime
+	parsed := &Configuration{Path: conf.Path, Warnings: conf.Warnings}
+	parsed.clear()
 	var mgrerr *SchemeManagerError
 	err = iterateSubfolders(conf.Path, func(dir string, _ os.FileInfo) error {
+		if strings.HasPrefix(filepath.Base(dir), ".") {
+			return nil // staged or previous version of a scheme, see UpdateSchemeManager
+		}
 		manager := NewSchemeManager(filepath.Base(dir))
-		err := conf.ParseSchemeManagerFolder(dir, manager)
+		err := parsed.ParseSchemeManagerFolder(dir, manager)
 		if err == nil {
 			return nil // OK, do next scheme manager folder
 		}
@@ -195,11 +257,12 @@ func (conf *Configuration) ParseFolder() (err error) {
 		// so as to continue parsing other managers.
 		var ok bool
 		if mgrerr, ok = err.(*SchemeManagerError); ok {
-			conf.DisabledSchemeManagers[manager.Identifier()] = mgrerr
+			parsed.DisabledSchemeManagers[manager.Identifier()] = mgrerr
 			return nil
 		}
 		return err // Not a SchemeManagerError? return it & halt parsing now
 	})
+	conf.takeOver(parsed)
 	if err != nil {
 		return
 	}
@@ -210,6 +273,37 @@ func (conf *Configuration) ParseFolder() (err error) {
 	return
 }
 
+// RLock locks the parsed contents of the Configuration (its scheme managers, issuers, credential
+// types, attribute types and keys) for reading, so that they are not replaced by ParseFolder, e.g.
+// after an automatic scheme update, while they are being read. It must be followed by RUnlock,
+// and ParseFolder must not be called in between.
+func (conf *Configuration) RLock() {
+	conf.parsedLock.RLock()
+}
+
+// RUnlock undoes a call to RLock.
+func (conf *Configuration) RUnlock() {
+	conf.parsedLock.RUnlock()
+}
+
+// takeOver replaces the parsed contents of this instance with those of the other instance.
+func (conf *Configuration) takeOver(other *Configuration) {
+	conf.parsedLock.Lock()
+	defer conf.parsedLock.Unlock()
+	conf.SchemeManagers = other.SchemeManagers
+	conf.Issuers = other.Issuers
+	conf.CredentialTypes = other.CredentialTypes
+	conf.AttributeTypes = other.AttributeTypes
+	conf.DisabledSchemeManagers = other.DisabledSchemeManagers
+	conf.Warnings = other.Warnings
+	conf.kssPublicKeys = other.kssPublicKeys
+	conf.publicKeys = other.publicKeys
+	conf.privateKeysLock.Lock()
+	conf.privateKeys = other.privateKeys
+	conf.privateKeysLock.Unlock()
+	conf.reverseHashes = other.reverseHashes
+}
+
 // ParseOrRestoreFolder parses the irma_configuration folder, and when possible attempts to restore
 // any broken scheme managers from their remote.
 // Any error encountered during parsing is considered recoverable only if it is of type *SchemeManagerError;
@@ -309,34 +403,70 @@ func (conf *Configuration) ParseSchemeManagerFolder(dir string, manager *SchemeM
 	return
 }
 
-// PrivateKey returns the specified private key, or nil if not present in the Configuration.
+// PrivateKey returns the private key of the specified issuer that should be used for issuance, or nil
+// if not present in the Configuration. This is the private key with the highest counter whose
+// public key is not expired, or if all of them are expired, the one with the highest counter.
 func (conf *Configuration) PrivateKey(id IssuerIdentifier) (*gabi.PrivateKey, error) {
-	if sk := conf.privateKeys[id]; sk != nil {
-		return sk, nil
+	// The key folder is scanned again when it is modified, so that keys added to it (e.g. by
+	// rotating the issuer key) are used without reparsing the Configuration
+	var modTime time.Time
+	info, err := os.Stat(filepath.Join(conf.Path, id.SchemeManagerIdentifier().Name(), id.Name(), "PrivateKeys"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		modTime = info.ModTime()
+	}
+
+	conf.privateKeysLock.RLock()
+	entry := conf.privateKeys[id]
+	conf.privateKeysLock.RUnlock()
+	if entry.valid(modTime) {
+		return entry.sk, nil
 	}
 
+	conf.privateKeysLock.Lock()
+	defer conf.privateKeysLock.Unlock()
+	if entry = conf.privateKeys[id]; entry.valid(modTime) {
+		return entry.sk, nil
+	}
+	if entry, err = conf.scanPrivateKeys(id, modTime); err != nil {
+		return nil, err
+	}
+	conf.privateKeys[id] = entry
+	return entry.sk, nil
+}
+
+func (entry *privateKeyEntry) valid(modTime time.Time) bool {
+	return entry != nil && entry.modTime.Equal(modTime) && time.Now().Unix() < entry.expiry
+}
+
+// scanPrivateKeys reads the private key of the issuer to be used for issuance from its key folder,
+// which had the specified modification time.
+func (conf *Configuration) scanPrivateKeys(id IssuerIdentifier, modTime time.Time) (*privateKeyEntry, error) {
+	entry := &privateKeyEntry{modTime: modTime, expiry: math.MaxInt64}
 	path := fmt.Sprintf(privkeyPattern, conf.Path, id.SchemeManagerIdentifier().Name(), id.Name())
-	files, err := filepath.Glob(path)
+	counters, err := conf.matchKeyPattern(id, privkeyPattern)
 	if err != nil {
 		return nil, err
 	}
-	if len(files) == 0 {
-		return nil, nil
+	if len(counters) == 0 {
+		return entry, nil
 	}
 
-	// List private keys and get highest counter
-	counters := make([]int, 0, len(files))
-	for _, file := range files {
-		filename := filepath.Base(file)
-		count := filename[:len(filename)-4]
-		i, err := strconv.Atoi(count)
+	// Take the highest counter whose public key is not expired, until it expires
+	counter := counters[len(counters)-1]
+	for i := len(counters) - 1; i >= 0; i-- {
+		pk, err := conf.PublicKey(id, counters[i])
 		if err != nil {
 			return nil, err
 		}
-		counters = append(counters, i)
+		if pk != nil && pk.ExpiryDate > time.Now().Unix() {
+			counter = counters[i]
+			entry.expiry = pk.ExpiryDate
+			break
+		}
 	}
-	sort.Ints(counters)
-	counter := counters[len(counters)-1]
 
 	// Read private key
 	file := strings.Replace(path, "*", strconv.Itoa(counter), 1)
@@ -347,9 +477,8 @@ func (conf *Configuration) PrivateKey(id IssuerIdentifier) (*gabi.PrivateKey, er
 	if int(sk.Counter) != counter {
 		return nil, errors.Errorf("Private key %s of issuer %s has wrong <Counter>", file, id.String())
 	}
-	conf.privateKeys[id] = sk
-
-	return sk, nil
+	entry.sk = sk
+	return entry, nil
 }
 
 // PublicKey returns the specified public key, or nil if not present in the Configuration.
@@ -480,6 +609,9 @@ func (conf *Configuration) DeleteSchemeManager(id SchemeManagerIdentifier) error
 		}
 	}
 	if !conf.readOnly {
+		if err := os.RemoveAll(conf.previousSchemePath(id)); err != nil {
+			return err
+		}
 		return os.RemoveAll(filepath.Join(conf.Path, id.Name()))
 	}
 	return nil
@@ -686,23 +818,36 @@ func (conf *Configuration) isUpToDate(scheme SchemeManagerIdentifier) (bool, err
 }
 
 func (conf *Configuration) CopyManagerFromAssets(scheme SchemeManagerIdentifier) (bool, error) {
+	conf.folderLock.Lock()
+	defer conf.folderLock.Unlock()
+	return conf.copyManagerFromAssets(scheme)
+}
+
+func (conf *Configuration) copyManagerFromAssets(scheme SchemeManagerIdentifier) (bool, error) {
 	if conf.assets == "" || conf.readOnly {
 		return false, nil
 	}
-	// Remove old version; we want an exact copy of the assets version
+	// Replace the old version as a whole; we want an exact copy of the assets version
 	// not a merge of the assets version and the storage version
 	name := scheme.String()
-	if err := os.RemoveAll(filepath.Join(conf.Path, name)); err != nil {
+	staging, err := conf.stageSchemeFolder(scheme, false)
+	if err != nil {
 		return false, err
 	}
-	return true, fs.CopyDirectory(
+	defer staging.removeStagingFolder()
+	err = fs.CopyDirectory(
 		filepath.Join(conf.assets, name),
-		filepath.Join(conf.Path, name),
+		filepath.Join(staging.Path, name),
 	)
+	if err != nil {
+		return false, err
+	}
+	return true, conf.installStagedScheme(scheme, staging, false)
 }
 
 // DownloadSchemeManager downloads and returns a scheme manager description.xml file
-// from the specified URL.
+// from the specified URL. As the scheme is not yet known, its SchemeServerPins can't be
+// used for this download; they are used for subsequent downloads of the scheme.
 func DownloadSchemeManager(url string) (*SchemeManager, error) {
 	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
 		url = "https://" + url
@@ -713,7 +858,9 @@ func DownloadSchemeManager(url string) (*SchemeManager, error) {
 	if strings.HasSuffix(url, "/description.xml") {
 		url = url[:len(url)-len("/description.xml")]
 	}
-	b, err := NewHTTPTransport(url).GetBytes("description.xml")
+	t := NewHTTPTransport(url)
+	t.Policy.Timeout = defaultDownloadTimeout
+	b, err := t.GetBytes("description.xml")
 	if err != nil {
 		return nil, err
 	}
@@ -721,6 +868,9 @@ func DownloadSchemeManager(url string) (*SchemeManager, error) {
 	if err = xml.Unmarshal(b, manager); err != nil {
 		return nil, err
 	}
+	if err = ValidateCertificatePins(manager.SchemeServerPins); err != nil {
+		return nil, errors.WrapPrefix(err, "Scheme has invalid SchemeServerPins", 0)
+	}
 
 	manager.URL = url // TODO?
 	return manager, nil
@@ -745,9 +895,15 @@ func (conf *Configuration) RemoveSchemeManager(id SchemeManagerIdentifier, fromS
 			delete(conf.publicKeys, issid)
 		}
 	}
+	if manager, ok := conf.SchemeManagers[id]; ok {
+		conf.setTimestampValidators(manager, CacheValidators{})
+	}
 	delete(conf.SchemeManagers, id)
 
 	if fromStorage || !conf.readOnly {
+		if err := os.RemoveAll(conf.previousSchemePath(id)); err != nil {
+			return err
+		}
 		return os.RemoveAll(fmt.Sprintf("%s/%s", conf.Path, id.String()))
 	}
 	return nil
@@ -760,30 +916,50 @@ func (conf *Configuration) ReinstallSchemeManager(manager *SchemeManager) (err e
 
 	// Check if downloading stuff from the remote works before we uninstall the specified manager:
 	// If we can't download anything we should keep the broken version
-	manager, err = DownloadSchemeManager(manager.URL)
+	// Keep the public key of the scheme if we have it, as a mirror may not supply it
+	url := manager.URL
+	publickey, err := ioutil.ReadFile(filepath.Join(conf.Path, manager.ID, "pk.pem"))
+	if os.IsNotExist(err) {
+		publickey, err = conf.DownloadSchemePublicKey(manager)
+	}
+	if err != nil {
+		return errors.WrapPrefix(err, "failed to get public key of scheme "+manager.ID, 0)
+	}
+	manager, err = DownloadSchemeManager(conf.SchemeURL(manager))
 	if err != nil {
 		return
 	}
+	if conf.SchemeMirrorURL != "" {
+		manager.URL = url
+	}
 	if err = conf.DeleteSchemeManager(manager.Identifier()); err != nil {
 		return
 	}
-	err = conf.InstallSchemeManager(manager, nil)
+	err = conf.InstallSchemeManager(manager, publickey)
 	return
 }
 
 // InstallSchemeManager downloads and adds the specified scheme manager to this Configuration,
-// provided its signature is valid.
+// provided its signature is valid against the specified public key. If publickey is nil the
+// public key is downloaded along with the scheme, which is refused if SchemeMirrorURL is set
+// (see DownloadSchemePublicKey).
 func (conf *Configuration) InstallSchemeManager(manager *SchemeManager, publickey []byte) error {
 	if conf.readOnly {
 		return errors.New("cannot install scheme into a read-only configuration")
 	}
+	if publickey == nil && conf.SchemeMirrorURL != "" {
+		return errors.New("cannot download the public key of a scheme from a mirror")
+	}
 
 	name := manager.ID
 	if err := fs.EnsureDirectoryExists(filepath.Join(conf.Path, name)); err != nil {
 		return err
 	}
 
-	t := NewHTTPTransport(manager.URL)
+	t, err := conf.schemeTransport(manager)
+	if err != nil {
+		return err
+	}
 	path := fmt.Sprintf("%s/%s", conf.Path, name)
 	if err := t.GetFile("description.xml", path+"/description.xml"); err != nil {
 		return err
@@ -811,19 +987,26 @@ func (conf *Configuration) InstallSchemeManager(manager *SchemeManager, publicke
 // DownloadSchemeManagerSignature downloads, stores and verifies the latest version
 // of the index file and signature of the specified manager.
 func (conf *Configuration) DownloadSchemeManagerSignature(manager *SchemeManager) (err error) {
+	return conf.downloadSchemeManagerSignature(context.Background(), manager)
+}
+
+func (conf *Configuration) downloadSchemeManagerSignature(ctx context.Context, manager *SchemeManager) (err error) {
 	if conf.readOnly {
 		return errors.New("cannot download into a read-only configuration")
 	}
 
-	t := NewHTTPTransport(manager.URL)
+	t, err := conf.schemeTransport(manager)
+	if err != nil {
+		return
+	}
 	path := fmt.Sprintf("%s/%s", conf.Path, manager.ID)
 	index := filepath.Join(path, "index")
 	sig := filepath.Join(path, "index.sig")
 
-	if err = t.GetFile("index", index); err != nil {
+	if err = t.GetFileContext(ctx, "index", index); err != nil {
 		return
 	}
-	if err = t.GetFile("index.sig", sig); err != nil {
+	if err = t.GetFileContext(ctx, "index.sig", sig); err != nil {
 		return
 	}
 	err = conf.VerifySignature(manager.Identifier())
@@ -852,14 +1035,23 @@ func (conf *Configuration) Download(session SessionRequest) (downloaded *IrmaIde
 
 	// Update the scheme  found above and parse them, if necessary
 	downloaded = newIrmaIdentifierSet()
+	var changes []*SchemeChange
 	for id := range missing.allSchemes() {
-		if err = conf.UpdateSchemeManager(id, downloaded); err != nil {
+		var change *SchemeChange
+		if change, err = conf.UpdateSchemeManagerReport(context.Background(), id, downloaded); err != nil {
+			conf.publishSchemeUpdateFailure(context.Background(), id, err)
+			if len(changes) > 0 {
+				_ = conf.parseUpdatedSchemes(changes)
+			}
 			return
 		}
+		if change != nil {
+			changes = append(changes, change)
+		}
 	}
 
-	if !downloaded.Empty() {
-		if err = conf.ParseFolder(); err != nil {
+	if len(changes) > 0 {
+		if err = conf.parseUpdatedSchemes(changes); err != nil {
 			return nil, err
 		}
 	}
@@ -1035,10 +1227,8 @@ func (conf *Configuration) checkUnsignedFiles(name string, index SchemeManagerIn
 		if err != nil {
 			return err
 		}
-		for _, ex := range sigExceptions {
-			if ex.MatchString(filepath.ToSlash(relpath)) {
-				return nil
-			}
+		if isSigException(filepath.ToSlash(relpath)) {
+			return nil
 		}
 
 		if info.IsDir() {
@@ -1076,9 +1266,19 @@ var sigExceptions = []*regexp.Regexp{
 	regexp.MustCompile(`^.*?/README\.md$`),
 	regexp.MustCompile(`^.*?/.*?/PrivateKeys$`),
 	regexp.MustCompile(`^.*?/.*?/PrivateKeys/\d+.xml$`),
+	regexp.MustCompile(`^.*?/.*?/PrivateKeys/\d+.xml.enc$`),
 	regexp.MustCompile(`\.DS_Store$`),
 }
 
+func isSigException(path string) bool {
+	for _, ex := range sigExceptions {
+		if ex.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
 func (conf *Configuration) VerifySchemeManager(manager *SchemeManager) error {
 	err := conf.VerifySignature(manager.Identifier())
 	if err != nil {
@@ -1200,115 +1400,208 @@ func (hash ConfigurationFileHash) Equal(other ConfigurationFileHash) bool {
 // with the remote version at the scheme manager's URL, downloading and storing
 // new and modified files, according to the index files of both versions.
 // It stores the identifiers of new or updated credential types or issuers in the second parameter.
+//
+// The new version is downloaded into a staging folder next to the stored version, and installed
+// only after its index signature, the hashes of all of its files, and its contents have been
+// verified, by replacing the stored version with it as a whole. If anything goes wrong before that,
+// the stored version is left untouched. The stored version is kept afterwards, so that the update
+// can be undone with RollbackSchemeManager.
 // Note: any newly downloaded files are not yet parsed and inserted into conf.
 func (conf *Configuration) UpdateSchemeManager(id SchemeManagerIdentifier, downloaded *IrmaIdentifierSet) (err error) {
+	return conf.UpdateSchemeManagerContext(context.Background(), id, downloaded)
+}
+
+// UpdateSchemeManagerContext is like UpdateSchemeManager, aborting when the context is cancelled.
+func (conf *Configuration) UpdateSchemeManagerContext(
+	ctx context.Context, id SchemeManagerIdentifier, downloaded *IrmaIdentifierSet,
+) error {
+	_, err := conf.UpdateSchemeManagerReport(ctx, id, downloaded)
+	return err
+}
+
+// UpdateSchemeManagerReport is like UpdateSchemeManagerContext, additionally returning the
+// differences between the stored and the new version of the scheme if a new version was installed,
+// and nil otherwise.
+func (conf *Configuration) UpdateSchemeManagerReport(
+	ctx context.Context, id SchemeManagerIdentifier, downloaded *IrmaIdentifierSet,
+) (*SchemeChange, error) {
 	if conf.readOnly {
-		return errors.New("cannot update a read-only configuration")
+		return nil, errors.New("cannot update a read-only configuration")
 	}
 	manager, contains := conf.SchemeManagers[id]
 	if !contains {
-		return errors.Errorf("Cannot update unknown scheme manager %s", id)
+		return nil, errors.Errorf("Cannot update unknown scheme manager %s", id)
 	}
 
-	// Check remote timestamp and see if we have to do anything
-	transport := NewHTTPTransport(manager.URL + "/")
-	timestampBts, err := transport.GetBytes("timestamp")
+	// Check remote timestamp and see if we have to do anything. The request is conditional on the
+	// timestamp file having changed since we last found our version to be up to date.
+	transport, err := conf.schemeTransport(manager)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	validators := conf.timestampValidators(manager)
+	timestampBts, err := transport.GetBytesIfModifiedContext(ctx, "timestamp", &validators)
+	if err != nil {
+		return nil, err
+	}
+	if timestampBts == nil {
+		Logger.WithField("scheme", id).Trace("Scheme timestamp not modified")
+		return nil, nil
 	}
 	timestamp, err := parseTimestamp(timestampBts)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !manager.Timestamp.Before(*timestamp) {
-		return nil
+		conf.setTimestampValidators(manager, validators)
+		return nil, nil
+	}
+
+	conf.folderLock.Lock()
+	defer conf.folderLock.Unlock()
+
+	// Download the new version into a copy of our stored version, leaving the latter intact
+	staging, err := conf.stageSchemeFolder(id, true)
+	if err != nil {
+		return nil, err
 	}
+	defer staging.removeStagingFolder()
 
 	// Download the new index and its signature, and check that the new index
 	// is validly signed by the new signature
-	// By aborting immediately in case of error, and restoring backup versions
-	// of the index and signature, we leave our stored copy of the scheme manager
-	// intact.
-	if err = conf.DownloadSchemeManagerSignature(manager); err != nil {
-		return
+	if err = staging.downloadSchemeManagerSignature(ctx, manager); err != nil {
+		return nil, err
 	}
-	newIndex, err := conf.parseIndex(manager.ID, manager)
+	newIndex, err := staging.parseIndex(manager.ID, manager)
 	if err != nil {
-		return
+		return nil, err
 	}
 
 	issPattern := regexp.MustCompile("^([^/]+)/([^/]+)/description\\.xml")
 	credPattern := regexp.MustCompile("^([^/]+)/([^/]+)/Issues/([^/]+)/description\\.xml")
 
-	// TODO: how to recover/fix local copy if err != nil below?
+	// Determine which files changed, and download them concurrently into the staging folder
+	var filenames []string
 	for filename, newHash := range newIndex {
-		path := filepath.Join(conf.Path, filename)
 		oldHash, known := manager.index[filename]
 		var have bool
-		have, err = fs.PathExists(path)
+		have, err = fs.PathExists(filepath.Join(staging.Path, filename))
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if known && have && oldHash.Equal(newHash) {
 			continue // nothing to do, we already have this file
 		}
-		// Ensure that the folder in which to write the file exists
-		if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
-			return err
-		}
-		stripped := filename[len(manager.ID)+1:] // Scheme manager URL already ends with its name
-		// Download the new file, store it in our own irma_configuration folder
-		if err = transport.GetSignedFile(stripped, path, newHash); err != nil {
-			return
-		}
-		// See if the file is a credential type or issuer, and add it to the downloaded set if so
-		if downloaded == nil {
-			continue
-		}
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	if err = conf.downloadSchemeFiles(ctx, transport, id, staging.Path, newIndex, filenames); err != nil {
+		return nil, err
+	}
+
+	// See if the downloaded files are credential types or issuers, and add them to the downloaded
+	// set if so. Only report what we downloaded once the new version has been installed.
+	staged := newIrmaIdentifierSet()
+	for _, filename := range filenames {
 		var matches []string
 		matches = issPattern.FindStringSubmatch(filepath.ToSlash(filename))
 		if len(matches) == 3 {
 			issid := NewIssuerIdentifier(fmt.Sprintf("%s.%s", matches[1], matches[2]))
-			downloaded.Issuers[issid] = struct{}{}
+			staged.Issuers[issid] = struct{}{}
 		}
 		matches = credPattern.FindStringSubmatch(filepath.ToSlash(filename))
 		if len(matches) == 4 {
 			credid := NewCredentialTypeIdentifier(fmt.Sprintf("%s.%s.%s", matches[1], matches[2], matches[3]))
-			downloaded.CredentialTypes[credid] = struct{}{}
+			staged.CredentialTypes[credid] = struct{}{}
 		}
 	}
 
-	if err := conf.downloadDemoPrivateKeys(manager); err != nil {
-		return err
+	if err = staging.downloadDemoPrivateKeys(ctx, manager); err != nil {
+		return nil, err
+	}
+	if err = staging.verifyStagedScheme(id); err != nil {
+		return nil, errors.WrapPrefix(err, "New version of scheme "+id.String()+" is invalid", 0)
 	}
 
-	return
+	change, err := DiffScheme(conf, staging, id)
+	if err != nil {
+		Logger.WithField("scheme", id).Warn("Failed to determine changes in new version of scheme: ", err.Error())
+		change = &SchemeChange{Scheme: id, NewTimestamp: timestamp}
+	}
+	if err = conf.installStagedScheme(id, staging, manager.Valid); err != nil {
+		return nil, err
+	}
+	conf.setTimestampValidators(manager, validators)
+
+	if downloaded != nil {
+		for issid := range staged.Issuers {
+			downloaded.Issuers[issid] = struct{}{}
+		}
+		for credid := range staged.CredentialTypes {
+			downloaded.CredentialTypes[credid] = struct{}{}
+		}
+	}
+	return change, nil
 }
 
+// UpdateSchemes updates all schemes using UpdateSchemeManager, and reparses them if anything changed.
+// Updated schemes that fail to parse are rolled back to their previous version.
 func (conf *Configuration) UpdateSchemes() error {
+	return conf.UpdateSchemesContext(context.Background())
+}
+
+// UpdateSchemesContext is like UpdateSchemes, aborting when the context is cancelled.
+func (conf *Configuration) UpdateSchemesContext(ctx context.Context) error {
+	_, err := conf.UpdateSchemesReport(ctx)
+	return err
+}
+
+// UpdateSchemesReport is like UpdateSchemesContext, additionally returning the differences
+// between the stored and the new version of each scheme of which a new version was installed.
+func (conf *Configuration) UpdateSchemesReport(ctx context.Context) ([]*SchemeChange, error) {
 	updated := IrmaIdentifierSet{
 		SchemeManagers:  map[SchemeManagerIdentifier]struct{}{},
 		Issuers:         map[IssuerIdentifier]struct{}{},
 		CredentialTypes: map[CredentialTypeIdentifier]struct{}{},
 	}
+	var changes []*SchemeChange
 	for id := range conf.SchemeManagers {
 		Logger.WithField("scheme", id).Info("Auto-updating scheme")
-		if err := conf.UpdateSchemeManager(id, &updated); err != nil {
-			return err
+		change, err := conf.UpdateSchemeManagerReport(ctx, id, &updated)
+		if err != nil {
+			conf.publishSchemeUpdateFailure(ctx, id, err)
+			if len(changes) > 0 {
+				_ = conf.parseUpdatedSchemes(changes)
+			}
+			return changes, err
+		}
+		if change != nil {
+			changes = append(changes, change)
 		}
 	}
-	if !updated.Empty() {
-		return conf.ParseFolder()
+	if len(changes) > 0 {
+		return changes, conf.parseUpdatedSchemes(changes)
 	}
-	return nil
+	return changes, nil
 }
 
 func (conf *Configuration) AutoUpdateSchemes(interval uint) {
 	Logger.Infof("Updating schemes every %d minutes", interval)
 
+	// Cancelled by StopAutoUpdateSchemes, aborting any update that is running at that moment
+	var ctx context.Context
+	ctx, conf.stopUpdates = context.WithCancel(context.Background())
+
 	conf.scheduler = gocron.NewScheduler()
 	conf.scheduler.Every(uint64(interval)).Minutes().Do(func() {
-		if err := conf.UpdateSchemes(); err != nil {
+		changes, err := conf.UpdateSchemesReport(ctx)
+		for _, change := range changes {
+			Logger.WithField("scheme", change.Scheme).Info("Installed new version of scheme:\n", change.String())
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			Logger.Error("Scheme autoupdater failed: ")
 			if e, ok := err.(*errors.Error); ok {
 				Logger.Error(e.ErrorStack())
@@ -1327,6 +1620,9 @@ func (conf *Configuration) AutoUpdateSchemes(interval uint) {
 }
 
 func (conf *Configuration) StopAutoUpdateSchemes() {
+	if conf.stopUpdates != nil {
+		conf.stopUpdates()
+	}
 	if conf.cronchan != nil {
 		Logger.Info("Stopped scheme autoupdater")
 		conf.cronchan <- true
@@ -1420,6 +1716,14 @@ func (conf *Configuration) validateScheme(scheme *SchemeManager, dir string) err
 			return errors.Errorf("Scheme %s has keyshare URL but no keyshare public key kss-0.pem", scheme.ID)
 		}
 	}
+	if err := ValidateCertificatePins(scheme.KeyshareServerPins); err != nil {
+		scheme.Status = SchemeManagerStatusParsingError
+		return errors.WrapPrefix(err, fmt.Sprintf("Scheme %s has invalid KeyshareServerPins", scheme.ID), 0)
+	}
+	if err := ValidateCertificatePins(scheme.SchemeServerPins); err != nil {
+		scheme.Status = SchemeManagerStatusParsingError
+		return errors.WrapPrefix(err, fmt.Sprintf("Scheme %s has invalid SchemeServerPins", scheme.ID), 0)
+	}
 	conf.validateTranslations(fmt.Sprintf("Scheme %s", scheme.ID), scheme)
 	return nil
 }
@@ -1,9 +1,30 @@
 package irma
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	gobig "math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -68,12 +89,731 @@ func TestRetryHTTPRequest(t *testing.T) {
 	defer test.StopBadHttpServer()
 
 	transport := NewHTTPTransport("http://localhost:48682")
-	transport.client.HTTPClient.Timeout = 500 * time.Millisecond
+	transport.Policy.Timeout = 500 * time.Millisecond
 	bts, err := transport.GetBytes("")
 	require.NoError(t, err)
 	require.Equal(t, "42\n", string(bts))
 }
 
+func TestHTTPRequestPolicy(t *testing.T) {
+	test.StartBadHttpServer(2, 1*time.Second, "42")
+	defer test.StopBadHttpServer()
+
+	// Without retries the bad server does not get the chance to succeed
+	transport := NewHTTPTransport("http://localhost:48682")
+	ctx := WithRequestPolicy(context.Background(), RequestPolicy{Timeout: 500 * time.Millisecond})
+	_, err := transport.GetBytesContext(ctx, "")
+	require.Error(t, err)
+}
+
+func TestHTTPRequestCancel(t *testing.T) {
+	test.StartBadHttpServer(1, 2*time.Second, "42")
+	defer test.StopBadHttpServer()
+
+	transport := NewHTTPTransport("http://localhost:48682")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := transport.GetBytesContext(ctx, "")
+	require.Error(t, err)
+	require.True(t, time.Since(start) < time.Second, "request was not aborted")
+}
+
+func TestHTTPCertificatePinning(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("42"))
+	}))
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	// Not trusted by the system CAs
+	transport := NewHTTPTransport(srv.URL)
+	_, err := transport.GetBytes("")
+	require.Error(t, err)
+
+	transport.SetRootCAs(pool)
+	bts, err := transport.GetBytes("")
+	require.NoError(t, err)
+	require.Equal(t, "42", string(bts))
+
+	require.NoError(t, transport.SetCertificatePins([]string{CertificatePin(srv.Certificate())}))
+	_, err = transport.GetBytes("")
+	require.NoError(t, err)
+
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	require.NoError(t, transport.SetCertificatePins([]string{wrongPin}))
+	_, err = transport.GetBytes("")
+	require.Error(t, err)
+
+	require.Error(t, transport.SetCertificatePins([]string{"not a pin"}))
+}
+
+func TestDiffScheme(t *testing.T) {
+	oldconf := parseConfiguration(t)
+	newconf, err := NewConfigurationReadOnly(filepath.Join("testdata", "irma_configuration_updated"))
+	require.NoError(t, err)
+	require.NoError(t, newconf.ParseFolder())
+
+	id := NewSchemeManagerIdentifier("irma-demo")
+	change, err := DiffScheme(oldconf, newconf, id)
+	require.NoError(t, err)
+	require.False(t, change.Empty())
+	require.Empty(t, change.Issuers)
+	require.Empty(t, change.CredentialTypes)
+	require.Empty(t, change.PublicKeys)
+	require.Equal(t, []DescriptionChange{
+		{ID: "irma-demo.RU.studentCard.level", Change: ChangeChanged, Fields: []string{"Optional"}},
+		{ID: "irma-demo.RU.studentCard.newAttribute", Change: ChangeAdded},
+	}, change.AttributeTypes)
+	require.Contains(t, change.String(), "+ attribute type irma-demo.RU.studentCard.newAttribute")
+
+	// Against an empty configuration, everything is new
+	emptyconf, err := NewConfigurationReadOnly(filepath.Join("testdata", "irma_configuration_updated"))
+	require.NoError(t, err)
+	change, err = DiffScheme(emptyconf, newconf, id)
+	require.NoError(t, err)
+	require.Nil(t, change.OldTimestamp)
+	require.Contains(t, change.Issuers, DescriptionChange{ID: "irma-demo.RU", Change: ChangeAdded})
+	require.NotEmpty(t, change.PublicKeys)
+	for _, key := range change.PublicKeys {
+		require.Equal(t, ChangeAdded, key.Change)
+	}
+
+	change, err = DiffScheme(oldconf, oldconf, id)
+	require.NoError(t, err)
+	require.True(t, change.Empty())
+}
+
+func TestMarshalDescriptions(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	cred := conf.CredentialTypes[NewCredentialTypeIdentifier("irma-demo.RU.studentCard")]
+	bts, err := xml.Marshal(cred)
+	require.NoError(t, err)
+	bts2, err := xml.Marshal(cred)
+	require.NoError(t, err)
+	require.Equal(t, bts, bts2, "marshaling should be deterministic")
+	require.NotContains(t, string(bts), "DeprecatedSince")
+	require.NotContains(t, string(bts), `optional=""`)
+
+	parsed := &CredentialType{}
+	require.NoError(t, xml.Unmarshal(bts, parsed))
+	require.Equal(t, cred.Name, parsed.Name)
+	require.Equal(t, cred.IssuerID, parsed.IssuerID)
+	require.Len(t, parsed.AttributeTypes, len(cred.AttributeTypes))
+	for i, attr := range cred.AttributeTypes {
+		require.Equal(t, attr.ID, parsed.AttributeTypes[i].ID)
+		require.Equal(t, attr.Optional, parsed.AttributeTypes[i].Optional)
+		require.Equal(t, attr.Name, parsed.AttributeTypes[i].Name)
+	}
+}
+
+func TestLintScheme(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	_, err := conf.LintScheme(NewSchemeManagerIdentifier("nonexisting"), nil)
+	require.Error(t, err)
+
+	findings, err := conf.LintScheme(NewSchemeManagerIdentifier("irma-demo"), nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, findings)
+
+	found := map[string]*LintFinding{}
+	for i, finding := range findings {
+		if i > 0 {
+			require.True(t, findings[i-1].Severity.AtLeast(finding.Severity), "findings should be sorted by severity")
+		}
+		found[finding.Check+" "+finding.Subject+" "+finding.File] = finding
+	}
+
+	// The latest public key of MijnOverheid in the testdata has expired
+	finding := found["keyexpiry irma-demo.MijnOverheid irma-demo/MijnOverheid/PublicKeys/2.xml"]
+	require.NotNil(t, finding)
+	require.Equal(t, LintError, finding.Severity)
+
+	// Private keys of older public keys are not used
+	finding = found["privatekeys irma-demo.RU irma-demo/RU/PrivateKeys/0.xml"]
+	require.NotNil(t, finding)
+	require.Equal(t, LintInfo, finding.Severity)
+	require.Nil(t, found["privatekeys irma-demo.RU irma-demo/RU/PrivateKeys/2.xml"])
+
+	// Empty IssueURLs are allowed
+	require.Nil(t, found["translations irma-demo.RU.studentCard irma-demo/RU/Issues/studentCard/description.xml"])
+
+	finding = found["logo irma-demo.RU irma-demo/RU/logo.png"]
+	require.NotNil(t, finding)
+	require.Equal(t, LintWarning, finding.Severity)
+	findings, err = conf.LintScheme(NewSchemeManagerIdentifier("irma-demo"), &LintOptions{LogoMinSize: 100})
+	require.NoError(t, err)
+	for _, finding := range findings {
+		require.NotEqual(t, "irma-demo/RU/logo.png", finding.File)
+	}
+
+	// Additional languages
+	findings, err = conf.LintScheme(NewSchemeManagerIdentifier("irma-demo"), &LintOptions{Languages: []string{"en", "nl", "de"}})
+	require.NoError(t, err)
+	var translations int
+	for _, finding := range findings {
+		if finding.Check == LintCheckTranslations {
+			translations++
+		}
+	}
+	require.NotZero(t, translations)
+}
+
+func TestLintEncryptedPrivateKeys(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	conf, err := NewConfigurationFromAssets(filepath.Join("testdata", "storage", "test", "irma_configuration"),
+		filepath.Join("testdata", "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	keydir := filepath.Join(conf.Path, "irma-demo", "RU", "PrivateKeys")
+	for _, file := range []string{"0.xml.enc", "2.xml.enc", "7.xml.enc"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(keydir, file), []byte("encrypted"), 0600))
+	}
+	findings, err := conf.LintScheme(NewSchemeManagerIdentifier("irma-demo"), nil)
+	require.NoError(t, err)
+	found := map[string]*LintFinding{}
+	for _, finding := range findings {
+		found[finding.Check+" "+finding.Subject+" "+finding.File] = finding
+	}
+
+	finding := found["privatekeys irma-demo.RU irma-demo/RU/PrivateKeys/0.xml.enc"]
+	require.NotNil(t, finding)
+	require.Equal(t, LintInfo, finding.Severity)
+	finding = found["privatekeys irma-demo.RU irma-demo/RU/PrivateKeys/7.xml.enc"]
+	require.NotNil(t, finding)
+	require.Equal(t, LintError, finding.Severity)
+	require.Nil(t, found["privatekeys irma-demo.RU irma-demo/RU/PrivateKeys/2.xml.enc"])
+	require.Nil(t, found["unsigned irma-demo irma-demo/RU/PrivateKeys/2.xml.enc"])
+}
+
+func TestPrivateKeyNewestNonexpired(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	// Public key 2 of MijnOverheid has expired, but public key 1 has not
+	sk, err := conf.PrivateKey(NewIssuerIdentifier("irma-demo.MijnOverheid"))
+	require.NoError(t, err)
+	require.NotNil(t, sk)
+	require.Equal(t, uint(1), sk.Counter)
+
+	// Public key 2 of RU is the newest and not expired
+	sk, err = conf.PrivateKey(NewIssuerIdentifier("irma-demo.RU"))
+	require.NoError(t, err)
+	require.NotNil(t, sk)
+	require.Equal(t, uint(2), sk.Counter)
+
+	sk, err = conf.PrivateKey(NewIssuerIdentifier("irma-demo.nonexisting"))
+	require.NoError(t, err)
+	require.Nil(t, sk)
+}
+
+func TestPrivateKeyRotationWithoutReparse(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	conf, err := NewConfigurationFromAssets(filepath.Join("testdata", "storage", "test", "irma_configuration"),
+		filepath.Join("testdata", "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	id := NewIssuerIdentifier("irma-demo.RU")
+	keydir := filepath.Join(conf.Path, "irma-demo", "RU", "PrivateKeys")
+	newest := filepath.Join(keydir, "2.xml")
+	aside := filepath.Join(conf.Path, "2.xml")
+	require.NoError(t, os.Rename(newest, aside))
+
+	sk, err := conf.PrivateKey(id)
+	require.NoError(t, err)
+	require.NotNil(t, sk)
+	require.Equal(t, uint(1), sk.Counter)
+
+	// A newer private key added to the folder is used, without parsing the configuration again
+	require.NoError(t, os.Rename(aside, newest))
+	sk, err = conf.PrivateKey(id)
+	require.NoError(t, err)
+	require.NotNil(t, sk)
+	require.Equal(t, uint(2), sk.Counter)
+
+	// Removed private keys are no longer returned
+	require.NoError(t, os.RemoveAll(keydir))
+	sk, err = conf.PrivateKey(id)
+	require.NoError(t, err)
+	require.Nil(t, sk)
+}
+
+func TestPrivateKeyConcurrent(t *testing.T) {
+	conf := parseConfiguration(t)
+	ids := []IssuerIdentifier{NewIssuerIdentifier("irma-demo.RU"), NewIssuerIdentifier("irma-demo.MijnOverheid")}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(id IssuerIdentifier) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				sk, err := conf.PrivateKey(id)
+				require.NoError(t, err)
+				require.NotNil(t, sk)
+			}
+		}(ids[i%len(ids)])
+	}
+	wg.Wait()
+}
+
+func TestSchemeMirror(t *testing.T) {
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	conf, err := NewConfigurationFromAssets(filepath.Join("testdata", "storage", "test", "irma_configuration"),
+		filepath.Join("testdata", "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	id := NewSchemeManagerIdentifier("irma-demo")
+	require.Equal(t, "http://localhost:48681/irma_configuration/irma-demo", conf.SchemeURL(conf.SchemeManagers[id]))
+
+	// A mirror containing a newer version of the scheme, signed by the same key
+	conf.SchemeMirrorURL = "http://localhost:48681/irma_configuration_updated/"
+	require.Equal(t, "http://localhost:48681/irma_configuration_updated/irma-demo", conf.SchemeURL(conf.SchemeManagers[id]))
+	change, err := conf.UpdateSchemeManagerReport(context.Background(), id, nil)
+	require.NoError(t, err)
+	require.NotNil(t, change)
+	require.NoError(t, conf.ParseFolder())
+	require.Contains(t, conf.AttributeTypes, NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute"))
+	// The scheme URL itself is unaffected
+	require.Equal(t, "http://localhost:48681/irma_configuration/irma-demo", conf.SchemeManagers[id].URL)
+
+	// A mirror serving a scheme whose contents do not match its index is rejected
+	mirror := filepath.Join("testdata", "storage", "test", "mirror")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration_updated", "irma-demo"), filepath.Join(mirror, "irma-demo")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mirror, "irma-demo", "RU", "Issues", "studentCard", "description.xml"), []byte("<IssueSpecification/>"), 0600))
+	server := httptest.NewServer(http.FileServer(http.Dir(mirror)))
+	defer server.Close()
+	conf, err = NewConfigurationFromAssets(filepath.Join("testdata", "storage", "test", "irma_configuration2"),
+		filepath.Join("testdata", "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	conf.SchemeMirrorURL = server.URL
+	_, err = conf.UpdateSchemeManagerReport(context.Background(), id, nil)
+	require.Error(t, err)
+	require.NotContains(t, conf.AttributeTypes, NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute"))
+}
+
+func TestSchemeMirrorPublicKey(t *testing.T) {
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	conf, err := NewConfigurationFromAssets(filepath.Join("testdata", "storage", "test", "irma_configuration"),
+		filepath.Join("testdata", "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	id := NewSchemeManagerIdentifier("irma-demo")
+	pkpath := filepath.Join(conf.Path, "irma-demo", "pk.pem")
+	pk, err := ioutil.ReadFile(pkpath)
+	require.NoError(t, err)
+
+	// A mirror serving the scheme with another public key, with which it signed the index
+	mirror := filepath.Join("testdata", "storage", "test", "mirror")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration_updated", "irma-demo"), filepath.Join(mirror, "irma-demo")))
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	pkbts, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mirror, "irma-demo", "pk.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkbts}), 0600))
+	index, err := ioutil.ReadFile(filepath.Join(mirror, "irma-demo", "index"))
+	require.NoError(t, err)
+	hash := sha256.Sum256(index)
+	r, s, err := ecdsa.Sign(rand.Reader, sk, hash[:])
+	require.NoError(t, err)
+	sig, err := asn1.Marshal([]*gobig.Int{r, s})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mirror, "irma-demo", "index.sig"), sig, 0600))
+	server := httptest.NewServer(http.FileServer(http.Dir(mirror)))
+	defer server.Close()
+	conf.SchemeMirrorURL = server.URL
+
+	// The public key is never downloaded from the mirror
+	require.Error(t, conf.InstallSchemeManager(NewSchemeManager("irma-demo"), nil))
+	downloaded, err := conf.DownloadSchemePublicKey(conf.SchemeManagers[id])
+	require.NoError(t, err)
+	require.Equal(t, pk, downloaded)
+
+	// Reinstalling keeps the stored public key, so the mirror's version of the scheme is rejected
+	require.Error(t, conf.ReinstallSchemeManager(conf.SchemeManagers[id]))
+	stored, err := ioutil.ReadFile(pkpath)
+	require.NoError(t, err)
+	require.Equal(t, pk, stored)
+}
+
+func TestSchemeUpdateConditionalParallel(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	var mutex sync.Mutex
+	var requests, conditional []string
+	fileserver := http.FileServer(http.Dir(filepath.Join("testdata", "irma_configuration_updated")))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests = append(requests, r.URL.Path)
+		if r.Header.Get("If-Modified-Since") != "" {
+			conditional = append(conditional, r.URL.Path)
+		}
+		mutex.Unlock()
+		fileserver.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	conf, err := NewConfigurationFromAssets(filepath.Join("testdata", "storage", "test", "irma_configuration"),
+		filepath.Join("testdata", "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	conf.SchemeMirrorURL = server.URL
+	conf.DownloadConcurrency = 2
+	var progress []SchemeUpdateProgress
+	conf.UpdateProgress = func(p *SchemeUpdateProgress) {
+		progress = append(progress, *p)
+	}
+	id := NewSchemeManagerIdentifier("irma-demo")
+
+	change, err := conf.UpdateSchemeManagerReport(context.Background(), id, nil)
+	require.NoError(t, err)
+	require.NotNil(t, change)
+	require.NoError(t, conf.ParseFolder())
+	require.Contains(t, conf.AttributeTypes, NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute"))
+
+	// Progress is reported before downloading and after each file
+	require.True(t, len(progress) > 1)
+	first, last := progress[0], progress[len(progress)-1]
+	require.Equal(t, id, first.Scheme)
+	require.Zero(t, first.Downloaded)
+	require.Equal(t, len(progress)-1, last.Total)
+	require.Equal(t, last.Total, last.Downloaded)
+	require.NotZero(t, last.Bytes)
+	require.Empty(t, conditional)
+
+	// The scheme is now up to date, so the timestamp is requested conditionally and not
+	// found to be modified, after which nothing else is downloaded
+	mutex.Lock()
+	requests = nil
+	mutex.Unlock()
+	change, err = conf.UpdateSchemeManagerReport(context.Background(), id, nil)
+	require.NoError(t, err)
+	require.Nil(t, change)
+	require.Equal(t, []string{"/irma-demo/timestamp"}, requests)
+	require.Equal(t, []string{"/irma-demo/timestamp"}, conditional)
+}
+
+func TestSchemeDownloadTimeout(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	fileserver := http.FileServer(http.Dir(filepath.Join("testdata", "irma_configuration_updated")))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fileserver.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	conf, err := NewConfigurationFromAssets(filepath.Join("testdata", "storage", "test", "irma_configuration"),
+		filepath.Join("testdata", "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	conf.SchemeMirrorURL = server.URL
+	id := NewSchemeManagerIdentifier("irma-demo")
+
+	// Scheme downloads are not subject to the short timeout of DefaultRequestPolicy
+	transport, err := conf.schemeTransport(conf.SchemeManagers[id])
+	require.NoError(t, err)
+	require.Equal(t, defaultDownloadTimeout, transport.Policy.Timeout)
+
+	conf.DownloadTimeout = 50 * time.Millisecond
+	conf.transports = newSchemeTransports()
+	_, err = conf.UpdateSchemeManagerReport(context.Background(), id, nil)
+	require.Error(t, err)
+
+	conf.DownloadTimeout = 5 * time.Second
+	conf.transports = newSchemeTransports()
+	_, err = conf.UpdateSchemeManagerReport(context.Background(), id, nil)
+	require.NoError(t, err)
+}
+
+func TestRecoverStagingFolders(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	conf, err := NewConfigurationFromAssets(filepath.Join("testdata", "storage", "test", "irma_configuration"),
+		filepath.Join("testdata", "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	stagingFolder := func(pid int, age time.Duration) string {
+		path := filepath.Join(conf.Path, fmt.Sprintf("%sirma-demo-%d-123", schemeStagingPrefix, pid))
+		require.NoError(t, os.MkdirAll(filepath.Join(path, "irma-demo"), 0700))
+		modified := time.Now().Add(-age)
+		require.NoError(t, os.Chtimes(filepath.Join(path, "irma-demo"), modified, modified))
+		require.NoError(t, os.Chtimes(path, modified, modified))
+		return path
+	}
+	otherPid := os.Getpid() + 1
+	ours := stagingFolder(os.Getpid(), 0)
+	recent := stagingFolder(otherPid, time.Minute)
+	old := stagingFolder(otherPid+1, 2*staleStagingAge)
+	active, err := conf.stageSchemeFolder(NewSchemeManagerIdentifier("irma-demo"), false)
+	require.NoError(t, err)
+	defer active.removeStagingFolder()
+
+	// Only our own staging folders that are no longer in use, and old ones of other processes,
+	// are removed; other processes may still be using theirs
+	require.NoError(t, conf.ParseFolder())
+	for path, exists := range map[string]bool{ours: false, recent: true, old: false, active.Path: true} {
+		e, err := fs.PathExists(path)
+		require.NoError(t, err)
+		require.Equal(t, exists, e, path)
+	}
+}
+
+func TestSchemeEvents(t *testing.T) {
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	// Only irma-demo, of which the mirror below contains a newer version
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), filepath.Join(path, "irma-demo")))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	id := NewSchemeManagerIdentifier("irma-demo")
+
+	var events []*SchemeEvent
+	unsubscribe := conf.SubscribeSchemeEvents(func(event *SchemeEvent) {
+		events = append(events, event)
+	})
+
+	// A failing update
+	conf.SchemeMirrorURL = "http://localhost:48681/nonexisting"
+	require.Error(t, conf.UpdateSchemes())
+	require.Len(t, events, 1)
+	require.Equal(t, SchemeEventUpdateFailed, events[0].Type)
+	require.Error(t, events[0].Err)
+
+	// A successful update of irma-demo, published once it has been parsed
+	events = nil
+	conf.SchemeMirrorURL = "http://localhost:48681/irma_configuration_updated/"
+	var parsed bool
+	conf.SubscribeSchemeEvents(func(event *SchemeEvent) {
+		_, parsed = conf.AttributeTypes[NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")]
+	})
+	require.NoError(t, conf.UpdateSchemes())
+	require.True(t, parsed)
+	require.Len(t, events, 1)
+	require.Equal(t, SchemeEventUpdated, events[0].Type)
+	require.Equal(t, id, events[0].Scheme)
+	require.NotNil(t, events[0].Change)
+	require.Equal(t, conf.SchemeManagers[id].Timestamp, *events[0].Change.NewTimestamp)
+
+	// Events derived from the changes
+	events = nil
+	deprecated := Timestamp(time.Now())
+	conf.publishSchemeChange(&SchemeChange{
+		Scheme: id,
+		CredentialTypes: []DescriptionChange{
+			{ID: "irma-demo.RU.studentCard", Change: ChangeChanged, Fields: []string{"DeprecatedSince"},
+				OldDeprecatedSince: &Timestamp{}, NewDeprecatedSince: &deprecated},
+			{ID: "irma-demo.MijnOverheid.root", Change: ChangeChanged, Fields: []string{"Name"}},
+		},
+		PublicKeys: []PublicKeyChange{
+			{Issuer: NewIssuerIdentifier("irma-demo.RU"), Counter: 3, Change: ChangeAdded},
+			{Issuer: NewIssuerIdentifier("irma-demo.RU"), Counter: 0, Change: ChangeExpired},
+		},
+	})
+	require.Len(t, events, 3)
+	require.Equal(t, SchemeEventUpdated, events[0].Type)
+	require.Equal(t, SchemeEventCredentialTypeDeprecated, events[1].Type)
+	require.Equal(t, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), *events[1].CredentialType)
+	require.Equal(t, SchemeEventPublicKeyAdded, events[2].Type)
+	require.Equal(t, uint(3), events[2].PublicKey.Counter)
+
+	// After unsubscribing no events are received anymore
+	events = nil
+	unsubscribe()
+	conf.publishSchemeChange(&SchemeChange{Scheme: id})
+	require.Empty(t, events)
+}
+
+func TestSchemeBundle(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	id := NewSchemeManagerIdentifier("irma-demo")
+	bundle := func(path string, id SchemeManagerIdentifier) []byte {
+		conf, err := NewConfigurationReadOnly(path)
+		require.NoError(t, err)
+		require.NoError(t, conf.ParseFolder())
+		var buf bytes.Buffer
+		require.NoError(t, conf.BundleScheme(id, &buf))
+		return buf.Bytes()
+	}
+	oldBundle := bundle(filepath.Join("testdata", "irma_configuration"), id)
+	newBundle := bundle(filepath.Join("testdata", "irma_configuration_updated"), id)
+
+	path := filepath.Join("testdata", "storage", "test", "irma_configuration")
+	require.NoError(t, fs.EnsureDirectoryExists(path))
+	conf, err := NewConfiguration(path)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	// Unknown scheme without public key to verify against
+	testBundle := bundle(filepath.Join("testdata", "irma_configuration"), NewSchemeManagerIdentifier("test"))
+	_, err = conf.InstallSchemeBundle(bytes.NewReader(testBundle), nil, false)
+	require.Error(t, err)
+
+	// Wrong public key
+	wrongpk, err := ioutil.ReadFile(filepath.Join("testdata", "irma_configuration", "test", "pk.pem"))
+	require.NoError(t, err)
+	_, err = conf.InstallSchemeBundle(bytes.NewReader(oldBundle), wrongpk, false)
+	require.Error(t, err)
+
+	// irma-demo is verified against its public key in DefaultSchemeManagers
+	installed, err := conf.InstallSchemeBundle(bytes.NewReader(oldBundle), nil, false)
+	require.NoError(t, err)
+	require.Equal(t, id, installed)
+	require.True(t, conf.SchemeManagers[id].Valid)
+	require.Contains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+	require.NotContains(t, conf.AttributeTypes, NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute"))
+
+	installed, err = conf.InstallSchemeBundle(bytes.NewReader(testBundle), wrongpk, false)
+	require.NoError(t, err)
+	require.Equal(t, NewSchemeManagerIdentifier("test"), installed)
+
+	// Update using the installed public key
+	_, err = conf.InstallSchemeBundle(bytes.NewReader(newBundle), nil, false)
+	require.NoError(t, err)
+	require.Contains(t, conf.AttributeTypes, NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute"))
+
+	// Downgrading requires allowOlder
+	_, err = conf.InstallSchemeBundle(bytes.NewReader(oldBundle), nil, false)
+	require.Error(t, err)
+	_, err = conf.InstallSchemeBundle(bytes.NewReader(oldBundle), nil, true)
+	require.NoError(t, err)
+	require.NotContains(t, conf.AttributeTypes, NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute"))
+
+	// Tampered bundle
+	tampered := tamperSchemeBundle(t, oldBundle, "irma-demo/RU/description.xml")
+	_, err = conf.InstallSchemeBundle(bytes.NewReader(tampered), nil, true)
+	require.Error(t, err)
+	require.True(t, conf.SchemeManagers[id].Valid)
+
+	// Files not in the index are refused, except for private keys of demo schemes
+	_, err = conf.InstallSchemeBundle(bytes.NewReader(addToSchemeBundle(t, oldBundle, "irma-demo/README.md")), nil, true)
+	require.Error(t, err)
+	_, err = conf.InstallSchemeBundle(bytes.NewReader(addToSchemeBundle(t, oldBundle, "irma-demo/RU/PrivateKeys/3.xml.enc")), nil, true)
+	require.Error(t, err)
+	_, err = conf.InstallSchemeBundle(bytes.NewReader(addToSchemeBundle(t, testBundle, "test/sk.pem")), wrongpk, true)
+	require.Error(t, err)
+	_, err = conf.InstallSchemeBundle(bytes.NewReader(addToSchemeBundle(t, testBundle, "test/test/PrivateKeys/0.xml")), wrongpk, true)
+	require.Error(t, err)
+	require.NoError(t, fs.AssertPathNotExists(filepath.Join(path, "test", "sk.pem")))
+}
+
+// addToSchemeBundle returns a copy of the scheme bundle to which the specified file is added.
+func addToSchemeBundle(t *testing.T, bundle []byte, file string) []byte {
+	gzr, err := gzip.NewReader(bytes.NewReader(bundle))
+	require.NoError(t, err)
+	tr := tar.NewReader(gzr)
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, tw.WriteHeader(header))
+		_, err = io.Copy(tw, tr)
+		require.NoError(t, err)
+	}
+	bts := []byte("added")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: file, Mode: 0644, Size: int64(len(bts)), Typeflag: tar.TypeReg}))
+	_, err = tw.Write(bts)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gzw.Close())
+	return buf.Bytes()
+}
+
+// tamperSchemeBundle returns a copy of the scheme bundle in which the specified file is modified.
+func tamperSchemeBundle(t *testing.T, bundle []byte, file string) []byte {
+	gzr, err := gzip.NewReader(bytes.NewReader(bundle))
+	require.NoError(t, err)
+	tr := tar.NewReader(gzr)
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		bts, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		if header.Name == file {
+			bts = append(bts, ' ')
+			header.Size++
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		_, err = tw.Write(bts)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gzw.Close())
+	return buf.Bytes()
+}
+
+func TestSchemeServerPinning(t *testing.T) {
+	test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t)
+
+	srv := httptest.NewTLSServer(http.FileServer(http.Dir(filepath.Join("testdata", "irma_configuration_updated"))))
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	conf, err := NewConfigurationFromAssets(filepath.Join("testdata", "storage", "test", "irma_configuration"),
+		filepath.Join("testdata", "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	id := NewSchemeManagerIdentifier("irma-demo")
+	scheme := conf.SchemeManagers[id]
+	scheme.URL = srv.URL + "/irma-demo"
+	conf.RootCAs = pool
+
+	// A scheme pinning another certificate than that of its server can't be downloaded
+	scheme.SchemeServerPins = []string{base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))}
+	_, err = conf.UpdateSchemeManagerReport(context.Background(), id, nil)
+	require.Error(t, err)
+
+	scheme.SchemeServerPins = []string{CertificatePin(srv.Certificate())}
+	change, err := conf.UpdateSchemeManagerReport(context.Background(), id, nil)
+	require.NoError(t, err)
+	require.NotNil(t, change)
+}
+
 func TestInvalidIrmaConfigurationRestoreFromRemote(t *testing.T) {
 	test.StartSchemeManagerHttpServer()
 	defer test.StopSchemeManagerHttpServer()
@@ -0,0 +1,189 @@
+package irma
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// LocalTransport sends and receives IRMA protocol messages over a local bidirectional byte stream,
+// such as a Unix socket, a pipe, or a Bluetooth or NFC channel, allowing IRMA sessions to be
+// performed when the IRMA app and the server are in proximity of each other but not necessarily online.
+//
+// Each message is a frame (see WriteFrame) containing a LocalRequest or LocalResponse; for each
+// LocalRequest sent to the server, the server sends back exactly one LocalResponse.
+type LocalTransport struct {
+	Server  string
+	conn    io.ReadWriter
+	headers map[string][]string
+	mutex   sync.Mutex
+}
+
+var _ Transport = (*LocalTransport)(nil)
+
+// LocalRequest is a request sent by the IRMA app to the server over a LocalTransport.
+type LocalRequest struct {
+	Method  string              `json:"method"`
+	URL     string              `json:"url"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	Body    []byte              `json:"body,omitempty"`
+}
+
+// LocalResponse is a response sent by the server to the IRMA app over a LocalTransport.
+type LocalResponse struct {
+	Status int    `json:"status"`
+	Body   []byte `json:"body,omitempty"`
+}
+
+// MaxFrameSize is the maximum size of frames read by ReadFrame.
+const MaxFrameSize = 1 << 24
+
+// NewLocalTransport returns a new LocalTransport sending messages over the specified stream.
+// The serverURL is prepended to the URL of each request.
+func NewLocalTransport(conn io.ReadWriter, serverURL string) *LocalTransport {
+	url := serverURL
+	if serverURL != "" && !strings.HasSuffix(url, "/") {
+		url += "/"
+	}
+	return &LocalTransport{
+		Server:  url,
+		conn:    conn,
+		headers: map[string][]string{},
+	}
+}
+
+// WriteFrame writes the JSON serialization of the message to w, prefixed with its length
+// as a 4-byte big endian unsigned integer.
+func WriteFrame(w io.Writer, message interface{}) error {
+	bts, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(bts))
+	binary.BigEndian.PutUint32(frame, uint32(len(bts)))
+	copy(frame[4:], bts)
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadFrame reads a frame as written by WriteFrame from r, and unmarshals it into message.
+// If the stream was closed before anything was read, io.EOF is returned.
+func ReadFrame(r io.Reader, message interface{}) error {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > MaxFrameSize {
+		return errors.Errorf("frame too large (%d bytes)", size)
+	}
+	bts := make([]byte, size)
+	if _, err := io.ReadFull(r, bts); err != nil {
+		return err
+	}
+	return json.Unmarshal(bts, message)
+}
+
+// SetHeader sets a header to be sent in requests.
+func (transport *LocalTransport) SetHeader(name, val string) {
+	transport.headers[http.CanonicalHeaderKey(name)] = []string{val}
+}
+
+func (transport *LocalTransport) request(
+	ctx context.Context, url string, method string, result interface{}, object interface{},
+) error {
+	body, _, err := marshalBody(object)
+	if err != nil {
+		return err
+	}
+
+	// Each request must be followed by its response before the next request can be sent
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	if err = ctx.Err(); err != nil {
+		return &SessionError{ErrorType: ErrorTransport, Err: err}
+	}
+	defer transport.watch(ctx)()
+
+	err = WriteFrame(transport.conn, &LocalRequest{
+		Method:  method,
+		URL:     transport.Server + url,
+		Headers: transport.headers,
+		Body:    body,
+	})
+	if err != nil {
+		return &SessionError{ErrorType: ErrorTransport, Err: err}
+	}
+	res := &LocalResponse{}
+	if err = ReadFrame(transport.conn, res); err != nil {
+		return &SessionError{ErrorType: ErrorTransport, Err: err}
+	}
+	if method == http.MethodDelete {
+		return nil
+	}
+	return unmarshalResponse(res.Status, res.Body, result)
+}
+
+// watch aborts pending reads and writes when the context is done, if the underlying stream
+// supports deadlines (as e.g. net.Conn does). The returned function stops watching.
+func (transport *LocalTransport) watch(ctx context.Context) func() {
+	conn, ok := transport.conn.(interface{ SetDeadline(time.Time) error })
+	if !ok || ctx.Done() == nil {
+		return func() {}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		_ = conn.SetDeadline(time.Time{})
+	}
+}
+
+// Post sends the object to the server and parses its response into result.
+func (transport *LocalTransport) Post(url string, result interface{}, object interface{}) error {
+	return transport.PostContext(context.Background(), url, result, object)
+}
+
+// PostContext sends the object to the server and parses its response into result,
+// aborting when the context is cancelled.
+func (transport *LocalTransport) PostContext(ctx context.Context, url string, result interface{}, object interface{}) error {
+	return transport.request(ctx, url, http.MethodPost, result, object)
+}
+
+// Get performs a GET request and parses the server's response into result.
+func (transport *LocalTransport) Get(url string, result interface{}) error {
+	return transport.GetContext(context.Background(), url, result)
+}
+
+// GetContext performs a GET request and parses the server's response into result,
+// aborting when the context is cancelled.
+func (transport *LocalTransport) GetContext(ctx context.Context, url string, result interface{}) error {
+	return transport.request(ctx, url, http.MethodGet, result, nil)
+}
+
+// Delete performs a DELETE.
+func (transport *LocalTransport) Delete() {
+	_ = transport.DeleteContext(context.Background())
+}
+
+// DeleteContext performs a DELETE, aborting when the context is cancelled.
+func (transport *LocalTransport) DeleteContext(ctx context.Context) error {
+	return transport.request(ctx, "", http.MethodDelete, nil, nil)
+}
@@ -0,0 +1,80 @@
+package irma
+
+import (
+	"encoding/json"
+
+	"github.com/go-errors/errors"
+)
+
+const LDContextReceipt = "https://irma.app/ld/receipt/v1"
+
+// Receipt is a portable record of a completed disclosure or attribute-based signature session,
+// containing the session request, the disclosure or signature made by the user, and the name of
+// the requestor and the time of the session as recorded by the user's IRMA app. It can be verified
+// offline against a snapshot of the schemes using Verify.
+//
+// ServerName and Time are not covered by the disclosure or signature: they are stated by the app
+// that exported the receipt and must not be relied upon.
+type Receipt struct {
+	LDContext  string           `json:"@context"`
+	Action     Action           `json:"action"`
+	ServerName TranslatedString `json:"serverName,omitempty"` // Unverified
+	Time       Timestamp        `json:"time"`                 // Unverified
+	Request    SessionRequest   `json:"request"`              // *DisclosureRequest or *SignatureRequest, depending on Action
+
+	Disclosure    *Disclosure    `json:"disclosure,omitempty"`    // Disclosure sessions
+	SignedMessage *SignedMessage `json:"signedMessage,omitempty"` // Signature sessions
+}
+
+func (r *Receipt) UnmarshalJSON(bts []byte) error {
+	type receipt Receipt // Same type, without this method
+	var tmp struct {
+		receipt
+		Request json.RawMessage `json:"request"`
+	}
+	if err := json.Unmarshal(bts, &tmp); err != nil {
+		return err
+	}
+	*r = Receipt(tmp.receipt)
+
+	switch r.Action {
+	case ActionDisclosing:
+		r.Request = &DisclosureRequest{}
+	case ActionSigning:
+		r.Request = &SignatureRequest{}
+	default:
+		return errors.Errorf("Unsupported receipt action %s", r.Action)
+	}
+	return json.Unmarshal(tmp.Request, r.Request)
+}
+
+// Verify verifies the disclosure or attribute-based signature of the receipt against its request.
+//
+// An attribute-based signature is verified as in SignedMessage.Verify, so that its timestamp, if
+// present, establishes when the attributes were valid. A disclosure contains no such proof of
+// time, so as in Disclosure.Verify it is checked that the disclosed credentials are valid now;
+// the unverified Time of the receipt is not used. A valid disclosure receipt only shows that the
+// disclosure was made in response to the request, which typically contains a nonce chosen by the
+// requestor.
+func (r *Receipt) Verify(configuration *Configuration) ([][]*DisclosedAttribute, ProofStatus, error) {
+	if r.LDContext != LDContextReceipt {
+		return nil, ProofStatusInvalid, errors.Errorf("Unsupported receipt context %s", r.LDContext)
+	}
+
+	switch r.Action {
+	case ActionDisclosing:
+		request, ok := r.Request.(*DisclosureRequest)
+		if !ok || r.Disclosure == nil {
+			return nil, ProofStatusInvalid, errors.New("Disclosure receipt must contain a disclosure request and a disclosure")
+		}
+		return r.Disclosure.Verify(configuration, request)
+	case ActionSigning:
+		request, ok := r.Request.(*SignatureRequest)
+		if !ok || r.SignedMessage == nil {
+			return nil, ProofStatusInvalid, errors.New("Signature receipt must contain a signature request and a signed message")
+		}
+		return r.SignedMessage.Verify(configuration, request)
+	default:
+		return nil, ProofStatusInvalid, errors.Errorf("Unsupported receipt action %s", r.Action)
+	}
+}
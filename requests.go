@@ -659,6 +659,9 @@ func (t Timestamp) IsZero() bool {
 }
 
 func (t *Timestamp) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if t.IsZero() {
+		return nil
+	}
 	return e.EncodeElement(t.String(), start)
 }
 
@@ -0,0 +1,252 @@
+package irma
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// A scheme bundle is a gzipped tar archive containing a scheme folder, i.e. its index, the
+// signature over it, the public key and all files listed in the index, and for demo schemes the
+// private keys. As all other files are authenticated by the signed index, the bundle as a whole is
+// signed by the scheme.
+
+// Maximum total size of the files in a scheme bundle.
+const maxSchemeBundleSize = 64 << 20
+
+// The files of a scheme bundle that are not in its index, apart from the private keys of demo schemes
+var schemeBundleUnsignedFiles = map[string]bool{"index": true, "index.sig": true, "pk.pem": true}
+
+// Private keys of demo schemes, relative to the scheme folder
+var schemeBundlePrivateKey = regexp.MustCompile(`^(sk\.pem|[^/]+/PrivateKeys/\d+\.xml)$`)
+
+// BundleScheme writes the specified scheme as a scheme bundle to w, after verifying it.
+func (conf *Configuration) BundleScheme(id SchemeManagerIdentifier, w io.Writer) error {
+	manager := conf.SchemeManagers[id]
+	if manager == nil || !manager.Valid {
+		return errors.Errorf("Scheme %s is unknown or invalid", id)
+	}
+	if err := conf.VerifySchemeManager(manager); err != nil {
+		return err
+	}
+
+	files := []string{"index", "index.sig", "pk.pem"}
+	for file := range manager.index {
+		files = append(files, strings.TrimPrefix(file, id.Name()+"/"))
+	}
+	if manager.Demo {
+		keys, err := filepath.Glob(filepath.Join(conf.Path, id.Name(), "*", "PrivateKeys", "*.xml"))
+		if err != nil {
+			return err
+		}
+		if exists, _ := fs.PathExists(filepath.Join(conf.Path, id.Name(), "sk.pem")); exists {
+			keys = append(keys, filepath.Join(conf.Path, id.Name(), "sk.pem"))
+		}
+		for _, key := range keys {
+			rel, err := filepath.Rel(filepath.Join(conf.Path, id.Name()), key)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+	}
+	sort.Strings(files)
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		bts, err := ioutil.ReadFile(filepath.Join(conf.Path, id.Name(), filepath.FromSlash(file)))
+		if err != nil {
+			return errors.WrapPrefix(err, "Scheme "+id.String()+" is incomplete", 0)
+		}
+		header := &tar.Header{
+			Name:     id.Name() + "/" + file,
+			Mode:     0644,
+			Size:     int64(len(bts)),
+			ModTime:  time.Time(manager.Timestamp),
+			Typeflag: tar.TypeReg,
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err = tw.Write(bts); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// InstallSchemeBundle installs or updates the scheme contained in the scheme bundle read from r,
+// after verifying it against the specified public key. If publickey is nil, the public key of the
+// scheme if it is already present in this Configuration is used, or otherwise the public key of
+// the scheme in DefaultSchemeManagers. Unless allowOlder is true, it refuses to replace the
+// installed version of the scheme by an older version. Afterwards ParseFolder is called.
+func (conf *Configuration) InstallSchemeBundle(r io.Reader, publickey []byte, allowOlder bool) (SchemeManagerIdentifier, error) {
+	var id SchemeManagerIdentifier
+	if conf.readOnly {
+		return id, errors.New("cannot install scheme into a read-only configuration")
+	}
+	id, files, err := readSchemeBundle(r)
+	if err != nil {
+		return id, errors.WrapPrefix(err, "Invalid scheme bundle", 0)
+	}
+
+	if publickey == nil {
+		if publickey, err = conf.schemePublicKey(id); err != nil {
+			return id, err
+		}
+	}
+	if !bytes.Equal(bytes.TrimSpace(files["pk.pem"]), bytes.TrimSpace(publickey)) {
+		return id, errors.Errorf("Scheme bundle of %s is not signed with the expected public key", id)
+	}
+
+	index := SchemeManagerIndex{}
+	if err = index.FromString(string(files["index"])); err != nil {
+		return id, errors.WrapPrefix(err, "Invalid scheme bundle", 0)
+	}
+	for file := range index {
+		if !strings.HasPrefix(file, id.Name()+"/") {
+			return id, errors.Errorf("Index of scheme bundle contains file %s of another scheme", file)
+		}
+		if _, ok := files[strings.TrimPrefix(file, id.Name()+"/")]; !ok {
+			return id, errors.Errorf("Scheme bundle is missing file %s", file)
+		}
+	}
+	// Files not covered by the signed index are only accepted if they are private keys of a demo
+	// scheme, which is checked once its (signed) description has been parsed
+	var privatekeys bool
+	for file := range files {
+		if _, ok := index[id.Name()+"/"+file]; ok || schemeBundleUnsignedFiles[file] {
+			continue
+		}
+		if !schemeBundlePrivateKey.MatchString(file) {
+			return id, errors.Errorf("Scheme bundle contains file %s which is not in the index", file)
+		}
+		privatekeys = true
+	}
+
+	if err = conf.installSchemeBundle(id, files, privatekeys, allowOlder); err != nil {
+		return id, err
+	}
+	return id, conf.ParseFolder()
+}
+
+func (conf *Configuration) installSchemeBundle(id SchemeManagerIdentifier, files map[string][]byte, privatekeys, allowOlder bool) error {
+	conf.folderLock.Lock()
+	defer conf.folderLock.Unlock()
+
+	staging, err := conf.stageSchemeFolder(id, false)
+	if err != nil {
+		return err
+	}
+	defer staging.removeStagingFolder()
+	for file, bts := range files {
+		dest := filepath.Join(staging.Path, id.Name(), filepath.FromSlash(file))
+		if err = os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+			return err
+		}
+		if err = fs.SaveFile(dest, bts); err != nil {
+			return err
+		}
+	}
+	if err = staging.verifyStagedScheme(id); err != nil {
+		return errors.WrapPrefix(err, "Scheme bundle of "+id.String()+" is invalid", 0)
+	}
+	if privatekeys && !staging.SchemeManagers[id].Demo {
+		return errors.Errorf("Scheme bundle of %s contains private keys, but it is not a demo scheme", id)
+	}
+
+	current := conf.SchemeManagers[id]
+	if current != nil && !allowOlder && staging.SchemeManagers[id].Timestamp.Before(current.Timestamp) {
+		return errors.Errorf("Scheme bundle contains an older version of %s than the installed version", id)
+	}
+	if current != nil {
+		conf.setTimestampValidators(current, CacheValidators{})
+	}
+	return conf.installStagedScheme(id, staging, current != nil && current.Valid)
+}
+
+// schemePublicKey returns the public key of the scheme if present in this Configuration,
+// or from DefaultSchemeManagers.
+func (conf *Configuration) schemePublicKey(id SchemeManagerIdentifier) ([]byte, error) {
+	if _, ok := conf.SchemeManagers[id]; ok {
+		return ioutil.ReadFile(filepath.Join(conf.Path, id.Name(), "pk.pem"))
+	}
+	for _, pointer := range DefaultSchemeManagers {
+		if strings.HasSuffix(pointer.Url, "/"+id.Name()) {
+			return pointer.Publickey, nil
+		}
+	}
+	return nil, errors.Errorf("No public key of scheme %s available to verify the scheme bundle against", id)
+}
+
+// readSchemeBundle reads the files from a scheme bundle, relative to the scheme folder, checking
+// that it contains only regular files of a single scheme.
+func readSchemeBundle(r io.Reader) (SchemeManagerIdentifier, map[string][]byte, error) {
+	var id SchemeManagerIdentifier
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return id, nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	files := map[string][]byte{}
+	var name string
+	var size int64
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return id, nil, err
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			return id, nil, errors.Errorf("%s is not a regular file", header.Name)
+		}
+		if path.Clean(header.Name) != header.Name || path.IsAbs(header.Name) || strings.Contains(header.Name, "..") ||
+			strings.Contains(header.Name, "\\") || !strings.Contains(header.Name, "/") {
+			return id, nil, errors.Errorf("Invalid filename %s", header.Name)
+		}
+		parts := strings.SplitN(header.Name, "/", 2)
+		if name == "" {
+			name = parts[0]
+		} else if parts[0] != name {
+			return id, nil, errors.New("Bundle contains files of multiple schemes")
+		}
+		if size += header.Size; size > maxSchemeBundleSize {
+			return id, nil, errors.New("Bundle is too large")
+		}
+		if files[parts[1]], err = ioutil.ReadAll(tr); err != nil {
+			return id, nil, err
+		}
+	}
+	if name == "" || strings.HasPrefix(name, ".") || strings.Contains(name, ".") {
+		return id, nil, errors.New("Bundle does not contain a scheme")
+	}
+	for _, file := range []string{"index", "index.sig", "pk.pem", "description.xml"} {
+		if _, ok := files[file]; !ok {
+			return id, nil, errors.Errorf("Bundle does not contain %s", file)
+		}
+	}
+	return NewSchemeManagerIdentifier(name), files, nil
+}
@@ -0,0 +1,364 @@
+package irma
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// SchemeChange describes the differences between two versions of a scheme.
+type SchemeChange struct {
+	Scheme       SchemeManagerIdentifier `json:"scheme"`
+	OldTimestamp *Timestamp              `json:"oldTimestamp,omitempty"`
+	NewTimestamp *Timestamp              `json:"newTimestamp,omitempty"`
+	// Names of the fields of the scheme description that changed
+	Fields []string `json:"fields,omitempty"`
+
+	Issuers         []DescriptionChange `json:"issuers,omitempty"`
+	CredentialTypes []DescriptionChange `json:"credentialTypes,omitempty"`
+	AttributeTypes  []DescriptionChange `json:"attributeTypes,omitempty"`
+	PublicKeys      []PublicKeyChange   `json:"publicKeys,omitempty"`
+}
+
+// ChangeKind specifies how an item changed between two versions of a scheme.
+type ChangeKind string
+
+const (
+	ChangeAdded   = ChangeKind("added")
+	ChangeRemoved = ChangeKind("removed")
+	ChangeChanged = ChangeKind("changed")
+	// Only for public keys: present in both versions, and expired in between them
+	ChangeExpired = ChangeKind("expired")
+)
+
+// DescriptionChange describes the change of an issuer, credential type or attribute type
+// between two versions of a scheme.
+type DescriptionChange struct {
+	ID     string     `json:"id"`
+	Change ChangeKind `json:"change"`
+	// In case of ChangeChanged, the names of the fields that changed
+	Fields []string `json:"fields,omitempty"`
+	// In case the DeprecatedSince field of an issuer or credential type changed, its old and new value
+	OldDeprecatedSince *Timestamp `json:"oldDeprecatedSince,omitempty"`
+	NewDeprecatedSince *Timestamp `json:"newDeprecatedSince,omitempty"`
+}
+
+// PublicKeyChange describes the change of an issuer public key between two versions of a scheme.
+type PublicKeyChange struct {
+	Issuer  IssuerIdentifier `json:"issuer"`
+	Counter uint             `json:"counter"`
+	Change  ChangeKind       `json:"change"`
+	Expiry  *Timestamp       `json:"expiry"`
+	Expired bool             `json:"expired"`
+}
+
+// DiffScheme compares the specified scheme in two Configurations, which must have parsed the scheme,
+// and returns the differences between the old and the new version. If the old Configuration
+// does not contain the scheme, everything in the new version is reported as added.
+func DiffScheme(oldConf, newConf *Configuration, id SchemeManagerIdentifier) (*SchemeChange, error) {
+	change := &SchemeChange{Scheme: id}
+	newScheme := newConf.SchemeManagers[id]
+	if newScheme == nil {
+		return nil, errors.Errorf("New configuration does not contain scheme %s", id)
+	}
+	ts := newScheme.Timestamp
+	change.NewTimestamp = &ts
+	oldScheme := oldConf.SchemeManagers[id]
+	if oldScheme != nil {
+		ts := oldScheme.Timestamp
+		change.OldTimestamp = &ts
+		change.Fields = changedFields(oldScheme, newScheme, "Timestamp")
+	}
+
+	// Issuers
+	oldIssuers, newIssuers := map[string]interface{}{}, map[string]interface{}{}
+	for issid, issuer := range oldConf.Issuers {
+		if issid.SchemeManagerIdentifier() == id {
+			oldIssuers[issid.String()] = issuer
+		}
+	}
+	for issid, issuer := range newConf.Issuers {
+		if issid.SchemeManagerIdentifier() == id {
+			newIssuers[issid.String()] = issuer
+		}
+	}
+	change.Issuers = diffDescriptions(oldIssuers, newIssuers)
+
+	// Credential types and their attribute types
+	oldCreds, newCreds := map[string]interface{}{}, map[string]interface{}{}
+	oldAttrs, newAttrs := map[string]interface{}{}, map[string]interface{}{}
+	for credid, cred := range oldConf.CredentialTypes {
+		if credid.IssuerIdentifier().SchemeManagerIdentifier() == id {
+			oldCreds[credid.String()] = cred
+			for _, attr := range cred.AttributeTypes {
+				oldAttrs[attr.GetAttributeTypeIdentifier().String()] = attr
+			}
+		}
+	}
+	for credid, cred := range newConf.CredentialTypes {
+		if credid.IssuerIdentifier().SchemeManagerIdentifier() == id {
+			newCreds[credid.String()] = cred
+			for _, attr := range cred.AttributeTypes {
+				newAttrs[attr.GetAttributeTypeIdentifier().String()] = attr
+			}
+		}
+	}
+	change.CredentialTypes = diffDescriptions(oldCreds, newCreds)
+	change.AttributeTypes = diffDescriptions(oldAttrs, newAttrs)
+
+	// Public keys
+	var oldTimestamp Timestamp
+	if change.OldTimestamp != nil {
+		oldTimestamp = *change.OldTimestamp
+	}
+	for issid := range newConf.Issuers {
+		if issid.SchemeManagerIdentifier() != id {
+			continue
+		}
+		changes, err := diffPublicKeys(oldConf, newConf, issid, oldTimestamp, newScheme.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		change.PublicKeys = append(change.PublicKeys, changes...)
+	}
+	for issid := range oldConf.Issuers {
+		if issid.SchemeManagerIdentifier() != id || newConf.Issuers[issid] != nil {
+			continue
+		}
+		changes, err := diffPublicKeys(oldConf, newConf, issid, oldTimestamp, newScheme.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		change.PublicKeys = append(change.PublicKeys, changes...)
+	}
+	sort.Slice(change.PublicKeys, func(i, j int) bool {
+		a, b := change.PublicKeys[i], change.PublicKeys[j]
+		if a.Issuer != b.Issuer {
+			return a.Issuer.String() < b.Issuer.String()
+		}
+		return a.Counter < b.Counter
+	})
+
+	return change, nil
+}
+
+// Empty returns whether the two versions of the scheme are equal, apart from their timestamps.
+func (change *SchemeChange) Empty() bool {
+	return len(change.Fields) == 0 && len(change.Issuers) == 0 && len(change.CredentialTypes) == 0 &&
+		len(change.AttributeTypes) == 0 && len(change.PublicKeys) == 0
+}
+
+// String returns a human-readable description of the changes.
+func (change *SchemeChange) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Scheme %s", change.Scheme)
+	if change.OldTimestamp != nil {
+		fmt.Fprintf(&b, " (%s -> %s)", formatTimestamp(change.OldTimestamp), formatTimestamp(change.NewTimestamp))
+	} else {
+		fmt.Fprintf(&b, " (new, %s)", formatTimestamp(change.NewTimestamp))
+	}
+	b.WriteString("\n")
+	if change.Empty() {
+		b.WriteString("  no changes\n")
+		return b.String()
+	}
+	if len(change.Fields) > 0 {
+		fmt.Fprintf(&b, "  ~ scheme description: %s\n", strings.Join(change.Fields, ", "))
+	}
+	writeDescriptionChanges(&b, "issuer", change.Issuers)
+	writeDescriptionChanges(&b, "credential type", change.CredentialTypes)
+	writeDescriptionChanges(&b, "attribute type", change.AttributeTypes)
+	for _, key := range change.PublicKeys {
+		fmt.Fprintf(&b, "  %s public key %s-%d (%s", changeSymbol(key.Change), key.Issuer, key.Counter, key.Change)
+		if key.Expired {
+			fmt.Fprintf(&b, ", expired at %s)\n", formatTimestamp(key.Expiry))
+		} else {
+			fmt.Fprintf(&b, ", expires at %s)\n", formatTimestamp(key.Expiry))
+		}
+	}
+	return b.String()
+}
+
+func writeDescriptionChanges(b *strings.Builder, typ string, changes []DescriptionChange) {
+	for _, c := range changes {
+		fmt.Fprintf(b, "  %s %s %s", changeSymbol(c.Change), typ, c.ID)
+		if len(c.Fields) > 0 {
+			fmt.Fprintf(b, ": %s", strings.Join(c.Fields, ", "))
+		}
+		if c.OldDeprecatedSince != nil || c.NewDeprecatedSince != nil {
+			fmt.Fprintf(b, " (deprecated since: %s -> %s)",
+				formatTimestamp(c.OldDeprecatedSince), formatTimestamp(c.NewDeprecatedSince))
+		}
+		b.WriteString("\n")
+	}
+}
+
+func changeSymbol(kind ChangeKind) string {
+	switch kind {
+	case ChangeAdded:
+		return "+"
+	case ChangeRemoved:
+		return "-"
+	case ChangeExpired:
+		return "!"
+	default:
+		return "~"
+	}
+}
+
+func formatTimestamp(t *Timestamp) string {
+	if t == nil || t.IsZero() {
+		return "none"
+	}
+	return time.Time(*t).UTC().Format(time.RFC3339)
+}
+
+// diffDescriptions compares two sets of issuers, credential types or attribute types by identifier.
+func diffDescriptions(oldDescs, newDescs map[string]interface{}) []DescriptionChange {
+	var changes []DescriptionChange
+	for id, o := range oldDescs {
+		n, present := newDescs[id]
+		if !present {
+			changes = append(changes, DescriptionChange{ID: id, Change: ChangeRemoved})
+			continue
+		}
+		fields := changedFields(o, n)
+		if len(fields) == 0 {
+			continue
+		}
+		c := DescriptionChange{ID: id, Change: ChangeChanged, Fields: fields}
+		for _, f := range fields {
+			if f == "DeprecatedSince" {
+				c.OldDeprecatedSince = deprecatedSince(o)
+				c.NewDeprecatedSince = deprecatedSince(n)
+			}
+		}
+		changes = append(changes, c)
+	}
+	for id, n := range newDescs {
+		if _, present := oldDescs[id]; present {
+			continue
+		}
+		c := DescriptionChange{ID: id, Change: ChangeAdded}
+		if ts := deprecatedSince(n); ts != nil && !ts.IsZero() {
+			c.NewDeprecatedSince = ts
+		}
+		changes = append(changes, c)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].ID < changes[j].ID })
+	return changes
+}
+
+func deprecatedSince(o interface{}) *Timestamp {
+	var ts Timestamp
+	switch d := o.(type) {
+	case *Issuer:
+		ts = d.DeprecatedSince
+	case *CredentialType:
+		ts = d.DeprecatedSince
+	default:
+		return nil
+	}
+	return &ts
+}
+
+var timestampType = reflect.TypeOf(Timestamp{})
+
+// changedFields returns the names of the exported fields of the two structs (of the same type) that
+// differ, ignoring fields that don't occur in the XML descriptions, and fields that contain
+// other descriptions that are compared separately.
+func changedFields(oldDesc, newDesc interface{}, ignore ...string) []string {
+	o, n := reflect.Indirect(reflect.ValueOf(oldDesc)), reflect.Indirect(reflect.ValueOf(newDesc))
+	skip := map[string]bool{"XMLName": true, "AttributeTypes": true}
+	for _, name := range ignore {
+		skip[name] = true
+	}
+	var fields []string
+	for i := 0; i < o.NumField(); i++ {
+		field := o.Type().Field(i)
+		if field.PkgPath != "" || field.Tag.Get("xml") == "-" || skip[field.Name] {
+			continue
+		}
+		var equal bool
+		if field.Type == timestampType {
+			equal = time.Time(o.Field(i).Interface().(Timestamp)).Equal(time.Time(n.Field(i).Interface().(Timestamp)))
+		} else {
+			equal = reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface())
+		}
+		if !equal {
+			fields = append(fields, field.Name)
+		}
+	}
+	// The position of an attribute within its credential type is significant, but not part of the XML
+	if attr, ok := oldDesc.(*AttributeType); ok && attr.Index != newDesc.(*AttributeType).Index {
+		fields = append(fields, "Index")
+	}
+	return fields
+}
+
+func diffPublicKeys(oldConf, newConf *Configuration, issid IssuerIdentifier, oldTime, newTime Timestamp) ([]PublicKeyChange, error) {
+	oldKeys, err := publicKeyExpiries(oldConf, issid)
+	if err != nil {
+		return nil, err
+	}
+	newKeys, err := publicKeyExpiries(newConf, issid)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var changes []PublicKeyChange
+	for counter, expiry := range newKeys {
+		expiry := expiry
+		c := PublicKeyChange{Issuer: issid, Counter: counter, Expiry: &expiry, Expired: time.Time(expiry).Before(now)}
+		oldExpiry, present := oldKeys[counter]
+		switch {
+		case !present:
+			c.Change = ChangeAdded
+		case !time.Time(oldExpiry).Equal(time.Time(expiry)):
+			c.Change = ChangeChanged
+		case !oldTime.IsZero() && !expiry.Before(oldTime) && expiry.Before(newTime):
+			c.Change = ChangeExpired
+		default:
+			continue
+		}
+		changes = append(changes, c)
+	}
+	for counter, expiry := range oldKeys {
+		if _, present := newKeys[counter]; present {
+			continue
+		}
+		expiry := expiry
+		changes = append(changes, PublicKeyChange{
+			Issuer: issid, Counter: counter, Change: ChangeRemoved, Expiry: &expiry, Expired: time.Time(expiry).Before(now),
+		})
+	}
+	return changes, nil
+}
+
+// publicKeyExpiries returns the expiry dates of the public keys of the issuer, by counter.
+func publicKeyExpiries(conf *Configuration, issid IssuerIdentifier) (map[uint]Timestamp, error) {
+	expiries := map[uint]Timestamp{}
+	if conf.Issuers[issid] == nil {
+		return expiries, nil
+	}
+	indices, err := conf.PublicKeyIndices(issid)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range indices {
+		pk, err := conf.PublicKey(issid, i)
+		if err != nil {
+			return nil, err
+		}
+		if pk == nil {
+			continue
+		}
+		expiries[uint(i)] = Timestamp(time.Unix(pk.ExpiryDate, 0))
+	}
+	return expiries, nil
+}
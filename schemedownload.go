@@ -0,0 +1,192 @@
+package irma
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Amount of files downloaded concurrently when updating a scheme, if
+// Configuration.DownloadConcurrency is not set.
+const defaultDownloadConcurrency = 4
+
+// Timeout of requests made when downloading schemes, if Configuration.DownloadTimeout is not set.
+// This is longer than the timeout of DefaultRequestPolicy, as scheme files can be large.
+const defaultDownloadTimeout = 30 * time.Second
+
+// SchemeUpdateProgress describes the progress of downloading a new version of a scheme.
+type SchemeUpdateProgress struct {
+	Scheme SchemeManagerIdentifier
+	// File that was just downloaded, relative to the scheme (empty when the download starts)
+	File string
+	// Amount of files downloaded so far, and the total amount of files to download
+	Downloaded int
+	Total      int
+	// Total size in bytes of the files downloaded so far
+	Bytes int64
+}
+
+// schemeTransports contains the HTTPTransports with which schemes are downloaded, so that their
+// connections are reused across updates, and the validators of the timestamp files of the schemes,
+// with which conditional requests are made for them. It is shared by a Configuration and the
+// staging Configurations into which new versions of its schemes are downloaded.
+type schemeTransports struct {
+	sync.Mutex
+	transports map[string]*HTTPTransport
+	validators map[string]CacheValidators
+}
+
+func newSchemeTransports() *schemeTransports {
+	return &schemeTransports{
+		transports: map[string]*HTTPTransport{},
+		validators: map[string]CacheValidators{},
+	}
+}
+
+// schemeTransport returns the transport with which the specified scheme is downloaded. Unless the
+// scheme is downloaded from a mirror, whose contents are authenticated only by the signature of
+// the scheme, the transport accepts only the TLS certificates pinned by the scheme, if any.
+func (conf *Configuration) schemeTransport(scheme *SchemeManager) (*HTTPTransport, error) {
+	var pins []string
+	if conf.SchemeMirrorURL == "" {
+		pins = scheme.SchemeServerPins
+	}
+	return conf.transport(conf.SchemeURL(scheme), pins)
+}
+
+func (conf *Configuration) transport(url string, pins []string) (*HTTPTransport, error) {
+	if conf.transports == nil {
+		conf.transports = newSchemeTransports()
+	}
+	conf.transports.Lock()
+	defer conf.transports.Unlock()
+	url = transportURL(url)
+	key := strings.Join(append([]string{url}, pins...), " ")
+	if t, ok := conf.transports.transports[key]; ok {
+		return t, nil
+	}
+	t := NewHTTPTransport(url)
+	t.Policy.Timeout = conf.DownloadTimeout
+	if t.Policy.Timeout <= 0 {
+		t.Policy.Timeout = defaultDownloadTimeout
+	}
+	if conf.RootCAs != nil {
+		t.SetRootCAs(conf.RootCAs)
+	}
+	if err := t.SetCertificatePins(pins); err != nil {
+		return nil, err
+	}
+	conf.transports.transports[key] = t
+	return t, nil
+}
+
+func transportURL(url string) string {
+	return strings.TrimSuffix(url, "/") + "/"
+}
+
+// timestampValidators returns the validators of the timestamp file of the scheme from when it was
+// last found to be up to date.
+func (conf *Configuration) timestampValidators(scheme *SchemeManager) CacheValidators {
+	if conf.transports == nil {
+		return CacheValidators{}
+	}
+	conf.transports.Lock()
+	defer conf.transports.Unlock()
+	return conf.transports.validators[transportURL(conf.SchemeURL(scheme))]
+}
+
+// setTimestampValidators stores the validators of the timestamp file of the scheme, which must be
+// done only when the stored version of the scheme is at least as new as that timestamp file.
+// Passing empty validators causes the next update to download the timestamp file unconditionally.
+func (conf *Configuration) setTimestampValidators(scheme *SchemeManager, validators CacheValidators) {
+	if conf.transports == nil {
+		conf.transports = newSchemeTransports()
+	}
+	conf.transports.Lock()
+	defer conf.transports.Unlock()
+	url := transportURL(conf.SchemeURL(scheme))
+	if validators == (CacheValidators{}) {
+		delete(conf.transports.validators, url)
+	} else {
+		conf.transports.validators[url] = validators
+	}
+}
+
+func (conf *Configuration) reportProgress(progress SchemeUpdateProgress) {
+	if conf.UpdateProgress != nil {
+		conf.UpdateProgress(&progress)
+	}
+}
+
+// downloadSchemeFiles downloads the specified files from the index of the scheme into the
+// staging folder dir, checking their hashes against the index. At most DownloadConcurrency files
+// are downloaded concurrently; if any download fails, the others are aborted.
+func (conf *Configuration) downloadSchemeFiles(
+	ctx context.Context, transport *HTTPTransport, id SchemeManagerIdentifier,
+	dir string, index SchemeManagerIndex, filenames []string,
+) error {
+	concurrency := conf.DownloadConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultDownloadConcurrency
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex // guards progress and err, and serializes progress reports
+		err      error
+		progress = SchemeUpdateProgress{Scheme: id, Total: len(filenames)}
+	)
+	conf.reportProgress(progress)
+	semaphore := make(chan struct{}, concurrency)
+
+loop:
+	for _, filename := range filenames {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			break loop
+		}
+		wg.Add(1)
+		go func(filename string) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			path := filepath.Join(dir, filename)
+			stripped := filename[len(id.Name())+1:] // Scheme manager URL already ends with its name
+			e := os.MkdirAll(filepath.Dir(path), 0700)
+			if e == nil {
+				e = transport.GetSignedFileContext(ctx, stripped, path, index[filename])
+			}
+			var info os.FileInfo
+			if e == nil {
+				info, e = os.Stat(path)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if e != nil {
+				if err == nil {
+					err = e
+					cancel()
+				}
+				return
+			}
+			progress.Downloaded++
+			progress.File = stripped
+			progress.Bytes += info.Size()
+			conf.reportProgress(progress)
+		}(filename)
+	}
+	wg.Wait()
+
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
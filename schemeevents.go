@@ -0,0 +1,167 @@
+package irma
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// SchemeEventType is the type of a SchemeEvent.
+type SchemeEventType string
+
+const (
+	// A new version of the scheme was installed and parsed; Change contains the differences
+	SchemeEventUpdated = SchemeEventType("updated")
+	// A credential type of the scheme became deprecated in the new version of the scheme
+	SchemeEventCredentialTypeDeprecated = SchemeEventType("credentialTypeDeprecated")
+	// A public key was added to an issuer in the new version of the scheme
+	SchemeEventPublicKeyAdded = SchemeEventType("publicKeyAdded")
+	// Downloading, verifying or parsing a new version of the scheme failed; Err contains the error
+	SchemeEventUpdateFailed = SchemeEventType("updateFailed")
+)
+
+// SchemeEvent describes something that happened when updating a scheme. Which of the fields
+// besides Type and Scheme are set depends on the Type.
+type SchemeEvent struct {
+	Type   SchemeEventType         `json:"type"`
+	Scheme SchemeManagerIdentifier `json:"scheme"`
+
+	// SchemeEventUpdated
+	Change *SchemeChange `json:"change,omitempty"`
+	// SchemeEventCredentialTypeDeprecated
+	CredentialType  *CredentialTypeIdentifier `json:"credentialType,omitempty"`
+	DeprecatedSince *Timestamp                `json:"deprecatedSince,omitempty"`
+	// SchemeEventPublicKeyAdded
+	PublicKey *PublicKeyChange `json:"publicKey,omitempty"`
+	// SchemeEventUpdateFailed
+	Err error `json:"-"`
+}
+
+// SubscribeSchemeEvents registers a function that is called for each SchemeEvent, and returns
+// a function that unregisters it. Events of a new version of a scheme are published after it has
+// been parsed into this Configuration, i.e. from UpdateSchemes, Download and the scheme
+// autoupdater, in the goroutine performing the update; subscribers should therefore return quickly.
+func (conf *Configuration) SubscribeSchemeEvents(subscriber func(event *SchemeEvent)) (unsubscribe func()) {
+	conf.subscribersLock.Lock()
+	defer conf.subscribersLock.Unlock()
+	if conf.subscribers == nil {
+		conf.subscribers = map[int]func(*SchemeEvent){}
+	}
+	id := conf.nextSubscriber
+	conf.nextSubscriber++
+	conf.subscribers[id] = subscriber
+	return func() {
+		conf.subscribersLock.Lock()
+		defer conf.subscribersLock.Unlock()
+		delete(conf.subscribers, id)
+	}
+}
+
+func (conf *Configuration) publishSchemeEvent(event *SchemeEvent) {
+	conf.subscribersLock.Lock()
+	ids := make([]int, 0, len(conf.subscribers))
+	for id := range conf.subscribers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids) // in order of subscription
+	subscribers := make([]func(*SchemeEvent), 0, len(ids))
+	for _, id := range ids {
+		subscribers = append(subscribers, conf.subscribers[id])
+	}
+	conf.subscribersLock.Unlock()
+
+	for _, subscriber := range subscribers {
+		subscriber(event)
+	}
+}
+
+// publishSchemeChange publishes the SchemeEventUpdated event of the change, followed by
+// the more specific events derived from it.
+func (conf *Configuration) publishSchemeChange(change *SchemeChange) {
+	conf.publishSchemeEvent(&SchemeEvent{Type: SchemeEventUpdated, Scheme: change.Scheme, Change: change})
+	for _, c := range change.CredentialTypes {
+		if c.NewDeprecatedSince == nil || c.NewDeprecatedSince.IsZero() {
+			continue
+		}
+		if c.OldDeprecatedSince != nil && time.Time(*c.OldDeprecatedSince).Equal(time.Time(*c.NewDeprecatedSince)) {
+			continue
+		}
+		id := NewCredentialTypeIdentifier(c.ID)
+		conf.publishSchemeEvent(&SchemeEvent{
+			Type:            SchemeEventCredentialTypeDeprecated,
+			Scheme:          change.Scheme,
+			CredentialType:  &id,
+			DeprecatedSince: c.NewDeprecatedSince,
+		})
+	}
+	for i := range change.PublicKeys {
+		if change.PublicKeys[i].Change != ChangeAdded {
+			continue
+		}
+		conf.publishSchemeEvent(&SchemeEvent{
+			Type:      SchemeEventPublicKeyAdded,
+			Scheme:    change.Scheme,
+			PublicKey: &change.PublicKeys[i],
+		})
+	}
+}
+
+// publishSchemeUpdateFailure publishes a SchemeEventUpdateFailed event, unless the update failed
+// because it was cancelled.
+func (conf *Configuration) publishSchemeUpdateFailure(ctx context.Context, id SchemeManagerIdentifier, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	conf.publishSchemeEvent(&SchemeEvent{Type: SchemeEventUpdateFailed, Scheme: id, Err: err})
+}
+
+// parseUpdatedSchemes reparses the Configuration after new versions of the schemes of the changes
+// have been installed, rolling back those that fail to parse to their previous version,
+// and publishes the corresponding events.
+func (conf *Configuration) parseUpdatedSchemes(changes []*SchemeChange) error {
+	err := conf.ParseFolder()
+	var rolledback []SchemeManagerIdentifier
+	for _, change := range changes {
+		id := change.Scheme
+		if _, disabled := conf.DisabledSchemeManagers[id]; !disabled {
+			continue
+		}
+		Logger.WithField("scheme", id).Warn("Updated scheme failed to parse, rolling back to previous version")
+		if rerr := conf.RollbackSchemeManager(id); rerr != nil {
+			Logger.WithField("scheme", id).Warn("Rolling back scheme failed: ", rerr.Error())
+			continue
+		}
+		rolledback = append(rolledback, id)
+	}
+	if len(rolledback) > 0 {
+		err = conf.ParseFolder()
+	}
+
+	for _, change := range changes {
+		if e, disabled := conf.DisabledSchemeManagers[change.Scheme]; disabled {
+			conf.publishSchemeEvent(&SchemeEvent{Type: SchemeEventUpdateFailed, Scheme: change.Scheme, Err: e})
+			continue
+		}
+		if containsScheme(rolledback, change.Scheme) {
+			conf.publishSchemeEvent(&SchemeEvent{
+				Type:   SchemeEventUpdateFailed,
+				Scheme: change.Scheme,
+				Err:    errors.Errorf("New version of scheme %s failed to parse and was rolled back", change.Scheme),
+			})
+			continue
+		}
+		conf.publishSchemeChange(change)
+	}
+	return err
+}
+
+func containsScheme(ids []SchemeManagerIdentifier, id SchemeManagerIdentifier) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,412 @@
+package irma
+
+import (
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+)
+
+// LintSeverity is the severity of a LintFinding.
+type LintSeverity string
+
+const (
+	// The scheme is broken or will break IRMA apps, issuers or verifiers
+	LintError = LintSeverity("error")
+	// The scheme works, but is likely to cause problems in the near future or for users
+	LintWarning = LintSeverity("warning")
+	// The scheme could be improved
+	LintInfo = LintSeverity("info")
+)
+
+var lintSeverityLevels = map[LintSeverity]int{LintInfo: 1, LintWarning: 2, LintError: 3}
+
+// AtLeast returns true if the severity is at least as severe as the specified severity.
+func (s LintSeverity) AtLeast(other LintSeverity) bool {
+	return lintSeverityLevels[s] >= lintSeverityLevels[other]
+}
+
+// The checks performed by LintScheme, used in LintFinding.Check
+const (
+	LintCheckTranslations   = "translations"
+	LintCheckLogo           = "logo"
+	LintCheckDisplayIndex   = "displayindex"
+	LintCheckKeyExpiry      = "keyexpiry"
+	LintCheckKeySize        = "keysize"
+	LintCheckOptionalOrder  = "optionalorder"
+	LintCheckUnsignedFiles  = "unsigned"
+	LintCheckUnusedPrivKeys = "privatekeys"
+)
+
+// LintFinding is a problem found in a scheme by LintScheme.
+type LintFinding struct {
+	Severity LintSeverity `json:"severity"`
+	Check    string       `json:"check"`
+	// Identifier of the scheme, issuer, credential type or attribute type the finding concerns
+	Subject string `json:"subject"`
+	// Path of the file the finding concerns, if any, relative to the Configuration path
+	File    string `json:"file,omitempty"`
+	Message string `json:"message"`
+}
+
+func (f *LintFinding) String() string {
+	s := fmt.Sprintf("%-7s [%s] %s: %s", f.Severity, f.Check, f.Subject, f.Message)
+	if f.File != "" {
+		s += " (" + f.File + ")"
+	}
+	return s
+}
+
+// LintOptions configures LintScheme. The zero value uses the defaults documented below.
+type LintOptions struct {
+	// Languages in which all texts must be translated (default "en" and "nl")
+	Languages []string
+	// Public keys expiring within this period are reported (default 90 days)
+	KeyExpiryWarning time.Duration
+	// Minimum width and height in pixels of logos (default 256)
+	LogoMinSize int
+	// Maximum file size in bytes of logos (default 256 KiB)
+	LogoMaxBytes int64
+}
+
+func (opts *LintOptions) withDefaults() LintOptions {
+	o := LintOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if len(o.Languages) == 0 {
+		o.Languages = []string{"en", "nl"}
+	}
+	if o.KeyExpiryWarning == 0 {
+		o.KeyExpiryWarning = 90 * 24 * time.Hour
+	}
+	if o.LogoMinSize == 0 {
+		o.LogoMinSize = 256
+	}
+	if o.LogoMaxBytes == 0 {
+		o.LogoMaxBytes = 256 * 1024
+	}
+	return o
+}
+
+type schemeLinter struct {
+	conf     *Configuration
+	scheme   *SchemeManager
+	opts     LintOptions
+	findings []*LintFinding
+}
+
+// LintScheme performs a thorough check of the specified scheme, which must have been parsed by
+// the Configuration, reporting problems that do not prevent the scheme from being parsed but
+// that are likely to cause problems. The findings are sorted by decreasing severity.
+func (conf *Configuration) LintScheme(id SchemeManagerIdentifier, opts *LintOptions) ([]*LintFinding, error) {
+	scheme := conf.SchemeManagers[id]
+	if scheme == nil {
+		return nil, errors.Errorf("Unknown scheme %s", id)
+	}
+	if !scheme.Valid {
+		return nil, errors.Errorf("Scheme %s is not valid (status %s)", id, scheme.Status)
+	}
+	l := &schemeLinter{conf: conf, scheme: scheme, opts: opts.withDefaults()}
+
+	l.translations(id.String(), filepath.Join(id.Name(), "description.xml"), scheme)
+	for issuerid, issuer := range conf.Issuers {
+		if issuerid.SchemeManagerIdentifier() != id {
+			continue
+		}
+		dir := filepath.Join(id.Name(), issuerid.Name())
+		l.translations(issuerid.String(), filepath.Join(dir, "description.xml"), issuer)
+		l.logo(issuerid.String(), filepath.Join(dir, "logo.png"))
+		if err := l.keys(issuerid, issuer); err != nil {
+			return nil, err
+		}
+	}
+	for credid, cred := range conf.CredentialTypes {
+		if credid.IssuerIdentifier().SchemeManagerIdentifier() != id {
+			continue
+		}
+		dir := filepath.Join(id.Name(), credid.IssuerIdentifier().Name(), "Issues", credid.Name())
+		l.translations(credid.String(), filepath.Join(dir, "description.xml"), cred)
+		l.logo(credid.String(), filepath.Join(dir, "logo.png"))
+		l.attributes(credid, cred, filepath.Join(dir, "description.xml"))
+	}
+	if err := l.unsignedFiles(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(l.findings, func(i, j int) bool {
+		fi, fj := l.findings[i], l.findings[j]
+		if fi.Severity != fj.Severity {
+			return fi.Severity.AtLeast(fj.Severity)
+		}
+		if fi.Subject != fj.Subject {
+			return fi.Subject < fj.Subject
+		}
+		return fi.Check < fj.Check
+	})
+	return l.findings, nil
+}
+
+func (l *schemeLinter) add(severity LintSeverity, check, subject, file, format string, args ...interface{}) {
+	l.findings = append(l.findings, &LintFinding{
+		Severity: severity,
+		Check:    check,
+		Subject:  subject,
+		File:     filepath.ToSlash(file),
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (l *schemeLinter) abs(file string) string {
+	return filepath.Join(l.conf.Path, file)
+}
+
+// translations checks that all TranslatedString fields of o are translated in all languages.
+// The IssueURL field of credential types is optional, so it is only checked if it is not empty.
+func (l *schemeLinter) translations(subject, file string, o interface{}) {
+	v := reflect.ValueOf(o)
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Type() != reflect.TypeOf(TranslatedString{}) {
+			continue
+		}
+		field := v.Type().Field(i).Name
+		val := v.Field(i).Interface().(TranslatedString)
+		if field == "IssueURL" && emptyTranslations(val) {
+			continue
+		}
+		for _, lang := range l.opts.Languages {
+			if text, ok := val[lang]; !ok || strings.TrimSpace(text) == "" {
+				l.add(LintWarning, LintCheckTranslations, subject, file, "missing %s translation in <%s>", lang, field)
+			}
+		}
+	}
+}
+
+func emptyTranslations(ts TranslatedString) bool {
+	for _, text := range ts {
+		if strings.TrimSpace(text) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *schemeLinter) logo(subject, file string) {
+	info, err := os.Stat(l.abs(file))
+	if err != nil {
+		l.add(LintWarning, LintCheckLogo, subject, file, "no logo.png")
+		return
+	}
+	if info.Size() > l.opts.LogoMaxBytes {
+		l.add(LintWarning, LintCheckLogo, subject, file, "logo is %d bytes, should be at most %d", info.Size(), l.opts.LogoMaxBytes)
+	}
+	f, err := os.Open(l.abs(file))
+	if err != nil {
+		l.add(LintError, LintCheckLogo, subject, file, "logo could not be read: %s", err.Error())
+		return
+	}
+	defer f.Close()
+	config, err := png.DecodeConfig(f)
+	if err != nil {
+		l.add(LintError, LintCheckLogo, subject, file, "logo is not a valid PNG image: %s", err.Error())
+		return
+	}
+	if config.Width != config.Height {
+		l.add(LintWarning, LintCheckLogo, subject, file, "logo is not square (%dx%d)", config.Width, config.Height)
+	}
+	if config.Width < l.opts.LogoMinSize || config.Height < l.opts.LogoMinSize {
+		l.add(LintWarning, LintCheckLogo, subject, file, "logo is %dx%d pixels, should be at least %dx%d",
+			config.Width, config.Height, l.opts.LogoMinSize, l.opts.LogoMinSize)
+	}
+}
+
+// attributes checks the display indices and the ordering of optional attributes of the
+// credential type.
+func (l *schemeLinter) attributes(credid CredentialTypeIdentifier, cred *CredentialType, file string) {
+	count := len(cred.AttributeTypes)
+	seen := map[int]string{}
+	withIndex := 0
+	for _, attr := range cred.AttributeTypes {
+		if attr.DisplayIndex == nil {
+			continue
+		}
+		withIndex++
+		index := *attr.DisplayIndex
+		if index < 0 || index >= count {
+			l.add(LintError, LintCheckDisplayIndex, credid.String(), file,
+				"attribute %s has displayIndex %d, should be between 0 and %d", attr.ID, index, count-1)
+		}
+		if other, ok := seen[index]; ok {
+			l.add(LintError, LintCheckDisplayIndex, credid.String(), file,
+				"attributes %s and %s have the same displayIndex %d", other, attr.ID, index)
+		}
+		seen[index] = attr.ID
+	}
+	if withIndex > 0 && withIndex < count {
+		l.add(LintError, LintCheckDisplayIndex, credid.String(), file,
+			"only %d of %d attributes have a displayIndex", withIndex, count)
+	}
+	if withIndex == count {
+		for i := 0; i < count; i++ {
+			if _, ok := seen[i]; !ok {
+				l.add(LintError, LintCheckDisplayIndex, credid.String(), file, "no attribute has displayIndex %d", i)
+			}
+		}
+	}
+
+	// Attributes are identified by their position within credentials, so attributes can only be
+	// added to existing credential types by appending them as optional attributes. An optional
+	// attribute before a required one suggests that an attribute was inserted instead.
+	var optional string
+	for _, attr := range cred.AttributeTypes {
+		if attr.IsOptional() {
+			if optional == "" {
+				optional = attr.ID
+			}
+		} else if optional != "" {
+			l.add(LintWarning, LintCheckOptionalOrder, credid.String(), file,
+				"required attribute %s comes after optional attribute %s; new attributes should be optional and appended at the end",
+				attr.ID, optional)
+		}
+	}
+}
+
+// keys checks the expiry of the public keys of the issuer, whether they are large enough for the
+// credential types of the issuer, and whether its private keys belong to a current public key.
+func (l *schemeLinter) keys(issuerid IssuerIdentifier, issuer *Issuer) error {
+	if err := l.conf.parseKeysFolder(issuerid); err != nil {
+		return err
+	}
+	indices, err := l.conf.PublicKeyIndices(issuerid)
+	if err != nil {
+		return err
+	}
+	keydir := filepath.Join(issuerid.SchemeManagerIdentifier().Name(), issuerid.Name(), "PublicKeys")
+	if len(indices) == 0 {
+		l.add(LintError, LintCheckKeyExpiry, issuerid.String(), keydir, "issuer has no public keys")
+		return nil
+	}
+	counter := indices[len(indices)-1]
+	latest, err := l.conf.PublicKey(issuerid, counter)
+	if err != nil {
+		return err
+	}
+	latestFile := filepath.Join(keydir, strconv.Itoa(counter)+".xml")
+
+	now := time.Now()
+	deprecated := !issuer.DeprecatedSince.IsZero() && !issuer.DeprecatedSince.After(Timestamp(now))
+	if !deprecated {
+		expiry := time.Unix(latest.ExpiryDate, 0)
+		if expiry.Before(now) {
+			l.add(LintError, LintCheckKeyExpiry, issuerid.String(), latestFile,
+				"latest public key expired at %s", expiry.UTC().Format(time.RFC3339))
+		} else if expiry.Before(now.Add(l.opts.KeyExpiryWarning)) {
+			l.add(LintWarning, LintCheckKeyExpiry, issuerid.String(), latestFile,
+				"latest public key expires at %s", expiry.UTC().Format(time.RFC3339))
+		}
+	}
+
+	// The public key must contain a base for each attribute, the secret key and the metadata attribute
+	for credid, cred := range l.conf.CredentialTypes {
+		if credid.IssuerIdentifier() != issuerid {
+			continue
+		}
+		if required := len(cred.AttributeTypes) + 2; required > len(latest.R) {
+			l.add(LintError, LintCheckKeySize, credid.String(), latestFile,
+				"latest public key of issuer supports %d attributes, credential type requires %d", len(latest.R), required)
+		}
+	}
+
+	return l.privateKeys(issuerid, counter)
+}
+
+// privateKeys checks that each private key of the issuer, plaintext or encrypted, belongs to its
+// latest public key.
+func (l *schemeLinter) privateKeys(issuerid IssuerIdentifier, latest int) error {
+	indices, err := l.conf.matchKeyPattern(issuerid, privkeyPattern)
+	if err != nil {
+		return err
+	}
+	keydir := filepath.Join(issuerid.SchemeManagerIdentifier().Name(), issuerid.Name(), "PrivateKeys")
+	for _, counter := range indices {
+		file := filepath.Join(keydir, strconv.Itoa(counter)+".xml")
+		sk, err := gabi.NewPrivateKeyFromFile(l.abs(file))
+		if err != nil {
+			l.add(LintError, LintCheckUnusedPrivKeys, issuerid.String(), file, "private key could not be parsed: %s", err.Error())
+			continue
+		}
+		pk, err := l.conf.PublicKey(issuerid, counter)
+		if err != nil {
+			return err
+		}
+		switch {
+		case pk == nil:
+			l.add(LintError, LintCheckUnusedPrivKeys, issuerid.String(), file, "private key has no corresponding public key")
+		case new(big.Int).Mul(sk.P, sk.Q).Cmp(pk.N) != 0:
+			l.add(LintError, LintCheckUnusedPrivKeys, issuerid.String(), file, "private key does not belong to public key %d", counter)
+		case counter != latest:
+			l.add(LintInfo, LintCheckUnusedPrivKeys, issuerid.String(), file,
+				"private key is not used since public key %d is the latest, and may be removed", latest)
+		}
+	}
+
+	// Without the passphrase, encrypted private keys can only be checked by their counter
+	matches, err := filepath.Glob(l.abs(filepath.Join(keydir, "*"+encryptedPrivkeySuffix)))
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		file := filepath.Join(keydir, filepath.Base(match))
+		counter, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(match), encryptedPrivkeySuffix))
+		if err != nil {
+			l.add(LintError, LintCheckUnusedPrivKeys, issuerid.String(), file, "encrypted private key has an invalid filename")
+			continue
+		}
+		pk, err := l.conf.PublicKey(issuerid, counter)
+		if err != nil {
+			return err
+		}
+		switch {
+		case pk == nil:
+			l.add(LintError, LintCheckUnusedPrivKeys, issuerid.String(), file, "encrypted private key has no corresponding public key")
+		case counter != latest:
+			l.add(LintInfo, LintCheckUnusedPrivKeys, issuerid.String(), file,
+				"encrypted private key is not used since public key %d is the latest, and may be removed", latest)
+		}
+	}
+	return nil
+}
+
+// unsignedFiles reports files within the scheme that are not included in its index, and that
+// consequently are ignored by IRMA apps and servers.
+func (l *schemeLinter) unsignedFiles() error {
+	id := l.scheme.Identifier()
+	return walkDir(l.abs(id.Name()), func(path string, info os.FileInfo) error {
+		if info.IsDir() {
+			return nil
+		}
+		relpath, err := filepath.Rel(l.conf.Path, path)
+		if err != nil {
+			return err
+		}
+		if isSigException(filepath.ToSlash(relpath)) {
+			return nil
+		}
+		if _, ok := l.scheme.index[filepath.ToSlash(relpath)]; !ok {
+			l.add(LintWarning, LintCheckUnsignedFiles, id.String(), relpath, "file is not included in the index and is ignored")
+		}
+		return nil
+	})
+}
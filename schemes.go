@@ -1,22 +1,31 @@
 package irma
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago/internal/fs"
 )
 
 // SchemeManagerPointer points to a remote IRMA scheme, containing information to download the scheme,
 // including its (pinned) public key.
 type SchemeManagerPointer struct {
+	ID        string // Identifier of the scheme, naming its folder in scheme mirrors
 	Url       string // URL to download scheme from
 	Publickey []byte // Public key of scheme against which to verify files after they have been downloaded
 }
 
 var DefaultSchemeManagers = [2]SchemeManagerPointer{
 	{
+		ID:  "irma-demo",
 		Url: "https://privacybydesign.foundation/schememanager/irma-demo",
 		Publickey: []byte(`-----BEGIN PUBLIC KEY-----
 MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEHVnmAY+kGkFZn7XXozdI4HY8GOjm
@@ -24,6 +33,7 @@ MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEHVnmAY+kGkFZn7XXozdI4HY8GOjm
 -----END PUBLIC KEY-----`),
 	},
 	{
+		ID:  "pbdf",
 		Url: "https://privacybydesign.foundation/schememanager/pbdf",
 		Publickey: []byte(`-----BEGIN PUBLIC KEY-----
 MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAELzHV5ipBimWpuZIDaQQd+KmNpNop
@@ -35,11 +45,16 @@ dpBeCqpDwf+Grrw9ReODb6nwlsPJ/c/gqLnc+Y3sKOAJ2bFGI+jHBSsglg==
 func (conf *Configuration) DownloadDefaultSchemes() error {
 	Logger.Info("downloading default schemes (may take a while)")
 	for _, s := range DefaultSchemeManagers {
-		Logger.Debugf("Downloading scheme at %s", s.Url)
-		scheme, err := DownloadSchemeManager(s.Url)
+		url := conf.mirroredURL(s.Url, s.ID)
+		Logger.Debugf("Downloading scheme at %s", url)
+		scheme, err := DownloadSchemeManager(url)
 		if err != nil {
 			return err
 		}
+		if scheme.ID != s.ID {
+			return errors.Errorf("scheme at %s has identifier %s instead of %s", url, scheme.ID, s.ID)
+		}
+		scheme.URL = s.Url
 		if err := conf.InstallSchemeManager(scheme, s.Publickey); err != nil {
 			return err
 		}
@@ -48,18 +63,45 @@ func (conf *Configuration) DownloadDefaultSchemes() error {
 	return nil
 }
 
+// SchemeURL returns the URL from which the scheme is downloaded and updated: the URL of the scheme
+// itself, or its folder at SchemeMirrorURL if that is set.
+func (conf *Configuration) SchemeURL(scheme *SchemeManager) string {
+	return conf.mirroredURL(scheme.URL, scheme.ID)
+}
+
+// DownloadSchemePublicKey downloads the public key of the scheme from the URL of the scheme itself,
+// also if SchemeMirrorURL is set: as the scheme is verified against this public key, it must not
+// be obtained from a mirror.
+func (conf *Configuration) DownloadSchemePublicKey(scheme *SchemeManager) ([]byte, error) {
+	t, err := conf.transport(scheme.URL, scheme.SchemeServerPins)
+	if err != nil {
+		return nil, err
+	}
+	return t.GetBytes("pk.pem")
+}
+
+func (conf *Configuration) mirroredURL(url, name string) string {
+	if conf.SchemeMirrorURL == "" {
+		return url
+	}
+	return strings.TrimSuffix(conf.SchemeMirrorURL, "/") + "/" + name
+}
+
 // downloadDemoPrivateKeys attempts to download the scheme and issuer private keys, if the scheme is
 // a demo scheme and if they are not already present in the scheme, without failing if any of them
 // is not available.
-func (conf *Configuration) downloadDemoPrivateKeys(scheme *SchemeManager) error {
+func (conf *Configuration) downloadDemoPrivateKeys(ctx context.Context, scheme *SchemeManager) error {
 	if !scheme.Demo {
 		return nil
 	}
 
 	Logger.Debugf("Attempting downloading of private keys of scheme %s", scheme.ID)
-	transport := NewHTTPTransport(scheme.URL)
+	transport, err := conf.schemeTransport(scheme)
+	if err != nil {
+		return err
+	}
 
-	err := transport.GetFile("sk.pem", filepath.Join(conf.Path, scheme.ID, "sk.pem"))
+	err = transport.GetFileContext(ctx, "sk.pem", filepath.Join(conf.Path, scheme.ID, "sk.pem"))
 	if err != nil { // If downloading of any of the private key fails just log it, and then continue
 		Logger.Warnf("Downloading private key of scheme %s failed ", scheme.ID)
 	}
@@ -81,10 +123,235 @@ func (conf *Configuration) downloadDemoPrivateKeys(scheme *SchemeManager) error
 			continue
 		}
 		remote := strings.Join(parts[len(parts)-3:len(parts)], "/")
-		if err = transport.GetFile(remote, local); err != nil {
+		if err = transport.GetFileContext(ctx, remote, local); err != nil {
 			Logger.Warnf("Downloading private key %s failed: %s", skpath, err)
 		}
 	}
 
 	return nil
 }
+
+const (
+	// Prefix of the temporary folders within the irma_configuration folder in which
+	// new versions of schemes are downloaded and verified before being installed
+	schemeStagingPrefix = ".staging-"
+	// Suffix of the folders within the irma_configuration folder containing
+	// the version of a scheme from before its last update
+	schemePreviousSuffix = ".previous"
+
+	// Age after which staging folders of other processes are considered to be left behind
+	// by interrupted updates
+	staleStagingAge = time.Hour
+)
+
+var (
+	// Staging folders in use by the Configurations of this process
+	activeStaging     = map[string]struct{}{}
+	activeStagingLock sync.Mutex
+)
+
+func (conf *Configuration) previousSchemePath(id SchemeManagerIdentifier) string {
+	return filepath.Join(conf.Path, "."+id.Name()+schemePreviousSuffix)
+}
+
+// stageSchemeFolder returns a temporary Configuration within a hidden folder in the irma_configuration
+// folder, into which a new version of the specified scheme can be written and verified without
+// affecting the stored version. If copyCurrent is true, the stored version is copied into it.
+func (conf *Configuration) stageSchemeFolder(id SchemeManagerIdentifier, copyCurrent bool) (*Configuration, error) {
+	// The name of the folder contains our process ID, so that we can recognize our own staging
+	// folders in recoverSchemeFolders
+	path, err := ioutil.TempDir(conf.Path, fmt.Sprintf("%s%s-%d-", schemeStagingPrefix, id.Name(), os.Getpid()))
+	if err != nil {
+		return nil, err
+	}
+	activeStagingLock.Lock()
+	activeStaging[path] = struct{}{}
+	activeStagingLock.Unlock()
+	staging := &Configuration{
+		Path:                path,
+		SchemeMirrorURL:     conf.SchemeMirrorURL,
+		DownloadConcurrency: conf.DownloadConcurrency,
+		DownloadTimeout:     conf.DownloadTimeout,
+		RootCAs:             conf.RootCAs,
+		UpdateProgress:      conf.UpdateProgress,
+		transports:          conf.transports,
+	}
+	staging.clear()
+
+	current := filepath.Join(conf.Path, id.Name())
+	exists, err := fs.PathExists(current)
+	if err != nil || !copyCurrent || !exists {
+		return staging, err
+	}
+	if err = fs.CopyDirectory(current, filepath.Join(path, id.Name())); err != nil {
+		staging.removeStagingFolder()
+		return nil, err
+	}
+	return staging, nil
+}
+
+func (conf *Configuration) removeStagingFolder() {
+	if err := os.RemoveAll(conf.Path); err != nil {
+		Logger.Warnf("Failed to remove scheme staging folder %s: %s", conf.Path, err)
+	}
+	activeStagingLock.Lock()
+	delete(activeStaging, conf.Path)
+	activeStagingLock.Unlock()
+}
+
+// staleStagingFolder returns whether the staging folder was left behind by an interrupted update:
+// either it was created by this process but is no longer in use, or it was created by another
+// process, which may be updating the scheme concurrently, and has not been modified for
+// staleStagingAge.
+func staleStagingFolder(path string) (bool, error) {
+	activeStagingLock.Lock()
+	_, active := activeStaging[path]
+	activeStagingLock.Unlock()
+	if active {
+		return false, nil
+	}
+
+	parts := strings.Split(filepath.Base(path), "-")
+	if len(parts) > 2 && parts[len(parts)-2] == strconv.Itoa(os.Getpid()) {
+		return true, nil
+	}
+	var modified time.Time
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil // removed concurrently
+		}
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+		return nil
+	})
+	return time.Since(modified) > staleStagingAge, err
+}
+
+// verifyStagedScheme checks the index signature and file hashes of the specified scheme within
+// a staging Configuration, and that its contents and public keys parse.
+func (conf *Configuration) verifyStagedScheme(id SchemeManagerIdentifier) error {
+	manager := NewSchemeManager(id.Name())
+	if err := conf.ParseSchemeManagerFolder(filepath.Join(conf.Path, id.Name()), manager); err != nil {
+		return err
+	}
+	for issid := range conf.Issuers {
+		if err := conf.parseKeysFolder(issid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installStagedScheme replaces the stored version of the scheme with the one in the staging
+// Configuration, keeping the stored version for RollbackSchemeManager if keepPrevious is true.
+// As both are complete versions of the scheme which are swapped by renaming them, the scheme
+// folder never contains a mix of both versions. Requires conf.folderLock.
+func (conf *Configuration) installStagedScheme(id SchemeManagerIdentifier, staging *Configuration, keepPrevious bool) error {
+	current := filepath.Join(conf.Path, id.Name())
+	previous := conf.previousSchemePath(id)
+	if err := os.RemoveAll(previous); err != nil {
+		return err
+	}
+	exists, err := fs.PathExists(current)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if err = os.Rename(current, previous); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(filepath.Join(staging.Path, id.Name()), current); err != nil {
+		if exists {
+			_ = os.Rename(previous, current)
+		}
+		return err
+	}
+	if !keepPrevious {
+		return os.RemoveAll(previous)
+	}
+	return nil
+}
+
+// RollbackSchemeManager replaces the stored version of the specified scheme with the version it had
+// before it was last updated by UpdateSchemeManager. Afterwards, ParseFolder should be called.
+func (conf *Configuration) RollbackSchemeManager(id SchemeManagerIdentifier) error {
+	if conf.readOnly {
+		return errors.New("cannot roll back a scheme in a read-only configuration")
+	}
+	conf.folderLock.Lock()
+	defer conf.folderLock.Unlock()
+
+	previous := conf.previousSchemePath(id)
+	exists, err := fs.PathExists(previous)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.Errorf("No previous version of scheme %s available", id)
+	}
+	if manager, ok := conf.SchemeManagers[id]; ok {
+		conf.setTimestampValidators(manager, CacheValidators{})
+	}
+
+	// Move the current version out of the way into a staging folder, which we remove afterwards.
+	// If we are interrupted in between, recoverSchemeFolders puts the previous version in place.
+	staging, err := conf.stageSchemeFolder(id, false)
+	if err != nil {
+		return err
+	}
+	defer staging.removeStagingFolder()
+	current := filepath.Join(conf.Path, id.Name())
+	if err = os.Rename(current, filepath.Join(staging.Path, id.Name())); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(previous, current)
+}
+
+// recoverSchemeFolders restores the previous version of schemes whose update was interrupted
+// while the new version was being installed, and removes staging folders left behind by
+// interrupted updates (see staleStagingFolder). Requires conf.folderLock.
+func (conf *Configuration) recoverSchemeFolders() error {
+	previous, err := filepath.Glob(filepath.Join(conf.Path, ".*"+schemePreviousSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range previous {
+		name := strings.TrimSuffix(filepath.Base(path)[1:], schemePreviousSuffix)
+		current := filepath.Join(conf.Path, name)
+		exists, err := fs.PathExists(current)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		Logger.WithField("scheme", name).Warn("Restoring previous version of scheme after interrupted update")
+		if err = os.Rename(path, current); err != nil {
+			return err
+		}
+	}
+
+	staging, err := filepath.Glob(filepath.Join(conf.Path, schemeStagingPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range staging {
+		stale, err := staleStagingFolder(path)
+		if err != nil {
+			return err
+		}
+		if !stale {
+			continue
+		}
+		Logger.Warnf("Removing scheme staging folder %s left behind by interrupted update", path)
+		if err = os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -12,6 +12,7 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -38,10 +39,24 @@ type Configuration struct {
 	DisableSchemesUpdate bool `json:"disable_schemes_update" mapstructure:"disable_schemes_update"`
 	// Update all schemes every x minutes (default value 0 means 60) (use DisableSchemesUpdate to disable)
 	SchemesUpdateInterval int `json:"schemes_update" mapstructure:"schemes_update"`
+	// If specified, download and update schemes from this mirror instead of from their own URL
+	// (see irma.Configuration.SchemeMirrorURL)
+	SchemesMirrorURL string `json:"schemes_mirror" mapstructure:"schemes_mirror"`
 	// Path to issuer private keys to parse
 	IssuerPrivateKeysPath string `json:"privkeys" mapstructure:"privkeys"`
+	// Passphrase with which private keys in IssuerPrivateKeysPath having the .enc extension are
+	// decrypted, or a path to a file containing it
+	IssuerPrivateKeysPassphrase     string `json:"privkeys_passphrase" mapstructure:"privkeys_passphrase"`
+	IssuerPrivateKeysPassphraseFile string `json:"privkeys_passphrase_file" mapstructure:"privkeys_passphrase_file"`
+	// Path to the unix socket of a key server from which to retrieve issuer private keys
+	IssuerPrivateKeysServer string `json:"privkeys_server" mapstructure:"privkeys_server"`
+	// If nonempty, only private keys of these issuers are loaded and used
+	IssuerPrivateKeysIssuers []string `json:"privkeys_issuers" mapstructure:"privkeys_issuers"`
 	// Issuer private keys
 	IssuerPrivateKeys map[irma.IssuerIdentifier]*gabi.PrivateKey `json:"-"`
+	// Provider of issuer private keys not present in IssuerPrivateKeys. If IssuerPrivateKeysServer
+	// is specified, this will be populated with a client of the key server.
+	IssuerPrivateKeyProvider PrivateKeyProvider `json:"-"`
 	// URL at which the IRMA app can reach this server during sessions
 	URL string `json:"url" mapstructure:"url"`
 	// Required to be set to true if URL does not begin with https:// in production mode.
@@ -54,6 +69,9 @@ type Configuration struct {
 	Email string `json:"email" mapstructure:"email"`
 	// Enable server sent events for status updates (experimental; tends to hang when a reverse proxy is used)
 	EnableSSE bool `json:"enable_sse" mapstructure:"enable_sse"`
+	// Enable websockets for status updates. Unlike server sent events these include periodic
+	// heartbeats, so that reverse proxies don't close idle connections.
+	EnableWebsockets bool `json:"enable_websockets" mapstructure:"enable_websockets"`
 
 	// Logging verbosity level: 0 is normal, 1 includes DEBUG level, 2 includes TRACE level
 	Verbose int `json:"verbose" mapstructure:"verbose"`
@@ -66,6 +84,10 @@ type Configuration struct {
 
 	// Production mode: enables safer and stricter defaults and config checking
 	Production bool `json:"production" mapstructure:"production"`
+
+	// Private keys from IssuerPrivateKeyProvider that passed VerifyPrivateKey
+	verifiedPrivateKeys     map[irma.IssuerIdentifier]*gabi.PrivateKey
+	verifiedPrivateKeysLock sync.Mutex
 }
 
 type SessionPackage struct {
@@ -119,7 +141,15 @@ func (r *SessionResult) Legacy() *LegacySessionResult {
 }
 
 func (conf *Configuration) PrivateKey(id irma.IssuerIdentifier) (sk *gabi.PrivateKey, err error) {
+	if !conf.PrivateKeyAllowed(id) {
+		return nil, nil
+	}
 	sk = conf.IssuerPrivateKeys[id]
+	if sk == nil && conf.IssuerPrivateKeyProvider != nil {
+		if sk, err = conf.providedPrivateKey(id); err != nil {
+			return nil, err
+		}
+	}
 	if sk == nil {
 		if sk, err = conf.IrmaConfiguration.PrivateKey(id); err != nil {
 			return nil, err
@@ -105,16 +105,24 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.String("schemes-assets-path", "", "if specified, copy schemes from here into --schemes-path")
 	flags.Int("schemes-update", 60, "update IRMA schemes every x minutes (0 to disable)")
 	flags.Bool("disable-schemes-update", false, "disable IRMA scheme updating")
+	flags.String("schemes-mirror", "", "download and update IRMA schemes from this mirror instead of from their own URL")
+	flags.Bool("schemes-revalidate", false, "check permissions and static sessions against updated IRMA schemes")
 	flags.StringP("privkeys", "k", "", "path to IRMA private keys")
+	flags.String("privkeys-passphrase-file", "", "path to passphrase of encrypted (.enc) private keys (default $IRMASERVER_PRIVKEYS_PASSPHRASE)")
+	flags.String("privkeys-server", "", "path to unix socket of key server from which to retrieve IRMA private keys")
+	flags.StringSlice("privkeys-issuers", nil, "if specified, only use private keys of these issuers")
 	flags.String("static-path", "", "Host files under this path as static files (leave empty to disable)")
 	flags.String("static-prefix", "/", "Host static files under this URL prefix")
 	flags.StringP("url", "u", defaulturl, "external URL to server to which the IRMA client connects")
 	flags.Bool("sse", false, "Enable server sent for status updates (experimental)")
+	flags.Bool("websockets", false, "Enable websockets for status updates")
 
 	flags.IntP("port", "p", 8088, "port at which to listen")
 	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0)")
 	flags.Int("client-port", 0, "if specified, start a separate server for the IRMA app at this port")
 	flags.String("client-listen-addr", "", "address at which server for IRMA app listens")
+	flags.Int("metrics-port", 0, "if specified, expose metrics at /metrics on a separate server at this port")
+	flags.String("metrics-listen-addr", "", "address at which the metrics server listens (default localhost)")
 	flags.Lookup("port").Header = `Server address and port to listen on`
 
 	flags.Bool("no-auth", !production, "whether or not to authenticate requestors (and reject all authenticated requests)")
@@ -146,6 +154,11 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.Bool("no-tls", false, "Disable TLS")
 	flags.Lookup("tls-cert").Header = "TLS configuration (leave empty to disable TLS)"
 
+	flags.String("callback-ca-cert", "", "CA certificate(s) that callback servers must use, instead of the system CAs")
+	flags.String("callback-ca-cert-file", "", "path to CA certificate(s) that callback servers must use, instead of the system CAs")
+	flags.StringSlice("callback-cert-pins", nil, "SPKI pins (base64 SHA256) of which callback servers must use at least one")
+	flags.Lookup("callback-ca-cert").Header = "Callback TLS configuration (leave empty to use the system CAs)"
+
 	flags.StringP("email", "e", "", "Email address of server admin, for incidental notifications such as breaking API changes")
 	flags.Bool("no-email", !production, "Opt out of prodiding an email address with --email")
 	flags.Lookup("email").Header = "Email address (see README for more info)"
@@ -214,20 +227,26 @@ func configure(cmd *cobra.Command) error {
 	// Read configuration from flags and/or environmental variables
 	conf = &requestorserver.Configuration{
 		Configuration: &server.Configuration{
-			SchemesPath:           viper.GetString("schemes-path"),
-			SchemesAssetsPath:     viper.GetString("schemes-assets-path"),
-			SchemesUpdateInterval: viper.GetInt("schemes-update"),
-			DisableSchemesUpdate:  viper.GetBool("disable-schemes-update") || viper.GetInt("schemes-update") == 0,
-			IssuerPrivateKeysPath: viper.GetString("privkeys"),
-			URL:        viper.GetString("url"),
-			DisableTLS: viper.GetBool("no-tls"),
-			Email:      viper.GetString("email"),
-			EnableSSE:  viper.GetBool("sse"),
-			Verbose:    viper.GetInt("verbose"),
-			Quiet:      viper.GetBool("quiet"),
-			LogJSON:    viper.GetBool("log-json"),
-			Logger:     logger,
-			Production: viper.GetBool("production"),
+			SchemesPath:                     viper.GetString("schemes-path"),
+			SchemesAssetsPath:               viper.GetString("schemes-assets-path"),
+			SchemesUpdateInterval:           viper.GetInt("schemes-update"),
+			DisableSchemesUpdate:            viper.GetBool("disable-schemes-update") || viper.GetInt("schemes-update") == 0,
+			SchemesMirrorURL:                viper.GetString("schemes-mirror"),
+			IssuerPrivateKeysPath:           viper.GetString("privkeys"),
+			IssuerPrivateKeysPassphrase:     viper.GetString("privkeys-passphrase"),
+			IssuerPrivateKeysPassphraseFile: viper.GetString("privkeys-passphrase-file"),
+			IssuerPrivateKeysServer:         viper.GetString("privkeys-server"),
+			IssuerPrivateKeysIssuers:        viper.GetStringSlice("privkeys-issuers"),
+			URL:                             viper.GetString("url"),
+			DisableTLS:                      viper.GetBool("no-tls"),
+			Email:                           viper.GetString("email"),
+			EnableSSE:                       viper.GetBool("sse"),
+			EnableWebsockets:                viper.GetBool("websockets"),
+			Verbose:                         viper.GetInt("verbose"),
+			Quiet:                           viper.GetBool("quiet"),
+			LogJSON:                         viper.GetBool("log-json"),
+			Logger:                          logger,
+			Production:                      viper.GetBool("production"),
 		},
 		Permissions: requestorserver.Permissions{
 			Disclosing: handlePermission("disclose-perms"),
@@ -246,6 +265,9 @@ func configure(cmd *cobra.Command) error {
 		MaxRequestAge:                  viper.GetInt("max-request-age"),
 		StaticPath:                     viper.GetString("static-path"),
 		StaticPrefix:                   viper.GetString("static-prefix"),
+		SchemesRevalidate:              viper.GetBool("schemes-revalidate"),
+		MetricsPort:                    viper.GetInt("metrics-port"),
+		MetricsListenAddress:           viper.GetString("metrics-listen-addr"),
 
 		TlsCertificate:           viper.GetString("tls-cert"),
 		TlsCertificateFile:       viper.GetString("tls-cert-file"),
@@ -255,6 +277,10 @@ func configure(cmd *cobra.Command) error {
 		ClientTlsCertificateFile: viper.GetString("client-tls-cert-file"),
 		ClientTlsPrivateKey:      viper.GetString("client-tls-privkey"),
 		ClientTlsPrivateKeyFile:  viper.GetString("client-tls-privkey-file"),
+
+		CallbackCACertificate:     viper.GetString("callback-ca-cert"),
+		CallbackCACertificateFile: viper.GetString("callback-ca-cert-file"),
+		CallbackCertificatePins:   viper.GetStringSlice("callback-cert-pins"),
 	}
 
 	if conf.Production {
@@ -5,8 +5,10 @@
 package irmaserver
 
 import (
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago"
@@ -105,6 +107,16 @@ func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 	return s.Server.SubscribeServerSentEvents(w, r, token, requestor)
 }
 
+// SubscribeWebsocket upgrades the HTTP connection to a websocket over which status updates
+// of the specified IRMA session are sent. The current status is sent upon connecting, so
+// clients that lose their connection can reconnect to resume.
+func SubscribeWebsocket(w http.ResponseWriter, r *http.Request, token string, requestor bool) error {
+	return s.SubscribeWebsocket(w, r, token, requestor)
+}
+func (s *Server) SubscribeWebsocket(w http.ResponseWriter, r *http.Request, token string, requestor bool) error {
+	return s.Server.SubscribeWebsocket(w, r, token, requestor)
+}
+
 // HandlerFunc returns a http.HandlerFunc that handles the IRMA protocol
 // with IRMA apps.
 //
@@ -137,6 +149,16 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 			}
 			return
 		}
+		if err == nil && noun == "statuswebsocket" {
+			if err = s.SubscribeWebsocket(w, r, token, false); err != nil {
+				server.WriteResponse(w, nil, &irma.RemoteError{
+					Status:      server.ErrorUnsupported.Status,
+					ErrorName:   string(server.ErrorUnsupported.Type),
+					Description: server.ErrorUnsupported.Description,
+				})
+			}
+			return
+		}
 
 		status, response, result := s.HandleProtocolMessage(r.URL.Path, r.Method, r.Header, message)
 		w.WriteHeader(status)
@@ -144,10 +166,70 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 		if err != nil {
 			_ = server.LogError(errors.WrapPrefix(err, "http.ResponseWriter.Write() returned error", 0))
 		}
-		if result != nil && result.Status.Finished() {
-			if handler := s.handlers[result.Token]; handler != nil {
-				go handler(result)
+		s.handleResult(result)
+	}
+}
+
+// StartLocalSession starts an IRMA session like StartSession, which is then performed with an
+// IRMA app over the specified local byte stream, e.g. a Unix socket or pipe (see irma.LocalTransport).
+// The session QR is sent over the stream as the first frame; this blocks until the app has read
+// it, if the stream is unbuffered. Afterwards StartLocalSession returns, and the protocol messages
+// of the app are handled in the background (see ServeLocal) until the stream is closed.
+// The result of the session is passed to the handler as usual.
+func StartLocalSession(conn io.ReadWriter, request interface{}, handler SessionHandler) (string, error) {
+	return s.StartLocalSession(conn, request, handler)
+}
+func (s *Server) StartLocalSession(conn io.ReadWriter, request interface{}, handler SessionHandler) (string, error) {
+	qr, token, err := s.StartSession(request, handler)
+	if err != nil {
+		return "", err
+	}
+	if err = irma.WriteFrame(conn, qr); err != nil {
+		_ = s.CancelSession(token)
+		return "", server.LogError(errors.WrapPrefix(err, "failed to send session QR", 0))
+	}
+	go func() {
+		_ = s.ServeLocal(conn) // errors are logged by ServeLocal
+	}()
+	return token, nil
+}
+
+// ServeLocal handles IRMA protocol messages sent by an IRMA app over the specified local
+// byte stream (see irma.LocalTransport), blocking until the stream is closed.
+func ServeLocal(conn io.ReadWriter) error {
+	return s.ServeLocal(conn)
+}
+func (s *Server) ServeLocal(conn io.ReadWriter) error {
+	for {
+		req := &irma.LocalRequest{}
+		if err := irma.ReadFrame(conn, req); err != nil {
+			if closedStream(err) {
+				return nil
 			}
+			return server.LogError(errors.WrapPrefix(err, "failed to read local request", 0))
+		}
+
+		status, response, result := s.HandleProtocolMessage(req.URL, req.Method, req.Headers, req.Body)
+		if err := irma.WriteFrame(conn, &irma.LocalResponse{Status: status, Body: response}); err != nil {
+			return server.LogError(errors.WrapPrefix(err, "failed to write local response", 0))
+		}
+		s.handleResult(result)
+	}
+}
+
+// closedStream returns whether the error, returned by reading from a local stream, means
+// that the stream was closed.
+func closedStream(err error) bool {
+	// net.ErrClosed, which is returned when reading from a closed net.Conn, is not
+	// available in the Go versions we support, so we compare its message
+	return err == io.EOF || err == io.ErrClosedPipe ||
+		strings.Contains(err.Error(), "use of closed network connection")
+}
+
+func (s *Server) handleResult(result *server.SessionResult) {
+	if result != nil && result.Status.Finished() {
+		if handler := s.handlers[result.Token]; handler != nil {
+			go handler(result)
 		}
 	}
 }
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/encryption"
+	"github.com/privacybydesign/irmago/internal/fs"
+)
+
+// EncryptedPrivateKeyExtension is the extension of encrypted private key files, which is appended
+// to the filename of the unencrypted private key (e.g. irma-demo.MijnOverheid.xml.enc).
+const EncryptedPrivateKeyExtension = ".enc"
+
+// PrivateKeyProvider provides issuer private keys to the IRMA server, in addition to those in
+// Configuration.IssuerPrivateKeys. It should return nil if it has no private key for the issuer.
+type PrivateKeyProvider interface {
+	PrivateKey(id irma.IssuerIdentifier) (*gabi.PrivateKey, error)
+}
+
+// PrivateKeyProviderFunc is an adapter to allow the use of ordinary functions as PrivateKeyProvider.
+type PrivateKeyProviderFunc func(id irma.IssuerIdentifier) (*gabi.PrivateKey, error)
+
+func (f PrivateKeyProviderFunc) PrivateKey(id irma.IssuerIdentifier) (*gabi.PrivateKey, error) {
+	return f(id)
+}
+
+// PrivateKeyAllowed returns whether the server may use the private key of the specified issuer,
+// i.e. whether IssuerPrivateKeysIssuers is empty or contains the issuer.
+func (conf *Configuration) PrivateKeyAllowed(id irma.IssuerIdentifier) bool {
+	if len(conf.IssuerPrivateKeysIssuers) == 0 {
+		return true
+	}
+	for _, issuer := range conf.IssuerPrivateKeysIssuers {
+		if issuer == id.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyPrivateKey checks that the private key belongs to the public key of the issuer having the
+// same counter.
+func (conf *Configuration) VerifyPrivateKey(id irma.IssuerIdentifier, sk *gabi.PrivateKey) error {
+	pk, err := conf.IrmaConfiguration.PublicKey(id, int(sk.Counter))
+	if err != nil {
+		return err
+	}
+	if pk == nil {
+		return errors.Errorf("Missing public key belonging to private key %s-%d", id.String(), sk.Counter)
+	}
+	if new(big.Int).Mul(sk.P, sk.Q).Cmp(pk.N) != 0 {
+		return errors.Errorf("Private key %s-%d does not belong to corresponding public key", id.String(), sk.Counter)
+	}
+	return nil
+}
+
+// PrivateKeysPassphrase returns the passphrase with which encrypted private keys are decrypted,
+// or nil if none is configured.
+func (conf *Configuration) PrivateKeysPassphrase() ([]byte, error) {
+	if conf.IssuerPrivateKeysPassphrase == "" && conf.IssuerPrivateKeysPassphraseFile == "" {
+		return nil, nil
+	}
+	passphrase, err := fs.ReadKey(conf.IssuerPrivateKeysPassphrase, conf.IssuerPrivateKeysPassphraseFile)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to read private keys passphrase", 0)
+	}
+	return []byte(strings.TrimRight(string(passphrase), "\r\n")), nil
+}
+
+// ReadPrivateKeyFile reads a private key from the specified file, decrypting it using the
+// passphrase if the filename has the EncryptedPrivateKeyExtension.
+func ReadPrivateKeyFile(path string, passphrase []byte) (*gabi.PrivateKey, error) {
+	if filepath.Ext(path) != EncryptedPrivateKeyExtension {
+		return gabi.NewPrivateKeyFromFile(path)
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.Errorf("Private key %s is encrypted but no passphrase is configured", filepath.Base(path))
+	}
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	bts, err = encryption.DecryptWithPassphrase(bts, passphrase)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to decrypt private key "+filepath.Base(path), 0)
+	}
+	return gabi.NewPrivateKeyFromXML(string(bts))
+}
+
+// ReadPrivateKeysFolder reads the private keys in the specified folder, whose filenames must be of
+// the form scheme.issuer.xml, or scheme.issuer.xml.enc for keys encrypted with the passphrase.
+// Only keys of issuers for which allowed returns true are read. The second return parameter
+// lists the files containing unencrypted private keys.
+func ReadPrivateKeysFolder(path string, passphrase []byte, allowed func(irma.IssuerIdentifier) bool) (
+	map[irma.IssuerIdentifier]*gabi.PrivateKey, []string, error,
+) {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := map[irma.IssuerIdentifier]*gabi.PrivateKey{}
+	var plaintext []string
+	for _, file := range files {
+		filename := file.Name()
+		name := strings.TrimSuffix(filename, EncryptedPrivateKeyExtension)
+		if filepath.Ext(name) != ".xml" || filename[0] == '.' || strings.Count(name, ".") != 2 {
+			Logger.WithField("file", filename).Infof("Skipping non-private key file encountered in private keys path")
+			continue
+		}
+		issid := irma.NewIssuerIdentifier(strings.TrimSuffix(name, ".xml"))
+		if allowed != nil && !allowed(issid) {
+			Logger.WithField("file", filename).Infof("Skipping private key of issuer not in allowed issuers")
+			continue
+		}
+		if _, present := keys[issid]; present {
+			return nil, nil, errors.Errorf("Multiple private keys found for issuer %s", issid)
+		}
+		sk, err := ReadPrivateKeyFile(filepath.Join(path, filename), passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		if name == filename {
+			plaintext = append(plaintext, filename)
+		}
+		keys[issid] = sk
+	}
+	return keys, plaintext, nil
+}
+
+// The key server protocol consists of a single endpoint, served over HTTP on a unix socket:
+// GET /privatekey/<issuer>, returning the XML encoded private key of the issuer, or status
+// 404 if the key server does not have it.
+
+// keyServerCacheDuration is how long a keyServerClient reuses a private key retrieved from the key
+// server, before retrieving it again to pick up key rotations.
+const keyServerCacheDuration = 5 * time.Minute
+
+// keyServerClient is a PrivateKeyProvider retrieving private keys from a key server.
+type keyServerClient struct {
+	client *http.Client
+
+	cache     map[irma.IssuerIdentifier]cachedPrivateKey
+	cacheLock sync.Mutex
+}
+
+type cachedPrivateKey struct {
+	sk      *gabi.PrivateKey
+	expires time.Time
+}
+
+// NewKeyServerClient returns a PrivateKeyProvider that retrieves private keys from the key server
+// listening on the specified unix socket (see KeyServerHandler).
+func NewKeyServerClient(socket string) PrivateKeyProvider {
+	return &keyServerClient{cache: map[irma.IssuerIdentifier]cachedPrivateKey{}, client: &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}}
+}
+
+func (c *keyServerClient) PrivateKey(id irma.IssuerIdentifier) (*gabi.PrivateKey, error) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	if cached, ok := c.cache[id]; ok && time.Now().Before(cached.expires) {
+		return cached.sk, nil
+	}
+	sk, err := c.retrieve(id)
+	if err != nil {
+		return nil, err
+	}
+	c.cache[id] = cachedPrivateKey{sk: sk, expires: time.Now().Add(keyServerCacheDuration)}
+	return sk, nil
+}
+
+func (c *keyServerClient) retrieve(id irma.IssuerIdentifier) (*gabi.PrivateKey, error) {
+	res, err := c.client.Get("http://keyserver/privatekey/" + id.String())
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to contact key server", 0)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	bts, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to read private key from key server", 0)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Key server returned status %d: %s", res.StatusCode, string(bts))
+	}
+	sk, err := gabi.NewPrivateKeyFromXML(string(bts))
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Key server returned invalid private key", 0)
+	}
+	return sk, nil
+}
+
+// KeyServerHandler returns a http.Handler serving the private keys of the provider to
+// keyServerClients. It should only be served on a unix socket that is accessible only to the
+// IRMA server.
+func KeyServerHandler(provider PrivateKeyProvider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, "/privatekey/") {
+			http.NotFound(w, r)
+			return
+		}
+		id := irma.NewIssuerIdentifier(strings.TrimPrefix(r.URL.Path, "/privatekey/"))
+		sk, err := provider.PrivateKey(id)
+		if err != nil {
+			Logger.WithField("issuer", id.String()).Error("Failed to get private key: ", err.Error())
+			http.Error(w, "failed to get private key", http.StatusInternalServerError)
+			return
+		}
+		if sk == nil {
+			http.NotFound(w, r)
+			return
+		}
+		Logger.WithField("issuer", id.String()).Debug("Serving private key")
+		w.Header().Set("Content-Type", "application/xml")
+		if _, err = sk.WriteTo(w); err != nil {
+			Logger.Error("Failed to write private key: ", err.Error())
+		}
+	})
+}
+
+func (conf *Configuration) providedPrivateKey(id irma.IssuerIdentifier) (*gabi.PrivateKey, error) {
+	sk, err := conf.IssuerPrivateKeyProvider.PrivateKey(id)
+	if err != nil || sk == nil {
+		return nil, err
+	}
+
+	// Verify each private key only once, instead of during every issuance session
+	conf.verifiedPrivateKeysLock.Lock()
+	defer conf.verifiedPrivateKeysLock.Unlock()
+	if conf.verifiedPrivateKeys[id] == sk {
+		return sk, nil
+	}
+	if err = conf.VerifyPrivateKey(id, sk); err != nil {
+		return nil, errors.WrapPrefix(err, fmt.Sprintf("Invalid private key of %s from provider", id), 0)
+	}
+	if conf.verifiedPrivateKeys == nil {
+		conf.verifiedPrivateKeys = map[irma.IssuerIdentifier]*gabi.PrivateKey{}
+	}
+	conf.verifiedPrivateKeys[id] = sk
+	return sk, nil
+}
@@ -3,6 +3,7 @@ package requestorserver
 import (
 	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"regexp"
@@ -47,6 +48,12 @@ type Configuration struct {
 	ClientTlsPrivateKey      string `json:"client_tls_privkey" mapstructure:"client_tls_privkey"`
 	ClientTlsPrivateKeyFile  string `json:"client_tls_privkey_file" mapstructure:"client_tls_privkey_file"`
 
+	// (Optional) PEM-encoded CA certificate(s) that result callback servers must use, instead of the system CAs
+	CallbackCACertificate     string `json:"callback_ca_cert" mapstructure:"callback_ca_cert"`
+	CallbackCACertificateFile string `json:"callback_ca_cert_file" mapstructure:"callback_ca_cert_file"`
+	// (Optional) SPKI pins (base64-encoded SHA256 hashes) of which result callback servers must use one
+	CallbackCertificatePins []string `json:"callback_cert_pins" mapstructure:"callback_cert_pins"`
+
 	// Requestor-specific permission and authentication configuration
 	RequestorsString string               `json:"-" mapstructure:"requestors"`
 	Requestors       map[string]Requestor `json:"requestors"`
@@ -68,8 +75,19 @@ type Configuration struct {
 
 	StaticSessions map[string]interface{} `json:"static_sessions"`
 
+	// Revalidate the permissions and static sessions against new versions of schemes,
+	// logging problems such as removed or deprecated credential types
+	SchemesRevalidate bool `json:"schemes_revalidate" mapstructure:"schemes_revalidate"`
+
+	// If specified, expose counters of scheme update events and the scheme timestamps at /metrics
+	// on a separate server at this port, which is not reachable through the requestor or client port
+	MetricsPort int `json:"metrics_port" mapstructure:"metrics_port"`
+	// If metrics_port is specified, the metrics server listens at this address (default localhost)
+	MetricsListenAddress string `json:"metrics_listen_addr" mapstructure:"metrics_listen_addr"`
+
 	staticSessions map[string]irma.RequestorRequest
 	jwtPrivateKey  *rsa.PrivateKey
+	callbackCAs    *x509.CertPool
 }
 
 // Permissions specify which attributes or credential a requestor may verify or issue.
@@ -202,6 +220,15 @@ func (conf *Configuration) initialize() error {
 	if conf.ClientListenAddress != "" && conf.ClientPort == 0 {
 		return errors.New("client_listen_addr must be combined with a nonzero client_port")
 	}
+	if conf.MetricsPort != 0 && (conf.MetricsPort == conf.Port || conf.MetricsPort == conf.ClientPort) {
+		return errors.New("If metrics_port is given it must be different from port and client_port")
+	}
+	if conf.MetricsPort < 0 || conf.MetricsPort > 65535 {
+		return errors.Errorf("metrics_port must be between 0 and 65535 (was %d)", conf.MetricsPort)
+	}
+	if conf.MetricsListenAddress != "" && conf.MetricsPort == 0 {
+		return errors.New("metrics_listen_addr must be combined with a nonzero metrics_port")
+	}
 
 	tlsConf, err := conf.tlsConfig()
 	if err != nil {
@@ -212,6 +239,13 @@ func (conf *Configuration) initialize() error {
 		return errors.WrapPrefix(err, "Failed to read client TLS configuration", 0)
 	}
 
+	if err := conf.readCallbackCAs(); err != nil {
+		return errors.WrapPrefix(err, "Failed to read callback CA certificates", 0)
+	}
+	if err := irma.ValidateCertificatePins(conf.CallbackCertificatePins); err != nil {
+		return errors.WrapPrefix(err, "Invalid callback_cert_pins", 0)
+	}
+
 	if err := conf.validatePermissions(); err != nil {
 		return err
 	}
@@ -391,6 +425,35 @@ func (conf *Configuration) readTlsConf(cert, certfile, key, keyfile string) (*tl
 	}, nil
 }
 
+func (conf *Configuration) readCallbackCAs() error {
+	if conf.CallbackCACertificate == "" && conf.CallbackCACertificateFile == "" {
+		return nil
+	}
+
+	certbts, err := fs.ReadKey(conf.CallbackCACertificate, conf.CallbackCACertificateFile)
+	if err != nil {
+		return err
+	}
+	conf.callbackCAs = x509.NewCertPool()
+	if !conf.callbackCAs.AppendCertsFromPEM(certbts) {
+		return errors.New("no valid PEM-encoded certificates found")
+	}
+	return nil
+}
+
+// callbackTransport returns a transport to the specified callback URL that trusts only
+// the configured callback CAs and certificate pins, if any.
+func (conf *Configuration) callbackTransport(url string) (*irma.HTTPTransport, error) {
+	transport := irma.NewHTTPTransport(url)
+	if conf.callbackCAs != nil {
+		transport.SetRootCAs(conf.callbackCAs)
+	}
+	if err := transport.SetCertificatePins(conf.CallbackCertificatePins); err != nil {
+		return nil, err
+	}
+	return transport, nil
+}
+
 func (conf *Configuration) readPrivateKey() error {
 	if conf.JwtPrivateKey == "" && conf.JwtPrivateKeyFile == "" {
 		return nil
@@ -410,6 +473,10 @@ func (conf *Configuration) separateClientServer() bool {
 	return conf.ClientPort != 0
 }
 
+func (conf *Configuration) metricsServer() bool {
+	return conf.MetricsPort != 0
+}
+
 // Return true iff query equals an element of strings.
 func contains(strings []string, query string) bool {
 	for _, s := range strings {
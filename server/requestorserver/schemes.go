@@ -0,0 +1,117 @@
+package requestorserver
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// schemeMetrics counts the scheme events of the IRMA configuration of the server,
+// for exposing them at /metrics.
+type schemeMetrics struct {
+	sync.Mutex
+	events map[schemeEventKey]int
+}
+
+type schemeEventKey struct {
+	scheme irma.SchemeManagerIdentifier
+	typ    irma.SchemeEventType
+}
+
+func (m *schemeMetrics) count(event *irma.SchemeEvent) {
+	m.Lock()
+	defer m.Unlock()
+	m.events[schemeEventKey{event.Scheme, event.Type}]++
+}
+
+// handleMetrics writes the scheme event counters and the timestamps of the schemes
+// in the Prometheus text exposition format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+
+	s.metrics.Lock()
+	keys := make([]schemeEventKey, 0, len(s.metrics.events))
+	for key := range s.metrics.events {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].scheme != keys[j].scheme {
+			return keys[i].scheme.String() < keys[j].scheme.String()
+		}
+		return keys[i].typ < keys[j].typ
+	})
+	b.WriteString("# HELP irma_scheme_events_total Amount of events that occurred when updating schemes.\n")
+	b.WriteString("# TYPE irma_scheme_events_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "irma_scheme_events_total{scheme=%q,type=%q} %d\n", key.scheme.String(), key.typ, s.metrics.events[key])
+	}
+	s.metrics.Unlock()
+
+	var schemes []string
+	timestamps := map[string]int64{}
+	s.conf.IrmaConfiguration.RLock()
+	for id, scheme := range s.conf.IrmaConfiguration.SchemeManagers {
+		schemes = append(schemes, id.String())
+		timestamps[id.String()] = time.Time(scheme.Timestamp).Unix()
+	}
+	s.conf.IrmaConfiguration.RUnlock()
+	sort.Strings(schemes)
+	b.WriteString("# HELP irma_scheme_timestamp_seconds Timestamp of the installed version of the scheme.\n")
+	b.WriteString("# TYPE irma_scheme_timestamp_seconds gauge\n")
+	for _, id := range schemes {
+		fmt.Fprintf(&b, "irma_scheme_timestamp_seconds{scheme=%q} %d\n", id, timestamps[id])
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(b.String()))
+}
+
+// revalidate checks the permissions and static sessions against a new version of a scheme,
+// logging the problems that it introduced, e.g. removed or deprecated credential types.
+func (s *Server) revalidate(event *irma.SchemeEvent) {
+	if event.Type != irma.SchemeEventUpdated {
+		return
+	}
+	logger := s.conf.Logger.WithField("scheme", event.Scheme)
+	if err := s.conf.validatePermissions(); err != nil {
+		logger.Error("Permissions invalid after scheme update: ", err.Error())
+	}
+	for _, problem := range s.conf.validateStaticSessions() {
+		logger.Error("Static session invalid after scheme update: ", problem)
+	}
+}
+
+// validateStaticSessions checks that the attributes requested by the static sessions exist
+// and do not belong to deprecated credential types.
+func (conf *Configuration) validateStaticSessions() []string {
+	var errs []string
+	now := time.Now()
+	for name, rrequest := range conf.staticSessions {
+		reported := map[irma.CredentialTypeIdentifier]struct{}{}
+		_ = rrequest.SessionRequest().Disclosure().Disclose.Iterate(func(attr *irma.AttributeRequest) error {
+			credid := attr.Type.CredentialTypeIdentifier()
+			if _, ok := reported[credid]; ok {
+				return nil
+			}
+			credtype := conf.IrmaConfiguration.CredentialTypes[credid]
+			switch {
+			case credtype == nil:
+				errs = append(errs, fmt.Sprintf("static session %s: unknown credential type %s", name, credid))
+				reported[credid] = struct{}{}
+			case !credtype.ContainsAttribute(attr.Type):
+				errs = append(errs, fmt.Sprintf("static session %s: unknown attribute type %s", name, attr.Type))
+			case !credtype.DeprecatedSince.IsZero() && time.Time(credtype.DeprecatedSince).Before(now):
+				errs = append(errs, fmt.Sprintf("static session %s: credential type %s is deprecated", name, credid))
+				reported[credid] = struct{}{}
+			}
+			return nil
+		})
+	}
+	sort.Strings(errs)
+	return errs
+}
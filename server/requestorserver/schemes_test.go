@@ -0,0 +1,116 @@
+package requestorserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func testServer(t *testing.T, metrics bool) (*Server, *bytes.Buffer) {
+	irmaconf, err := irma.NewConfiguration(filepath.Join(test.FindTestdataFolder(t), "irma_configuration"))
+	require.NoError(t, err)
+	require.NoError(t, irmaconf.ParseFolder())
+
+	logs := &bytes.Buffer{}
+	logger := logrus.New()
+	logger.Out = logs
+	s := &Server{conf: &Configuration{
+		Configuration: &server.Configuration{IrmaConfiguration: irmaconf, Logger: logger},
+	}}
+	if metrics {
+		s.metrics = &schemeMetrics{events: map[schemeEventKey]int{}}
+	}
+	return s, logs
+}
+
+func TestHandleMetrics(t *testing.T) {
+	s, _ := testServer(t, false)
+	require.Nil(t, s.MetricsHandler())
+
+	s, _ = testServer(t, true)
+	id := irma.NewSchemeManagerIdentifier("irma-demo")
+	s.metrics.count(&irma.SchemeEvent{Type: irma.SchemeEventUpdated, Scheme: id})
+	s.metrics.count(&irma.SchemeEvent{Type: irma.SchemeEventUpdated, Scheme: id})
+	s.metrics.count(&irma.SchemeEvent{Type: irma.SchemeEventUpdateFailed, Scheme: id})
+
+	srv := httptest.NewServer(s.MetricsHandler())
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/metrics")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.True(t, strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain"))
+	body := &bytes.Buffer{}
+	_, err = body.ReadFrom(res.Body)
+	require.NoError(t, err)
+
+	timestamp := time.Time(s.conf.IrmaConfiguration.SchemeManagers[id].Timestamp).Unix()
+	require.Contains(t, body.String(), `irma_scheme_events_total{scheme="irma-demo",type="`+string(irma.SchemeEventUpdated)+`"} 2`)
+	require.Contains(t, body.String(), `irma_scheme_events_total{scheme="irma-demo",type="`+string(irma.SchemeEventUpdateFailed)+`"} 1`)
+	require.Contains(t, body.String(), `irma_scheme_timestamp_seconds{scheme="irma-demo"} `+strconv.FormatInt(timestamp, 10))
+
+	// Only /metrics is served
+	res, err = http.Get(srv.URL + "/session")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestValidateStaticSessions(t *testing.T) {
+	s, _ := testServer(t, false)
+	conf := s.conf
+	conf.staticSessions = map[string]irma.RequestorRequest{
+		"valid": &irma.ServiceProviderRequest{Request: irma.NewDisclosureRequest(
+			irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+		)},
+		"unknowncred": &irma.ServiceProviderRequest{Request: irma.NewDisclosureRequest(
+			irma.NewAttributeTypeIdentifier("irma-demo.RU.nonexisting.studentID"),
+			irma.NewAttributeTypeIdentifier("irma-demo.RU.nonexisting.university"),
+		)},
+		"unknownattr": &irma.ServiceProviderRequest{Request: irma.NewDisclosureRequest(
+			irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.nonexisting"),
+		)},
+	}
+	require.Equal(t, []string{
+		"static session unknownattr: unknown attribute type irma-demo.MijnOverheid.root.nonexisting",
+		"static session unknowncred: unknown credential type irma-demo.RU.nonexisting",
+	}, conf.validateStaticSessions())
+
+	// Deprecation is reported once it has taken effect
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	credtype := conf.IrmaConfiguration.CredentialTypes[credid]
+	credtype.DeprecatedSince = irma.Timestamp(time.Now().Add(time.Hour))
+	require.Len(t, conf.validateStaticSessions(), 2)
+	credtype.DeprecatedSince = irma.Timestamp(time.Now().Add(-time.Hour))
+	require.Contains(t, conf.validateStaticSessions(), "static session valid: credential type irma-demo.RU.studentCard is deprecated")
+}
+
+func TestRevalidate(t *testing.T) {
+	s, logs := testServer(t, false)
+	s.conf.Permissions.Disclosing = []string{"irma-demo.RU.nonexisting.studentID"}
+	s.conf.staticSessions = map[string]irma.RequestorRequest{
+		"static": &irma.ServiceProviderRequest{Request: irma.NewDisclosureRequest(
+			irma.NewAttributeTypeIdentifier("irma-demo.RU.nonexisting.studentID"),
+		)},
+	}
+	id := irma.NewSchemeManagerIdentifier("irma-demo")
+
+	// Only scheme updates cause revalidation
+	s.revalidate(&irma.SchemeEvent{Type: irma.SchemeEventUpdateFailed, Scheme: id})
+	require.Empty(t, logs.String())
+
+	s.revalidate(&irma.SchemeEvent{Type: irma.SchemeEventUpdated, Scheme: id})
+	require.Contains(t, logs.String(), "Permissions invalid after scheme update")
+	require.Contains(t, logs.String(), "Static session invalid after scheme update: static session static: unknown credential type irma-demo.RU.nonexisting")
+}
@@ -34,6 +34,9 @@ type Server struct {
 	irmaserv *irmaserver.Server
 	stop     chan struct{}
 	stopped  chan struct{}
+
+	metrics      *schemeMetrics
+	unsubscribes []func()
 }
 
 // Start the server. If successful then it will not return until Stop() is called.
@@ -55,7 +58,10 @@ func (s *Server) Start(config *Configuration) error {
 
 	count := 1
 	if s.conf.separateClientServer() {
-		count = 2
+		count++
+	}
+	if s.conf.metricsServer() {
+		count++
 	}
 	done := make(chan error, count)
 	s.stop = make(chan struct{})
@@ -66,6 +72,11 @@ func (s *Server) Start(config *Configuration) error {
 			done <- s.startClientServer()
 		}()
 	}
+	if s.conf.metricsServer() {
+		go func() {
+			done <- s.startMetricsServer()
+		}()
+	}
 	go func() {
 		done <- s.startRequestorServer()
 	}()
@@ -95,6 +106,14 @@ func (s *Server) startClientServer() error {
 	return s.startServer(s.ClientHandler(), "Client server", s.conf.ClientListenAddress, s.conf.ClientPort, tlsConf)
 }
 
+func (s *Server) startMetricsServer() error {
+	addr := s.conf.MetricsListenAddress
+	if addr == "" {
+		addr = "localhost"
+	}
+	return s.startServer(s.MetricsHandler(), "Metrics server", addr, s.conf.MetricsPort, nil)
+}
+
 func (s *Server) startServer(handler http.Handler, name, addr string, port int, tlsConf *tls.Config) error {
 	fulladdr := fmt.Sprintf("%s:%d", addr, port)
 	s.conf.Logger.Info(name, " listening at ", fulladdr)
@@ -133,12 +152,18 @@ func filterStopError(err error) error {
 }
 
 func (s *Server) Stop() {
+	for _, unsubscribe := range s.unsubscribes {
+		unsubscribe()
+	}
 	s.irmaserv.Stop()
 	s.stop <- struct{}{}
 	<-s.stopped
 	if s.conf.separateClientServer() {
 		<-s.stopped
 	}
+	if s.conf.metricsServer() {
+		<-s.stopped
+	}
 }
 
 func New(config *Configuration) (*Server, error) {
@@ -149,10 +174,18 @@ func New(config *Configuration) (*Server, error) {
 	if err := config.initialize(); err != nil {
 		return nil, err
 	}
-	return &Server{
+	s := &Server{
 		conf:     config,
 		irmaserv: irmaserv,
-	}, nil
+	}
+	if config.metricsServer() {
+		s.metrics = &schemeMetrics{events: map[schemeEventKey]int{}}
+		s.unsubscribes = append(s.unsubscribes, config.IrmaConfiguration.SubscribeSchemeEvents(s.metrics.count))
+	}
+	if config.SchemesRevalidate {
+		s.unsubscribes = append(s.unsubscribes, config.IrmaConfiguration.SubscribeSchemeEvents(s.revalidate))
+	}
+	return s, nil
 }
 
 var corsOptions = cors.Options{
@@ -208,6 +241,7 @@ func (s *Server) Handler() http.Handler {
 		r.Delete("/session/{token}", s.handleDelete)
 		r.Get("/session/{token}/status", s.handleStatus)
 		r.Get("/session/{token}/statusevents", s.handleStatusEvents)
+		r.Get("/session/{token}/statuswebsocket", s.handleStatusWebsocket)
 		r.Get("/session/{token}/result", s.handleResult)
 
 		// Routes for getting signed JWTs containing the session result. Only work if configuration has a private key
@@ -220,6 +254,17 @@ func (s *Server) Handler() http.Handler {
 	return router
 }
 
+// MetricsHandler returns a http.Handler exposing the metrics of the server at /metrics, or nil if
+// metrics are disabled. It should not be reachable by requestors nor IRMA apps.
+func (s *Server) MetricsHandler() http.Handler {
+	if s.metrics == nil {
+		return nil
+	}
+	router := chi.NewRouter()
+	router.Get("/metrics", s.handleMetrics)
+	return router
+}
+
 // logHandler is middleware for logging HTTP requests and responses.
 func (s *Server) logHandler(typ string, logResponse, logHeaders, logFrom bool) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -395,6 +440,18 @@ func (s *Server) handleStatusEvents(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) handleStatusWebsocket(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	s.conf.Logger.WithFields(logrus.Fields{"session": token}).Debug("new client subscribed to websocket")
+	if err := s.irmaserv.SubscribeWebsocket(w, r, token, true); err != nil {
+		server.WriteResponse(w, nil, &irma.RemoteError{
+			Status:      server.ErrorUnsupported.Status,
+			ErrorName:   string(server.ErrorUnsupported.Type),
+			Description: server.ErrorUnsupported.Description,
+		})
+	}
+}
+
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	err := s.irmaserv.CancelSession(chi.URLParam(r, "token"))
 	if err != nil {
@@ -576,8 +633,13 @@ func (s *Server) doResultCallback(result *server.SessionResult) {
 		res = string(bts)
 	}
 
+	transport, err := s.conf.callbackTransport(callbackUrl)
+	if err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "Failed to configure TLS for result callback", 0))
+		return
+	}
 	var x string // dummy for the server's return value that we don't care about
-	if err := irma.NewHTTPTransport(callbackUrl).Post("", &x, res); err != nil {
+	if err := transport.Post("", &x, res); err != nil {
 		// not our problem, log it and go on
 		logger.Warn(errors.WrapPrefix(err, "Failed to POST session result to callback URL", 0))
 	}
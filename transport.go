@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"io"
 	"io/ioutil"
@@ -22,11 +25,59 @@ import (
 	"github.com/privacybydesign/irmago/internal/fs"
 )
 
+// Transport sends IRMA protocol messages to an IRMA server, and parses its responses.
+// HTTPTransport does this over HTTP, and LocalTransport over a local byte stream.
+type Transport interface {
+	// SetHeader sets a header to be sent in requests.
+	SetHeader(name, val string)
+	// GetContext performs a GET request and parses the server's response into result.
+	GetContext(ctx context.Context, url string, result interface{}) error
+	// PostContext sends the object to the server and parses its response into result.
+	PostContext(ctx context.Context, url string, result interface{}, object interface{}) error
+	// DeleteContext performs a DELETE.
+	DeleteContext(ctx context.Context) error
+}
+
+var _ Transport = (*HTTPTransport)(nil)
+
 // HTTPTransport sends and receives JSON messages to a HTTP server.
 type HTTPTransport struct {
-	Server  string
-	client  *retryablehttp.Client
-	headers map[string]string
+	Server string
+	// Policy determines the timeout and retries of requests, unless overridden for a
+	// specific request using WithRequestPolicy.
+	Policy RequestPolicy
+
+	transport *http.Transport
+	headers   map[string]string
+}
+
+// RequestPolicy specifies how long HTTP requests may take and how they are retried.
+// Requests that fail because of a network error are retried; requests to which the server
+// responds with an error status are not.
+type RequestPolicy struct {
+	// Timeout of each attempt, including reading the response body (0 means no timeout)
+	Timeout time.Duration
+	// Maximum amount of retries after the first attempt
+	RetryMax int
+	// Minimum and maximum time to wait between attempts
+	RetryWaitMin time.Duration
+	RetryWaitMax time.Duration
+}
+
+// DefaultRequestPolicy is the RequestPolicy of new HTTPTransport instances.
+var DefaultRequestPolicy = RequestPolicy{
+	Timeout:      3 * time.Second,
+	RetryMax:     2,
+	RetryWaitMin: 100 * time.Millisecond,
+	RetryWaitMax: 200 * time.Millisecond,
+}
+
+type requestPolicyKey struct{}
+
+// WithRequestPolicy returns a copy of the context which makes HTTPTransport requests
+// using the context follow the specified policy instead of the transport's own Policy.
+func WithRequestPolicy(ctx context.Context, policy RequestPolicy) context.Context {
+	return context.WithValue(ctx, requestPolicyKey{}, policy)
 }
 
 // Logger is used for logging. If not set, init() will initialize it to logrus.StandardLogger().
@@ -55,6 +106,7 @@ func NewHTTPTransport(serverURL string) *HTTPTransport {
 
 	// Create a transport that dials with a SIGPIPE handler (which is only active on iOS)
 	var innerTransport http.Transport
+	innerTransport.TLSClientConfig = &tls.Config{}
 
 	innerTransport.Dial = func(network, addr string) (c net.Conn, err error) {
 		c, err = net.Dial(network, addr)
@@ -67,27 +119,91 @@ func NewHTTPTransport(serverURL string) *HTTPTransport {
 		return c, nil
 	}
 
-	client := &retryablehttp.Client{
+	return &HTTPTransport{
+		Server:    url,
+		Policy:    DefaultRequestPolicy,
+		headers:   map[string]string{},
+		transport: &innerTransport,
+	}
+}
+
+// SetRootCAs makes the transport trust only the specified CA certificates when verifying TLS
+// certificates of the server, instead of the root CAs of the system. Pass nil to use the latter again.
+func (transport *HTTPTransport) SetRootCAs(pool *x509.CertPool) {
+	transport.transport.TLSClientConfig.RootCAs = pool
+}
+
+// SetCertificatePins makes the transport accept only servers whose verified TLS certificate chain
+// contains a certificate whose public key matches one of the pins, in addition to the usual
+// verification of the chain. Each pin is the base64 encoding of the SHA256 hash of the
+// DER-encoded SubjectPublicKeyInfo of a certificate (see CertificatePin). Pass no pins to
+// disable pinning.
+func (transport *HTTPTransport) SetCertificatePins(pins []string) error {
+	if len(pins) == 0 {
+		transport.transport.TLSClientConfig.VerifyPeerCertificate = nil
+		return nil
+	}
+	if err := ValidateCertificatePins(pins); err != nil {
+		return err
+	}
+	transport.transport.TLSClientConfig.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				pin := CertificatePin(cert)
+				for _, p := range pins {
+					if pin == p {
+						return nil
+					}
+				}
+			}
+		}
+		return errors.New("TLS certificate of server does not match any of the pinned public keys")
+	}
+	return nil
+}
+
+// CertificatePin returns the pin of the certificate for use in SetCertificatePins: the base64
+// encoding of the SHA256 hash of the DER-encoded SubjectPublicKeyInfo of the certificate.
+func CertificatePin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// ValidateCertificatePins checks that the pins are valid pins as returned by CertificatePin.
+func ValidateCertificatePins(pins []string) error {
+	for _, pin := range pins {
+		bts, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(bts) != sha256.Size {
+			return errors.Errorf("invalid certificate pin %s: must be base64 encoded SHA256 hash", pin)
+		}
+	}
+	return nil
+}
+
+func (transport *HTTPTransport) client(ctx context.Context) *retryablehttp.Client {
+	policy := transport.Policy
+	if p, ok := ctx.Value(requestPolicyKey{}).(RequestPolicy); ok {
+		policy = p
+	}
+	return &retryablehttp.Client{
 		Logger:       transportlogger,
-		RetryWaitMin: 100 * time.Millisecond,
-		RetryWaitMax: 200 * time.Millisecond,
-		RetryMax:     2,
+		RetryWaitMin: policy.RetryWaitMin,
+		RetryWaitMax: policy.RetryWaitMax,
+		RetryMax:     policy.RetryMax,
 		Backoff:      retryablehttp.DefaultBackoff,
 		CheckRetry: func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+			// Don't retry when the request was cancelled
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
 			// Don't retry on 5xx (which retryablehttp does by default)
 			return err != nil || resp.StatusCode == 0, err
 		},
 		HTTPClient: &http.Client{
-			Timeout:   time.Second * 3,
-			Transport: &innerTransport,
+			Timeout:   policy.Timeout,
+			Transport: transport.transport,
 		},
 	}
-
-	return &HTTPTransport{
-		Server:  url,
-		headers: map[string]string{},
-		client:  client,
-	}
 }
 
 // SetHeader sets a header to be sent in requests.
@@ -96,13 +212,14 @@ func (transport *HTTPTransport) SetHeader(name, val string) {
 }
 
 func (transport *HTTPTransport) request(
-	url string, method string, reader io.Reader, isstr bool,
+	ctx context.Context, url string, method string, reader io.Reader, isstr bool, header http.Header,
 ) (response *http.Response, err error) {
 	var req retryablehttp.Request
 	req.Request, err = http.NewRequest(method, transport.Server+url, reader)
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
+	req.Request = req.Request.WithContext(ctx)
 
 	req.Header.Set("User-Agent", "irmago")
 	if reader != nil {
@@ -115,15 +232,20 @@ func (transport *HTTPTransport) request(
 	for name, val := range transport.headers {
 		req.Header.Set(name, val)
 	}
+	for name := range header {
+		req.Header.Set(name, header.Get(name))
+	}
 
-	res, err := transport.client.Do(&req)
+	res, err := transport.client(ctx).Do(&req)
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
 	return res, nil
 }
 
-func (transport *HTTPTransport) jsonRequest(url string, method string, result interface{}, object interface{}) error {
+func (transport *HTTPTransport) jsonRequest(
+	ctx context.Context, url string, method string, result interface{}, object interface{},
+) error {
 	if method != http.MethodPost && method != http.MethodGet && method != http.MethodDelete {
 		panic("Unsupported HTTP method " + method)
 	}
@@ -131,24 +253,16 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 		panic("Cannot GET and also post an object")
 	}
 
-	var isstr bool
 	var reader io.Reader
-	if object != nil {
-		var objstr string
-		if objstr, isstr = object.(string); isstr {
-			Logger.Trace("transport: body: ", objstr)
-			reader = bytes.NewBuffer([]byte(objstr))
-		} else {
-			marshaled, err := json.Marshal(object)
-			if err != nil {
-				return &SessionError{ErrorType: ErrorSerialization, Err: err}
-			}
-			Logger.Trace("transport: body: ", string(marshaled))
-			reader = bytes.NewBuffer(marshaled)
-		}
+	body, isstr, err := marshalBody(object)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		reader = bytes.NewBuffer(body)
 	}
 
-	res, err := transport.request(url, method, reader, isstr)
+	res, err := transport.request(ctx, url, method, reader, isstr, nil)
 	if err != nil {
 		return err
 	}
@@ -156,39 +270,98 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 		return nil
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	body, err = ioutil.ReadAll(res.Body)
 	if err != nil {
 		return &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
 	}
-	if res.StatusCode != 200 {
+	return unmarshalResponse(res.StatusCode, body, result)
+}
+
+// marshalBody returns the bytes to be sent to the server for the specified object, and whether or
+// not the object was a string (which is sent as is instead of being JSON-marshaled).
+func marshalBody(object interface{}) ([]byte, bool, error) {
+	if object == nil {
+		return nil, false, nil
+	}
+	if objstr, isstr := object.(string); isstr {
+		Logger.Trace("transport: body: ", objstr)
+		return []byte(objstr), true, nil
+	}
+	marshaled, err := json.Marshal(object)
+	if err != nil {
+		return nil, false, &SessionError{ErrorType: ErrorSerialization, Err: err}
+	}
+	Logger.Trace("transport: body: ", string(marshaled))
+	return marshaled, false, nil
+}
+
+// unmarshalResponse parses the server's response into result, or into a *SessionError if the
+// server returned an error.
+func unmarshalResponse(status int, body []byte, result interface{}) error {
+	if status != 200 {
 		apierr := &RemoteError{}
-		err = json.Unmarshal(body, apierr)
+		err := json.Unmarshal(body, apierr)
 		if err != nil || apierr.ErrorName == "" { // Not an ApiErrorMessage
-			return &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode}
+			return &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: status}
 		}
 		Logger.Tracef("transport: error: %+v", apierr)
-		return &SessionError{ErrorType: ErrorApi, RemoteStatus: res.StatusCode, RemoteError: apierr}
+		return &SessionError{ErrorType: ErrorApi, RemoteStatus: status, RemoteError: apierr}
 	}
 
 	Logger.Tracef("transport: response: %s", string(body))
 	if _, resultstr := result.(*string); resultstr {
 		*result.(*string) = string(body)
 	} else {
-		err = UnmarshalValidate(body, result)
-		if err != nil {
-			return &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
+		if err := UnmarshalValidate(body, result); err != nil {
+			return &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: status}
 		}
 	}
 
 	return nil
 }
 
+// GetBytes performs a GET request and returns the server's response.
 func (transport *HTTPTransport) GetBytes(url string) ([]byte, error) {
-	res, err := transport.request(url, http.MethodGet, nil, false)
+	return transport.GetBytesContext(context.Background(), url)
+}
+
+// GetBytesContext performs a GET request and returns the server's response,
+// aborting when the context is cancelled.
+func (transport *HTTPTransport) GetBytesContext(ctx context.Context, url string) ([]byte, error) {
+	return transport.getBytes(ctx, url, nil)
+}
+
+// CacheValidators are the validators (ETag and Last-Modified headers) of a previously downloaded
+// resource, with which a conditional request for it can be made.
+type CacheValidators struct {
+	ETag         string
+	LastModified string
+}
+
+// GetBytesIfModifiedContext performs a conditional GET request using the validators. If the server
+// reports that the resource has not been modified, it returns nil. Otherwise it returns the
+// server's response and updates the validators to those of the response.
+func (transport *HTTPTransport) GetBytesIfModifiedContext(ctx context.Context, url string, validators *CacheValidators) ([]byte, error) {
+	return transport.getBytes(ctx, url, validators)
+}
+
+func (transport *HTTPTransport) getBytes(ctx context.Context, url string, validators *CacheValidators) ([]byte, error) {
+	header := http.Header{}
+	if validators != nil && validators.ETag != "" {
+		header.Set("If-None-Match", validators.ETag)
+	}
+	if validators != nil && validators.LastModified != "" {
+		header.Set("If-Modified-Since", validators.LastModified)
+	}
+	res, err := transport.request(ctx, url, http.MethodGet, nil, false, header)
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
+	defer res.Body.Close()
 
+	if validators != nil && res.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
 	if res.StatusCode != 200 {
 		return nil, &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode}
 	}
@@ -196,11 +369,22 @@ func (transport *HTTPTransport) GetBytes(url string) ([]byte, error) {
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
 	}
+	if validators != nil {
+		validators.ETag = res.Header.Get("ETag")
+		validators.LastModified = res.Header.Get("Last-Modified")
+	}
 	return b, nil
 }
 
+// GetSignedFile downloads the file at the specified URL to dest, provided its SHA256 hash equals
+// the specified hash (if not nil).
 func (transport *HTTPTransport) GetSignedFile(url string, dest string, hash ConfigurationFileHash) error {
-	b, err := transport.GetBytes(url)
+	return transport.GetSignedFileContext(context.Background(), url, dest, hash)
+}
+
+// GetSignedFileContext is like GetSignedFile, aborting when the context is cancelled.
+func (transport *HTTPTransport) GetSignedFileContext(ctx context.Context, url string, dest string, hash ConfigurationFileHash) error {
+	b, err := transport.GetBytesContext(ctx, url)
 	if err != nil {
 		return err
 	}
@@ -214,21 +398,44 @@ func (transport *HTTPTransport) GetSignedFile(url string, dest string, hash Conf
 	return fs.SaveFile(dest, b)
 }
 
+// GetFile downloads the file at the specified URL to dest.
 func (transport *HTTPTransport) GetFile(url string, dest string) error {
-	return transport.GetSignedFile(url, dest, nil)
+	return transport.GetSignedFileContext(context.Background(), url, dest, nil)
+}
+
+// GetFileContext downloads the file at the specified URL to dest, aborting when the context is cancelled.
+func (transport *HTTPTransport) GetFileContext(ctx context.Context, url string, dest string) error {
+	return transport.GetSignedFileContext(ctx, url, dest, nil)
 }
 
 // Post sends the object to the server and parses its response into result.
 func (transport *HTTPTransport) Post(url string, result interface{}, object interface{}) error {
-	return transport.jsonRequest(url, http.MethodPost, result, object)
+	return transport.PostContext(context.Background(), url, result, object)
+}
+
+// PostContext sends the object to the server and parses its response into result,
+// aborting when the context is cancelled.
+func (transport *HTTPTransport) PostContext(ctx context.Context, url string, result interface{}, object interface{}) error {
+	return transport.jsonRequest(ctx, url, http.MethodPost, result, object)
 }
 
 // Get performs a GET request and parses the server's response into result.
 func (transport *HTTPTransport) Get(url string, result interface{}) error {
-	return transport.jsonRequest(url, http.MethodGet, result, nil)
+	return transport.GetContext(context.Background(), url, result)
+}
+
+// GetContext performs a GET request and parses the server's response into result,
+// aborting when the context is cancelled.
+func (transport *HTTPTransport) GetContext(ctx context.Context, url string, result interface{}) error {
+	return transport.jsonRequest(ctx, url, http.MethodGet, result, nil)
 }
 
 // Delete performs a DELETE.
 func (transport *HTTPTransport) Delete() {
-	_ = transport.jsonRequest("", http.MethodDelete, nil, nil)
+	_ = transport.DeleteContext(context.Background())
+}
+
+// DeleteContext performs a DELETE, aborting when the context is cancelled.
+func (transport *HTTPTransport) DeleteContext(ctx context.Context) error {
+	return transport.jsonRequest(ctx, "", http.MethodDelete, nil, nil)
 }